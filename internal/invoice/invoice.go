@@ -0,0 +1,139 @@
+package invoice
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/silaselisha/coffee-api/pkg/store"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const ContentType = "text/html; charset=utf-8"
+
+// FormatNumber turns a sequence value into the printed invoice number.
+func FormatNumber(seq int64) string {
+	return fmt.Sprintf("INV-%06d", seq)
+}
+
+// ObjectKey is where the rendered invoice is stored in the bucket.
+func ObjectKey(number string) string {
+	return fmt.Sprintf("invoices/%s.html", number)
+}
+
+// ParseTaxRate reads the INVOICE_TAX_RATE setting, a percentage such as
+// "16". An empty setting means no tax is charged.
+func ParseTaxRate(value string) (float64, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	rate, err := strconv.ParseFloat(value, 64)
+	if err != nil || rate < 0 || rate >= 100 {
+		return 0, fmt.Errorf("invalid invoice tax rate %q", value)
+	}
+	return rate, nil
+}
+
+// Build copies the order lines into a new invoice and splits every line's
+// tax inclusive total into net and tax at taxRate percent. Products that
+// have since been deleted keep their line under a placeholder name.
+func Build(number string, order store.Order, customer store.User, products map[primitive.ObjectID]store.Item, taxRate float64) store.Invoice {
+	inv := store.Invoice{
+		Id:            primitive.NewObjectID(),
+		Number:        number,
+		Order:         order.Id,
+		Customer:      customer.Id,
+		CustomerName:  customer.UserName,
+		CustomerEmail: customer.Email,
+		TaxRate:       taxRate,
+		IssuedAt:      time.Now(),
+		CreatedAt:     time.Now(),
+		UpdatedAt:     time.Now(),
+	}
+
+	for _, item := range order.Items {
+		name := "Discontinued product"
+		if product, ok := products[item.Product]; ok {
+			name = product.Name
+		}
+
+		total := round(item.Amount - item.Discount)
+		net := round(total / (1 + taxRate/100))
+		line := store.InvoiceLine{
+			Product:   item.Product,
+			Name:      name,
+			Quantity:  item.Quantity,
+			UnitPrice: round(item.Amount / float64(max(item.Quantity, 1))),
+			Amount:    round(item.Amount),
+			Discount:  round(item.Discount),
+			Net:       net,
+			Tax:       round(total - net),
+			Total:     total,
+		}
+
+		inv.Lines = append(inv.Lines, line)
+		inv.Discount += line.Discount
+		inv.Net += line.Net
+		inv.Tax += line.Tax
+		inv.Total += line.Total
+	}
+
+	inv.Discount = round(inv.Discount)
+	inv.Net = round(inv.Net)
+	inv.Tax = round(inv.Tax)
+	inv.Total = round(inv.Total)
+	return inv
+}
+
+// Render produces the HTML document handed to customers.
+func Render(inv store.Invoice) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := invoiceTemplate.Execute(&buf, inv); err != nil {
+		return nil, fmt.Errorf("error occured while rendering invoice %s %w", inv.Number, err)
+	}
+	return buf.Bytes(), nil
+}
+
+func round(value float64) float64 {
+	return math.Round(value*100) / 100
+}
+
+var invoiceTemplate = template.Must(template.New("invoice").Funcs(template.FuncMap{
+	"money": func(value float64) string { return fmt.Sprintf("%.2f", value) },
+	"date":  func(value time.Time) string { return value.Format("02 Jan 2006") },
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Invoice {{.Number}}</title>
+<style>
+body { font-family: sans-serif; margin: 2rem; color: #2b2118; }
+table { width: 100%; border-collapse: collapse; margin-top: 1.5rem; }
+th, td { padding: .4rem; border-bottom: 1px solid #ddd; text-align: right; }
+th:first-child, td:first-child { text-align: left; }
+tfoot td { font-weight: bold; }
+</style>
+</head>
+<body>
+<h1>Invoice {{.Number}}</h1>
+<p>Issued {{date .IssuedAt}}<br>Order {{.Order.Hex}}</p>
+<p>Billed to<br>{{.CustomerName}}<br>{{.CustomerEmail}}</p>
+<table>
+<thead>
+<tr><th>Item</th><th>Qty</th><th>Unit price</th><th>Discount</th><th>Net</th><th>Tax</th><th>Total</th></tr>
+</thead>
+<tbody>
+{{range .Lines}}<tr><td>{{.Name}}</td><td>{{.Quantity}}</td><td>{{money .UnitPrice}}</td><td>{{money .Discount}}</td><td>{{money .Net}}</td><td>{{money .Tax}}</td><td>{{money .Total}}</td></tr>
+{{end}}</tbody>
+<tfoot>
+<tr><td colspan="3">Totals</td><td>{{money .Discount}}</td><td>{{money .Net}}</td><td>{{money .Tax}}</td><td>{{money .Total}}</td></tr>
+</tfoot>
+</table>
+<p>Prices include tax at {{.TaxRate}}%.</p>
+</body>
+</html>
+`))
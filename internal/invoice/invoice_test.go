@@ -0,0 +1,107 @@
+package invoice
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/silaselisha/coffee-api/pkg/store"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestFormatNumber(t *testing.T) {
+	require.Equal(t, "INV-000001", FormatNumber(1))
+	require.Equal(t, "INV-123456", FormatNumber(123456))
+	require.Equal(t, "INV-1234567", FormatNumber(1234567))
+	require.Equal(t, "invoices/INV-000001.html", ObjectKey(FormatNumber(1)))
+
+	t.Run("counter sequence sorts in issue order", func(t *testing.T) {
+		numbers := []string{}
+		for seq := int64(1); seq <= 12; seq++ {
+			numbers = append(numbers, FormatNumber(seq))
+		}
+		require.True(t, sort.StringsAreSorted(numbers))
+		require.Equal(t, "INV-000010", numbers[9])
+	})
+}
+
+func TestParseTaxRate(t *testing.T) {
+	rate, err := ParseTaxRate("")
+	require.NoError(t, err)
+	require.Zero(t, rate)
+
+	rate, err = ParseTaxRate("16")
+	require.NoError(t, err)
+	require.Equal(t, 16.0, rate)
+
+	for _, value := range []string{"sixteen", "-1", "100"} {
+		_, err := ParseTaxRate(value)
+		require.Error(t, err, value)
+	}
+}
+
+func TestBuild(t *testing.T) {
+	latte := store.Item{Id: primitive.NewObjectID(), Name: "Latte"}
+	mocha := store.Item{Id: primitive.NewObjectID(), Name: "Mocha"}
+	customer := store.User{Id: primitive.NewObjectID(), UserName: "jane", Email: "jane@example.com"}
+	order := store.Order{
+		Id: primitive.NewObjectID(),
+		Items: []store.OrderItem{
+			{Product: latte.Id, Quantity: 2, Amount: 11.60},
+			{Product: mocha.Id, Quantity: 3, Amount: 10, Discount: 1},
+			{Product: primitive.NewObjectID(), Quantity: 1, Amount: 1},
+		},
+	}
+	products := map[primitive.ObjectID]store.Item{latte.Id: latte, mocha.Id: mocha}
+
+	t.Run("splits tax inclusive totals", func(t *testing.T) {
+		inv := Build(FormatNumber(7), order, customer, products, 16)
+		require.Equal(t, "INV-000007", inv.Number)
+		require.Equal(t, order.Id, inv.Order)
+		require.Equal(t, customer.Id, inv.Customer)
+		require.Equal(t, "jane@example.com", inv.CustomerEmail)
+		require.Len(t, inv.Lines, 3)
+
+		latteLine := inv.Lines[0]
+		require.Equal(t, "Latte", latteLine.Name)
+		require.Equal(t, 5.80, latteLine.UnitPrice)
+		require.Equal(t, 10.00, latteLine.Net)
+		require.Equal(t, 1.60, latteLine.Tax)
+		require.Equal(t, 11.60, latteLine.Total)
+
+		mochaLine := inv.Lines[1]
+		require.Equal(t, 3.33, mochaLine.UnitPrice)
+		require.Equal(t, 1.0, mochaLine.Discount)
+		require.Equal(t, 7.76, mochaLine.Net)
+		require.Equal(t, 1.24, mochaLine.Tax)
+		require.Equal(t, 9.0, mochaLine.Total)
+
+		// 1 / 1.16 rounds to 0.86, leaving 0.14 of tax so that every line
+		// still adds up to what the customer paid.
+		require.Equal(t, "Discontinued product", inv.Lines[2].Name)
+		require.Equal(t, 0.86, inv.Lines[2].Net)
+		require.Equal(t, 0.14, inv.Lines[2].Tax)
+
+		require.Equal(t, 1.0, inv.Discount)
+		require.Equal(t, 18.62, inv.Net)
+		require.Equal(t, 2.98, inv.Tax)
+		require.Equal(t, 21.60, inv.Total)
+	})
+
+	t.Run("without tax", func(t *testing.T) {
+		inv := Build(FormatNumber(8), order, customer, products, 0)
+		for _, line := range inv.Lines {
+			require.Equal(t, line.Total, line.Net)
+			require.Zero(t, line.Tax)
+		}
+		require.Equal(t, inv.Total, inv.Net)
+	})
+
+	t.Run("renders the invoice", func(t *testing.T) {
+		document, err := Render(Build(FormatNumber(9), order, customer, products, 16))
+		require.NoError(t, err)
+		require.Contains(t, string(document), "Invoice INV-000009")
+		require.Contains(t, string(document), "Discontinued product")
+		require.Contains(t, string(document), "21.60")
+	})
+}
@@ -0,0 +1,129 @@
+package internal
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	DefaultPageLimit int64 = 20
+	MaxPageLimit     int64 = 100
+)
+
+// ParseLimit reads the ?limit= query parameter, falling back to
+// DefaultPageLimit and capping it at MaxPageLimit.
+func ParseLimit(query url.Values) (int64, error) {
+	value := query.Get("limit")
+	if value == "" {
+		return DefaultPageLimit, nil
+	}
+
+	limit, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || limit < 1 {
+		return 0, fmt.Errorf("invalid limit %q", value)
+	}
+
+	if limit > MaxPageLimit {
+		limit = MaxPageLimit
+	}
+	return limit, nil
+}
+
+// EncodeCursor turns the id of the last document of a page into an opaque
+// cursor for the next page.
+func EncodeCursor(id primitive.ObjectID) string {
+	return base64.RawURLEncoding.EncodeToString(id[:])
+}
+
+func DecodeCursor(cursor string) (primitive.ObjectID, error) {
+	var id primitive.ObjectID
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || len(data) != len(id) {
+		return id, fmt.Errorf("invalid cursor %q", cursor)
+	}
+
+	copy(id[:], data)
+	return id, nil
+}
+
+// EncodeOffsetCursor turns a skip offset into an opaque cursor for listings
+// that are not sorted on _id.
+func EncodeOffsetCursor(offset int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(offset, 10)))
+}
+
+func DecodeOffsetCursor(cursor string) (int64, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, fmt.Errorf("invalid cursor %q", cursor)
+	}
+
+	offset, err := strconv.ParseInt(string(data), 10, 64)
+	if err != nil || offset < 0 {
+		return 0, fmt.Errorf("invalid cursor %q", cursor)
+	}
+	return offset, nil
+}
+
+// ParseDateRange reads ?from= and ?to= as either RFC3339 timestamps or plain
+// YYYY-MM-DD dates and returns a range filter on field. A date-only ?to= is
+// inclusive of the whole day.
+func ParseDateRange(query url.Values, field string) (bson.E, bool, error) {
+	rng := bson.D{}
+	if value := query.Get("from"); value != "" {
+		from, _, err := parseDate(value)
+		if err != nil {
+			return bson.E{}, false, err
+		}
+		rng = append(rng, bson.E{Key: "$gte", Value: from})
+	}
+
+	if value := query.Get("to"); value != "" {
+		to, dateOnly, err := parseDate(value)
+		if err != nil {
+			return bson.E{}, false, err
+		}
+		if dateOnly {
+			to = to.AddDate(0, 0, 1)
+		}
+		rng = append(rng, bson.E{Key: "$lt", Value: to})
+	}
+
+	if len(rng) == 0 {
+		return bson.E{}, false, nil
+	}
+	return bson.E{Key: field, Value: rng}, true, nil
+}
+
+func parseDate(value string) (date time.Time, dateOnly bool, err error) {
+	date, err = time.Parse(time.RFC3339, value)
+	if err == nil {
+		return date, false, nil
+	}
+
+	date, err = time.Parse(time.DateOnly, value)
+	if err != nil {
+		return date, false, fmt.Errorf("invalid date %q, expected RFC3339 or YYYY-MM-DD", value)
+	}
+	return date, true, nil
+}
+
+// SplitQueryList splits a comma separated query parameter and drops empty
+// entries, e.g. ?status=pending,ready.
+func SplitQueryList(value string) []string {
+	var list []string
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry != "" {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
@@ -0,0 +1,78 @@
+package password
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrUnknownHash    = errors.New("unrecognised password hash")
+	ErrMalformedHash  = errors.New("malformed password hash")
+	ErrLegacyHashOnly = errors.New("legacy hashes can only be verified")
+)
+
+// PasswordHasher is one password hashing scheme. Every scheme stores its
+// parameters inside the encoded hash, so hashes made with older settings
+// keep verifying after the settings change.
+type PasswordHasher interface {
+	Hash(password string) (string, error)
+	Verify(password, encoded string) (bool, error)
+	// Identifies reports whether encoded was produced by this scheme.
+	Identifies(encoded string) bool
+	// NeedsRehash reports whether encoded was produced with weaker
+	// parameters than the hasher currently uses.
+	NeedsRehash(encoded string) bool
+}
+
+// Manager hashes new passwords with the preferred scheme and verifies
+// passwords against any scheme it knows, flagging hashes that should be
+// upgraded to the preferred one.
+type Manager struct {
+	preferred PasswordHasher
+	known     []PasswordHasher
+}
+
+func NewManager(preferred PasswordHasher, accepted ...PasswordHasher) *Manager {
+	return &Manager{
+		preferred: preferred,
+		known:     append([]PasswordHasher{preferred}, accepted...),
+	}
+}
+
+// NewDefaultManager returns a manager preferring scheme ("argon2id" or
+// "bcrypt", argon2id when empty) that also accepts the other scheme and
+// the legacy SHA-256 hashes.
+func NewDefaultManager(scheme string) (*Manager, error) {
+	argon := NewArgon2idHasher(DefaultArgon2idParams)
+	bcrypt := NewBcryptHasher(DefaultBcryptCost)
+
+	switch scheme {
+	case "", "argon2id":
+		return NewManager(argon, bcrypt, LegacySHA256Hasher{}), nil
+	case "bcrypt":
+		return NewManager(bcrypt, argon, LegacySHA256Hasher{}), nil
+	default:
+		return nil, fmt.Errorf("unknown password hashing scheme %q", scheme)
+	}
+}
+
+func (m *Manager) Hash(password string) (string, error) {
+	return m.preferred.Hash(password)
+}
+
+// Verify checks password against encoded. rehash is true when the password
+// matched but encoded should be replaced by a fresh Hash of it.
+func (m *Manager) Verify(password, encoded string) (ok bool, rehash bool, err error) {
+	for _, hasher := range m.known {
+		if !hasher.Identifies(encoded) {
+			continue
+		}
+
+		ok, err := hasher.Verify(password, encoded)
+		if err != nil || !ok {
+			return false, false, err
+		}
+		return true, hasher != m.preferred || hasher.NeedsRehash(encoded), nil
+	}
+	return false, false, ErrUnknownHash
+}
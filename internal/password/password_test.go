@@ -0,0 +1,213 @@
+package password
+
+import (
+	"crypto"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Cheap parameters keep the tests fast; the defaults take a good fraction
+// of a second per hash by design.
+var testArgon2idParams = Argon2idParams{
+	Memory:      1024,
+	Iterations:  1,
+	Parallelism: 1,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+func legacyHash(password string) string {
+	return hex.EncodeToString(crypto.SHA256.New().Sum([]byte(password)))
+}
+
+func TestArgon2idHasher(t *testing.T) {
+	hasher := NewArgon2idHasher(testArgon2idParams)
+
+	encoded, err := hasher.Hash("Abstract$87")
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(encoded, "$argon2id$v=19$m=1024,t=1,p=1$"))
+	require.True(t, hasher.Identifies(encoded))
+	require.False(t, hasher.NeedsRehash(encoded))
+
+	ok, err := hasher.Verify("Abstract$87", encoded)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	ok, err = hasher.Verify("Abstract$88", encoded)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	t.Run("salted", func(t *testing.T) {
+		again, err := hasher.Hash("Abstract$87")
+		require.NoError(t, err)
+		require.NotEqual(t, encoded, again)
+	})
+
+	t.Run("stronger parameters need a rehash", func(t *testing.T) {
+		stronger := testArgon2idParams
+		stronger.Iterations = 2
+		require.True(t, NewArgon2idHasher(stronger).NeedsRehash(encoded))
+
+		// Hashes keep verifying after the parameters change.
+		ok, err := NewArgon2idHasher(stronger).Verify("Abstract$87", encoded)
+		require.NoError(t, err)
+		require.True(t, ok)
+	})
+
+	t.Run("malformed hashes", func(t *testing.T) {
+		for _, encoded := range []string{
+			"",
+			"$argon2id$v=19$m=1024,t=1,p=1$c2FsdA",
+			"$argon2id$v=18$m=1024,t=1,p=1$c2FsdA$a2V5",
+			"$argon2id$v=19$m=x,t=1,p=1$c2FsdA$a2V5",
+			"$argon2id$v=19$m=1024,t=1,p=1$c2FsdA$",
+		} {
+			_, err := hasher.Verify("Abstract$87", encoded)
+			require.ErrorIs(t, err, ErrMalformedHash, encoded)
+			require.True(t, hasher.NeedsRehash(encoded), encoded)
+		}
+	})
+}
+
+func TestBcryptHasher(t *testing.T) {
+	hasher := NewBcryptHasher(bcrypt.MinCost)
+
+	encoded, err := hasher.Hash("Abstract$87")
+	require.NoError(t, err)
+	require.True(t, hasher.Identifies(encoded))
+	require.False(t, hasher.NeedsRehash(encoded))
+	require.True(t, NewBcryptHasher(bcrypt.MinCost+1).NeedsRehash(encoded))
+	require.True(t, hasher.NeedsRehash("not a hash"))
+
+	ok, err := hasher.Verify("Abstract$87", encoded)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	ok, err = hasher.Verify("Abstract$88", encoded)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	_, err = hasher.Verify("Abstract$87", "$2a$04$short")
+	require.Error(t, err)
+
+	require.True(t, hasher.Identifies("$2b$12$"))
+	require.True(t, hasher.Identifies("$2y$12$"))
+	require.False(t, hasher.Identifies("$argon2id$"))
+}
+
+func TestLegacySHA256Hasher(t *testing.T) {
+	var hasher LegacySHA256Hasher
+	encoded := legacyHash("Abstract$87")
+
+	require.True(t, hasher.Identifies(encoded))
+	require.True(t, hasher.NeedsRehash(encoded))
+	require.False(t, hasher.Identifies("$2a$12$"+encoded))
+	require.False(t, hasher.Identifies("abcdef"))
+	require.False(t, hasher.Identifies(strings.Repeat("z", 64)))
+
+	ok, err := hasher.Verify("Abstract$87", encoded)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	ok, err = hasher.Verify("Abstract$88", encoded)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	_, err = hasher.Hash("Abstract$87")
+	require.ErrorIs(t, err, ErrLegacyHashOnly)
+}
+
+func TestManagerVerify(t *testing.T) {
+	argon := NewArgon2idHasher(testArgon2idParams)
+	bcryptHasher := NewBcryptHasher(bcrypt.MinCost)
+	manager := NewManager(argon, bcryptHasher, LegacySHA256Hasher{})
+
+	preferred, err := manager.Hash("Abstract$87")
+	require.NoError(t, err)
+	require.True(t, argon.Identifies(preferred))
+
+	bcrypted, err := bcryptHasher.Hash("Abstract$87")
+	require.NoError(t, err)
+
+	weaker, err := NewArgon2idHasher(Argon2idParams{Memory: 512, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}).Hash("Abstract$87")
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name     string
+		password string
+		encoded  string
+		ok       bool
+		rehash   bool
+		err      error
+	}{
+		{name: "preferred scheme", password: "Abstract$87", encoded: preferred, ok: true},
+		{name: "other scheme", password: "Abstract$87", encoded: bcrypted, ok: true, rehash: true},
+		{name: "weaker parameters", password: "Abstract$87", encoded: weaker, ok: true, rehash: true},
+		{name: "legacy hash", password: "Abstract$87", encoded: legacyHash("Abstract$87"), ok: true, rehash: true},
+		{name: "wrong password", password: "Abstract$88", encoded: bcrypted},
+		{name: "wrong legacy password", password: "Abstract$88", encoded: legacyHash("Abstract$87")},
+		{name: "unknown scheme", password: "Abstract$87", encoded: "$1$plain", err: ErrUnknownHash},
+		{name: "malformed hash", password: "Abstract$87", encoded: "$argon2id$v=19$m=1024", err: ErrMalformedHash},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			ok, rehash, err := manager.Verify(test.password, test.encoded)
+			if test.err != nil {
+				require.True(t, errors.Is(err, test.err), err)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, test.ok, ok)
+			require.Equal(t, test.rehash, rehash)
+		})
+	}
+}
+
+func TestNewDefaultManager(t *testing.T) {
+	for _, scheme := range []string{"", "argon2id", "bcrypt"} {
+		_, err := NewDefaultManager(scheme)
+		require.NoError(t, err, scheme)
+	}
+
+	_, err := NewDefaultManager("md5")
+	require.Error(t, err)
+}
+
+func TestValidate(t *testing.T) {
+	testCases := []struct {
+		name     string
+		password string
+		personal []string
+		valid    bool
+	}{
+		{name: "three classes", password: "abstract$87", valid: true},
+		{name: "four classes", password: "Abstract$87", valid: true},
+		{name: "shortest", password: "Abcdef1!", valid: true},
+		{name: "too short", password: "Abcde1!"},
+		{name: "longest", password: "Aa1" + strings.Repeat("x", MaxLength-3), valid: true},
+		{name: "too long", password: "Aa1" + strings.Repeat("x", MaxLength-2)},
+		{name: "two classes", password: "abstract87"},
+		{name: "symbols count as a class", password: "ABSTRACT$$87", valid: true},
+		{name: "contains username", password: "Jane$Doe87", personal: []string{"jane"}},
+		{name: "contains email case insensitively", password: "xJANEDOEx$87", personal: []string{" JaneDoe "}},
+		{name: "short details are ignored", password: "Jo$Abstract87", personal: []string{"jo"}, valid: true},
+		{name: "empty details are ignored", password: "Abstract$87", personal: []string{"", "   "}, valid: true},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			err := Validate(test.password, test.personal...)
+			if test.valid {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorIs(t, err, ErrWeakPassword)
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package password
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+const (
+	MinLength = 8
+	// MaxLength is bcrypt's input limit; longer passwords would be
+	// silently truncated by it.
+	MaxLength = 72
+)
+
+var ErrWeakPassword = errors.New("weak password")
+
+// Validate enforces the password policy for signup and reset: 8 to 72
+// bytes, at least three of lower case, upper case, digits and symbols, and
+// not containing any of the given personal details such as the username or
+// the local part of the email address.
+func Validate(password string, personal ...string) error {
+	if len(password) < MinLength || len(password) > MaxLength {
+		return fmt.Errorf("%w: must be between %d and %d characters long", ErrWeakPassword, MinLength, MaxLength)
+	}
+
+	var lower, upper, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+
+	classes := 0
+	for _, present := range []bool{lower, upper, digit, symbol} {
+		if present {
+			classes++
+		}
+	}
+	if classes < 3 {
+		return fmt.Errorf("%w: must mix at least three of lower case, upper case, digits and symbols", ErrWeakPassword)
+	}
+
+	lowered := strings.ToLower(password)
+	for _, detail := range personal {
+		detail = strings.ToLower(strings.TrimSpace(detail))
+		if len(detail) >= 3 && strings.Contains(lowered, detail) {
+			return fmt.Errorf("%w: must not contain your username or email", ErrWeakPassword)
+		}
+	}
+	return nil
+}
@@ -2,7 +2,6 @@ package internal
 
 import (
 	"context"
-	"crypto"
 	"crypto/rand"
 	"encoding/json"
 	"fmt"
@@ -11,7 +10,6 @@ import (
 	"net/http"
 	"regexp"
 	"strings"
-	"time"
 
 	"github.com/go-playground/validator/v10"
 	"github.com/silaselisha/coffee-api/pkg/store"
@@ -93,15 +91,6 @@ func CreateNewUser(email, name, phoneNumber, role string) store.User {
 	return user
 }
 
-func PasswordEncryption(password []byte) string {
-	return fmt.Sprintf("%x", crypto.SHA256.New().Sum(password))
-}
-
-func ComparePasswordEncryption(password, comparePassword string) bool {
-	hash := fmt.Sprintf("%x", crypto.SHA256.New().Sum([]byte(password)))
-	return hash == comparePassword
-}
-
 func genObjectToken() (string, error) {
 	buff := make([]byte, 16)
 	_, err := rand.Read(buff)
@@ -111,12 +100,6 @@ func genObjectToken() (string, error) {
 	return fmt.Sprintf("%x", buff), nil
 }
 
-func ResetToken(expire int32) (timestamp int64) {
-	duration := time.Minute * time.Duration(int(expire))
-	expiryTime := time.Now().Add(duration)
-	return expiryTime.Local().UnixMilli()
-}
-
 func ImageProcessor(ctx context.Context, file io.ReadCloser, opts *types.FileMetadata) (data []byte, fileName string, extension string, err error) {
 	data, err = io.ReadAll(file)
 	if err != nil {
@@ -153,7 +136,7 @@ func NewErrorResponse(status string, err string) *types.ErrorResParams {
 	}
 }
 
-func ReadReqBody[T types.UserReqParams | types.OrderParams | types.UserLoginParams | types.ForgotPasswordParams | types.PasswordResetParams](data io.ReadCloser, sanitizer *validator.Validate) (payload T, err error) {
+func ReadReqBody[T types.UserReqParams | types.OrderParams | types.UserLoginParams | types.ForgotPasswordParams | types.RefreshTokenParams | types.TwoFactorCodeParams | types.TwoFactorLoginParams | types.PasswordResetParams | types.OrderStatusParams | types.OrderCancelParams | types.ReviewParams | types.ReviewUpdateParams | types.ReviewVisibilityParams | types.IngredientParams | types.IngredientStockParams | types.TableParams | types.TableUpdateParams | types.ReservationParams | types.ReservationUpdateParams | types.PaymentParams | types.RefundParams | types.RoleParams | types.RoleUpdateParams | types.UserRoleParams | types.APIKeyParams](data io.ReadCloser, sanitizer *validator.Validate) (payload T, err error) {
 	payloadBytes, err := io.ReadAll(data)
 	if err != nil {
 		if err == io.EOF {
@@ -161,19 +144,19 @@ func ReadReqBody[T types.UserReqParams | types.OrderParams | types.UserLoginPara
 		}
 		return payload, err
 	}
-	
+
 	err = json.Unmarshal(payloadBytes, &payload)
 	if err != nil {
 		return payload, err
 	}
-	
+
 	defer func(payload T) {
 		if dErr := data.Close(); dErr != nil {
 			err = dErr
 			return
 		}
 	}(payload)
-	
+
 	err = sanitizer.Struct(payload)
 	if err != nil {
 		return payload, err
@@ -187,7 +170,7 @@ func ReadReqBody[T types.UserReqParams | types.OrderParams | types.UserLoginPara
 
 func ExtractProductsID(orders types.OrderParams) ([]primitive.ObjectID, []store.OrderItem, error) {
 	var products []store.OrderItem
-    var productsIds []primitive.ObjectID
+	var productsIds []primitive.ObjectID
 
 	for _, order := range orders.Items {
 		id, err := primitive.ObjectIDFromHex(order.Product)
@@ -195,7 +178,7 @@ func ExtractProductsID(orders types.OrderParams) ([]primitive.ObjectID, []store.
 			return nil, nil, err
 		}
 		item := store.OrderItem{
-			Product: id,
+			Product:  id,
 			Quantity: order.Quantity,
 		}
 
@@ -203,4 +186,4 @@ func ExtractProductsID(orders types.OrderParams) ([]primitive.ObjectID, []store.
 		products = append(products, item)
 	}
 	return productsIds, products, nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,87 @@
+package apikey
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/silaselisha/coffee-api/pkg/cache"
+	"github.com/silaselisha/coffee-api/pkg/store"
+	"github.com/silaselisha/coffee-api/pkg/token"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// KeyPrefix marks API keys so that they are recognisable when they leak,
+// e.g. to secret scanners, and cannot be mistaken for JWTs.
+const KeyPrefix = "cfk_"
+
+// lastUsedPrecision bounds how often a busy key writes its last use.
+const lastUsedPrecision = time.Minute
+
+var ErrInvalidKey = errors.New("invalid, expired or revoked api key")
+
+// Generate returns a new key for the client, the digest stored in its place
+// and the prefix shown in listings.
+func Generate() (key string, digest string, prefix string, err error) {
+	secret, _, err := token.NewOpaqueToken()
+	if err != nil {
+		return "", "", "", err
+	}
+
+	key = KeyPrefix + secret
+	return key, token.HashOpaqueToken(key), key[:len(KeyPrefix)+6], nil
+}
+
+type Verifier struct {
+	str       store.Mongo
+	userCache *cache.UserCache
+}
+
+func NewVerifier(str store.Mongo, userCache *cache.UserCache) *Verifier {
+	return &Verifier{str: str, userCache: userCache}
+}
+
+// Verify returns the key unless it is unknown, expired or revoked, and
+// records that it was used. Keys are looked up through the cache, so
+// revoking one must invalidate it there.
+func (v *Verifier) Verify(ctx context.Context, key string) (store.APIKey, error) {
+	if !strings.HasPrefix(key, KeyPrefix) {
+		return store.APIKey{}, ErrInvalidKey
+	}
+
+	digest := token.HashOpaqueToken(key)
+	apiKey, err := v.userCache.APIKey(ctx, digest)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return store.APIKey{}, ErrInvalidKey
+		}
+		return store.APIKey{}, err
+	}
+
+	now := time.Now()
+	if apiKey.ExpiresAt != nil && !now.Before(*apiKey.ExpiresAt) {
+		return store.APIKey{}, ErrInvalidKey
+	}
+
+	if apiKey.LastUsedAt == nil || now.Sub(*apiKey.LastUsedAt) >= lastUsedPrecision {
+		collection := v.str.Collection(ctx, "coffeeshop", "api_keys")
+		filter := bson.D{
+			{Key: "_id", Value: apiKey.Id},
+			{Key: "$or", Value: bson.A{
+				bson.D{{Key: "last_used_at", Value: bson.D{{Key: "$exists", Value: false}}}},
+				bson.D{{Key: "last_used_at", Value: bson.D{{Key: "$lt", Value: now.Add(-lastUsedPrecision)}}}},
+			}},
+		}
+		_, err := collection.UpdateOne(ctx, filter, bson.D{{Key: "$set", Value: bson.D{{Key: "last_used_at", Value: now}}}})
+		if err != nil {
+			log.Printf("failed to record the use of api key %s %v\n", apiKey.Id.Hex(), err)
+		}
+		// The cached last use is now stale; reloading it keeps the next
+		// requests from writing again.
+		v.userCache.InvalidateAPIKey(ctx, digest)
+	}
+	return apiKey, nil
+}
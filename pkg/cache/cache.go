@@ -0,0 +1,161 @@
+package cache
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Backend stores encoded values under a key for a limited time. Get reports
+// a missing or expired key with ok set to false.
+type Backend interface {
+	Get(ctx context.Context, key string) (value []byte, ok bool, err error)
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	Delete(ctx context.Context, keys ...string) error
+}
+
+type memoryEntry struct {
+	value     []byte
+	expiresAt time.Time
+}
+
+// Memory is a Backend local to the process. Once it holds size entries,
+// expired entries are dropped and then, if it is still full, an arbitrary
+// one.
+type Memory struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]memoryEntry
+	stats   *Stats
+}
+
+func NewMemory(size int, stats *Stats) *Memory {
+	return &Memory{
+		size:    size,
+		entries: make(map[string]memoryEntry, size),
+		stats:   stats,
+	}
+}
+
+func (m *Memory) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, ok := m.entries[key]
+	if !ok {
+		return nil, false, nil
+	}
+	if time.Now().After(entry.expiresAt) {
+		delete(m.entries, key)
+		return nil, false, nil
+	}
+	return entry.value, true, nil
+}
+
+func (m *Memory) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.entries[key]; !ok && len(m.entries) >= m.size {
+		m.evict()
+	}
+	m.entries[key] = memoryEntry{value: value, expiresAt: time.Now().Add(ttl)}
+	return nil
+}
+
+func (m *Memory) Delete(ctx context.Context, keys ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, key := range keys {
+		delete(m.entries, key)
+	}
+	return nil
+}
+
+func (m *Memory) evict() {
+	now := time.Now()
+	for key, entry := range m.entries {
+		if now.After(entry.expiresAt) {
+			delete(m.entries, key)
+		}
+	}
+
+	for key := range m.entries {
+		if len(m.entries) < m.size {
+			break
+		}
+		delete(m.entries, key)
+		m.stats.evictions.Add(1)
+	}
+}
+
+// Redis is a Backend shared by every instance of the API, so an
+// invalidation on one instance is seen by all of them.
+type Redis struct {
+	client redis.UniversalClient
+	prefix string
+}
+
+func NewRedis(client redis.UniversalClient, prefix string) *Redis {
+	return &Redis{client: client, prefix: prefix}
+}
+
+func (rd *Redis) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	value, err := rd.client.Get(ctx, rd.prefix+key).Bytes()
+	if err == redis.Nil {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+func (rd *Redis) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return rd.client.Set(ctx, rd.prefix+key, value, ttl).Err()
+}
+
+func (rd *Redis) Delete(ctx context.Context, keys ...string) error {
+	prefixed := make([]string, 0, len(keys))
+	for _, key := range keys {
+		prefixed = append(prefixed, rd.prefix+key)
+	}
+	return rd.client.Del(ctx, prefixed...).Err()
+}
+
+// Stats counts cache lookups. Counters only grow; rates are derived from
+// them by whoever reads the snapshot.
+type Stats struct {
+	hits          atomic.Uint64
+	misses        atomic.Uint64
+	evictions     atomic.Uint64
+	invalidations atomic.Uint64
+	errors        atomic.Uint64
+}
+
+type StatsSnapshot struct {
+	Hits          uint64  `json:"hits"`
+	Misses        uint64  `json:"misses"`
+	Evictions     uint64  `json:"evictions"`
+	Invalidations uint64  `json:"invalidations"`
+	Errors        uint64  `json:"errors"`
+	HitRate       float64 `json:"hit_rate"`
+}
+
+func (st *Stats) Snapshot() StatsSnapshot {
+	snapshot := StatsSnapshot{
+		Hits:          st.hits.Load(),
+		Misses:        st.misses.Load(),
+		Evictions:     st.evictions.Load(),
+		Invalidations: st.invalidations.Load(),
+		Errors:        st.errors.Load(),
+	}
+	if lookups := snapshot.Hits + snapshot.Misses; lookups > 0 {
+		snapshot.HitRate = float64(snapshot.Hits) / float64(lookups)
+	}
+	return snapshot
+}
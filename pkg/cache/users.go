@@ -0,0 +1,212 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/silaselisha/coffee-api/pkg/store"
+	"github.com/silaselisha/coffee-api/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// CachedUser is the part of a user the auth middleware needs. Password
+// hashes never enter the cache.
+type CachedUser struct {
+	Id                primitive.ObjectID `json:"id"`
+	Email             string             `json:"email"`
+	Avatar            string             `json:"avatar"`
+	Role              string             `json:"role"`
+	Verified          bool               `json:"verified"`
+	TwoFactor         bool               `json:"two_factor"`
+	TokenVersion      int64              `json:"token_version"`
+	PasswordChangedAt time.Time          `json:"password_changed_at"`
+}
+
+// UserCache fronts the users, roles and API keys lookups every
+// authenticated request makes. Handlers that change a user, a role or a key
+// must invalidate it; the TTL bounds how long another instance with its own
+// memory cache may serve the old entry.
+type UserCache struct {
+	str     store.Mongo
+	backend Backend
+	ttl     time.Duration
+	stats   *Stats
+}
+
+func NewUserCache(str store.Mongo, backend Backend, ttl time.Duration, stats *Stats) *UserCache {
+	return &UserCache{
+		str:     str,
+		backend: backend,
+		ttl:     ttl,
+		stats:   stats,
+	}
+}
+
+func userKey(id primitive.ObjectID) string {
+	return "user:" + id.Hex()
+}
+
+func roleKey(name string) string {
+	return "role:" + name
+}
+
+// User returns mongo.ErrNoDocuments for unknown ids. Misses are not cached.
+func (uc *UserCache) User(ctx context.Context, id primitive.ObjectID) (CachedUser, error) {
+	var cached CachedUser
+	if uc.get(ctx, userKey(id), &cached) {
+		return cached, nil
+	}
+
+	var user store.User
+	collection := uc.str.Collection(ctx, "coffeeshop", "users")
+	err := collection.FindOne(ctx, bson.D{{Key: "_id", Value: id}}).Decode(&user)
+	if err != nil {
+		return CachedUser{}, err
+	}
+
+	cached = CachedUser{
+		Id:                user.Id,
+		Email:             user.Email,
+		Avatar:            user.Avatar,
+		Role:              user.Role,
+		Verified:          user.Verified,
+		TwoFactor:         user.TwoFactor != nil && user.TwoFactor.Enabled,
+		TokenVersion:      user.TokenVersion,
+		PasswordChangedAt: user.PasswordChangedAt,
+	}
+	uc.set(ctx, userKey(id), cached)
+	return cached, nil
+}
+
+// CachedRole is what a role grants its holders.
+type CachedRole struct {
+	Permissions      []string `json:"permissions"`
+	RequireTwoFactor bool     `json:"require_two_factor"`
+}
+
+// Role reads the role from the roles collection. The admin role always
+// holds every permission so that it cannot be locked out, and a role that no
+// longer exists grants nothing.
+func (uc *UserCache) Role(ctx context.Context, name string) (CachedRole, error) {
+	var cached CachedRole
+	if !uc.get(ctx, roleKey(name), &cached) {
+		var role store.Role
+		collection := uc.str.Collection(ctx, "coffeeshop", "roles")
+		err := collection.FindOne(ctx, bson.D{{Key: "name", Value: name}}).Decode(&role)
+		if err != nil && err != mongo.ErrNoDocuments {
+			return CachedRole{}, err
+		}
+
+		cached = CachedRole{Permissions: role.Permissions, RequireTwoFactor: role.RequireTwoFactor}
+		uc.set(ctx, roleKey(name), cached)
+	}
+
+	if cached.Permissions == nil {
+		cached.Permissions = []string{}
+	}
+	if name == types.ROLE_ADMIN {
+		cached.Permissions = []string{types.PERM_ALL}
+	}
+	return cached, nil
+}
+
+func apiKeyKey(digest string) string {
+	return "apikey:" + digest
+}
+
+// APIKey returns the unrevoked API key stored under digest, or
+// mongo.ErrNoDocuments. Misses are not cached, so a new key works at once;
+// the digest being the cache key, the entry holds nothing secret.
+func (uc *UserCache) APIKey(ctx context.Context, digest string) (store.APIKey, error) {
+	var cached store.APIKey
+	if uc.get(ctx, apiKeyKey(digest), &cached) {
+		return cached, nil
+	}
+
+	collection := uc.str.Collection(ctx, "coffeeshop", "api_keys")
+	filter := bson.D{
+		{Key: "key_hash", Value: digest},
+		{Key: "revoked_at", Value: bson.D{{Key: "$exists", Value: false}}},
+	}
+	if err := collection.FindOne(ctx, filter).Decode(&cached); err != nil {
+		return store.APIKey{}, err
+	}
+	uc.set(ctx, apiKeyKey(digest), cached)
+	return cached, nil
+}
+
+func (uc *UserCache) InvalidateUser(ctx context.Context, ids ...primitive.ObjectID) {
+	keys := make([]string, 0, len(ids))
+	for _, id := range ids {
+		keys = append(keys, userKey(id))
+	}
+	uc.invalidate(ctx, keys)
+}
+
+func (uc *UserCache) InvalidateRole(ctx context.Context, names ...string) {
+	keys := make([]string, 0, len(names))
+	for _, name := range names {
+		keys = append(keys, roleKey(name))
+	}
+	uc.invalidate(ctx, keys)
+}
+
+func (uc *UserCache) InvalidateAPIKey(ctx context.Context, digests ...string) {
+	keys := make([]string, 0, len(digests))
+	for _, digest := range digests {
+		keys = append(keys, apiKeyKey(digest))
+	}
+	uc.invalidate(ctx, keys)
+}
+
+func (uc *UserCache) Stats() StatsSnapshot {
+	return uc.stats.Snapshot()
+}
+
+// get treats a failing backend as a miss so that requests fall back to
+// Mongo instead of failing.
+func (uc *UserCache) get(ctx context.Context, key string, dst interface{}) bool {
+	data, ok, err := uc.backend.Get(ctx, key)
+	if err == nil && ok {
+		err = json.Unmarshal(data, dst)
+		if err == nil {
+			uc.stats.hits.Add(1)
+			return true
+		}
+	}
+
+	if err != nil {
+		uc.stats.errors.Add(1)
+		log.Printf("user cache get %s failed %v\n", key, err)
+	}
+	uc.stats.misses.Add(1)
+	return false
+}
+
+func (uc *UserCache) set(ctx context.Context, key string, value interface{}) {
+	data, err := json.Marshal(value)
+	if err == nil {
+		err = uc.backend.Set(ctx, key, data, uc.ttl)
+	}
+
+	if err != nil {
+		uc.stats.errors.Add(1)
+		log.Printf("user cache set %s failed %v\n", key, err)
+	}
+}
+
+func (uc *UserCache) invalidate(ctx context.Context, keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+
+	uc.stats.invalidations.Add(uint64(len(keys)))
+	if err := uc.backend.Delete(ctx, keys...); err != nil {
+		uc.stats.errors.Add(1)
+		log.Printf("user cache invalidation failed %v\n", err)
+	}
+}
@@ -0,0 +1,126 @@
+package lockout
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Policy decides how failed logins are throttled. Failures are forgotten
+// Window after the first one of a streak, or as soon as a login succeeds.
+type Policy struct {
+	Window time.Duration
+	// From the DelayAfter-th failure on an account has to wait BaseDelay,
+	// doubling with every further failure up to MaxDelay, before it may try
+	// again.
+	DelayAfter int64
+	BaseDelay  time.Duration
+	MaxDelay   time.Duration
+	// The LockAfter-th failure locks the account for LockFor.
+	LockAfter int64
+	LockFor   time.Duration
+	// An address failing MaxPerIP times within Window, on any accounts, is
+	// blocked for the rest of the window.
+	MaxPerIP int64
+}
+
+// Failure is what recording a failed login led to.
+type Failure struct {
+	Locked     bool
+	RetryAfter time.Duration
+}
+
+// Guard keeps its counters in Redis so that every instance of the API
+// enforces the same limits.
+type Guard struct {
+	client redis.UniversalClient
+	prefix string
+	policy Policy
+}
+
+func NewGuard(client redis.UniversalClient, prefix string, policy Policy) *Guard {
+	return &Guard{client: client, prefix: prefix, policy: policy}
+}
+
+// incr starts the expiry with the first failure so that a streak cannot be
+// kept alive forever by failing just often enough.
+var incr = redis.NewScript(`
+local count = redis.call("INCR", KEYS[1])
+if count == 1 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+return count
+`)
+
+// Check returns how long the account or the address must wait before the
+// next attempt, zero if it may go ahead.
+func (g *Guard) Check(ctx context.Context, account, ip string) (time.Duration, error) {
+	pipe := g.client.Pipeline()
+	accountWait := pipe.PTTL(ctx, g.key("block:account:", account))
+	ipWait := pipe.PTTL(ctx, g.key("block:ip:", ip))
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+
+	// PTTL is negative for keys that do not exist.
+	return max(accountWait.Val(), ipWait.Val(), 0), nil
+}
+
+// Fail records a failed attempt on account from ip. Unknown accounts are
+// counted like existing ones so that the responses do not tell them apart.
+func (g *Guard) Fail(ctx context.Context, account, ip string) (Failure, error) {
+	window := g.policy.Window.Milliseconds()
+	count, err := incr.Run(ctx, g.client, []string{g.key("fail:account:", account)}, window).Int64()
+	if err != nil {
+		return Failure{}, err
+	}
+	ipCount, err := incr.Run(ctx, g.client, []string{g.key("fail:ip:", ip)}, window).Int64()
+	if err != nil {
+		return Failure{}, err
+	}
+
+	var failure Failure
+	switch {
+	case count >= g.policy.LockAfter:
+		failure = Failure{Locked: true, RetryAfter: g.policy.LockFor}
+	case count >= g.policy.DelayAfter:
+		delay := g.policy.BaseDelay << (count - g.policy.DelayAfter)
+		failure.RetryAfter = min(delay, g.policy.MaxDelay)
+	}
+	if failure.RetryAfter > 0 {
+		err = g.client.Set(ctx, g.key("block:account:", account), 1, failure.RetryAfter).Err()
+		if err != nil {
+			return Failure{}, err
+		}
+	}
+
+	if ipCount >= g.policy.MaxPerIP {
+		err = g.client.SetNX(ctx, g.key("block:ip:", ip), 1, g.policy.Window).Err()
+		if err != nil {
+			return Failure{}, err
+		}
+		failure.RetryAfter = max(failure.RetryAfter, g.policy.Window)
+	}
+	return failure, nil
+}
+
+// Succeed ends the account's streak of failures.
+func (g *Guard) Succeed(ctx context.Context, account string) error {
+	return g.client.Del(ctx, g.key("fail:account:", account)).Err()
+}
+
+// Unlock lifts a lock or delay on the account along with its failures.
+func (g *Guard) Unlock(ctx context.Context, account string) error {
+	return g.client.Del(ctx, g.key("fail:account:", account), g.key("block:account:", account)).Err()
+}
+
+// key hashes accounts and addresses so that no email addresses end up in
+// Redis.
+func (g *Guard) key(kind, value string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(value))))
+	return g.prefix + kind + hex.EncodeToString(sum[:16])
+}
@@ -0,0 +1,356 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+var (
+	ErrUnknownProvider = errors.New("unknown identity provider")
+	ErrInvalidIdToken  = errors.New("invalid id token")
+	ErrExchangeFailed  = errors.New("authorization code exchange failed")
+)
+
+// keysRefreshInterval limits how often an unknown kid makes us refetch the
+// provider's JWKS.
+const keysRefreshInterval = time.Minute
+
+// Config describes one OpenID Connect relying party registration.
+type Config struct {
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+	// ResponseMode is sent as response_mode when set; Apple only posts the
+	// email scope back with "form_post".
+	ResponseMode string
+	// ClientSecretFunc, when set, replaces ClientSecret with a value minted
+	// for each token request, as Apple requires.
+	ClientSecretFunc func(now time.Time) (string, error)
+	HTTPClient       *http.Client
+}
+
+// Identity is what a verified id token says about the user.
+type Identity struct {
+	Provider      string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Provider runs the authorization code flow with PKCE against one issuer.
+// The discovery document and signing keys are fetched on first use, so an
+// unreachable provider does not keep the API from starting.
+type Provider struct {
+	cfg Config
+
+	mu            sync.Mutex
+	discovery     *discovery
+	keys          map[string]crypto.PublicKey
+	keysFetchedAt time.Time
+}
+
+func NewProvider(cfg Config) *Provider {
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"openid", "email", "profile"}
+	}
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &Provider{cfg: cfg}
+}
+
+func (p *Provider) Name() string {
+	return p.cfg.Name
+}
+
+// NewSecret returns a random URL safe value for state, nonce and PKCE
+// verifiers.
+func NewSecret() (string, error) {
+	data := make([]byte, 32)
+	if _, err := rand.Read(data); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// AuthCodeURL is where the user's browser is sent to sign in.
+func (p *Provider) AuthCodeURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	disc, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.cfg.ClientID},
+		"redirect_uri":          {p.cfg.RedirectURL},
+		"scope":                 {strings.Join(p.cfg.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	if p.cfg.ResponseMode != "" {
+		query.Set("response_mode", p.cfg.ResponseMode)
+	}
+
+	separator := "?"
+	if strings.Contains(disc.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return disc.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+// Exchange trades the authorization code for an id token and returns the
+// identity it asserts once signature, issuer, audience, expiry and nonce
+// check out.
+func (p *Provider) Exchange(ctx context.Context, code, verifier, nonce string) (*Identity, error) {
+	disc, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	secret := p.cfg.ClientSecret
+	if p.cfg.ClientSecretFunc != nil {
+		secret, err = p.cfg.ClientSecretFunc(time.Now())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.cfg.RedirectURL},
+		"client_id":     {p.cfg.ClientID},
+		"client_secret": {secret},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, disc.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	res, err := p.cfg.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w %v", ErrExchangeFailed, err)
+	}
+	defer res.Body.Close()
+
+	var body struct {
+		IdToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&body); err != nil {
+		return nil, fmt.Errorf("%w %v", ErrExchangeFailed, err)
+	}
+	if res.StatusCode != http.StatusOK || body.IdToken == "" {
+		return nil, fmt.Errorf("%w: %s %s", ErrExchangeFailed, body.Error, body.ErrorDescription)
+	}
+
+	return p.verify(ctx, disc, body.IdToken, nonce)
+}
+
+type idTokenClaims struct {
+	jwt.RegisteredClaims
+	Nonce string `json:"nonce"`
+	Email string `json:"email"`
+	// EmailVerified is a boolean for most providers and the string "true"
+	// for Apple.
+	EmailVerified interface{} `json:"email_verified"`
+	Name          string      `json:"name"`
+}
+
+func (p *Provider) verify(ctx context.Context, disc *discovery, idToken, nonce string) (*Identity, error) {
+	keyFunc := func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.key(ctx, disc, kid)
+	}
+
+	parser := jwt.NewParser(jwt.WithValidMethods([]string{
+		jwt.SigningMethodRS256.Alg(),
+		jwt.SigningMethodES256.Alg(),
+	}))
+
+	var claims idTokenClaims
+	if _, err := parser.ParseWithClaims(idToken, &claims, keyFunc); err != nil {
+		return nil, fmt.Errorf("%w %v", ErrInvalidIdToken, err)
+	}
+
+	if claims.Subject == "" || claims.IssuedAt == nil || claims.ExpiresAt == nil {
+		return nil, fmt.Errorf("%w: missing claims", ErrInvalidIdToken)
+	}
+	if !claims.VerifyIssuer(disc.Issuer, true) {
+		return nil, fmt.Errorf("%w: unexpected issuer", ErrInvalidIdToken)
+	}
+	if !claims.VerifyAudience(p.cfg.ClientID, true) {
+		return nil, fmt.Errorf("%w: unexpected audience", ErrInvalidIdToken)
+	}
+	if nonce == "" || claims.Nonce != nonce {
+		return nil, fmt.Errorf("%w: nonce mismatch", ErrInvalidIdToken)
+	}
+
+	verified := false
+	switch value := claims.EmailVerified.(type) {
+	case bool:
+		verified = value
+	case string:
+		verified = value == "true"
+	}
+
+	return &Identity{
+		Provider:      p.cfg.Name,
+		Subject:       claims.Subject,
+		Email:         strings.ToLower(strings.TrimSpace(claims.Email)),
+		EmailVerified: verified && claims.Email != "",
+		Name:          claims.Name,
+	}, nil
+}
+
+func (p *Provider) discover(ctx context.Context) (*discovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	var disc discovery
+	endpoint := strings.TrimSuffix(p.cfg.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := p.getJSON(ctx, endpoint, &disc); err != nil {
+		return nil, fmt.Errorf("failed to discover %s %w", p.cfg.Name, err)
+	}
+
+	if disc.Issuer != p.cfg.Issuer {
+		return nil, fmt.Errorf("%s discovery names issuer %q, expected %q", p.cfg.Name, disc.Issuer, p.cfg.Issuer)
+	}
+	if disc.AuthorizationEndpoint == "" || disc.TokenEndpoint == "" || disc.JWKSURI == "" {
+		return nil, fmt.Errorf("%s discovery document is incomplete", p.cfg.Name)
+	}
+
+	p.discovery = &disc
+	return p.discovery, nil
+}
+
+// key looks up the signing key by kid, refetching the JWKS when the
+// provider has rotated to a key we have not seen.
+func (p *Provider) key(ctx context.Context, disc *discovery, kid string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(p.keysFetchedAt) < keysRefreshInterval && p.keys != nil {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	var set jwkSet
+	if err := p.getJSON(ctx, disc.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("failed to fetch %s signing keys %w", p.cfg.Name, err)
+	}
+
+	keys, err := set.publicKeys()
+	if err != nil {
+		return nil, err
+	}
+	p.keys = keys
+	p.keysFetchedAt = time.Now()
+
+	key, ok := p.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+func (p *Provider) getJSON(ctx context.Context, endpoint string, dst interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := p.cfg.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned %d", endpoint, res.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(dst)
+}
+
+type Registry struct {
+	mu        sync.RWMutex
+	providers map[string]*Provider
+}
+
+func NewRegistry(providers ...*Provider) *Registry {
+	registry := &Registry{providers: make(map[string]*Provider)}
+	for _, provider := range providers {
+		registry.Register(provider)
+	}
+	return registry
+}
+
+// Register adds or replaces the provider under its name.
+func (reg *Registry) Register(provider *Provider) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.providers[provider.Name()] = provider
+}
+
+func (reg *Registry) Get(name string) (*Provider, error) {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+
+	provider, ok := reg.providers[name]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownProvider, name)
+	}
+	return provider, nil
+}
+
+func (reg *Registry) Names() []string {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+
+	names := make([]string, 0, len(reg.providers))
+	for name := range reg.providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,153 @@
+package payments
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/silaselisha/coffee-api/types"
+)
+
+const FakeSignatureHeader = "X-Fake-Signature"
+
+// FakeProvider stands in for a real vendor during development and tests.
+// Charges live in memory and stay pending until a signed webhook (see Sign)
+// or Settle moves them on.
+type FakeProvider struct {
+	secret  []byte
+	mu      sync.Mutex
+	charges map[string]types.PaymentStatus
+	refunds map[string]*Refund
+}
+
+func NewFakeProvider(secret string) *FakeProvider {
+	return &FakeProvider{
+		secret:  []byte(secret),
+		charges: make(map[string]types.PaymentStatus),
+		refunds: make(map[string]*Refund),
+	}
+}
+
+func (fp *FakeProvider) Name() string {
+	return "fake"
+}
+
+func (fp *FakeProvider) Initiate(ctx context.Context, intent Intent) (*Charge, error) {
+	if intent.Amount <= 0 {
+		return nil, fmt.Errorf("invalid payment amount %.2f", intent.Amount)
+	}
+	if intent.Method == METHOD_MOBILE_MONEY && intent.Phone == "" {
+		return nil, fmt.Errorf("a phone number is required for mobile money payments")
+	}
+
+	reference, err := randomReference()
+	if err != nil {
+		return nil, err
+	}
+
+	fp.mu.Lock()
+	fp.charges[reference] = types.PENDING
+	fp.mu.Unlock()
+
+	charge := &Charge{Reference: reference, Status: types.PENDING}
+	if intent.Method == METHOD_CARD {
+		charge.RedirectURL = fmt.Sprintf("http://localhost:3000/fake-checkout/%s", reference)
+	}
+	return charge, nil
+}
+
+func (fp *FakeProvider) Confirm(ctx context.Context, reference string) (*Charge, error) {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+
+	status, ok := fp.charges[reference]
+	if !ok {
+		return nil, fmt.Errorf("%w %s", ErrUnknownCharge, reference)
+	}
+	return &Charge{Reference: reference, Status: status}, nil
+}
+
+func (fp *FakeProvider) Refund(ctx context.Context, reference string, intent RefundIntent) (*Refund, error) {
+	if intent.Amount <= 0 {
+		return nil, fmt.Errorf("invalid refund amount %.2f", intent.Amount)
+	}
+
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+
+	if refund, ok := fp.refunds[intent.Id]; ok {
+		return refund, nil
+	}
+
+	refundReference, err := randomReference()
+	if err != nil {
+		return nil, err
+	}
+
+	refund := &Refund{Reference: refundReference, Amount: intent.Amount}
+	fp.refunds[intent.Id] = refund
+	return refund, nil
+}
+
+// VerifyWebhook accepts a JSON body of the form
+// {"id": "...", "type": "payment.succeeded", "reference": "..."} signed with
+// a hex HMAC-SHA256 of the body in the X-Fake-Signature header.
+func (fp *FakeProvider) VerifyWebhook(ctx context.Context, header http.Header, body []byte) (*Event, error) {
+	if len(fp.secret) == 0 {
+		return nil, ErrInvalidSignature
+	}
+
+	signature, err := hex.DecodeString(header.Get(FakeSignatureHeader))
+	if err != nil || !hmac.Equal(signature, fp.mac(body)) {
+		return nil, ErrInvalidSignature
+	}
+
+	var event Event
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, fmt.Errorf("malformed webhook body %w", err)
+	}
+
+	switch event.Type {
+	case EVENT_PAYMENT_SUCCEEDED:
+		event.Status = types.PAID
+	case EVENT_PAYMENT_FAILED:
+		event.Status = types.REJECTED
+	default:
+		return nil, fmt.Errorf("unsupported webhook event %q", event.Type)
+	}
+
+	fp.Settle(event.Reference, event.Status)
+	return &event, nil
+}
+
+// Settle changes the status the fake reports for a charge.
+func (fp *FakeProvider) Settle(reference string, status types.PaymentStatus) {
+	fp.mu.Lock()
+	fp.charges[reference] = status
+	fp.mu.Unlock()
+}
+
+// Sign returns the signature header value for a webhook body.
+func (fp *FakeProvider) Sign(body []byte) string {
+	return hex.EncodeToString(fp.mac(body))
+}
+
+func (fp *FakeProvider) mac(body []byte) []byte {
+	mac := hmac.New(sha256.New, fp.secret)
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+func randomReference() (string, error) {
+	buf := make([]byte, 12)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return "fake_" + hex.EncodeToString(buf), nil
+}
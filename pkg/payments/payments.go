@@ -0,0 +1,108 @@
+package payments
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/silaselisha/coffee-api/types"
+)
+
+const (
+	METHOD_CARD         = "card"
+	METHOD_MOBILE_MONEY = "mobile_money"
+)
+
+const (
+	EVENT_PAYMENT_SUCCEEDED = "payment.succeeded"
+	EVENT_PAYMENT_FAILED    = "payment.failed"
+)
+
+var (
+	ErrUnknownProvider  = errors.New("unknown payment provider")
+	ErrInvalidSignature = errors.New("invalid webhook signature")
+	ErrUnknownCharge    = errors.New("unknown payment reference")
+)
+
+// Intent describes a payment the shop wants to collect. Id is our own
+// payment id and is handed to the provider as its idempotency key.
+type Intent struct {
+	Id          string
+	Amount      float64
+	Currency    string
+	Method      string
+	Email       string
+	Phone       string
+	Description string
+}
+
+// Charge is the provider's view of a payment. RedirectURL is set when the
+// customer has to finish a card payment on the provider's checkout page.
+type Charge struct {
+	Reference   string
+	Status      types.PaymentStatus
+	RedirectURL string
+}
+
+// RefundIntent asks for part or all of a charge back. Id is our own refund
+// id; providers use it as idempotency key so a retried request does not pay
+// out twice.
+type RefundIntent struct {
+	Id     string
+	Amount float64
+}
+
+type Refund struct {
+	Reference string
+	Amount    float64
+}
+
+// Event is a verified webhook notification about a charge.
+type Event struct {
+	Id        string
+	Type      string
+	Reference string
+	Status    types.PaymentStatus
+}
+
+// Provider is implemented by every payment vendor. Handlers only talk to
+// this interface, so adding a vendor means adding an implementation and
+// registering it, nothing more.
+type Provider interface {
+	Name() string
+	Initiate(ctx context.Context, intent Intent) (*Charge, error)
+	Confirm(ctx context.Context, reference string) (*Charge, error)
+	Refund(ctx context.Context, reference string, refund RefundIntent) (*Refund, error)
+	VerifyWebhook(ctx context.Context, header http.Header, body []byte) (*Event, error)
+}
+
+type Registry struct {
+	providers map[string]Provider
+	fallback  string
+}
+
+// NewRegistry registers providers under their names. fallback is used when
+// a request does not pick a provider itself.
+func NewRegistry(fallback string, providers ...Provider) *Registry {
+	registry := &Registry{
+		providers: make(map[string]Provider),
+		fallback:  fallback,
+	}
+	for _, provider := range providers {
+		registry.providers[provider.Name()] = provider
+	}
+	return registry
+}
+
+func (reg *Registry) Get(name string) (Provider, error) {
+	if name == "" {
+		name = reg.fallback
+	}
+
+	provider, ok := reg.providers[name]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownProvider, name)
+	}
+	return provider, nil
+}
@@ -0,0 +1,172 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/silaselisha/coffee-api/pkg/token"
+)
+
+// Rule allows Requests per client within any sliding Window. Name keeps
+// the counters of different rules apart.
+type Rule struct {
+	Name     string
+	Requests int64
+	Window   time.Duration
+}
+
+// ParseRule reads a limit written as "<requests>/<window>", e.g. "10/1m".
+func ParseRule(name, spec string) (Rule, error) {
+	requests, window, ok := strings.Cut(spec, "/")
+	if !ok {
+		return Rule{}, fmt.Errorf("invalid rate limit %q, expected <requests>/<window>", spec)
+	}
+
+	count, err := strconv.ParseInt(requests, 10, 64)
+	if err != nil || count < 1 {
+		return Rule{}, fmt.Errorf("invalid rate limit %q, requests must be a positive number", spec)
+	}
+	duration, err := time.ParseDuration(window)
+	if err != nil || duration <= 0 {
+		return Rule{}, fmt.Errorf("invalid rate limit %q, window must be a positive duration", spec)
+	}
+	return Rule{Name: name, Requests: count, Window: duration}, nil
+}
+
+// Result describes the client's standing after a request. Reset is how
+// long until the oldest request counted leaves the window and frees a slot.
+type Result struct {
+	Allowed   bool
+	Limit     int64
+	Remaining int64
+	Reset     time.Duration
+}
+
+// Store counts requests per rule and client key. Both stores keep a log of
+// request times, so the window slides instead of resetting at fixed
+// boundaries where a client could burst twice the limit.
+type Store interface {
+	Allow(ctx context.Context, rule Rule, key string) (Result, error)
+}
+
+// Redis shares the counters between every instance of the API.
+type Redis struct {
+	client redis.UniversalClient
+	prefix string
+}
+
+func NewRedis(client redis.UniversalClient, prefix string) *Redis {
+	return &Redis{client: client, prefix: prefix}
+}
+
+var slidingWindow = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local limit = tonumber(ARGV[3])
+
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", now - window)
+local count = redis.call("ZCARD", KEYS[1])
+local allowed = 0
+if count < limit then
+	redis.call("ZADD", KEYS[1], now, ARGV[4])
+	count = count + 1
+	allowed = 1
+end
+redis.call("PEXPIRE", KEYS[1], window)
+
+local oldest = redis.call("ZRANGE", KEYS[1], 0, 0, "WITHSCORES")
+return {allowed, count, tonumber(oldest[2]) + window - now}
+`)
+
+func (rd *Redis) Allow(ctx context.Context, rule Rule, key string) (Result, error) {
+	now := time.Now().UnixMilli()
+	// Requests in the same millisecond need members of their own.
+	member, _, err := token.NewOpaqueToken()
+	if err != nil {
+		return Result{}, err
+	}
+
+	keys := []string{rd.prefix + rule.Name + ":" + key}
+	values, err := slidingWindow.Run(ctx, rd.client, keys, now, rule.Window.Milliseconds(), rule.Requests, member).Int64Slice()
+	if err != nil {
+		return Result{}, err
+	}
+	return Result{
+		Allowed:   values[0] == 1,
+		Limit:     rule.Requests,
+		Remaining: rule.Requests - values[1],
+		Reset:     time.Duration(values[2]) * time.Millisecond,
+	}, nil
+}
+
+// Memory keeps the counters in the process. It suits a single instance and
+// the tests.
+type Memory struct {
+	mu      sync.Mutex
+	clients map[string]*memoryClient
+	calls   int
+}
+
+type memoryClient struct {
+	times  []time.Time
+	window time.Duration
+}
+
+func NewMemory() *Memory {
+	return &Memory{clients: make(map[string]*memoryClient)}
+}
+
+// sweepEvery bounds the memory held for clients that never return.
+const sweepEvery = 1000
+
+func (mm *Memory) Allow(ctx context.Context, rule Rule, key string) (Result, error) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+
+	now := time.Now()
+	mm.calls++
+	if mm.calls%sweepEvery == 0 {
+		mm.sweep(now)
+	}
+
+	key = rule.Name + ":" + key
+	client, ok := mm.clients[key]
+	if !ok {
+		client = &memoryClient{window: rule.Window}
+		mm.clients[key] = client
+	}
+	client.times = prune(client.times, now.Add(-rule.Window))
+
+	allowed := int64(len(client.times)) < rule.Requests
+	if allowed {
+		client.times = append(client.times, now)
+	}
+
+	return Result{
+		Allowed:   allowed,
+		Limit:     rule.Requests,
+		Remaining: rule.Requests - int64(len(client.times)),
+		Reset:     client.times[0].Add(rule.Window).Sub(now),
+	}, nil
+}
+
+func (mm *Memory) sweep(now time.Time) {
+	for key, client := range mm.clients {
+		if len(prune(client.times, now.Add(-client.window))) == 0 {
+			delete(mm.clients, key)
+		}
+	}
+}
+
+func prune(times []time.Time, since time.Time) []time.Time {
+	i := 0
+	for i < len(times) && !times[i].After(since) {
+		i++
+	}
+	return times[i:]
+}
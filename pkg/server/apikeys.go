@@ -0,0 +1,203 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/silaselisha/coffee-api/internal"
+	"github.com/silaselisha/coffee-api/pkg/apikey"
+	"github.com/silaselisha/coffee-api/pkg/store"
+	"github.com/silaselisha/coffee-api/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var errInvalidAPIKey = errors.New("invalid api key")
+
+func (s *Server) GetAllAPIKeysHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	collection := s.Store.Collection(ctx, "coffeeshop", "api_keys")
+
+	cur, err := collection.Find(ctx, bson.D{}, options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}))
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+	defer cur.Close(ctx)
+
+	keys := []store.APIKey{}
+	if err := cur.All(ctx, &keys); err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+
+	data := make([]types.APIKeyResParams, 0, len(keys))
+	for _, key := range keys {
+		data = append(data, apiKeyResponse(key))
+	}
+
+	result := struct {
+		Status  string                  `json:"status"`
+		Results int32                   `json:"results"`
+		Data    []types.APIKeyResParams `json:"data"`
+	}{
+		Status:  "success",
+		Results: int32(len(data)),
+		Data:    data,
+	}
+	return internal.ResponseHandler(w, result, http.StatusOK)
+}
+
+// CreateAPIKeyHandler returns the key itself only in this response; it is
+// not stored and cannot be shown again.
+func (s *Server) CreateAPIKeyHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	collection := s.Store.Collection(ctx, "coffeeshop", "api_keys")
+	userInfo := ctx.Value(types.AuthUserInfoKey{}).(*types.UserInfo)
+
+	payload, err := internal.ReadReqBody[types.APIKeyParams](r.Body, s.vd)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+	}
+
+	for _, permission := range payload.Permissions {
+		// Keys can neither mint further keys nor grant themselves or anybody
+		// else more through roles, so one leaked key stays one key.
+		if !types.ValidPermission(permission) || keyManagementPermission(permission) {
+			err := fmt.Errorf("%w: permission %q cannot be granted to an api key", errInvalidAPIKey, permission)
+			return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+		}
+
+		if !userInfo.Can(permission) {
+			err := fmt.Errorf("%w: cannot grant %q without holding it", errInvalidAPIKey, permission)
+			return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusForbidden)
+		}
+	}
+
+	if payload.ExpiresAt != nil && !payload.ExpiresAt.After(time.Now()) {
+		err := fmt.Errorf("%w: expiry must be in the future", errInvalidAPIKey)
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+	}
+
+	_, err = collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "key_hash", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+
+	plain, digest, prefix, err := apikey.Generate()
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+
+	key := store.APIKey{
+		Id:          primitive.NewObjectID(),
+		Name:        payload.Name,
+		Prefix:      prefix,
+		KeyHash:     digest,
+		Permissions: payload.Permissions,
+		ExpiresAt:   payload.ExpiresAt,
+		CreatedBy:   userInfo.Id,
+		CreatedAt:   time.Now(),
+	}
+
+	session, err := s.Store.TxnStartSession(ctx)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(ctx mongo.SessionContext) (interface{}, error) {
+		collection := s.Store.Collection(ctx, "coffeeshop", "api_keys")
+		if _, err := collection.InsertOne(ctx, key); err != nil {
+			return nil, err
+		}
+		return nil, s.writeAudit(ctx, r, types.AUDIT_APIKEY_CREATE, "apikey", key.Id.Hex(), nil, key)
+	}, &options.TransactionOptions{})
+
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+
+	result := struct {
+		Status string                `json:"status"`
+		Key    string                `json:"key"`
+		Data   types.APIKeyResParams `json:"data"`
+	}{
+		Status: "success",
+		Key:    plain,
+		Data:   apiKeyResponse(key),
+	}
+	return internal.ResponseHandler(w, result, http.StatusCreated)
+}
+
+// RevokeAPIKeyHandler keeps revoked keys so that their use stays traceable.
+func (s *Server) RevokeAPIKeyHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+	}
+
+	session, err := s.Store.TxnStartSession(ctx)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+	defer session.EndSession(ctx)
+
+	response, err := session.WithTransaction(ctx, func(ctx mongo.SessionContext) (interface{}, error) {
+		collection := s.Store.Collection(ctx, "coffeeshop", "api_keys")
+
+		filter := bson.D{{Key: "_id", Value: id}, {Key: "revoked_at", Value: bson.D{{Key: "$exists", Value: false}}}}
+		update := bson.D{{Key: "$set", Value: bson.D{{Key: "revoked_at", Value: time.Now()}}}}
+		oldDocs := options.Before
+		var previous store.APIKey
+		err := collection.FindOneAndUpdate(ctx, filter, update, &options.FindOneAndUpdateOptions{
+			ReturnDocument: &oldDocs,
+		}).Decode(&previous)
+		if err != nil {
+			return nil, err
+		}
+
+		var key store.APIKey
+		if err := collection.FindOne(ctx, bson.D{{Key: "_id", Value: id}}).Decode(&key); err != nil {
+			return nil, err
+		}
+		err = s.writeAudit(ctx, r, types.AUDIT_APIKEY_REVOKE, "apikey", id.Hex(), previous, key)
+		if err != nil {
+			return nil, err
+		}
+		return key, nil
+	}, &options.TransactionOptions{})
+
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return internal.ResponseHandler(w, internal.NewErrorResponse("failed", fmt.Errorf("document not found %w", err).Error()), http.StatusNotFound)
+		}
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+	s.UserCache.InvalidateAPIKey(ctx, response.(store.APIKey).KeyHash)
+	return internal.ResponseHandler(w, "", http.StatusNoContent)
+}
+
+func keyManagementPermission(permission string) bool {
+	granted := []string{permission}
+	return types.PermissionGranted(granted, types.PERM_APIKEYS_MANAGE) || types.PermissionGranted(granted, types.PERM_ROLES_MANAGE)
+}
+
+func apiKeyResponse(key store.APIKey) types.APIKeyResParams {
+	return types.APIKeyResParams{
+		Id:          key.Id.Hex(),
+		Name:        key.Name,
+		Prefix:      key.Prefix,
+		Permissions: key.Permissions,
+		ExpiresAt:   key.ExpiresAt,
+		LastUsedAt:  key.LastUsedAt,
+		RevokedAt:   key.RevokedAt,
+		CreatedBy:   key.CreatedBy.Hex(),
+		CreatedAt:   key.CreatedAt,
+	}
+}
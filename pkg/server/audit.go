@@ -0,0 +1,279 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/silaselisha/coffee-api/internal"
+	middleware "github.com/silaselisha/coffee-api/pkg/server/internal"
+	"github.com/silaselisha/coffee-api/pkg/store"
+	"github.com/silaselisha/coffee-api/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// redactedAuditFields hold secrets. The log notes that they changed but not
+// what to.
+var redactedAuditFields = map[string]bool{
+	"password":    true,
+	"phoneNumber": true,
+	"two_factor":  true,
+	"key_hash":    true,
+}
+
+// ignoredAuditFields change with every write or are already the target.
+var ignoredAuditFields = map[string]bool{
+	"_id":        true,
+	"updated_at": true,
+}
+
+const redactedAuditValue = "[redacted]"
+
+// writeAudit appends an entry for action on the target. before and after are
+// the target's documents around the change; either is nil when the action
+// created or removed the target. Called with a transaction's context, the
+// entry commits or aborts with the change itself.
+func (s *Server) writeAudit(ctx context.Context, r *http.Request, action, targetType, targetId string, before, after interface{}) error {
+	changes, err := auditChanges(before, after)
+	if err != nil {
+		return err
+	}
+
+	entry := store.AuditEntry{
+		Id:         primitive.NewObjectID(),
+		Action:     action,
+		TargetType: targetType,
+		TargetId:   targetId,
+		Changes:    changes,
+		RequestId:  middleware.RequestID(ctx),
+		IP:         clientIP(r),
+		CreatedAt:  time.Now(),
+	}
+
+	if userInfo, ok := ctx.Value(types.AuthUserInfoKey{}).(*types.UserInfo); ok {
+		entry.ActorId = userInfo.Id
+		entry.ActorType = "user"
+		entry.ActorEmail = userInfo.Email
+		entry.ActorRole = userInfo.Role
+		if userInfo.APIKey {
+			entry.ActorType = "api_key"
+		}
+	}
+
+	_, err = s.Store.Collection(ctx, "coffeeshop", "audit_log").InsertOne(ctx, entry)
+	return err
+}
+
+func auditChanges(before, after interface{}) ([]store.AuditChange, error) {
+	old, err := auditFields(before)
+	if err != nil {
+		return nil, err
+	}
+	updated, err := auditFields(after)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := []string{}
+	for field := range old {
+		fields = append(fields, field)
+	}
+	for field := range updated {
+		if _, ok := old[field]; !ok {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+
+	changes := []store.AuditChange{}
+	for _, field := range fields {
+		if ignoredAuditFields[field] || reflect.DeepEqual(old[field], updated[field]) {
+			continue
+		}
+
+		change := store.AuditChange{Field: field, Before: old[field], After: updated[field]}
+		if redactedAuditFields[field] {
+			change.Before, change.After = redactAuditValue(change.Before), redactAuditValue(change.After)
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+// auditFields reads a document the way it is stored, so that fields are
+// compared and named by their bson names.
+func auditFields(document interface{}) (bson.M, error) {
+	fields := bson.M{}
+	if document == nil {
+		return fields, nil
+	}
+
+	data, err := bson.Marshal(document)
+	if err != nil {
+		return nil, err
+	}
+	if err := bson.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+func redactAuditValue(value interface{}) interface{} {
+	if value == nil {
+		return nil
+	}
+	return redactedAuditValue
+}
+
+// GetAuditLogHandler lists audit entries newest first. Entries can be
+// filtered on ?actor_id=, ?actor_type=, ?action= (comma separated),
+// ?target_type=, ?target_id=, ?request_id= and ?from=&to=, and are paged
+// with ?limit= and ?cursor=.
+func (s *Server) GetAuditLogHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	collection := s.Store.Collection(ctx, "coffeeshop", "audit_log")
+
+	queries := r.URL.Query()
+	limit, err := internal.ParseLimit(queries)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+	}
+
+	filter := bson.D{}
+	if actor := queries.Get("actor_id"); actor != "" {
+		actorId, err := primitive.ObjectIDFromHex(actor)
+		if err != nil {
+			return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+		}
+		filter = append(filter, bson.E{Key: "actor_id", Value: actorId})
+	}
+
+	for _, field := range []string{"actor_type", "target_type", "target_id", "request_id"} {
+		if value := queries.Get(field); value != "" {
+			filter = append(filter, bson.E{Key: field, Value: value})
+		}
+	}
+
+	if actions := internal.SplitQueryList(queries.Get("action")); len(actions) > 0 {
+		filter = append(filter, bson.E{Key: "action", Value: bson.D{{Key: "$in", Value: actions}}})
+	}
+
+	createdAt, ok, err := internal.ParseDateRange(queries, "created_at")
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+	}
+	if ok {
+		filter = append(filter, createdAt)
+	}
+
+	if cursor := queries.Get("cursor"); cursor != "" {
+		lastId, err := internal.DecodeCursor(cursor)
+		if err != nil {
+			return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+		}
+		filter = append(filter, bson.E{Key: "_id", Value: bson.D{{Key: "$lt", Value: lastId}}})
+	}
+
+	_, err = collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "target_type", Value: 1}, {Key: "target_id", Value: 1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "actor_id", Value: 1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "request_id", Value: 1}}},
+	})
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: -1}}).SetLimit(limit + 1)
+	cur, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+	defer cur.Close(ctx)
+
+	entries := []store.AuditEntry{}
+	if err := cur.All(ctx, &entries); err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+
+	var nextCursor string
+	if int64(len(entries)) > limit {
+		entries = entries[:limit]
+		nextCursor = internal.EncodeCursor(entries[len(entries)-1].Id)
+	}
+
+	data := make([]types.AuditEntryResParams, 0, len(entries))
+	for _, entry := range entries {
+		data = append(data, auditEntryResponse(entry))
+	}
+
+	result := struct {
+		Status     string                      `json:"status"`
+		Results    int32                       `json:"results"`
+		NextCursor string                      `json:"next_cursor,omitempty"`
+		Data       []types.AuditEntryResParams `json:"data"`
+	}{
+		Status:     "success",
+		Results:    int32(len(data)),
+		NextCursor: nextCursor,
+		Data:       data,
+	}
+	return internal.ResponseHandler(w, result, http.StatusOK)
+}
+
+func auditEntryResponse(entry store.AuditEntry) types.AuditEntryResParams {
+	changes := make([]types.AuditChangeResParams, 0, len(entry.Changes))
+	for _, change := range entry.Changes {
+		changes = append(changes, types.AuditChangeResParams{
+			Field:  change.Field,
+			Before: auditJSONValue(change.Before),
+			After:  auditJSONValue(change.After),
+		})
+	}
+
+	return types.AuditEntryResParams{
+		Id:         entry.Id.Hex(),
+		ActorId:    entry.ActorId.Hex(),
+		ActorType:  entry.ActorType,
+		ActorEmail: entry.ActorEmail,
+		ActorRole:  entry.ActorRole,
+		Action:     entry.Action,
+		TargetType: entry.TargetType,
+		TargetId:   entry.TargetId,
+		Changes:    changes,
+		RequestId:  entry.RequestId,
+		IP:         entry.IP,
+		CreatedAt:  entry.CreatedAt,
+	}
+}
+
+// auditJSONValue turns the embedded documents the driver decodes into
+// primitive.D back into objects, which would otherwise encode as lists of
+// key and value pairs.
+func auditJSONValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case primitive.D:
+		object := make(map[string]interface{}, len(value))
+		for _, field := range value {
+			object[field.Key] = auditJSONValue(field.Value)
+		}
+		return object
+	case primitive.M:
+		object := make(map[string]interface{}, len(value))
+		for key, field := range value {
+			object[key] = auditJSONValue(field)
+		}
+		return object
+	case primitive.A:
+		list := make([]interface{}, 0, len(value))
+		for _, item := range value {
+			list = append(list, auditJSONValue(item))
+		}
+		return list
+	default:
+		return value
+	}
+}
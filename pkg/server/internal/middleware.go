@@ -5,105 +5,257 @@ import (
 	"errors"
 	"net/http"
 	"strings"
+	"time"
 
-	"github.com/silaselisha/coffee-api/pkg/store"
+	"github.com/silaselisha/coffee-api/pkg/apikey"
+	"github.com/silaselisha/coffee-api/pkg/cache"
 	"github.com/silaselisha/coffee-api/pkg/token"
 	"github.com/silaselisha/coffee-api/types"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
-func AuthMiddleware(tkn token.Token) func(next http.Handler) http.Handler {
+// AuthMiddleware accepts a bearer JWT, or an API key in X-API-Key or in an
+// "Authorization: ApiKey ..." header. Callers with an API key are resolved
+// to their UserInfo right away, the permission middlewares then treat them
+// like any user.
+func AuthMiddleware(tkn token.Token, keys *apikey.Verifier) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			authorizationHeader := r.Header.Get("authorization")
-			if len(authorizationHeader) == 0 {
-				http.Error(w, "invalid token header", http.StatusForbidden)
+			authenticated, code, err := authenticate(r, tkn, keys)
+			if err != nil {
+				http.Error(w, err.Error(), code)
 				return
 			}
+			next.ServeHTTP(w, authenticated)
+		})
+	}
+}
 
-			fields := strings.Split(authorizationHeader, " ")
-			if len(fields) < 2 {
-				http.Error(w, "invalid token header", http.StatusForbidden)
-				return
+// OptionalAuthMiddleware identifies callers the way AuthMiddleware does on
+// public routes, where it only matters for things like rate limiting.
+// Requests without valid credentials go through anonymously.
+func OptionalAuthMiddleware(tkn token.Token, keys *apikey.Verifier) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if authenticated, _, err := authenticate(r, tkn, keys); err == nil {
+				r = authenticated
 			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
 
-			if strings.ToLower(fields[0]) != "bearer" {
-				http.Error(w, "invalid token header", http.StatusForbidden)
-				return
+// authenticate returns r carrying the caller's identity, or the status to
+// answer with when the credentials are missing or invalid.
+func authenticate(r *http.Request, tkn token.Token, keys *apikey.Verifier) (*http.Request, int, error) {
+	if key, ok := apiKeyFromRequest(r); ok {
+		apiKey, err := keys.Verify(r.Context(), key)
+		if err != nil {
+			if errors.Is(err, apikey.ErrInvalidKey) {
+				return nil, http.StatusForbidden, err
 			}
+			return nil, http.StatusInternalServerError, err
+		}
+
+		userInfo := &types.UserInfo{
+			Permissions: apiKey.Permissions,
+			Verified:    true,
+			APIKey:      true,
+			Id:          apiKey.Id,
+		}
+		ctx := context.WithValue(r.Context(), types.AuthUserInfoKey{}, userInfo)
+		return r.WithContext(ctx), http.StatusOK, nil
+	}
+
+	authorizationHeader := r.Header.Get("authorization")
+	if len(authorizationHeader) == 0 {
+		return nil, http.StatusForbidden, errInvalidTokenHeader
+	}
+
+	fields := strings.Split(authorizationHeader, " ")
+	if len(fields) < 2 {
+		return nil, http.StatusForbidden, errInvalidTokenHeader
+	}
+
+	if strings.ToLower(fields[0]) != "bearer" {
+		return nil, http.StatusForbidden, errInvalidTokenHeader
+	}
+
+	payload, err := tkn.VerifyToken(context.Background(), fields[1])
+	if err != nil {
+		return nil, http.StatusForbidden, errInvalidToken
+	}
 
-			payload, err := tkn.VerifyToken(context.Background(), fields[1])
+	ctx := context.WithValue(r.Context(), types.AuthPayloadKey{}, payload)
+	return r.WithContext(ctx), http.StatusOK, nil
+}
+
+func apiKeyFromRequest(r *http.Request) (string, bool) {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key, true
+	}
+
+	scheme, key, ok := strings.Cut(r.Header.Get("authorization"), " ")
+	if ok && strings.EqualFold(scheme, "apikey") {
+		return strings.TrimSpace(key), true
+	}
+	return "", false
+}
+
+var (
+	errInvalidTokenHeader = errors.New("invalid token header")
+	errInvalidToken       = errors.New("invalid token")
+	errForbidden          = errors.New("user forbidden to perform an operation on this resource")
+	errSessionExpired     = errors.New("session expired, kindly log in again")
+	errTwoFactor          = errors.New("your role requires two-factor authentication, kindly enroll before continuing")
+)
+
+// RestrictToMiddleware lets through users holding one of the named roles.
+func RestrictToMiddleware(users *cache.UserCache, args ...string) func(next http.Handler) http.Handler {
+	authorized := map[string]bool{}
+	for _, role := range args {
+		authorized[role] = true
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			userInfo, status, err := loadUserInfo(r, users, true)
 			if err != nil {
-				http.Error(w, "invalid token", http.StatusForbidden)
+				http.Error(w, err.Error(), status)
+				return
+			}
+
+			if !authorized[userInfo.Role] {
+				http.Error(w, errForbidden.Error(), http.StatusForbidden)
 				return
 			}
 
-			ctx := context.WithValue(r.Context(), types.AuthPayloadKey{}, payload)
+			ctx := context.WithValue(r.Context(), types.AuthUserInfoKey{}, userInfo)
 			r = r.WithContext(ctx)
 			next.ServeHTTP(w, r)
 		})
 	}
 }
 
-func RestrictToMiddleware(str store.Mongo, args ...string) func(next http.Handler) http.Handler {
+// RequirePermissionMiddleware lets through users whose role grants every
+// one of the permissions, whatever the role is called.
+func RequirePermissionMiddleware(users *cache.UserCache, permissions ...string) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			var isAuthorized bool
-			var authorized map[string]string = map[string]string{}
-			roles := map[string]string{
-				"admin": "admin",
-				"user":  "user",
+			userInfo, status, err := loadUserInfo(r, users, true)
+			if err != nil {
+				http.Error(w, err.Error(), status)
+				return
 			}
 
-			for _, role := range args {
-				_, ok := roles[role]
-				if ok {
-					isAuthorized = true
-					authorized[role] = role
+			for _, permission := range permissions {
+				if !userInfo.Can(permission) {
+					http.Error(w, errForbidden.Error(), http.StatusForbidden)
+					return
 				}
 			}
 
-			if !isAuthorized {
-				err := errors.New("user forbidden to perform an operation on this resource 1")
-				http.Error(w, err.Error(), http.StatusForbidden)
-				return
-			}
+			ctx := context.WithValue(r.Context(), types.AuthUserInfoKey{}, userInfo)
+			r = r.WithContext(ctx)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
 
-			payload := r.Context().Value(types.AuthPayloadKey{}).(*token.Payload)
-			var user store.User
-			collection := str.Collection(r.Context(), "coffeeshop", "users")
-			id, err := primitive.ObjectIDFromHex(payload.Id)
+// TwoFactorEnrollmentMiddleware lets through any signed in user, including
+// those whose role requires two-factor authentication they have not set up
+// yet, so that they can enroll.
+func TwoFactorEnrollmentMiddleware(users *cache.UserCache) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			userInfo, status, err := loadUserInfo(r, users, false)
 			if err != nil {
-				err := errors.New("user forbidden to perform an operation on this resource")
-				http.Error(w, err.Error(), http.StatusForbidden)
+				http.Error(w, err.Error(), status)
 				return
 			}
-			curr := collection.FindOne(r.Context(), bson.D{{Key: "_id", Value: id}})
 
-			err = curr.Decode(&user)
-			if err != nil {
-				err := errors.New("user forbidden to perform an operation on this resource")
-				http.Error(w, err.Error(), http.StatusForbidden)
+			if userInfo.APIKey {
+				http.Error(w, errForbidden.Error(), http.StatusForbidden)
 				return
 			}
 
-			role, ok := authorized[user.Role]
+			ctx := context.WithValue(r.Context(), types.AuthUserInfoKey{}, userInfo)
+			r = r.WithContext(ctx)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// loadUserInfo resolves the token AuthMiddleware verified to the current
+// user and the permissions of their role. With enforceTwoFactor set, users
+// whose role requires two-factor authentication are turned away until they
+// have enrolled.
+func loadUserInfo(r *http.Request, users *cache.UserCache, enforceTwoFactor bool) (*types.UserInfo, int, error) {
+	// API keys were resolved by AuthMiddleware.
+	if userInfo, ok := r.Context().Value(types.AuthUserInfoKey{}).(*types.UserInfo); ok && userInfo.APIKey {
+		return userInfo, http.StatusOK, nil
+	}
+
+	payload, ok := token.PayloadFromContext(r.Context())
+	if !ok {
+		return nil, http.StatusForbidden, errForbidden
+	}
+
+	id, err := primitive.ObjectIDFromHex(payload.Id())
+	if err != nil {
+		return nil, http.StatusForbidden, errForbidden
+	}
+
+	user, err := users.User(r.Context(), id)
+	if err != nil {
+		return nil, http.StatusForbidden, errForbidden
+	}
+
+	// Tokens signed before the password was last changed or before the
+	// user's sessions were revoked are no longer honoured. iat only has
+	// second precision.
+	if payload.IssuedAtTime().Before(user.PasswordChangedAt.Truncate(time.Second)) || payload.Version != user.TokenVersion {
+		return nil, http.StatusUnauthorized, errSessionExpired
+	}
+
+	role, err := users.Role(r.Context(), user.Role)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	if enforceTwoFactor && role.RequireTwoFactor && !user.TwoFactor {
+		return nil, http.StatusForbidden, errTwoFactor
+	}
+
+	return &types.UserInfo{
+		Role:        user.Role,
+		Permissions: role.Permissions,
+		Email:       user.Email,
+		Avatar:      user.Avatar,
+		Verified:    user.Verified,
+		TwoFactor:   user.TwoFactor,
+		Id:          id,
+	}, http.StatusOK, nil
+}
+
+// RequireVerifiedMiddleware must run after RestrictToMiddleware or
+// RequirePermissionMiddleware. It turns away accounts that have not
+// confirmed their email address; admin accounts are provisioned by staff and
+// are exempt.
+func RequireVerifiedMiddleware() func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			userInfo, ok := r.Context().Value(types.AuthUserInfoKey{}).(*types.UserInfo)
 			if !ok {
-				err := errors.New("user forbidden to perform an operation on this resource")
-				http.Error(w, err.Error(), http.StatusForbidden)
+				http.Error(w, errForbidden.Error(), http.StatusForbidden)
 				return
 			}
 
-			var userInfo *types.UserInfo = &types.UserInfo{
-				Role:   role,
-				Email:  user.Email,
-				Avatar: user.Avatar,
-				Id:     id,
+			if !userInfo.Verified && userInfo.Role != types.ROLE_ADMIN {
+				err := errors.New("kindly verify your email address before performing this operation")
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
 			}
-
-			ctx := context.WithValue(r.Context(), types.AuthUserInfoKey{}, userInfo)
-			r = r.WithContext(ctx)
 			next.ServeHTTP(w, r)
 		})
 	}
@@ -0,0 +1,80 @@
+package internal
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/silaselisha/coffee-api/pkg/ratelimit"
+	"github.com/silaselisha/coffee-api/pkg/token"
+	"github.com/silaselisha/coffee-api/types"
+)
+
+// KeyFunc names the client a request is counted against.
+type KeyFunc func(r *http.Request) string
+
+// KeyByIP counts requests per remote address.
+func KeyByIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return "ip:" + r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// KeyByUser counts authenticated requests per user and the rest per
+// address. It needs AuthMiddleware to have run first.
+func KeyByUser(r *http.Request) string {
+	if payload, ok := token.PayloadFromContext(r.Context()); ok {
+		return "user:" + payload.Id()
+	}
+	return KeyByIP(r)
+}
+
+// KeyByAPIKey counts requests per API key, then per user, then per
+// address. Only keys AuthMiddleware verified count, so that clients cannot
+// get a fresh allowance by sending made up keys.
+func KeyByAPIKey(r *http.Request) string {
+	if userInfo, ok := r.Context().Value(types.AuthUserInfoKey{}).(*types.UserInfo); ok && userInfo.APIKey {
+		return "apikey:" + userInfo.Id.Hex()
+	}
+	return KeyByUser(r)
+}
+
+// RateLimitMiddleware answers 429 once a client exceeds rule. Every
+// response carries the RateLimit-* headers so that well behaved clients can
+// slow down before that. A failing store lets requests through rather than
+// taking the routes down with it.
+func RateLimitMiddleware(limiter ratelimit.Store, rule ratelimit.Rule, key KeyFunc) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			result, err := limiter.Allow(r.Context(), rule, key(r))
+			if err != nil {
+				log.Printf("rate limit %s failed %v\n", rule.Name, err)
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			reset := strconv.Itoa(seconds(result.Reset))
+			w.Header().Set("RateLimit-Limit", strconv.FormatInt(result.Limit, 10))
+			w.Header().Set("RateLimit-Remaining", strconv.FormatInt(result.Remaining, 10))
+			w.Header().Set("RateLimit-Reset", reset)
+			w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", rule.Requests, seconds(rule.Window)))
+
+			if !result.Allowed {
+				w.Header().Set("Retry-After", reset)
+				http.Error(w, "too many requests, try again later", http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
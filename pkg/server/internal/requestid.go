@@ -0,0 +1,42 @@
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+
+	"github.com/silaselisha/coffee-api/types"
+)
+
+// requestIDFormat bounds the ids accepted from clients and proxies, which end
+// up in logs and in the audit log.
+var requestIDFormat = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// RequestIDMiddleware tags every request with an id, keeping the
+// X-Request-Id sent by a proxy in front of the API when there is one, and
+// echoes it back so that a client can quote it.
+func RequestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-Id")
+		if !requestIDFormat.MatchString(id) {
+			buff := make([]byte, 16)
+			if _, err := rand.Read(buff); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			id = hex.EncodeToString(buff)
+		}
+
+		w.Header().Set("X-Request-Id", id)
+		ctx := context.WithValue(r.Context(), types.RequestIDKey{}, id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// RequestID is the id RequestIDMiddleware gave the request, if it ran.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(types.RequestIDKey{}).(string)
+	return id
+}
@@ -0,0 +1,372 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gorilla/mux"
+	"github.com/silaselisha/coffee-api/internal"
+	"github.com/silaselisha/coffee-api/pkg/store"
+	"github.com/silaselisha/coffee-api/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// insufficientStockError is returned by reserveStock when one or more
+// products or ingredients cannot cover an order.
+type insufficientStockError struct {
+	Items []types.StockShortageParams
+}
+
+func (e *insufficientStockError) Error() string {
+	return fmt.Sprintf("insufficient stock for %d item(s)", len(e.Items))
+}
+
+func (s *Server) GetAllIngredientsHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	collection := s.Store.Collection(ctx, "coffeeshop", "ingredients")
+
+	cur, err := collection.Find(ctx, bson.D{}, options.Find().SetSort(bson.D{{Key: "name", Value: 1}}))
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+	defer cur.Close(ctx)
+
+	ingredients := []store.Ingredient{}
+	if err := cur.All(ctx, &ingredients); err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+
+	result := struct {
+		Status  string             `json:"status"`
+		Results int32              `json:"results"`
+		Data    []store.Ingredient `json:"data"`
+	}{
+		Status:  "success",
+		Results: int32(len(ingredients)),
+		Data:    ingredients,
+	}
+	return internal.ResponseHandler(w, result, http.StatusOK)
+}
+
+func (s *Server) CreateIngredientHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	collection := s.Store.Collection(ctx, "coffeeshop", "ingredients")
+
+	payload, err := internal.ReadReqBody[types.IngredientParams](r.Body, s.vd)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+	}
+
+	_, err = collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "name", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+
+	ingredient := store.Ingredient{
+		Id:        primitive.NewObjectID(),
+		Name:      payload.Name,
+		Unit:      payload.Unit,
+		Stock:     payload.Stock,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+
+	session, err := s.Store.TxnStartSession(ctx)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(ctx mongo.SessionContext) (interface{}, error) {
+		collection := s.Store.Collection(ctx, "coffeeshop", "ingredients")
+		if _, err := collection.InsertOne(ctx, ingredient); err != nil {
+			return nil, err
+		}
+		return nil, s.writeAudit(ctx, r, types.AUDIT_INGREDIENT_CREATE, "ingredient", ingredient.Id.Hex(), nil, ingredient)
+	}, &options.TransactionOptions{})
+
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return internal.ResponseHandler(w, internal.NewErrorResponse("failed", fmt.Errorf("document already exists %w", err).Error()), http.StatusBadRequest)
+		}
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+
+	result := struct {
+		Status string           `json:"status"`
+		Data   store.Ingredient `json:"data"`
+	}{
+		Status: "success",
+		Data:   ingredient,
+	}
+	return internal.ResponseHandler(w, result, http.StatusCreated)
+}
+
+// UpdateIngredientStockHandler either sets an ingredient's stock outright
+// ({"stock": 12}) or adjusts it relative to the current level ({"delta": -2})
+// so deliveries can be booked without racing concurrent orders.
+func (s *Server) UpdateIngredientStockHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+	}
+
+	payload, err := internal.ReadReqBody[types.IngredientStockParams](r.Body, s.vd)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+	}
+
+	set := bson.D{{Key: "updated_at", Value: time.Now()}}
+	if payload.Stock != nil {
+		set = append(set, bson.E{Key: "stock", Value: *payload.Stock})
+	}
+	if payload.Unit != "" {
+		set = append(set, bson.E{Key: "unit", Value: payload.Unit})
+	}
+
+	filter := bson.D{{Key: "_id", Value: id}}
+	update := bson.D{{Key: "$set", Value: set}}
+	if payload.Stock == nil && payload.Delta != 0 {
+		update = append(update, bson.E{Key: "$inc", Value: bson.D{{Key: "stock", Value: payload.Delta}}})
+		if payload.Delta < 0 {
+			filter = append(filter, bson.E{Key: "stock", Value: bson.D{{Key: "$gte", Value: -payload.Delta}}})
+		}
+	}
+
+	session, err := s.Store.TxnStartSession(ctx)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+	defer session.EndSession(ctx)
+
+	response, err := session.WithTransaction(ctx, func(ctx mongo.SessionContext) (interface{}, error) {
+		collection := s.Store.Collection(ctx, "coffeeshop", "ingredients")
+
+		oldDocs := options.Before
+		var previous store.Ingredient
+		err := collection.FindOneAndUpdate(ctx, filter, update, &options.FindOneAndUpdateOptions{
+			ReturnDocument: &oldDocs,
+		}).Decode(&previous)
+		if err != nil {
+			return nil, err
+		}
+
+		var ingredient store.Ingredient
+		if err := collection.FindOne(ctx, bson.D{{Key: "_id", Value: id}}).Decode(&ingredient); err != nil {
+			return nil, err
+		}
+
+		err = s.writeAudit(ctx, r, types.AUDIT_INGREDIENT_UPDATE, "ingredient", id.Hex(), previous, ingredient)
+		if err != nil {
+			return nil, err
+		}
+		return ingredient, nil
+	}, &options.TransactionOptions{})
+
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			err = fmt.Errorf("document not found or stock would drop below zero %w", err)
+			return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusNotFound)
+		}
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+
+	result := struct {
+		Status string           `json:"status"`
+		Data   store.Ingredient `json:"data"`
+	}{
+		Status: "success",
+		Data:   response.(store.Ingredient),
+	}
+	return internal.ResponseHandler(w, result, http.StatusOK)
+}
+
+// reserveStock decrements product and ingredient stock for an order and
+// records on every item what it took. It must run inside a transaction: on
+// shortage it keeps going so the caller gets the full list, and relies on the
+// transaction being aborted to undo the decrements that did succeed.
+func (s *Server) reserveStock(ctx context.Context, items []store.OrderItem, products map[primitive.ObjectID]store.Item) error {
+	prodColl := s.Store.Collection(ctx, "coffeeshop", "products")
+	ingColl := s.Store.Collection(ctx, "coffeeshop", "ingredients")
+
+	for i := range items {
+		product := products[items[i].Product]
+		recipe := product.Recipe
+		if recipe == nil {
+			recipe = []store.RecipeItem{}
+		}
+		items[i].Reserved = &store.StockReservation{Product: product.TrackStock, Recipe: recipe}
+	}
+
+	quantities, ingredients := stockRequirements(items, products)
+
+	var shortages []types.StockShortageParams
+	for productId, quantity := range quantities {
+		product := products[productId]
+		if !product.TrackStock {
+			continue
+		}
+
+		filter := bson.D{
+			{Key: "_id", Value: productId},
+			{Key: "stock", Value: bson.D{{Key: "$gte", Value: quantity}}},
+		}
+		update := bson.D{{Key: "$inc", Value: bson.D{{Key: "stock", Value: -quantity}}}}
+		res, err := prodColl.UpdateOne(ctx, filter, update)
+		if err != nil {
+			return err
+		}
+
+		if res.MatchedCount == 0 {
+			var current store.Item
+			if err := prodColl.FindOne(ctx, bson.D{{Key: "_id", Value: productId}}).Decode(&current); err != nil {
+				return err
+			}
+			shortages = append(shortages, types.StockShortageParams{
+				Product:   productId.Hex(),
+				Name:      product.Name,
+				Requested: float64(quantity),
+				Available: float64(current.Stock),
+			})
+		}
+	}
+
+	for ingredientId, quantity := range ingredients {
+		filter := bson.D{
+			{Key: "_id", Value: ingredientId},
+			{Key: "stock", Value: bson.D{{Key: "$gte", Value: quantity}}},
+		}
+		update := bson.D{{Key: "$inc", Value: bson.D{{Key: "stock", Value: -quantity}}}}
+		res, err := ingColl.UpdateOne(ctx, filter, update)
+		if err != nil {
+			return err
+		}
+
+		if res.MatchedCount == 0 {
+			var current store.Ingredient
+			err := ingColl.FindOne(ctx, bson.D{{Key: "_id", Value: ingredientId}}).Decode(&current)
+			if err != nil && err != mongo.ErrNoDocuments {
+				return err
+			}
+			shortages = append(shortages, types.StockShortageParams{
+				Ingredient: ingredientId.Hex(),
+				Name:       current.Name,
+				Requested:  quantity,
+				Available:  current.Stock,
+			})
+		}
+	}
+
+	if len(shortages) > 0 {
+		return &insufficientStockError{Items: shortages}
+	}
+	return nil
+}
+
+// restockOrderItems gives the stock taken by reserveStock back, as recorded
+// on the items. Items of orders placed before reservations were recorded
+// fall back to the products as they are now, skipping those that stopped
+// tracking stock.
+func (s *Server) restockOrderItems(ctx context.Context, items []store.OrderItem) error {
+	prodColl := s.Store.Collection(ctx, "coffeeshop", "products")
+	ingColl := s.Store.Collection(ctx, "coffeeshop", "ingredients")
+
+	quantities := make(map[primitive.ObjectID]int64)
+	ingredients := make(map[primitive.ObjectID]float64)
+
+	var unrecorded []store.OrderItem
+	var ids []primitive.ObjectID
+	for _, item := range items {
+		if item.Reserved == nil {
+			unrecorded = append(unrecorded, item)
+			ids = append(ids, item.Product)
+			continue
+		}
+
+		if item.Reserved.Product {
+			quantities[item.Product] += int64(item.Quantity)
+		}
+		for _, recipe := range item.Reserved.Recipe {
+			ingredients[recipe.Ingredient] += recipe.Quantity * float64(item.Quantity)
+		}
+	}
+
+	if len(unrecorded) > 0 {
+		products, err := s.BatchGetAllProductsByIds(ctx, ids)
+		if err != nil {
+			return err
+		}
+
+		current, recipes := stockRequirements(unrecorded, products)
+		for productId, quantity := range current {
+			if products[productId].TrackStock {
+				quantities[productId] += quantity
+			}
+		}
+		for ingredientId, quantity := range recipes {
+			ingredients[ingredientId] += quantity
+		}
+	}
+
+	for productId, quantity := range quantities {
+		update := bson.D{{Key: "$inc", Value: bson.D{{Key: "stock", Value: quantity}}}}
+		if _, err := prodColl.UpdateOne(ctx, bson.D{{Key: "_id", Value: productId}}, update); err != nil {
+			return err
+		}
+	}
+
+	for ingredientId, quantity := range ingredients {
+		update := bson.D{{Key: "$inc", Value: bson.D{{Key: "stock", Value: quantity}}}}
+		if _, err := ingColl.UpdateOne(ctx, bson.D{{Key: "_id", Value: ingredientId}}, update); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stockRequirements totals the product units and ingredient amounts needed
+// by a list of order items, merging repeated lines for the same product.
+func stockRequirements(items []store.OrderItem, products map[primitive.ObjectID]store.Item) (map[primitive.ObjectID]int64, map[primitive.ObjectID]float64) {
+	quantities := make(map[primitive.ObjectID]int64)
+	ingredients := make(map[primitive.ObjectID]float64)
+
+	for _, item := range items {
+		quantities[item.Product] += int64(item.Quantity)
+		for _, recipe := range products[item.Product].Recipe {
+			ingredients[recipe.Ingredient] += recipe.Quantity * float64(item.Quantity)
+		}
+	}
+	return quantities, ingredients
+}
+
+// parseRecipe decodes the JSON "recipe" form field of the product endpoints,
+// e.g. [{"ingredient": "<id>", "quantity": 0.2}].
+func parseRecipe(data []byte, vd *validator.Validate) ([]store.RecipeItem, error) {
+	var params []types.RecipeItemParams
+	if err := json.Unmarshal(data, &params); err != nil {
+		return nil, err
+	}
+
+	recipe := []store.RecipeItem{}
+	for _, param := range params {
+		if err := vd.Struct(param); err != nil {
+			return nil, err
+		}
+
+		id, err := primitive.ObjectIDFromHex(param.Ingredient)
+		if err != nil {
+			return nil, errors.New("invalid recipe ingredient id")
+		}
+		recipe = append(recipe, store.RecipeItem{Ingredient: id, Quantity: param.Quantity})
+	}
+	return recipe, nil
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/hibiken/asynq"
+	"github.com/silaselisha/coffee-api/internal"
+	"github.com/silaselisha/coffee-api/internal/invoice"
+	"github.com/silaselisha/coffee-api/pkg/store"
+	"github.com/silaselisha/coffee-api/types"
+	"github.com/silaselisha/coffee-api/workers"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// GetOrderInvoiceHandler downloads the rendered invoice of an order, or
+// returns the invoice record itself with ?format=json.
+func (s *Server) GetOrderInvoiceHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ordColl := s.Store.Collection(ctx, "coffeeshop", "orders")
+	invColl := s.Store.Collection(ctx, "coffeeshop", "invoices")
+	userInfo := ctx.Value(types.AuthUserInfoKey{}).(*types.UserInfo)
+
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+	}
+
+	var order store.Order
+	err = ordColl.FindOne(ctx, bson.D{{Key: "_id", Value: id}}).Decode(&order)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return internal.ResponseHandler(w, internal.NewErrorResponse("failed", fmt.Errorf("document not found %w", err).Error()), http.StatusNotFound)
+		}
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+
+	if order.Owner != userInfo.Id && !userInfo.Can(types.PERM_ORDERS_READ) {
+		err := errors.New("user only allowed to retrieve invoices of their own orders")
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusForbidden)
+	}
+
+	var inv store.Invoice
+	err = invColl.FindOne(ctx, bson.D{{Key: "order", Value: order.Id}}).Decode(&inv)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			err := errors.New("no invoice has been issued for this order yet")
+			return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusNotFound)
+		}
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+
+	if r.URL.Query().Get("format") == "json" {
+		result := struct {
+			Status string        `json:"status"`
+			Data   store.Invoice `json:"data"`
+		}{
+			Status: "success",
+			Data:   inv,
+		}
+		return internal.ResponseHandler(w, result, http.StatusOK)
+	}
+
+	if inv.ObjectKey == "" {
+		err := fmt.Errorf("invoice %s is still being generated", inv.Number)
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusNotFound)
+	}
+
+	document, err := s.coffeeShopS3Bucket.DownloadObject(ctx, inv.ObjectKey, s.envs.S3_BUCKET_NAME)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+
+	w.Header().Set("Content-Type", invoice.ContentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", inv.Number+".html"))
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(document)
+	return err
+}
+
+// queueInvoice asks the workers to issue the invoice of a paid order. The
+// order itself is already settled, so a queueing failure is only logged;
+// the task is idempotent and can be queued again later.
+func (s *Server) queueInvoice(ctx context.Context, order store.Order) {
+	opts := []asynq.Option{
+		asynq.MaxRetry(10),
+		asynq.Queue(workers.DefaultQueue),
+		asynq.TaskID(fmt.Sprintf("invoice:%s", order.Id.Hex())),
+		asynq.Retention(24 * time.Hour),
+	}
+
+	payload := &types.PayloadGenerateInvoice{Order: order.Id.Hex()}
+	if err := s.taskDistributor.InvoiceGenerationTask(ctx, payload, opts...); err != nil {
+		log.Printf("failed to enqueue invoice for order %s %v\n", order.Id.Hex(), err)
+	}
+}
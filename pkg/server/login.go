@@ -0,0 +1,126 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/hibiken/asynq"
+	"github.com/silaselisha/coffee-api/internal"
+	"github.com/silaselisha/coffee-api/pkg/lockout"
+	"github.com/silaselisha/coffee-api/pkg/store"
+	"github.com/silaselisha/coffee-api/types"
+)
+
+// loginPolicy starts slowing an account down after its third failed login
+// in a row and locks it with the fifth, capping an online guessing attack at
+// a handful of passwords per quarter hour.
+var loginPolicy = lockout.Policy{
+	Window:     15 * time.Minute,
+	DelayAfter: 3,
+	BaseDelay:  time.Second,
+	MaxDelay:   time.Minute,
+	LockAfter:  5,
+	LockFor:    15 * time.Minute,
+	MaxPerIP:   100,
+}
+
+var (
+	// Unknown emails, wrong passwords and accounts without a password get
+	// the same answer so that logins cannot be used to find accounts.
+	errInvalidCredentials = errors.New("invalid email address or password")
+	errTooManyLogins      = errors.New("too many failed login attempts, try again later")
+)
+
+// loginWait is how long the account or the address has to wait before
+// trying again. The guard fails open; being unable to reach Redis must not
+// keep everybody out.
+func (s *Server) loginWait(ctx context.Context, r *http.Request, email string) time.Duration {
+	wait, err := s.loginGuard.Check(ctx, email, clientIP(r))
+	if err != nil {
+		log.Printf("login guard check failed %v\n", err)
+		return 0
+	}
+	return wait
+}
+
+// loginFailed counts the failure and answers it the same way whether or not
+// the account exists.
+func (s *Server) loginFailed(ctx context.Context, w http.ResponseWriter, r *http.Request, user *store.User, email string) error {
+	s.countLoginFailure(ctx, r, user, email)
+	return internal.ResponseHandler(w, internal.NewErrorResponse("failed", errInvalidCredentials.Error()), http.StatusUnauthorized)
+}
+
+// countLoginFailure counts a wrong password or second factor and, when it
+// locks an existing account, mails its owner a link to unlock it.
+func (s *Server) countLoginFailure(ctx context.Context, r *http.Request, user *store.User, email string) {
+	failure, err := s.loginGuard.Fail(ctx, email, clientIP(r))
+	if err != nil {
+		log.Printf("login guard failed to count a failure %v\n", err)
+	}
+
+	if failure.Locked && user != nil {
+		if err := s.sendUnlockMail(ctx, *user); err != nil {
+			log.Printf("failed to send the unlock mail of user %s %v\n", user.Id.Hex(), err)
+		}
+	}
+}
+
+func (s *Server) loginSucceeded(ctx context.Context, email string) {
+	if err := s.loginGuard.Succeed(ctx, email); err != nil {
+		log.Printf("login guard failed to reset failures %v\n", err)
+	}
+}
+
+func (s *Server) sendUnlockMail(ctx context.Context, user store.User) error {
+	if err := s.ensureUserTokenIndexes(ctx); err != nil {
+		return err
+	}
+
+	unlockToken, err := s.issueUserToken(ctx, user, types.TOKEN_ACCOUNT_UNLOCK)
+	if err != nil {
+		return err
+	}
+
+	opts := []asynq.Option{
+		asynq.MaxRetry(10),
+		asynq.Queue("critical"),
+	}
+	return s.taskDistributor.AccountUnlockMailTask(ctx, &types.PayloadSendMail{Email: user.Email, Token: unlockToken}, opts...)
+}
+
+// UnlockAccountHandler lifts a lockout through the link mailed when it
+// started.
+func (s *Server) UnlockAccountHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	tokens := s.Store.Collection(ctx, "coffeeshop", "user_tokens")
+
+	userToken, err := consumeUserToken(ctx, tokens, r.URL.Query().Get("token"), types.TOKEN_ACCOUNT_UNLOCK)
+	if err != nil {
+		if errors.Is(err, errInvalidUserToken) {
+			return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+		}
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+
+	if err := s.loginGuard.Unlock(ctx, userToken.Email); err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+
+	result := struct {
+		Status string `json:"status"`
+		Data   string `json:"data"`
+	}{
+		Status: "success",
+		Data:   "account unlocked",
+	}
+	return internal.ResponseHandler(w, result, http.StatusOK)
+}
+
+func tooManyLogins(w http.ResponseWriter, wait time.Duration) error {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	return internal.ResponseHandler(w, internal.NewErrorResponse("failed", errTooManyLogins.Error()), http.StatusTooManyRequests)
+}
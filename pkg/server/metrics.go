@@ -0,0 +1,22 @@
+package server
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/silaselisha/coffee-api/internal"
+	"github.com/silaselisha/coffee-api/pkg/cache"
+)
+
+// UserCacheStatsHandler reports the lookups the auth middleware served from
+// the user cache since start up.
+func (s *Server) UserCacheStatsHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	result := struct {
+		Status string              `json:"status"`
+		Data   cache.StatsSnapshot `json:"data"`
+	}{
+		Status: "success",
+		Data:   s.UserCache.Stats(),
+	}
+	return internal.ResponseHandler(w, result, http.StatusOK)
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/silaselisha/coffee-api/pkg/store"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// migrationLease is how long an instance may hold a migration before the
+// others assume it died half way and take it over.
+const migrationLease = time.Hour
+
+// migration is a one off change to existing data. run must be safe to
+// repeat, since an instance may die before recording that it finished.
+type migration struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+// runMigrations applies the migrations that have not been applied yet.
+// Every instance calls it at start up, so each migration is claimed in the
+// migrations collection first and only the instance holding the claim runs
+// it. A failed migration is logged and retried at the next start rather
+// than keeping the server from serving.
+func runMigrations(ctx context.Context, str store.Mongo, migrations ...migration) {
+	collection := str.Collection(ctx, "coffeeshop", "migrations")
+
+	for _, m := range migrations {
+		claimed, err := claimMigration(ctx, collection, m.name)
+		if err != nil {
+			log.Printf("failed to claim migration %s %v\n", m.name, err)
+			continue
+		}
+		if !claimed {
+			continue
+		}
+
+		if err := m.run(ctx); err != nil {
+			log.Printf("migration %s failed %v\n", m.name, err)
+			unapplied := bson.D{{Key: "_id", Value: m.name}, {Key: "applied_at", Value: bson.D{{Key: "$exists", Value: false}}}}
+			if _, err := collection.DeleteOne(ctx, unapplied); err != nil {
+				log.Printf("failed to release migration %s %v\n", m.name, err)
+			}
+			continue
+		}
+
+		update := bson.D{{Key: "$set", Value: bson.D{{Key: "applied_at", Value: time.Now()}}}}
+		if _, err := collection.UpdateOne(ctx, bson.D{{Key: "_id", Value: m.name}}, update); err != nil {
+			log.Printf("failed to record migration %s %v\n", m.name, err)
+			continue
+		}
+		log.Printf("applied migration %s\n", m.name)
+	}
+}
+
+// claimMigration reports whether this instance may run the named
+// migration. The upsert only matches a claim that was never completed and
+// whose lease ran out; otherwise it tries to insert a second document
+// with the same id, which fails for applied migrations and live claims.
+func claimMigration(ctx context.Context, collection *mongo.Collection, name string) (bool, error) {
+	now := time.Now()
+	filter := bson.D{
+		{Key: "_id", Value: name},
+		{Key: "applied_at", Value: bson.D{{Key: "$exists", Value: false}}},
+		{Key: "started_at", Value: bson.D{{Key: "$lt", Value: now.Add(-migrationLease)}}},
+	}
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "started_at", Value: now}}}}
+
+	_, err := collection.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,299 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/silaselisha/coffee-api/internal"
+	"github.com/silaselisha/coffee-api/pkg/oidc"
+	"github.com/silaselisha/coffee-api/pkg/store"
+	"github.com/silaselisha/coffee-api/pkg/token"
+	"github.com/silaselisha/coffee-api/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const oidcStateTTL = 10 * time.Minute
+
+var (
+	errInvalidOIDCState    = errors.New("invalid or expired login state, kindly start the login again")
+	errOIDCEmailUnverified = errors.New("the identity provider has not verified this email address")
+	usernameCharacters     = regexp.MustCompile(`[^a-z0-9]+`)
+)
+
+// newOIDCRegistry registers the providers that have credentials configured.
+// Redirect URLs are OIDC_REDIRECT_URL followed by /{provider}/callback.
+func newOIDCRegistry(envs *types.Config) *oidc.Registry {
+	registry := oidc.NewRegistry()
+	base := strings.TrimSuffix(envs.OIDC_REDIRECT_URL, "/")
+	callback := func(name string) string {
+		return fmt.Sprintf("%s/%s/callback", base, name)
+	}
+
+	if envs.GOOGLE_CLIENT_ID != "" {
+		registry.Register(oidc.NewProvider(oidc.Google(envs.GOOGLE_CLIENT_ID, envs.GOOGLE_CLIENT_SECRET, callback("google"))))
+	}
+
+	if envs.APPLE_CLIENT_ID != "" {
+		key, err := oidc.LoadAppleKey(envs.APPLE_KEY_FILE)
+		if err != nil {
+			log.Panic(err)
+		}
+		registry.Register(oidc.NewProvider(oidc.Apple(envs.APPLE_CLIENT_ID, envs.APPLE_TEAM_ID, envs.APPLE_KEY_ID, key, callback("apple"))))
+	}
+
+	if envs.OIDC_ISSUER != "" {
+		name := envs.OIDC_NAME
+		if name == "" {
+			name = "oidc"
+		}
+		registry.Register(oidc.NewProvider(oidc.Config{
+			Name:         name,
+			Issuer:       envs.OIDC_ISSUER,
+			ClientID:     envs.OIDC_CLIENT_ID,
+			ClientSecret: envs.OIDC_CLIENT_SECRET,
+			RedirectURL:  callback(name),
+		}))
+	}
+	return registry
+}
+
+// OIDCLoginHandler sends the browser to the provider's sign in page. The
+// state, nonce and PKCE verifier are kept server side until the callback.
+func (s *Server) OIDCLoginHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	provider, err := s.OIDC.Get(mux.Vars(r)["provider"])
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusNotFound)
+	}
+
+	state, stateHash, err := token.NewOpaqueToken()
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+	nonce, err := oidc.NewSecret()
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+	verifier, err := oidc.NewSecret()
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+
+	redirect, err := provider.AuthCodeURL(ctx, state, nonce, verifier)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadGateway)
+	}
+
+	collection := s.Store.Collection(ctx, "coffeeshop", "oidc_states")
+	_, err = collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "state_hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+
+	_, err = collection.InsertOne(ctx, store.OIDCState{
+		Id:        primitive.NewObjectID(),
+		StateHash: stateHash,
+		Provider:  provider.Name(),
+		Nonce:     nonce,
+		Verifier:  verifier,
+		ExpiresAt: time.Now().Add(oidcStateTTL),
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+
+	http.Redirect(w, r, redirect, http.StatusFound)
+	return nil
+}
+
+// OIDCCallbackHandler finishes a social login. The identity is linked to
+// the account with the same verified email, or a new account is created on
+// first login, and the usual access and refresh tokens are issued.
+func (s *Server) OIDCCallbackHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	provider, err := s.OIDC.Get(mux.Vars(r)["provider"])
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusNotFound)
+	}
+
+	// Apple posts the callback as a form, the others redirect with a query.
+	if err := r.ParseForm(); err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+	}
+	if reason := r.Form.Get("error"); reason != "" {
+		err := fmt.Errorf("%s login failed: %s", provider.Name(), reason)
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusUnauthorized)
+	}
+
+	code, state := r.Form.Get("code"), r.Form.Get("state")
+	if code == "" || state == "" {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", errInvalidOIDCState.Error()), http.StatusBadRequest)
+	}
+
+	var pending store.OIDCState
+	filter := bson.D{
+		{Key: "state_hash", Value: token.HashOpaqueToken(state)},
+		{Key: "provider", Value: provider.Name()},
+		{Key: "expires_at", Value: bson.D{{Key: "$gt", Value: time.Now()}}},
+	}
+	err = s.Store.Collection(ctx, "coffeeshop", "oidc_states").FindOneAndDelete(ctx, filter).Decode(&pending)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return internal.ResponseHandler(w, internal.NewErrorResponse("failed", errInvalidOIDCState.Error()), http.StatusBadRequest)
+		}
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+
+	identity, err := provider.Exchange(ctx, code, pending.Verifier, pending.Nonce)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusUnauthorized)
+	}
+
+	user, err := s.userForIdentity(ctx, identity)
+	if err != nil {
+		if errors.Is(err, errOIDCEmailUnverified) {
+			return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusForbidden)
+		}
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+
+	return s.completeLogin(ctx, w, r, user)
+}
+
+// userForIdentity finds the user an external identity belongs to. Identities
+// are only linked through an email address the provider has verified, so an
+// attacker cannot claim an account by registering its email elsewhere.
+func (s *Server) userForIdentity(ctx context.Context, identity *oidc.Identity) (store.User, error) {
+	collection := s.Store.Collection(ctx, "coffeeshop", "users")
+	_, err := collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "email", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "username", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{
+			Keys: bson.D{{Key: "identities.provider", Value: 1}, {Key: "identities.subject", Value: 1}},
+			Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.D{
+				{Key: "identities.subject", Value: bson.D{{Key: "$exists", Value: true}}},
+			}),
+		},
+	})
+	if err != nil {
+		return store.User{}, err
+	}
+
+	var user store.User
+	linked := bson.D{{Key: "identities", Value: bson.D{{Key: "$elemMatch", Value: bson.D{
+		{Key: "provider", Value: identity.Provider},
+		{Key: "subject", Value: identity.Subject},
+	}}}}}
+	err = collection.FindOne(ctx, linked).Decode(&user)
+	if err == nil {
+		return user, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return store.User{}, err
+	}
+
+	if !identity.EmailVerified {
+		return store.User{}, errOIDCEmailUnverified
+	}
+
+	link := store.Identity{Provider: identity.Provider, Subject: identity.Subject, LinkedAt: time.Now()}
+	err = collection.FindOne(ctx, bson.D{{Key: "email", Value: identity.Email}}).Decode(&user)
+	if err == nil {
+		return s.linkIdentity(ctx, user, link)
+	}
+	if err != mongo.ErrNoDocuments {
+		return store.User{}, err
+	}
+
+	// First login: the account has no password until the user sets one
+	// through the forgot password flow.
+	timestamp := time.Now()
+	user = store.User{
+		Id:         primitive.NewObjectID(),
+		Role:       types.ROLE_USER,
+		Email:      identity.Email,
+		Verified:   true,
+		Identities: []store.Identity{link},
+		CreatedAt:  timestamp,
+		UpdatedAt:  timestamp,
+	}
+	for attempt := 0; attempt < 3; attempt++ {
+		user.UserName, err = oidcUserName(identity)
+		if err != nil {
+			return store.User{}, err
+		}
+
+		_, err = collection.InsertOne(ctx, user)
+		if !mongo.IsDuplicateKeyError(err) {
+			break
+		}
+	}
+	if err != nil {
+		return store.User{}, err
+	}
+	return user, nil
+}
+
+// linkIdentity adds the identity to an existing account. Until now nobody
+// proved they own an unverified account's email, so whoever signed up with it
+// may not be its owner: their password and sessions are dropped.
+func (s *Server) linkIdentity(ctx context.Context, user store.User, link store.Identity) (store.User, error) {
+	collection := s.Store.Collection(ctx, "coffeeshop", "users")
+
+	set := bson.D{{Key: "verified", Value: true}, {Key: "updated_at", Value: time.Now()}}
+	update := bson.D{{Key: "$push", Value: bson.D{{Key: "identities", Value: link}}}}
+	if !user.Verified {
+		set = append(set, bson.E{Key: "password", Value: ""})
+		update = append(update, bson.E{Key: "$inc", Value: bson.D{{Key: "token_version", Value: 1}}})
+	}
+	update = append(update, bson.E{Key: "$set", Value: set})
+
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err := collection.FindOneAndUpdate(ctx, bson.D{{Key: "_id", Value: user.Id}}, update, opts).Decode(&user)
+	if err != nil {
+		return store.User{}, err
+	}
+	s.UserCache.InvalidateUser(ctx, user.Id)
+
+	if user.Password == "" {
+		err = revokeRefreshTokens(ctx, s.Store.Collection(ctx, "coffeeshop", "refresh_tokens"), bson.D{{Key: "user", Value: user.Id}})
+		if err != nil {
+			return store.User{}, err
+		}
+	}
+	return user, nil
+}
+
+// oidcUserName derives a username from the email address plus a random
+// suffix, since usernames are unique and the user never picked one.
+func oidcUserName(identity *oidc.Identity) (string, error) {
+	name := usernameCharacters.ReplaceAllString(strings.ToLower(emailLocalPart(identity.Email)), "")
+	if len(name) > 20 {
+		name = name[:20]
+	}
+	if name == "" {
+		name = identity.Provider
+	}
+
+	suffix, err := oidc.NewSecret()
+	if err != nil {
+		return "", err
+	}
+	suffix = usernameCharacters.ReplaceAllString(strings.ToLower(suffix), "")
+	if len(suffix) > 6 {
+		suffix = suffix[:6]
+	}
+	return name + suffix, nil
+}
@@ -2,19 +2,42 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"time"
 
+	"github.com/gorilla/mux"
 	"github.com/silaselisha/coffee-api/internal"
 	"github.com/silaselisha/coffee-api/pkg/store"
 	"github.com/silaselisha/coffee-api/types"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-func (s *Server) CreateOrderHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
-	ordColl := s.Store.Collection(ctx, "coffeeshop", "orders")
+// orderTransitions lists, for every order status, the statuses it may move to.
+// completed and cancelled are terminal.
+var orderTransitions = map[string][]string{
+	types.ORDER_PENDING:   {types.ORDER_ACCEPTED, types.ORDER_CANCELLED},
+	types.ORDER_ACCEPTED:  {types.ORDER_PREPARING, types.ORDER_CANCELLED},
+	types.ORDER_PREPARING: {types.ORDER_READY, types.ORDER_CANCELLED},
+	types.ORDER_READY:     {types.ORDER_COMPLETED},
+}
+
+var errIllegalOrderTransition = errors.New("illegal order status transition")
+
+func canTransitionOrder(from, to string) bool {
+	for _, status := range orderTransitions[from] {
+		if status == to {
+			return true
+		}
+	}
+	return false
+}
 
+func (s *Server) CreateOrderHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	orderPayload, err := internal.ReadReqBody[types.OrderParams](r.Body, s.vd)
 	if err != nil {
 		res := internal.NewErrorResponse("failed", err.Error())
@@ -61,21 +84,385 @@ func (s *Server) CreateOrderHandler(ctx context.Context, w http.ResponseWriter,
 	}
 
 	order := store.Order{
-		Id:            primitive.NewObjectID(),
-		Items:         orderItems,
-		TotalAmount:   totalAmount,
-		Owner:         userInfo.Id,
-		Status:        "pending",
+		Id:          primitive.NewObjectID(),
+		Items:       orderItems,
+		TotalAmount: totalAmount,
+		Owner:       userInfo.Id,
+		Status:      types.ORDER_PENDING,
+		StatusHistory: []store.OrderStatusChange{
+			{To: types.ORDER_PENDING, ChangedBy: userInfo.Id, ChangedAt: time.Now()},
+		},
 		TotalDiscount: totalDiscount,
+		StockReserved: true,
 		CreatedAt:     time.Now(),
 		UpdatedAt:     time.Now(),
 	}
 
-	_, err = ordColl.InsertOne(ctx, order)
+	session, err := s.Store.TxnStartSession(ctx)
 	if err != nil {
 		res := internal.NewErrorResponse("failed", err.Error())
 		return internal.ResponseHandler(w, res, http.StatusInternalServerError)
 	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(ctx mongo.SessionContext) (interface{}, error) {
+		if err := s.reserveStock(ctx, orderItems, products); err != nil {
+			return nil, err
+		}
+
+		ordColl := s.Store.Collection(ctx, "coffeeshop", "orders")
+		return ordColl.InsertOne(ctx, order)
+	}, &options.TransactionOptions{})
+
+	if err != nil {
+		var stockErr *insufficientStockError
+		if errors.As(err, &stockErr) {
+			res := struct {
+				Status string                      `json:"status"`
+				Error  string                      `json:"error"`
+				Items  []types.StockShortageParams `json:"items"`
+			}{
+				Status: "failed",
+				Error:  stockErr.Error(),
+				Items:  stockErr.Items,
+			}
+			return internal.ResponseHandler(w, res, http.StatusConflict)
+		}
+
+		res := internal.NewErrorResponse("failed", err.Error())
+		return internal.ResponseHandler(w, res, http.StatusInternalServerError)
+	}
 
 	return internal.ResponseHandler(w, order, http.StatusCreated)
 }
+
+func (s *Server) GetAllOrdersHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ordColl := s.Store.Collection(ctx, "coffeeshop", "orders")
+	userInfo := ctx.Value(types.AuthUserInfoKey{}).(*types.UserInfo)
+
+	filter := bson.D{}
+	if !userInfo.Can(types.PERM_ORDERS_READ) {
+		filter = append(filter, bson.E{Key: "owner", Value: userInfo.Id})
+	}
+
+	if status := r.URL.Query().Get("status"); status != "" {
+		filter = append(filter, bson.E{Key: "status", Value: status})
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}})
+	cur, err := ordColl.Find(ctx, filter, opts)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+	defer cur.Close(ctx)
+
+	orders := []store.Order{}
+	if err := cur.All(ctx, &orders); err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+
+	result := struct {
+		Status  string        `json:"status"`
+		Results int32         `json:"results"`
+		Data    []store.Order `json:"data"`
+	}{
+		Status:  "success",
+		Results: int32(len(orders)),
+		Data:    orders,
+	}
+	return internal.ResponseHandler(w, result, http.StatusOK)
+}
+
+func (s *Server) GetOrderByIdHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ordColl := s.Store.Collection(ctx, "coffeeshop", "orders")
+	userInfo := ctx.Value(types.AuthUserInfoKey{}).(*types.UserInfo)
+
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+	}
+
+	var order store.Order
+	err = ordColl.FindOne(ctx, bson.D{{Key: "_id", Value: id}}).Decode(&order)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return internal.ResponseHandler(w, internal.NewErrorResponse("failed", fmt.Errorf("document not found %w", err).Error()), http.StatusNotFound)
+		}
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+
+	if order.Owner != userInfo.Id && !userInfo.Can(types.PERM_ORDERS_READ) {
+		err := errors.New("user only allowed to retrieve their own orders")
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusForbidden)
+	}
+
+	result := struct {
+		Status string      `json:"status"`
+		Data   store.Order `json:"data"`
+	}{
+		Status: "success",
+		Data:   order,
+	}
+	return internal.ResponseHandler(w, result, http.StatusOK)
+}
+
+// GetUserOrdersHandler returns the order history of a single user, newest
+// first. Customers may only read their own history (/me/orders or
+// /users/me/orders), admins may read anyone's.
+func (s *Server) GetUserOrdersHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ordColl := s.Store.Collection(ctx, "coffeeshop", "orders")
+	userInfo := ctx.Value(types.AuthUserInfoKey{}).(*types.UserInfo)
+
+	owner := userInfo.Id
+	if param, ok := mux.Vars(r)["id"]; ok && param != "me" {
+		id, err := primitive.ObjectIDFromHex(param)
+		if err != nil {
+			return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+		}
+		owner = id
+	}
+
+	if owner != userInfo.Id && !userInfo.Can(types.PERM_ORDERS_READ) {
+		err := errors.New("user only allowed to retrieve their own orders")
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusForbidden)
+	}
+
+	queries := r.URL.Query()
+	limit, err := internal.ParseLimit(queries)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+	}
+
+	filter := bson.D{{Key: "owner", Value: owner}}
+	if cursor := queries.Get("cursor"); cursor != "" {
+		lastId, err := internal.DecodeCursor(cursor)
+		if err != nil {
+			return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+		}
+		filter = append(filter, bson.E{Key: "_id", Value: bson.D{{Key: "$lt", Value: lastId}}})
+	}
+
+	createdAt, ok, err := internal.ParseDateRange(queries, "created_at")
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+	}
+	if ok {
+		filter = append(filter, createdAt)
+	}
+
+	if statuses := internal.SplitQueryList(queries.Get("status")); len(statuses) > 0 {
+		filter = append(filter, bson.E{Key: "status", Value: bson.D{{Key: "$in", Value: statuses}}})
+	}
+
+	// ObjectIDs grow with insertion time, so sorting on _id keeps the cursor
+	// stable even when several orders share a created_at timestamp.
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: -1}}).SetLimit(limit + 1)
+	cur, err := ordColl.Find(ctx, filter, opts)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+	defer cur.Close(ctx)
+
+	orders := []store.Order{}
+	if err := cur.All(ctx, &orders); err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+
+	var nextCursor string
+	if int64(len(orders)) > limit {
+		orders = orders[:limit]
+		nextCursor = internal.EncodeCursor(orders[len(orders)-1].Id)
+	}
+
+	result := struct {
+		Status     string        `json:"status"`
+		Results    int32         `json:"results"`
+		NextCursor string        `json:"next_cursor,omitempty"`
+		Data       []store.Order `json:"data"`
+	}{
+		Status:     "success",
+		Results:    int32(len(orders)),
+		NextCursor: nextCursor,
+		Data:       orders,
+	}
+	return internal.ResponseHandler(w, result, http.StatusOK)
+}
+
+// CancelOrderHandler lets a customer cancel one of their own orders while it
+// is still pending; once the baristas have accepted it only an admin can
+// cancel it through UpdateOrderStatusHandler.
+func (s *Server) CancelOrderHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ordColl := s.Store.Collection(ctx, "coffeeshop", "orders")
+	userInfo := ctx.Value(types.AuthUserInfoKey{}).(*types.UserInfo)
+
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+	}
+
+	var payload types.OrderCancelParams
+	if r.ContentLength > 0 {
+		payload, err = internal.ReadReqBody[types.OrderCancelParams](r.Body, s.vd)
+		if err != nil {
+			return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+		}
+	}
+
+	var order store.Order
+	err = ordColl.FindOne(ctx, bson.D{{Key: "_id", Value: id}}).Decode(&order)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return internal.ResponseHandler(w, internal.NewErrorResponse("failed", fmt.Errorf("document not found %w", err).Error()), http.StatusNotFound)
+		}
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+
+	if order.Owner != userInfo.Id {
+		err := errors.New("user only allowed to cancel their own orders")
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusForbidden)
+	}
+
+	if order.Status != types.ORDER_PENDING {
+		err := fmt.Errorf("%w: an order that is %s can no longer be cancelled", errIllegalOrderTransition, order.Status)
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusConflict)
+	}
+
+	updated, err := s.transitionOrder(ctx, r, order, types.ORDER_CANCELLED, userInfo.Id, payload.Reason)
+	if err != nil {
+		if errors.Is(err, errIllegalOrderTransition) {
+			return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusConflict)
+		}
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+
+	result := struct {
+		Status string      `json:"status"`
+		Data   store.Order `json:"data"`
+	}{
+		Status: "success",
+		Data:   updated,
+	}
+	return internal.ResponseHandler(w, result, http.StatusOK)
+}
+
+func (s *Server) UpdateOrderStatusHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ordColl := s.Store.Collection(ctx, "coffeeshop", "orders")
+	userInfo := ctx.Value(types.AuthUserInfoKey{}).(*types.UserInfo)
+
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+	}
+
+	payload, err := internal.ReadReqBody[types.OrderStatusParams](r.Body, s.vd)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+	}
+
+	var order store.Order
+	err = ordColl.FindOne(ctx, bson.D{{Key: "_id", Value: id}}).Decode(&order)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return internal.ResponseHandler(w, internal.NewErrorResponse("failed", fmt.Errorf("document not found %w", err).Error()), http.StatusNotFound)
+		}
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+
+	updated, err := s.transitionOrder(ctx, r, order, payload.Status, userInfo.Id, payload.Reason)
+	if err != nil {
+		if errors.Is(err, errIllegalOrderTransition) {
+			return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusConflict)
+		}
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+
+	result := struct {
+		Status string      `json:"status"`
+		Data   store.Order `json:"data"`
+	}{
+		Status: "success",
+		Data:   updated,
+	}
+	return internal.ResponseHandler(w, result, http.StatusOK)
+}
+
+// transitionOrder moves order to status and appends the change to its
+// history. The update is conditional on the order still being in the status
+// and payment status it was read with, so two baristas racing on the same
+// order cannot both win and a payment settling meanwhile is not cancelled.
+// Cancelling an order returns its reserved stock in the same transaction, and
+// the change is audited with it.
+func (s *Server) transitionOrder(ctx context.Context, r *http.Request, order store.Order, status string, actor primitive.ObjectID, reason string) (store.Order, error) {
+	if !canTransitionOrder(order.Status, status) {
+		return store.Order{}, fmt.Errorf("%w from %s to %s", errIllegalOrderTransition, order.Status, status)
+	}
+
+	// Cancelling would keep the customer's money without a trace; paid
+	// orders are cancelled by refunding them in full first.
+	if status == types.ORDER_CANCELLED && (order.PaymentStatus == types.PAID || order.PaymentStatus == types.PARTIALLY_REFUNDED) {
+		return store.Order{}, fmt.Errorf("%w: a %s order must be refunded before it is cancelled", errIllegalOrderTransition, order.PaymentStatus)
+	}
+
+	session, err := s.Store.TxnStartSession(ctx)
+	if err != nil {
+		return store.Order{}, err
+	}
+	defer session.EndSession(ctx)
+
+	response, err := session.WithTransaction(ctx, func(ctx mongo.SessionContext) (interface{}, error) {
+		ordColl := s.Store.Collection(ctx, "coffeeshop", "orders")
+		now := time.Now()
+		change := store.OrderStatusChange{
+			From:      order.Status,
+			To:        status,
+			ChangedBy: actor,
+			Reason:    reason,
+			ChangedAt: now,
+		}
+
+		set := bson.D{{Key: "status", Value: status}, {Key: "updated_at", Value: now}}
+		restock := status == types.ORDER_CANCELLED && order.StockReserved
+		if restock {
+			set = append(set, bson.E{Key: "stock_reserved", Value: false})
+		}
+
+		filter := bson.D{
+			{Key: "_id", Value: order.Id},
+			{Key: "status", Value: order.Status},
+			{Key: "payment_status", Value: order.PaymentStatus},
+		}
+		update := bson.D{
+			{Key: "$set", Value: set},
+			{Key: "$push", Value: bson.D{{Key: "status_history", Value: change}}},
+		}
+
+		newDocs := options.After
+		var updated store.Order
+		err := ordColl.FindOneAndUpdate(ctx, filter, update, &options.FindOneAndUpdateOptions{
+			ReturnDocument: &newDocs,
+		}).Decode(&updated)
+		if err != nil {
+			if err == mongo.ErrNoDocuments {
+				return nil, fmt.Errorf("%w: order was modified concurrently", errIllegalOrderTransition)
+			}
+			return nil, err
+		}
+
+		if restock {
+			if err := s.restockOrderItems(ctx, order.Items); err != nil {
+				return nil, err
+			}
+		}
+
+		err = s.writeAudit(ctx, r, types.AUDIT_ORDER_STATUS_UPDATE, "order", order.Id.Hex(), order, updated)
+		if err != nil {
+			return nil, err
+		}
+		return updated, nil
+	}, &options.TransactionOptions{})
+
+	if err != nil {
+		return store.Order{}, err
+	}
+	return response.(store.Order), nil
+}
@@ -0,0 +1,435 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/silaselisha/coffee-api/internal"
+	"github.com/silaselisha/coffee-api/pkg/payments"
+	"github.com/silaselisha/coffee-api/pkg/store"
+	"github.com/silaselisha/coffee-api/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const defaultPaymentCurrency = "USD"
+
+var (
+	errPaymentEventProcessed = errors.New("payment event already processed")
+	errPaymentInProgress     = errors.New("another payment for this order is still pending")
+)
+
+// CreatePaymentHandler starts paying for an order with the requested (or
+// default) provider. Card payments answer with a redirect_url to the
+// provider's checkout; mobile money payments are approved on the phone.
+// Either way the order is only marked paid once the provider confirms.
+// Only one payment may be pending per order, so it cannot be paid twice.
+func (s *Server) CreatePaymentHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	payColl := s.Store.Collection(ctx, "coffeeshop", "payments")
+	userInfo := ctx.Value(types.AuthUserInfoKey{}).(*types.UserInfo)
+
+	order, code, err := s.findPayableOrder(ctx, mux.Vars(r)["id"], userInfo)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), code)
+	}
+
+	payload, err := internal.ReadReqBody[types.PaymentParams](r.Body, s.vd)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+	}
+
+	if order.Status == types.ORDER_CANCELLED || (order.PaymentStatus != types.PENDING && order.PaymentStatus != types.REJECTED) {
+		err := fmt.Errorf("an order that is %s and %s cannot be paid", order.Status, order.PaymentStatus)
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusConflict)
+	}
+
+	if code, err := s.settleLatestPayment(ctx, order); err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), code)
+	}
+
+	provider, err := s.payments.Get(payload.Provider)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+	}
+
+	currency := s.envs.PAYMENT_CURRENCY
+	if currency == "" {
+		currency = defaultPaymentCurrency
+	}
+
+	payment := store.Payment{
+		Id:        primitive.NewObjectID(),
+		Order:     order.Id,
+		Provider:  provider.Name(),
+		Method:    payload.Method,
+		Amount:    order.TotalAmount,
+		Currency:  currency,
+		Status:    types.PENDING,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+
+	charge, err := provider.Initiate(ctx, payments.Intent{
+		Id:          payment.Id.Hex(),
+		Amount:      payment.Amount,
+		Currency:    payment.Currency,
+		Method:      payment.Method,
+		Email:       userInfo.Email,
+		Phone:       payload.Phone,
+		Description: fmt.Sprintf("Coffee shop order %s", order.Id.Hex()),
+	})
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadGateway)
+	}
+	payment.Reference = charge.Reference
+	payment.RedirectURL = charge.RedirectURL
+
+	_, err = payColl.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "provider", Value: 1}, {Key: "reference", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+
+	session, err := s.Store.TxnStartSession(ctx)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+	defer session.EndSession(ctx)
+
+	response, err := session.WithTransaction(ctx, func(ctx mongo.SessionContext) (interface{}, error) {
+		payColl := s.Store.Collection(ctx, "coffeeshop", "payments")
+		ordColl := s.Store.Collection(ctx, "coffeeshop", "orders")
+
+		if _, err := payColl.InsertOne(ctx, payment); err != nil {
+			return nil, err
+		}
+
+		// Matching the payment the order pointed at when it was read keeps a
+		// concurrent request from linking a second pending payment.
+		latest := bson.E{Key: "payment", Value: order.Payment}
+		if order.Payment.IsZero() {
+			latest = bson.E{Key: "payment", Value: bson.D{{Key: "$exists", Value: false}}}
+		}
+		unsettled := bson.A{types.PENDING, types.REJECTED}
+		filter := bson.D{{Key: "_id", Value: order.Id}, {Key: "payment_status", Value: bson.D{{Key: "$in", Value: unsettled}}}, latest}
+		update := bson.D{{Key: "$set", Value: bson.D{
+			{Key: "payment", Value: payment.Id},
+			{Key: "payment_status", Value: types.PENDING},
+			{Key: "updated_at", Value: time.Now()},
+		}}}
+		res, err := ordColl.UpdateOne(ctx, filter, update)
+		if err != nil {
+			return nil, err
+		}
+		if res.ModifiedCount == 0 {
+			return nil, errPaymentInProgress
+		}
+
+		// Some providers settle synchronously, e.g. a saved card.
+		return s.settlePayment(ctx, payment, charge.Status)
+	}, &options.TransactionOptions{})
+
+	if err != nil {
+		if errors.Is(err, errPaymentInProgress) {
+			return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusConflict)
+		}
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+
+	if paid := response.(bool); paid {
+		s.queueInvoice(ctx, order)
+	}
+	payment.Status = charge.Status
+
+	result := struct {
+		Status string        `json:"status"`
+		Data   store.Payment `json:"data"`
+	}{
+		Status: "success",
+		Data:   payment,
+	}
+	return internal.ResponseHandler(w, result, http.StatusCreated)
+}
+
+// ConfirmPaymentHandler asks the provider for the state of the order's
+// latest payment. Clients call it after returning from a checkout page so
+// they do not have to wait for the webhook.
+func (s *Server) ConfirmPaymentHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	payColl := s.Store.Collection(ctx, "coffeeshop", "payments")
+	userInfo := ctx.Value(types.AuthUserInfoKey{}).(*types.UserInfo)
+
+	order, code, err := s.findPayableOrder(ctx, mux.Vars(r)["id"], userInfo)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), code)
+	}
+
+	var payment store.Payment
+	err = payColl.FindOne(ctx, bson.D{{Key: "_id", Value: order.Payment}}).Decode(&payment)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			err := errors.New("no payment has been started for this order")
+			return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusNotFound)
+		}
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+
+	provider, err := s.payments.Get(payment.Provider)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+
+	charge, err := provider.Confirm(ctx, payment.Reference)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadGateway)
+	}
+
+	paid, err := s.settlePaymentTxn(ctx, payment, charge.Status)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+	if paid {
+		s.queueInvoice(ctx, order)
+	}
+
+	err = payColl.FindOne(ctx, bson.D{{Key: "_id", Value: payment.Id}}).Decode(&payment)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+
+	result := struct {
+		Status string        `json:"status"`
+		Data   store.Payment `json:"data"`
+	}{
+		Status: "success",
+		Data:   payment,
+	}
+	return internal.ResponseHandler(w, result, http.StatusOK)
+}
+
+// PaymentWebhookHandler receives notifications from providers. Every event
+// is recorded in the same transaction that applies it, so a redelivered
+// event is acknowledged without being applied twice, and an event that
+// failed half way is not recorded and can be redelivered.
+func (s *Server) PaymentWebhookHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	provider, err := s.payments.Get(mux.Vars(r)["provider"])
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusNotFound)
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+	}
+	defer r.Body.Close()
+
+	event, err := provider.VerifyWebhook(ctx, r.Header, body)
+	if err != nil {
+		if errors.Is(err, payments.ErrInvalidSignature) {
+			return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusUnauthorized)
+		}
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+	}
+
+	session, err := s.Store.TxnStartSession(ctx)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+	defer session.EndSession(ctx)
+
+	var order primitive.ObjectID
+	response, err := session.WithTransaction(ctx, func(ctx mongo.SessionContext) (interface{}, error) {
+		payColl := s.Store.Collection(ctx, "coffeeshop", "payments")
+		evtColl := s.Store.Collection(ctx, "coffeeshop", "payment_events")
+
+		var payment store.Payment
+		filter := bson.D{{Key: "provider", Value: provider.Name()}, {Key: "reference", Value: event.Reference}}
+		if err := payColl.FindOne(ctx, filter).Decode(&payment); err != nil {
+			return nil, err
+		}
+		order = payment.Order
+
+		_, err := evtColl.InsertOne(ctx, store.PaymentEvent{
+			Id:        fmt.Sprintf("%s:%s", provider.Name(), event.Id),
+			Payment:   payment.Id,
+			Type:      event.Type,
+			CreatedAt: time.Now(),
+		})
+		if err != nil {
+			if mongo.IsDuplicateKeyError(err) {
+				return nil, errPaymentEventProcessed
+			}
+			return nil, err
+		}
+
+		return s.settlePayment(ctx, payment, event.Status)
+	}, &options.TransactionOptions{})
+
+	if err != nil {
+		switch {
+		case errors.Is(err, errPaymentEventProcessed):
+			return internal.ResponseHandler(w, struct {
+				Status string `json:"status"`
+				Data   string `json:"data"`
+			}{Status: "success", Data: err.Error()}, http.StatusOK)
+		case errors.Is(err, mongo.ErrNoDocuments):
+			err := fmt.Errorf("%w %s", payments.ErrUnknownCharge, event.Reference)
+			return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusNotFound)
+		default:
+			return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+		}
+	}
+
+	if paid := response.(bool); paid {
+		s.queueInvoice(ctx, store.Order{Id: order})
+	}
+
+	result := struct {
+		Status string `json:"status"`
+		Data   string `json:"data"`
+	}{
+		Status: "success",
+		Data:   fmt.Sprintf("payment %s", event.Status),
+	}
+	return internal.ResponseHandler(w, result, http.StatusOK)
+}
+
+// settlePayment moves a pending payment to status and mirrors it on the
+// order. Settled payments are final, so late or out of order notifications
+// are ignored. It must run inside a transaction and reports whether the
+// order became paid.
+func (s *Server) settlePayment(ctx context.Context, payment store.Payment, status types.PaymentStatus) (bool, error) {
+	if status == types.PENDING {
+		return false, nil
+	}
+
+	payColl := s.Store.Collection(ctx, "coffeeshop", "payments")
+	ordColl := s.Store.Collection(ctx, "coffeeshop", "orders")
+	now := time.Now()
+
+	res, err := payColl.UpdateOne(ctx,
+		bson.D{{Key: "_id", Value: payment.Id}, {Key: "status", Value: types.PENDING}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "status", Value: status}, {Key: "updated_at", Value: now}}}},
+	)
+	if err != nil {
+		return false, err
+	}
+	if res.ModifiedCount == 0 {
+		return false, nil
+	}
+
+	unsettled := bson.A{types.PENDING, types.REJECTED}
+	filter := bson.D{{Key: "_id", Value: payment.Order}, {Key: "payment_status", Value: bson.D{{Key: "$in", Value: unsettled}}}}
+	set := bson.D{{Key: "payment_status", Value: status}, {Key: "updated_at", Value: now}}
+	if status == types.PAID {
+		set = append(set, bson.E{Key: "payment", Value: payment.Id}, bson.E{Key: "paid_at", Value: now})
+	} else {
+		// A rejected attempt only matters while it is the latest one.
+		filter = append(filter, bson.E{Key: "payment", Value: payment.Id})
+	}
+
+	res, err = ordColl.UpdateOne(ctx, filter, bson.D{{Key: "$set", Value: set}})
+	if err != nil {
+		return false, err
+	}
+	if status == types.PAID && res.ModifiedCount == 0 {
+		// The order was settled by another payment, so this one holds the
+		// customer's money for nothing and has to be refunded by hand.
+		log.Printf("payment %s was paid but order %s is already settled, refund it\n", payment.Id.Hex(), payment.Order.Hex())
+	}
+	return status == types.PAID && res.ModifiedCount > 0, nil
+}
+
+func (s *Server) settlePaymentTxn(ctx context.Context, payment store.Payment, status types.PaymentStatus) (bool, error) {
+	session, err := s.Store.TxnStartSession(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer session.EndSession(ctx)
+
+	response, err := session.WithTransaction(ctx, func(ctx mongo.SessionContext) (interface{}, error) {
+		return s.settlePayment(ctx, payment, status)
+	}, &options.TransactionOptions{})
+	if err != nil {
+		return false, err
+	}
+	return response.(bool), nil
+}
+
+// settleLatestPayment asks the provider about the order's latest payment
+// while it is pending, so that a checkout that was abandoned and has since
+// failed does not block a new attempt. It fails with errPaymentInProgress,
+// and the status code to answer with, while that payment may still be paid.
+func (s *Server) settleLatestPayment(ctx context.Context, order store.Order) (int, error) {
+	if order.Payment.IsZero() || order.PaymentStatus != types.PENDING {
+		return http.StatusOK, nil
+	}
+
+	payColl := s.Store.Collection(ctx, "coffeeshop", "payments")
+	var payment store.Payment
+	err := payColl.FindOne(ctx, bson.D{{Key: "_id", Value: order.Payment}}).Decode(&payment)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if payment.Status != types.PENDING {
+		return http.StatusOK, nil
+	}
+
+	provider, err := s.payments.Get(payment.Provider)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	charge, err := provider.Confirm(ctx, payment.Reference)
+	if err != nil {
+		return http.StatusBadGateway, err
+	}
+
+	paid, err := s.settlePaymentTxn(ctx, payment, charge.Status)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if paid {
+		s.queueInvoice(ctx, order)
+		return http.StatusConflict, errors.New("the order has been paid")
+	}
+	if charge.Status == types.PENDING {
+		return http.StatusConflict, fmt.Errorf("%w, confirm payment %s before starting another", errPaymentInProgress, payment.Id.Hex())
+	}
+	return http.StatusOK, nil
+}
+
+// findPayableOrder loads an order by its hex id for its owner or an admin,
+// returning the status code to answer with when it cannot.
+func (s *Server) findPayableOrder(ctx context.Context, hex string, userInfo *types.UserInfo) (store.Order, int, error) {
+	ordColl := s.Store.Collection(ctx, "coffeeshop", "orders")
+
+	id, err := primitive.ObjectIDFromHex(hex)
+	if err != nil {
+		return store.Order{}, http.StatusBadRequest, err
+	}
+
+	var order store.Order
+	err = ordColl.FindOne(ctx, bson.D{{Key: "_id", Value: id}}).Decode(&order)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return store.Order{}, http.StatusNotFound, fmt.Errorf("document not found %w", err)
+		}
+		return store.Order{}, http.StatusInternalServerError, err
+	}
+
+	// Staff taking payment at the counter may settle anybody's order.
+	if order.Owner != userInfo.Id && !userInfo.Can(types.PERM_ORDERS_PAY) {
+		return store.Order{}, http.StatusForbidden, errors.New("user only allowed to pay for their own orders")
+	}
+	return order, http.StatusOK, nil
+}
@@ -8,6 +8,8 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -25,6 +27,8 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+var errInvalidProductField = errors.New("invalid product field")
+
 func (s *Server) UpdateProductHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	session, err := s.Store.TxnStartSession(ctx)
 	if err != nil {
@@ -113,6 +117,43 @@ func (s *Server) UpdateProductHandler(ctx context.Context, w http.ResponseWriter
 				}
 				updates[curr.FormName()] = strings.Split(string(data), ",")
 
+			case "stock":
+				data, err := io.ReadAll(curr)
+				if err != nil {
+					return nil, err
+				}
+
+				stock, err := strconv.ParseInt(string(data), 10, 64)
+				if err != nil || stock < 0 {
+					return nil, fmt.Errorf("%w: stock %q", errInvalidProductField, string(data))
+				}
+				updates[curr.FormName()] = stock
+				updates["track_stock"] = true
+
+			case "track_stock":
+				data, err := io.ReadAll(curr)
+				if err != nil {
+					return nil, err
+				}
+
+				trackStock, err := strconv.ParseBool(string(data))
+				if err != nil {
+					return nil, fmt.Errorf("%w: track_stock %q", errInvalidProductField, string(data))
+				}
+				updates[curr.FormName()] = trackStock
+
+			case "recipe":
+				data, err := io.ReadAll(curr)
+				if err != nil {
+					return nil, err
+				}
+
+				recipe, err := parseRecipe(data, s.vd)
+				if err != nil {
+					return nil, fmt.Errorf("%w: recipe %v", errInvalidProductField, err)
+				}
+				updates[curr.FormName()] = recipe
+
 			case "thumbnail":
 				data, err := io.ReadAll(curr)
 				if err != nil {
@@ -176,19 +217,27 @@ func (s *Server) UpdateProductHandler(ctx context.Context, w http.ResponseWriter
 		}
 
 		product := types.ItemResParams{
-			Id:          updatedDocument.Id.Hex(),
-			Images:      updatedDocument.Images,
-			Name:        updatedDocument.Name,
-			Price:       updatedDocument.Price,
-			Discount:    updatedDocument.Discount,
-			Summary:     updatedDocument.Summary,
-			Category:    updatedDocument.Category,
-			Thumbnail:   updatedDocument.Thumbnail,
-			Description: updatedDocument.Description,
-			Ingridients: updatedDocument.Ingridients,
-			Ratings:     updatedDocument.Ratings,
-			CreatedAt:   updatedDocument.CreatedAt,
-			UpdatedAt:   updatedDocument.UpdatedAt,
+			Id:           updatedDocument.Id.Hex(),
+			Images:       updatedDocument.Images,
+			Name:         updatedDocument.Name,
+			Price:        updatedDocument.Price,
+			Discount:     updatedDocument.Discount,
+			Summary:      updatedDocument.Summary,
+			Category:     updatedDocument.Category,
+			Thumbnail:    updatedDocument.Thumbnail,
+			Description:  updatedDocument.Description,
+			Ingridients:  updatedDocument.Ingridients,
+			Ratings:      updatedDocument.Ratings,
+			RatingsCount: updatedDocument.RatingsCount,
+			TrackStock:   updatedDocument.TrackStock,
+			Stock:        updatedDocument.Stock,
+			CreatedAt:    updatedDocument.CreatedAt,
+			UpdatedAt:    updatedDocument.UpdatedAt,
+		}
+
+		err = s.writeAudit(ctx, r, types.AUDIT_PRODUCT_UPDATE, "product", id.Hex(), item, updatedDocument)
+		if err != nil {
+			return nil, err
 		}
 
 		err = session.CommitTransaction(ctx)
@@ -212,6 +261,9 @@ func (s *Server) UpdateProductHandler(ctx context.Context, w http.ResponseWriter
 				return internal.ResponseHandler(w, internal.NewErrorResponse("failed", fmt.Errorf("document not found %w", err).Error()), http.StatusNotFound)
 			}
 
+		case errors.Is(err, errInvalidProductField):
+			return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+
 		case errors.Is(err, &json.SyntaxError{}):
 			return internal.ResponseHandler(w, internal.NewErrorResponse("failed", fmt.Errorf("ivalid data input for operation %w", err).Error()), http.StatusBadRequest)
 
@@ -236,18 +288,39 @@ func (s *Server) UpdateProductHandler(ctx context.Context, w http.ResponseWriter
 func (s *Server) GetAllProductsHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	collection := s.Store.Collection(ctx, "coffeeshop", "products")
 
-	var result types.ItemResponseListParams
+	query, err := parseProductListQuery(r.URL.Query())
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+	}
+
 	type resp struct {
-		Status  string                       `json:"status"`
-		Results int32                        `json:"results"`
-		Data    types.ItemResponseListParams `json:"data"`
+		Status     string      `json:"status"`
+		Results    int32       `json:"results"`
+		Total      int64       `json:"total"`
+		Page       int64       `json:"page"`
+		Limit      int64       `json:"limit"`
+		NextCursor string      `json:"next_cursor,omitempty"`
+		Data       interface{} `json:"data"`
+	}
+
+	total, err := collection.CountDocuments(ctx, query.filter)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+
+	opts := options.Find().
+		SetSort(query.sort).
+		SetSkip(query.offset).
+		SetLimit(query.limit)
+	if query.projection != nil {
+		opts.SetProjection(query.projection)
 	}
 
-	productRes := resp{Status: "success", Results: 0, Data: result}
-	cur, err := collection.Find(ctx, bson.D{})
+	var result types.ItemResponseListParams
+	cur, err := collection.Find(ctx, query.filter, opts)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
-			return internal.ResponseHandler(w, productRes, http.StatusOK)
+			return internal.ResponseHandler(w, resp{Status: "success", Total: total, Page: query.page(), Limit: query.limit, Data: result}, http.StatusOK)
 		}
 
 		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
@@ -265,28 +338,155 @@ func (s *Server) GetAllProductsHandler(ctx context.Context, w http.ResponseWrite
 		}
 
 		product := types.ItemResParams{
-			Id:          item.Id.Hex(),
-			Images:      item.Images,
-			Name:        item.Name,
-			Author:      item.Author,
-			Price:       item.Price,
-			Discount:    item.Discount,
-			Summary:     item.Summary,
-			Category:    item.Category,
-			Thumbnail:   item.Thumbnail,
-			Description: item.Description,
-			Ingridients: item.Ingridients,
-			Ratings:     item.Ratings,
-			CreatedAt:   item.CreatedAt,
-			UpdatedAt:   item.UpdatedAt,
+			Id:           item.Id.Hex(),
+			Images:       item.Images,
+			Name:         item.Name,
+			Author:       item.Author,
+			Price:        item.Price,
+			Discount:     item.Discount,
+			Summary:      item.Summary,
+			Category:     item.Category,
+			Thumbnail:    item.Thumbnail,
+			Description:  item.Description,
+			Ingridients:  item.Ingridients,
+			Ratings:      item.Ratings,
+			RatingsCount: item.RatingsCount,
+			TrackStock:   item.TrackStock,
+			Stock:        item.Stock,
+			CreatedAt:    item.CreatedAt,
+			UpdatedAt:    item.UpdatedAt,
 		}
 		result = append(result, product)
 	}
 
-	productRes = resp{Status: "success", Results: int32(len(result)), Data: result}
+	var nextCursor string
+	if next := query.offset + int64(len(result)); next < total {
+		nextCursor = internal.EncodeOffsetCursor(next)
+	}
+
+	var data interface{} = result
+	if query.fields != nil {
+		data, err = selectProductFields(result, query.fields)
+		if err != nil {
+			return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+		}
+	}
+
+	productRes := resp{
+		Status:     "success",
+		Results:    int32(len(result)),
+		Total:      total,
+		Page:       query.page(),
+		Limit:      query.limit,
+		NextCursor: nextCursor,
+		Data:       data,
+	}
 	return internal.ResponseHandler(w, productRes, http.StatusOK)
 }
 
+// SearchProductsHandler serves GET /products/search?q=. Queries are matched
+// against the products text index and ranked by relevance; when that finds
+// nothing, or with ?autocomplete=true, it falls back to a case-insensitive
+// prefix match on product names and ingridients.
+func (s *Server) SearchProductsHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	collection := s.Store.Collection(ctx, "coffeeshop", "products")
+
+	queries := r.URL.Query()
+	term := strings.TrimSpace(queries.Get("q"))
+	if term == "" {
+		err := errors.New("search term q is required")
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+	}
+
+	limit, err := internal.ParseLimit(queries)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+	}
+
+	type scoredItem struct {
+		store.Item `bson:",inline"`
+		Score      float64 `bson:"score"`
+	}
+
+	var items []scoredItem
+	mode := "text"
+	if queries.Get("autocomplete") != "true" {
+		filter := bson.D{{Key: "$text", Value: bson.D{{Key: "$search", Value: term}}}}
+		score := bson.D{{Key: "score", Value: bson.D{{Key: "$meta", Value: "textScore"}}}}
+		opts := options.Find().
+			SetProjection(score).
+			SetSort(score).
+			SetLimit(limit)
+
+		cur, err := collection.Find(ctx, filter, opts)
+		if err != nil {
+			return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+		}
+
+		if err := cur.All(ctx, &items); err != nil {
+			return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+		}
+	}
+
+	if len(items) == 0 {
+		mode = "prefix"
+		prefix := primitive.Regex{Pattern: `\b` + regexp.QuoteMeta(term), Options: "i"}
+		filter := bson.D{{Key: "$or", Value: bson.A{
+			bson.D{{Key: "name", Value: prefix}},
+			bson.D{{Key: "ingridients", Value: prefix}},
+		}}}
+		opts := options.Find().
+			SetSort(bson.D{{Key: "name", Value: 1}}).
+			SetLimit(limit)
+
+		cur, err := collection.Find(ctx, filter, opts)
+		if err != nil {
+			return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+		}
+
+		if err := cur.All(ctx, &items); err != nil {
+			return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+		}
+	}
+
+	products := types.ItemResponseListParams{}
+	for _, item := range items {
+		products = append(products, types.ItemResParams{
+			Id:           item.Id.Hex(),
+			Images:       item.Images,
+			Name:         item.Name,
+			Author:       item.Author,
+			Price:        item.Price,
+			Discount:     item.Discount,
+			Summary:      item.Summary,
+			Category:     item.Category,
+			Thumbnail:    item.Thumbnail,
+			Description:  item.Description,
+			Ingridients:  item.Ingridients,
+			Ratings:      item.Ratings,
+			RatingsCount: item.RatingsCount,
+			TrackStock:   item.TrackStock,
+			Stock:        item.Stock,
+			Score:        item.Score,
+			CreatedAt:    item.CreatedAt,
+			UpdatedAt:    item.UpdatedAt,
+		})
+	}
+
+	result := struct {
+		Status  string                       `json:"status"`
+		Results int32                        `json:"results"`
+		Mode    string                       `json:"mode"`
+		Data    types.ItemResponseListParams `json:"data"`
+	}{
+		Status:  "success",
+		Results: int32(len(products)),
+		Mode:    mode,
+		Data:    products,
+	}
+	return internal.ResponseHandler(w, result, http.StatusOK)
+}
+
 func (s *Server) GetProductByIdHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	collection := s.Store.Collection(ctx, "coffeeshop", "products")
 
@@ -309,20 +509,23 @@ func (s *Server) GetProductByIdHandler(ctx context.Context, w http.ResponseWrite
 	}
 
 	product := types.ItemResParams{
-		Id:          item.Id.Hex(),
-		Images:      item.Images,
-		Name:        item.Name,
-		Author:      item.Author,
-		Price:       item.Price,
-		Discount:    item.Discount,
-		Summary:     item.Summary,
-		Category:    item.Category,
-		Thumbnail:   item.Thumbnail,
-		Description: item.Description,
-		Ingridients: item.Ingridients,
-		Ratings:     item.Ratings,
-		CreatedAt:   item.CreatedAt,
-		UpdatedAt:   item.UpdatedAt,
+		Id:           item.Id.Hex(),
+		Images:       item.Images,
+		Name:         item.Name,
+		Author:       item.Author,
+		Price:        item.Price,
+		Discount:     item.Discount,
+		Summary:      item.Summary,
+		Category:     item.Category,
+		Thumbnail:    item.Thumbnail,
+		Description:  item.Description,
+		Ingridients:  item.Ingridients,
+		Ratings:      item.Ratings,
+		RatingsCount: item.RatingsCount,
+		TrackStock:   item.TrackStock,
+		Stock:        item.Stock,
+		CreatedAt:    item.CreatedAt,
+		UpdatedAt:    item.UpdatedAt,
 	}
 
 	res := struct {
@@ -391,6 +594,11 @@ func (s *Server) DeleteProductByIdHandler(ctx context.Context, w http.ResponseWr
 			return err, nil
 		}
 
+		err = s.writeAudit(ctx, r, types.AUDIT_PRODUCT_DELETE, "product", id.Hex(), product, nil)
+		if err != nil {
+			return nil, err
+		}
+
 		err = session.CommitTransaction(ctx)
 		if err != nil {
 			return nil, err
@@ -491,6 +699,29 @@ func (s *Server) CreateProductHandler(ctx context.Context, w http.ResponseWriter
 				ingridients := strings.Split(string(data), ",")
 				item.Ingridients = ingridients
 
+			case "stock":
+				data, err := io.ReadAll(curr)
+				if err != nil {
+					return nil, err
+				}
+				stock, err := strconv.ParseInt(string(data), 10, 64)
+				if err != nil || stock < 0 {
+					return nil, fmt.Errorf("%w: stock %q", errInvalidProductField, string(data))
+				}
+				item.Stock = stock
+				item.TrackStock = true
+
+			case "recipe":
+				data, err := io.ReadAll(curr)
+				if err != nil {
+					return nil, err
+				}
+				recipe, err := parseRecipe(data, s.vd)
+				if err != nil {
+					return nil, fmt.Errorf("%w: recipe %v", errInvalidProductField, err)
+				}
+				item.Recipe = recipe
+
 			case "name":
 				data, err := io.ReadAll(curr)
 				if err != nil {
@@ -592,10 +823,17 @@ func (s *Server) CreateProductHandler(ctx context.Context, w http.ResponseWriter
 			Summary:     item.Summary,
 			Category:    item.Category,
 			Description: item.Description,
+			TrackStock:  item.TrackStock,
+			Stock:       item.Stock,
 			CreatedAt:   item.CreatedAt,
 			UpdatedAt:   item.UpdatedAt,
 		}
 
+		err = s.writeAudit(ctx, r, types.AUDIT_PRODUCT_CREATE, "product", item.Id.Hex(), nil, item)
+		if err != nil {
+			return nil, err
+		}
+
 		err = session.CommitTransaction(ctx)
 		if err != nil {
 			return nil, err
@@ -612,6 +850,9 @@ func (s *Server) CreateProductHandler(ctx context.Context, w http.ResponseWriter
 				return internal.ResponseHandler(w, internal.NewErrorResponse("failed", fmt.Errorf("document already exists %w", err).Error()), http.StatusBadRequest)
 			}
 
+		case errors.Is(err, errInvalidProductField):
+			return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+
 		case errors.Is(err, &json.SyntaxError{}):
 			return internal.ResponseHandler(w, internal.NewErrorResponse("failed", fmt.Errorf("invalid data input for operation %w", err).Error()), http.StatusBadRequest)
 
@@ -666,4 +907,178 @@ func (s *Server) BatchGetAllProductsByIds(ctx context.Context, data []primitive.
 	return
 }
 
+// ensureProductSearchIndex creates the weighted text index that
+// SearchProductsHandler queries. It runs once at start up.
+func ensureProductSearchIndex(ctx context.Context, str store.Mongo) error {
+	collection := str.Collection(ctx, "coffeeshop", "products")
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "name", Value: "text"},
+			{Key: "summary", Value: "text"},
+			{Key: "description", Value: "text"},
+			{Key: "ingridients", Value: "text"},
+		},
+		Options: options.Index().
+			SetName("products_text_search").
+			SetWeights(bson.D{
+				{Key: "name", Value: 10},
+				{Key: "ingridients", Value: 5},
+				{Key: "summary", Value: 3},
+				{Key: "description", Value: 1},
+			}),
+	})
+	return err
+}
+
+// productFields maps the public (json) product field names accepted by
+// ?sort= and ?fields= to their bson names.
+var productFields = map[string]string{
+	"_id":           "_id",
+	"images":        "images",
+	"name":          "name",
+	"author":        "author",
+	"price":         "price",
+	"discount":      "discount",
+	"summary":       "summary",
+	"category":      "category",
+	"thumbnail":     "thumbnail",
+	"description":   "description",
+	"ingridients":   "ingridients",
+	"ratings":       "ratings",
+	"ratings_count": "ratings_count",
+	"track_stock":   "track_stock",
+	"stock":         "stock",
+	"created_at":    "created_at",
+	"updated_at":    "updated_at",
+}
+
+var sortableProductFields = map[string]bool{
+	"name":          true,
+	"price":         true,
+	"discount":      true,
+	"ratings":       true,
+	"ratings_count": true,
+	"created_at":    true,
+	"updated_at":    true,
+}
+
+type productListQuery struct {
+	filter     bson.D
+	sort       bson.D
+	projection bson.D
+	fields     []string
+	offset     int64
+	limit      int64
+}
+
+func (q productListQuery) page() int64 {
+	return q.offset/q.limit + 1
+}
+
+// parseProductListQuery turns the query string of GET /products into a
+// mongo filter, sort, projection and page window. Supported parameters are
+// ?page=&limit= or ?cursor=, ?sort=price,-ratings, ?category=,
+// ?minPrice=&maxPrice= and ?fields=name,price.
+func parseProductListQuery(queries url.Values) (query productListQuery, err error) {
+	query.limit, err = internal.ParseLimit(queries)
+	if err != nil {
+		return
+	}
+
+	switch {
+	case queries.Get("cursor") != "":
+		query.offset, err = internal.DecodeOffsetCursor(queries.Get("cursor"))
+		if err != nil {
+			return
+		}
+	case queries.Get("page") != "":
+		page, perr := strconv.ParseInt(queries.Get("page"), 10, 64)
+		if perr != nil || page < 1 {
+			err = fmt.Errorf("invalid page %q", queries.Get("page"))
+			return
+		}
+		query.offset = (page - 1) * query.limit
+	}
+
+	query.filter = bson.D{}
+	if categories := internal.SplitQueryList(queries.Get("category")); len(categories) > 0 {
+		query.filter = append(query.filter, bson.E{Key: "category", Value: bson.D{{Key: "$in", Value: categories}}})
+	}
+
+	price := bson.D{}
+	for param, operator := range map[string]string{"minPrice": "$gte", "maxPrice": "$lte"} {
+		value := queries.Get(param)
+		if value == "" {
+			continue
+		}
+
+		amount, perr := strconv.ParseFloat(value, 64)
+		if perr != nil || amount < 0 {
+			err = fmt.Errorf("invalid %s %q", param, value)
+			return
+		}
+		price = append(price, bson.E{Key: operator, Value: amount})
+	}
+	if len(price) > 0 {
+		query.filter = append(query.filter, bson.E{Key: "price", Value: price})
+	}
+
+	query.sort = bson.D{}
+	for _, field := range internal.SplitQueryList(queries.Get("sort")) {
+		order := 1
+		if strings.HasPrefix(field, "-") {
+			order = -1
+			field = field[1:]
+		}
+
+		if !sortableProductFields[field] {
+			err = fmt.Errorf("cannot sort products by %q", field)
+			return
+		}
+		query.sort = append(query.sort, bson.E{Key: productFields[field], Value: order})
+	}
+	// always break ties on _id so page boundaries are deterministic
+	query.sort = append(query.sort, bson.E{Key: "_id", Value: 1})
+
+	if fields := internal.SplitQueryList(queries.Get("fields")); len(fields) > 0 {
+		query.projection = bson.D{{Key: "_id", Value: 1}}
+		query.fields = []string{"_id"}
+		for _, field := range fields {
+			name, ok := productFields[field]
+			if !ok {
+				err = fmt.Errorf("unknown product field %q", field)
+				return
+			}
+			if name == "_id" {
+				continue
+			}
+			query.projection = append(query.projection, bson.E{Key: name, Value: 1})
+			query.fields = append(query.fields, field)
+		}
+	}
+	return
+}
+
+// selectProductFields trims every product down to the requested json fields
+// so a ?fields= projection also shrinks the response body.
+func selectProductFields(products types.ItemResponseListParams, fields []string) ([]map[string]interface{}, error) {
+	selected := make([]map[string]interface{}, 0, len(products))
+	for _, product := range products {
+		data, err := json.Marshal(product)
+		if err != nil {
+			return nil, err
+		}
+
+		var all map[string]interface{}
+		if err := json.Unmarshal(data, &all); err != nil {
+			return nil, err
+		}
 
+		trimmed := make(map[string]interface{}, len(fields))
+		for _, field := range fields {
+			trimmed[field] = all[field]
+		}
+		selected = append(selected, trimmed)
+	}
+	return selected, nil
+}
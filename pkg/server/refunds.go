@@ -0,0 +1,365 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/hibiken/asynq"
+	"github.com/silaselisha/coffee-api/internal"
+	"github.com/silaselisha/coffee-api/pkg/payments"
+	"github.com/silaselisha/coffee-api/pkg/store"
+	"github.com/silaselisha/coffee-api/types"
+	"github.com/silaselisha/coffee-api/workers"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	errInvalidRefund    = errors.New("invalid refund")
+	errConcurrentRefund = errors.New("order was refunded concurrently, retry")
+	errRefundDeclined   = errors.New("payment provider declined the refund")
+)
+
+// CreateRefundHandler gives money back on a paid order, either for every
+// line still held by the customer or for the listed product quantities. The
+// order's items and totals are reduced to what the customer keeps, so a
+// later cancellation or refund only considers the remainder.
+func (s *Server) CreateRefundHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ordColl := s.Store.Collection(ctx, "coffeeshop", "orders")
+	payColl := s.Store.Collection(ctx, "coffeeshop", "payments")
+	userInfo := ctx.Value(types.AuthUserInfoKey{}).(*types.UserInfo)
+
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+	}
+
+	payload, err := internal.ReadReqBody[types.RefundParams](r.Body, s.vd)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+	}
+
+	var order store.Order
+	err = ordColl.FindOne(ctx, bson.D{{Key: "_id", Value: id}}).Decode(&order)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return internal.ResponseHandler(w, internal.NewErrorResponse("failed", fmt.Errorf("document not found %w", err).Error()), http.StatusNotFound)
+		}
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+
+	if order.PaymentStatus != types.PAID && order.PaymentStatus != types.PARTIALLY_REFUNDED {
+		err := fmt.Errorf("an order whose payment is %s cannot be refunded", order.PaymentStatus)
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusConflict)
+	}
+
+	var payment store.Payment
+	err = payColl.FindOne(ctx, bson.D{{Key: "_id", Value: order.Payment}}).Decode(&payment)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+
+	provider, err := s.payments.Get(payment.Provider)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+
+	refundItems, remaining, err := splitRefund(order.Items, payload.Items)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+	}
+
+	refund := store.Refund{
+		Id:        primitive.NewObjectID(),
+		Order:     order.Id,
+		Payment:   payment.Id,
+		Items:     refundItems,
+		Currency:  payment.Currency,
+		Reason:    payload.Reason,
+		Restocked: order.StockReserved && (payload.Restock == nil || *payload.Restock),
+		CreatedBy: userInfo.Id,
+		CreatedAt: time.Now(),
+	}
+
+	// Lines of the same product were reserved together, from one snapshot.
+	reserved := make(map[primitive.ObjectID]*store.StockReservation)
+	for _, item := range order.Items {
+		reserved[item.Product] = item.Reserved
+	}
+
+	var restock []store.OrderItem
+	for _, item := range refundItems {
+		refund.Amount += item.Amount - item.Discount
+		restock = append(restock, store.OrderItem{Product: item.Product, Quantity: item.Quantity, Reserved: reserved[item.Product]})
+	}
+	refund.Amount = math.Round(refund.Amount*100) / 100
+
+	var totalAmount, totalDiscount float64
+	var held uint32
+	for _, item := range remaining {
+		totalAmount += item.Amount - item.Discount
+		totalDiscount += item.Discount
+		held += item.Quantity
+	}
+
+	paymentStatus := types.PARTIALLY_REFUNDED
+	if held == 0 {
+		paymentStatus = types.REFUNDED
+	}
+
+	// The refund is first recorded as pending and the order claimed for it,
+	// then the provider pays, and only then is the order reduced. A crash in
+	// between leaves a pending refund to reconcile rather than money paid
+	// out without a trace; the refund id keeps a retried provider call from
+	// paying twice.
+	refund.Status = types.REFUND_PENDING
+	if err := s.startRefund(ctx, order, refund); err != nil {
+		if errors.Is(err, errConcurrentRefund) {
+			return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusConflict)
+		}
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+
+	paid, err := provider.Refund(ctx, payment.Reference, payments.RefundIntent{
+		Id:     refund.Id.Hex(),
+		Amount: refund.Amount,
+	})
+	if err != nil {
+		if failErr := s.failRefund(ctx, refund, err); failErr != nil {
+			log.Printf("failed to record the failure of refund %s %v\n", refund.Id.Hex(), failErr)
+		}
+		err := fmt.Errorf("%w: %w", errRefundDeclined, err)
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadGateway)
+	}
+	refund.Reference = paid.Reference
+	settledAt := time.Now()
+
+	session, err := s.Store.TxnStartSession(ctx)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+	defer session.EndSession(ctx)
+
+	response, err := session.WithTransaction(ctx, func(ctx mongo.SessionContext) (interface{}, error) {
+		ordColl := s.Store.Collection(ctx, "coffeeshop", "orders")
+		refColl := s.Store.Collection(ctx, "coffeeshop", "refunds")
+
+		filter := bson.D{{Key: "_id", Value: order.Id}, {Key: "refund_pending", Value: refund.Id}}
+		update := bson.D{
+			{Key: "$set", Value: bson.D{
+				{Key: "items", Value: remaining},
+				{Key: "total_amount", Value: totalAmount},
+				{Key: "total_discount", Value: totalDiscount},
+				{Key: "payment_status", Value: paymentStatus},
+				{Key: "updated_at", Value: time.Now()},
+			}},
+			{Key: "$inc", Value: bson.D{{Key: "refunded_total", Value: refund.Amount}}},
+			{Key: "$unset", Value: bson.D{{Key: "refund_pending", Value: ""}}},
+		}
+
+		newDocs := options.After
+		var updated store.Order
+		err := ordColl.FindOneAndUpdate(ctx, filter, update, &options.FindOneAndUpdateOptions{
+			ReturnDocument: &newDocs,
+		}).Decode(&updated)
+		if err != nil {
+			return nil, err
+		}
+
+		if refund.Restocked {
+			if err := s.restockOrderItems(ctx, restock); err != nil {
+				return nil, err
+			}
+		}
+
+		settle := bson.D{{Key: "$set", Value: bson.D{
+			{Key: "status", Value: types.REFUND_SETTLED},
+			{Key: "reference", Value: refund.Reference},
+			{Key: "settled_at", Value: settledAt},
+		}}}
+		if _, err := refColl.UpdateOne(ctx, bson.D{{Key: "_id", Value: refund.Id}}, settle); err != nil {
+			return nil, err
+		}
+
+		err = s.writeAudit(ctx, r, types.AUDIT_REFUND_CREATE, "order", order.Id.Hex(), order, updated)
+		if err != nil {
+			return nil, err
+		}
+		return updated, nil
+	}, &options.TransactionOptions{})
+
+	if err != nil {
+		// The customer has their money; the pending refund tells staff which
+		// order still needs reducing.
+		log.Printf("refund %s was paid but could not be settled %v\n", refund.Id.Hex(), err)
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+	refund.Status = types.REFUND_SETTLED
+	refund.SettledAt = &settledAt
+
+	s.sendRefundMail(ctx, order.Owner, refund)
+
+	result := struct {
+		Status string `json:"status"`
+		Data   struct {
+			Refund store.Refund `json:"refund"`
+			Order  store.Order  `json:"order"`
+		} `json:"data"`
+	}{
+		Status: "success",
+	}
+	result.Data.Refund = refund
+	result.Data.Order = response.(store.Order)
+	return internal.ResponseHandler(w, result, http.StatusCreated)
+}
+
+// startRefund records refund as pending and claims the order for it.
+// Matching on the refunded total and payment status read before turns a
+// concurrent refund of the same order into a conflict.
+func (s *Server) startRefund(ctx context.Context, order store.Order, refund store.Refund) error {
+	session, err := s.Store.TxnStartSession(ctx)
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(ctx mongo.SessionContext) (interface{}, error) {
+		ordColl := s.Store.Collection(ctx, "coffeeshop", "orders")
+		refColl := s.Store.Collection(ctx, "coffeeshop", "refunds")
+
+		filter := bson.D{
+			{Key: "_id", Value: order.Id},
+			{Key: "payment_status", Value: order.PaymentStatus},
+			{Key: "refunded_total", Value: order.RefundedTotal},
+			{Key: "refund_pending", Value: bson.D{{Key: "$exists", Value: false}}},
+		}
+		update := bson.D{{Key: "$set", Value: bson.D{{Key: "refund_pending", Value: refund.Id}}}}
+		result, err := ordColl.UpdateOne(ctx, filter, update)
+		if err != nil {
+			return nil, err
+		}
+		if result.MatchedCount == 0 {
+			return nil, errConcurrentRefund
+		}
+
+		_, err = refColl.InsertOne(ctx, refund)
+		return nil, err
+	}, &options.TransactionOptions{})
+	return err
+}
+
+// failRefund records that the provider did not pay and releases the order,
+// which was not changed.
+func (s *Server) failRefund(ctx context.Context, refund store.Refund, cause error) error {
+	session, err := s.Store.TxnStartSession(ctx)
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(ctx mongo.SessionContext) (interface{}, error) {
+		ordColl := s.Store.Collection(ctx, "coffeeshop", "orders")
+		refColl := s.Store.Collection(ctx, "coffeeshop", "refunds")
+
+		update := bson.D{{Key: "$set", Value: bson.D{
+			{Key: "status", Value: types.REFUND_FAILED},
+			{Key: "failure", Value: cause.Error()},
+		}}}
+		if _, err := refColl.UpdateOne(ctx, bson.D{{Key: "_id", Value: refund.Id}}, update); err != nil {
+			return nil, err
+		}
+
+		filter := bson.D{{Key: "_id", Value: refund.Order}, {Key: "refund_pending", Value: refund.Id}}
+		_, err := ordColl.UpdateOne(ctx, filter, bson.D{{Key: "$unset", Value: bson.D{{Key: "refund_pending", Value: ""}}}})
+		return nil, err
+	}, &options.TransactionOptions{})
+	return err
+}
+
+// splitRefund takes the requested quantities off the order lines, pricing
+// refunded units at their line's unit amount and discount. An empty request
+// refunds every unit still held.
+func splitRefund(items []store.OrderItem, requested []types.RefundItemParams) ([]store.RefundItem, []store.OrderItem, error) {
+	wanted := make(map[primitive.ObjectID]uint32)
+	var order []primitive.ObjectID
+	for _, param := range requested {
+		product, err := primitive.ObjectIDFromHex(param.Product)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: invalid product id %s", errInvalidRefund, param.Product)
+		}
+		if _, ok := wanted[product]; !ok {
+			order = append(order, product)
+		}
+		wanted[product] += param.Quantity
+	}
+
+	remaining := make([]store.OrderItem, len(items))
+	copy(remaining, items)
+
+	var refunded []store.RefundItem
+	for i, item := range remaining {
+		quantity := item.Quantity
+		if len(requested) > 0 {
+			quantity = min(wanted[item.Product], item.Quantity)
+			wanted[item.Product] -= quantity
+		}
+		if quantity == 0 {
+			continue
+		}
+
+		share := float64(quantity) / float64(item.Quantity)
+		refundItem := store.RefundItem{
+			Product:  item.Product,
+			Quantity: quantity,
+			Amount:   item.Amount * share,
+			Discount: item.Discount * share,
+		}
+		refunded = append(refunded, refundItem)
+
+		remaining[i].Quantity -= quantity
+		remaining[i].Amount -= refundItem.Amount
+		remaining[i].Discount -= refundItem.Discount
+		remaining[i].Refunded += quantity
+	}
+
+	for _, product := range order {
+		if wanted[product] > 0 {
+			return nil, nil, fmt.Errorf("%w: %d more unit(s) of product %s requested than remain on the order", errInvalidRefund, wanted[product], product.Hex())
+		}
+	}
+
+	if len(refunded) == 0 {
+		return nil, nil, fmt.Errorf("%w: nothing left to refund", errInvalidRefund)
+	}
+	return refunded, remaining, nil
+}
+
+// sendRefundMail tells the customer about a refund. The money has already
+// been returned, so failures are only logged.
+func (s *Server) sendRefundMail(ctx context.Context, owner primitive.ObjectID, refund store.Refund) {
+	var customer store.User
+	users := s.Store.Collection(ctx, "coffeeshop", "users")
+	if err := users.FindOne(ctx, bson.D{{Key: "_id", Value: owner}}).Decode(&customer); err != nil {
+		log.Printf("failed to look up customer for refund %s %v\n", refund.Id.Hex(), err)
+		return
+	}
+
+	opts := []asynq.Option{
+		asynq.MaxRetry(5),
+		asynq.ProcessIn(3 * time.Second),
+		asynq.Queue(workers.CriticalQueue),
+	}
+
+	payload := &types.PayloadRefundMail{Email: customer.Email, Refund: refund.Id.Hex()}
+	if err := s.taskDistributor.RefundMailTask(ctx, payload, opts...); err != nil {
+		log.Printf("failed to enqueue refund mail for %s %v\n", refund.Id.Hex(), err)
+	}
+}
@@ -0,0 +1,861 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/hibiken/asynq"
+	"github.com/silaselisha/coffee-api/internal"
+	"github.com/silaselisha/coffee-api/pkg/store"
+	"github.com/silaselisha/coffee-api/types"
+	"github.com/silaselisha/coffee-api/workers"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Reservations can be made between opening and closing time (UTC) on the
+// day they start, and availability is offered in fixed slots.
+const (
+	reservationOpensAt         = 7 * time.Hour
+	reservationClosesAt        = 21 * time.Hour
+	reservationSlotInterval    = 30 * time.Minute
+	defaultReservationDuration = 90 * time.Minute
+	maxReservationDuration     = 4 * time.Hour
+)
+
+var (
+	errInvalidReservationTime = errors.New("invalid reservation time")
+	errTableUnavailable       = errors.New("table not found, inactive or too small for the party")
+	errReservationConflict    = errors.New("no table is free for the requested time")
+	errTableBooked            = errors.New("table is still booked")
+)
+
+func (s *Server) GetAllTablesHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	tblColl := s.Store.Collection(ctx, "coffeeshop", "tables")
+
+	cur, err := tblColl.Find(ctx, bson.D{}, options.Find().SetSort(bson.D{{Key: "number", Value: 1}}))
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+	defer cur.Close(ctx)
+
+	tables := []store.CoffeeDateTable{}
+	if err := cur.All(ctx, &tables); err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+
+	result := struct {
+		Status  string                  `json:"status"`
+		Results int32                   `json:"results"`
+		Data    []store.CoffeeDateTable `json:"data"`
+	}{
+		Status:  "success",
+		Results: int32(len(tables)),
+		Data:    tables,
+	}
+	return internal.ResponseHandler(w, result, http.StatusOK)
+}
+
+func (s *Server) CreateTableHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	tblColl := s.Store.Collection(ctx, "coffeeshop", "tables")
+
+	payload, err := internal.ReadReqBody[types.TableParams](r.Body, s.vd)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+	}
+
+	_, err = tblColl.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "number", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+
+	table := store.CoffeeDateTable{
+		Id:        primitive.NewObjectID(),
+		Number:    payload.Number,
+		Capacity:  payload.Capacity,
+		Location:  payload.Location,
+		Active:    true,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+
+	session, err := s.Store.TxnStartSession(ctx)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(ctx mongo.SessionContext) (interface{}, error) {
+		tblColl := s.Store.Collection(ctx, "coffeeshop", "tables")
+		if _, err := tblColl.InsertOne(ctx, table); err != nil {
+			return nil, err
+		}
+		return nil, s.writeAudit(ctx, r, types.AUDIT_TABLE_CREATE, "table", table.Id.Hex(), nil, table)
+	}, &options.TransactionOptions{})
+
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return internal.ResponseHandler(w, internal.NewErrorResponse("failed", fmt.Errorf("document already exists %w", err).Error()), http.StatusBadRequest)
+		}
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+
+	result := struct {
+		Status string                `json:"status"`
+		Data   store.CoffeeDateTable `json:"data"`
+	}{
+		Status: "success",
+		Data:   table,
+	}
+	return internal.ResponseHandler(w, result, http.StatusCreated)
+}
+
+func (s *Server) UpdateTableHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+	}
+
+	payload, err := internal.ReadReqBody[types.TableUpdateParams](r.Body, s.vd)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+	}
+
+	set := bson.D{{Key: "updated_at", Value: time.Now()}}
+	if payload.Capacity != 0 {
+		set = append(set, bson.E{Key: "capacity", Value: payload.Capacity})
+	}
+	if payload.Location != nil {
+		set = append(set, bson.E{Key: "location", Value: *payload.Location})
+	}
+	if payload.Active != nil {
+		set = append(set, bson.E{Key: "active", Value: *payload.Active})
+	}
+
+	session, err := s.Store.TxnStartSession(ctx)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+	defer session.EndSession(ctx)
+
+	response, err := session.WithTransaction(ctx, func(ctx mongo.SessionContext) (interface{}, error) {
+		tblColl := s.Store.Collection(ctx, "coffeeshop", "tables")
+
+		oldDocs := options.Before
+		var previous store.CoffeeDateTable
+		err := tblColl.FindOneAndUpdate(ctx, bson.D{{Key: "_id", Value: id}}, bson.D{{Key: "$set", Value: set}}, &options.FindOneAndUpdateOptions{
+			ReturnDocument: &oldDocs,
+		}).Decode(&previous)
+		if err != nil {
+			return nil, err
+		}
+
+		var table store.CoffeeDateTable
+		if err := tblColl.FindOne(ctx, bson.D{{Key: "_id", Value: id}}).Decode(&table); err != nil {
+			return nil, err
+		}
+
+		err = s.writeAudit(ctx, r, types.AUDIT_TABLE_UPDATE, "table", id.Hex(), previous, table)
+		if err != nil {
+			return nil, err
+		}
+		return table, nil
+	}, &options.TransactionOptions{})
+
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return internal.ResponseHandler(w, internal.NewErrorResponse("failed", fmt.Errorf("document not found %w", err).Error()), http.StatusNotFound)
+		}
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+
+	result := struct {
+		Status string                `json:"status"`
+		Data   store.CoffeeDateTable `json:"data"`
+	}{
+		Status: "success",
+		Data:   response.(store.CoffeeDateTable),
+	}
+	return internal.ResponseHandler(w, result, http.StatusOK)
+}
+
+// DeleteTableHandler refuses to remove a table that still has upcoming
+// confirmed reservations; deactivate it instead and move the bookings first.
+// The table's last_booked_at is touched before counting them, so a booking
+// made at the same time write-conflicts with the deletion, as in bookTable.
+func (s *Server) DeleteTableHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+	}
+
+	session, err := s.Store.TxnStartSession(ctx)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(ctx mongo.SessionContext) (interface{}, error) {
+		tblColl := s.Store.Collection(ctx, "coffeeshop", "tables")
+		resColl := s.Store.Collection(ctx, "coffeeshop", "reservations")
+
+		update := bson.D{{Key: "$set", Value: bson.D{{Key: "last_booked_at", Value: time.Now()}}}}
+		res, err := tblColl.UpdateOne(ctx, bson.D{{Key: "_id", Value: id}}, update)
+		if err != nil {
+			return nil, err
+		}
+		if res.MatchedCount == 0 {
+			return nil, mongo.ErrNoDocuments
+		}
+
+		upcoming, err := resColl.CountDocuments(ctx, bson.D{
+			{Key: "table", Value: id},
+			{Key: "status", Value: types.RESERVATION_CONFIRMED},
+			{Key: "ends_at", Value: bson.D{{Key: "$gt", Value: time.Now()}}},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if upcoming > 0 {
+			return nil, fmt.Errorf("%w: table has %d upcoming reservation(s)", errTableBooked, upcoming)
+		}
+
+		var table store.CoffeeDateTable
+		if err := tblColl.FindOneAndDelete(ctx, bson.D{{Key: "_id", Value: id}}).Decode(&table); err != nil {
+			return nil, err
+		}
+		return nil, s.writeAudit(ctx, r, types.AUDIT_TABLE_DELETE, "table", id.Hex(), table, nil)
+	}, &options.TransactionOptions{})
+
+	if err != nil {
+		switch {
+		case errors.Is(err, errTableBooked):
+			return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusConflict)
+		case errors.Is(err, mongo.ErrNoDocuments):
+			return internal.ResponseHandler(w, internal.NewErrorResponse("failed", fmt.Errorf("document not found %w", err).Error()), http.StatusNotFound)
+		default:
+			return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+		}
+	}
+	return internal.ResponseHandler(w, "", http.StatusNoContent)
+}
+
+// GetReservationAvailabilityHandler lists the slots on ?date= (YYYY-MM-DD)
+// in which at least one table seats ?guests= for ?duration= minutes, along
+// with the tables that are free for each slot.
+func (s *Server) GetReservationAvailabilityHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	query := r.URL.Query()
+
+	day, err := time.ParseInLocation(time.DateOnly, query.Get("date"), time.UTC)
+	if err != nil {
+		err := fmt.Errorf("%w: date must be formatted as YYYY-MM-DD", errInvalidReservationTime)
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+	}
+
+	guests, err := strconv.ParseUint(query.Get("guests"), 10, 32)
+	if err != nil || guests == 0 {
+		err := errors.New("guests must be a positive number")
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+	}
+
+	duration := defaultReservationDuration
+	if value := query.Get("duration"); value != "" {
+		minutes, err := strconv.Atoi(value)
+		if err != nil || minutes <= 0 || time.Duration(minutes)*time.Minute > maxReservationDuration {
+			err := fmt.Errorf("duration must be between 1 and %d minutes", int(maxReservationDuration.Minutes()))
+			return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+		}
+		duration = time.Duration(minutes) * time.Minute
+	}
+
+	tables, err := s.findTables(ctx, bson.D{
+		{Key: "active", Value: true},
+		{Key: "capacity", Value: bson.D{{Key: "$gte", Value: guests}}},
+	})
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+
+	opens, closes := day.Add(reservationOpensAt), day.Add(reservationClosesAt)
+	reservations, err := s.findReservations(ctx, bson.D{
+		{Key: "status", Value: types.RESERVATION_CONFIRMED},
+		{Key: "starts_at", Value: bson.D{{Key: "$lt", Value: closes}}},
+		{Key: "ends_at", Value: bson.D{{Key: "$gt", Value: opens}}},
+	})
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+
+	booked := make(map[primitive.ObjectID][]store.Reservation)
+	for _, reservation := range reservations {
+		booked[reservation.Table] = append(booked[reservation.Table], reservation)
+	}
+
+	slots := []types.ReservationSlotParams{}
+	for start := opens; !start.Add(duration).After(closes); start = start.Add(reservationSlotInterval) {
+		if start.Before(time.Now()) {
+			continue
+		}
+
+		end := start.Add(duration)
+		slot := types.ReservationSlotParams{StartsAt: start, EndsAt: end, Tables: []primitive.ObjectID{}}
+		for _, table := range tables {
+			free := true
+			for _, reservation := range booked[table.Id] {
+				if reservation.StartsAt.Before(end) && reservation.EndsAt.After(start) {
+					free = false
+					break
+				}
+			}
+			if free {
+				slot.Tables = append(slot.Tables, table.Id)
+			}
+		}
+
+		if len(slot.Tables) > 0 {
+			slots = append(slots, slot)
+		}
+	}
+
+	result := struct {
+		Status  string                        `json:"status"`
+		Results int32                         `json:"results"`
+		Data    []types.ReservationSlotParams `json:"data"`
+	}{
+		Status:  "success",
+		Results: int32(len(slots)),
+		Data:    slots,
+	}
+	return internal.ResponseHandler(w, result, http.StatusOK)
+}
+
+func (s *Server) CreateReservationHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	resColl := s.Store.Collection(ctx, "coffeeshop", "reservations")
+	userInfo := ctx.Value(types.AuthUserInfoKey{}).(*types.UserInfo)
+
+	payload, err := internal.ReadReqBody[types.ReservationParams](r.Body, s.vd)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+	}
+
+	var table primitive.ObjectID
+	if payload.Table != "" {
+		table, err = primitive.ObjectIDFromHex(payload.Table)
+		if err != nil {
+			return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+		}
+	}
+
+	reservation := store.Reservation{
+		Id:        primitive.NewObjectID(),
+		Owner:     userInfo.Id,
+		Guests:    payload.Guests,
+		StartsAt:  payload.StartsAt.UTC(),
+		EndsAt:    payload.EndsAt.UTC(),
+		Status:    types.RESERVATION_CONFIRMED,
+		Note:      payload.Note,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+
+	if err := validateReservationTime(reservation.StartsAt, reservation.EndsAt); err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+	}
+
+	_, err = resColl.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "table", Value: 1}, {Key: "starts_at", Value: 1}},
+	})
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+
+	session, err := s.Store.TxnStartSession(ctx)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(ctx mongo.SessionContext) (interface{}, error) {
+		if err := s.bookTable(ctx, &reservation, table); err != nil {
+			return nil, err
+		}
+
+		resColl := s.Store.Collection(ctx, "coffeeshop", "reservations")
+		return resColl.InsertOne(ctx, reservation)
+	}, &options.TransactionOptions{})
+
+	if err != nil {
+		return reservationErrorResponse(w, err)
+	}
+
+	s.sendReservationMail(ctx, reservation)
+
+	result := struct {
+		Status string            `json:"status"`
+		Data   store.Reservation `json:"data"`
+	}{
+		Status: "success",
+		Data:   reservation,
+	}
+	return internal.ResponseHandler(w, result, http.StatusCreated)
+}
+
+// GetReservationsHandler lists the caller's own reservations, latest first,
+// optionally narrowed down with ?status=.
+func (s *Server) GetReservationsHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	userInfo := ctx.Value(types.AuthUserInfoKey{}).(*types.UserInfo)
+
+	filter := bson.D{{Key: "owner", Value: userInfo.Id}}
+	if status := r.URL.Query().Get("status"); status != "" {
+		filter = append(filter, bson.E{Key: "status", Value: status})
+	}
+
+	reservations, err := s.findReservations(ctx, filter, options.Find().SetSort(bson.D{{Key: "starts_at", Value: -1}}))
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+
+	result := struct {
+		Status  string              `json:"status"`
+		Results int32               `json:"results"`
+		Data    []store.Reservation `json:"data"`
+	}{
+		Status:  "success",
+		Results: int32(len(reservations)),
+		Data:    reservations,
+	}
+	return internal.ResponseHandler(w, result, http.StatusOK)
+}
+
+func (s *Server) GetReservationByIdHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	userInfo := ctx.Value(types.AuthUserInfoKey{}).(*types.UserInfo)
+
+	reservation, code, err := s.findOwnReservation(ctx, mux.Vars(r)["id"], userInfo)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), code)
+	}
+
+	result := struct {
+		Status string            `json:"status"`
+		Data   store.Reservation `json:"data"`
+	}{
+		Status: "success",
+		Data:   reservation,
+	}
+	return internal.ResponseHandler(w, result, http.StatusOK)
+}
+
+// UpdateReservationHandler moves an upcoming reservation to another time,
+// party size or table. Without an explicit table the current one is kept,
+// and the change is rejected if that table is taken at the new time.
+func (s *Server) UpdateReservationHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	userInfo := ctx.Value(types.AuthUserInfoKey{}).(*types.UserInfo)
+
+	reservation, code, err := s.findOwnReservation(ctx, mux.Vars(r)["id"], userInfo)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), code)
+	}
+
+	payload, err := internal.ReadReqBody[types.ReservationUpdateParams](r.Body, s.vd)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+	}
+
+	if reservation.Status != types.RESERVATION_CONFIRMED || !reservation.StartsAt.After(time.Now()) {
+		err := errors.New("only upcoming confirmed reservations can be modified")
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusConflict)
+	}
+
+	table := reservation.Table
+	if payload.Table != "" {
+		table, err = primitive.ObjectIDFromHex(payload.Table)
+		if err != nil {
+			return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+		}
+	}
+	if payload.Guests != 0 {
+		reservation.Guests = payload.Guests
+	}
+	if payload.StartsAt != nil {
+		reservation.StartsAt = payload.StartsAt.UTC()
+	}
+	if payload.EndsAt != nil {
+		reservation.EndsAt = payload.EndsAt.UTC()
+	}
+	if payload.Note != nil {
+		reservation.Note = *payload.Note
+	}
+	reservation.UpdatedAt = time.Now()
+
+	if err := validateReservationTime(reservation.StartsAt, reservation.EndsAt); err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+	}
+
+	session, err := s.Store.TxnStartSession(ctx)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(ctx mongo.SessionContext) (interface{}, error) {
+		if err := s.bookTable(ctx, &reservation, table); err != nil {
+			return nil, err
+		}
+
+		resColl := s.Store.Collection(ctx, "coffeeshop", "reservations")
+		filter := bson.D{
+			{Key: "_id", Value: reservation.Id},
+			{Key: "status", Value: types.RESERVATION_CONFIRMED},
+		}
+		update := bson.D{{Key: "$set", Value: bson.D{
+			{Key: "table", Value: reservation.Table},
+			{Key: "guests", Value: reservation.Guests},
+			{Key: "starts_at", Value: reservation.StartsAt},
+			{Key: "ends_at", Value: reservation.EndsAt},
+			{Key: "note", Value: reservation.Note},
+			{Key: "updated_at", Value: reservation.UpdatedAt},
+		}}}
+
+		res, err := resColl.UpdateOne(ctx, filter, update)
+		if err != nil {
+			return nil, err
+		}
+		if res.MatchedCount == 0 {
+			return nil, errReservationConflict
+		}
+		return res, nil
+	}, &options.TransactionOptions{})
+
+	if err != nil {
+		return reservationErrorResponse(w, err)
+	}
+
+	s.sendReservationMail(ctx, reservation)
+
+	result := struct {
+		Status string            `json:"status"`
+		Data   store.Reservation `json:"data"`
+	}{
+		Status: "success",
+		Data:   reservation,
+	}
+	return internal.ResponseHandler(w, result, http.StatusOK)
+}
+
+// CancelReservationHandler frees the table of a confirmed reservation and
+// lets its owner know, since staff may cancel on the owner's behalf.
+func (s *Server) CancelReservationHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	userInfo := ctx.Value(types.AuthUserInfoKey{}).(*types.UserInfo)
+
+	reservation, code, err := s.findOwnReservation(ctx, mux.Vars(r)["id"], userInfo)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), code)
+	}
+
+	filter := bson.D{
+		{Key: "_id", Value: reservation.Id},
+		{Key: "status", Value: types.RESERVATION_CONFIRMED},
+	}
+	update := bson.D{{Key: "$set", Value: bson.D{
+		{Key: "status", Value: types.RESERVATION_CANCELLED},
+		{Key: "cancelled_by", Value: userInfo.Id},
+		{Key: "updated_at", Value: time.Now()},
+	}}}
+
+	session, err := s.Store.TxnStartSession(ctx)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+	defer session.EndSession(ctx)
+
+	response, err := session.WithTransaction(ctx, func(ctx mongo.SessionContext) (interface{}, error) {
+		resColl := s.Store.Collection(ctx, "coffeeshop", "reservations")
+
+		var previous store.Reservation
+		oldDocs := options.Before
+		err := resColl.FindOneAndUpdate(ctx, filter, update, &options.FindOneAndUpdateOptions{
+			ReturnDocument: &oldDocs,
+		}).Decode(&previous)
+		if err != nil {
+			return nil, err
+		}
+
+		var cancelled store.Reservation
+		if err := resColl.FindOne(ctx, bson.D{{Key: "_id", Value: reservation.Id}}).Decode(&cancelled); err != nil {
+			return nil, err
+		}
+
+		err = s.writeAudit(ctx, r, types.AUDIT_RESERVATION_CANCEL, "reservation", reservation.Id.Hex(), previous, cancelled)
+		if err != nil {
+			return nil, err
+		}
+		return cancelled, nil
+	}, &options.TransactionOptions{})
+
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			err := errors.New("only confirmed reservations can be cancelled")
+			return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusConflict)
+		}
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+	reservation = response.(store.Reservation)
+
+	s.sendReservationMail(ctx, reservation)
+
+	result := struct {
+		Status string            `json:"status"`
+		Data   store.Reservation `json:"data"`
+	}{
+		Status: "success",
+		Data:   reservation,
+	}
+	return internal.ResponseHandler(w, result, http.StatusOK)
+}
+
+// GetDayReservationsHandler is the floor view for staff: every table with
+// the reservations it holds on ?date= (YYYY-MM-DD, defaults to today).
+// Cancelled reservations are left out unless ?status=cancelled is asked for.
+func (s *Server) GetDayReservationsHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	query := r.URL.Query()
+
+	day := time.Now().UTC().Truncate(24 * time.Hour)
+	if value := query.Get("date"); value != "" {
+		var err error
+		day, err = time.ParseInLocation(time.DateOnly, value, time.UTC)
+		if err != nil {
+			err := fmt.Errorf("%w: date must be formatted as YYYY-MM-DD", errInvalidReservationTime)
+			return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+		}
+	}
+
+	status := types.RESERVATION_CONFIRMED
+	if value := query.Get("status"); value != "" {
+		status = value
+	}
+
+	tables, err := s.findTables(ctx, bson.D{})
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+
+	reservations, err := s.findReservations(ctx, bson.D{
+		{Key: "status", Value: status},
+		{Key: "starts_at", Value: bson.D{{Key: "$gte", Value: day}, {Key: "$lt", Value: day.AddDate(0, 0, 1)}}},
+	}, options.Find().SetSort(bson.D{{Key: "starts_at", Value: 1}}))
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+
+	type tableSchedule struct {
+		Table        store.CoffeeDateTable `json:"table"`
+		Reservations []store.Reservation   `json:"reservations"`
+	}
+
+	schedules := make([]tableSchedule, 0, len(tables))
+	index := make(map[primitive.ObjectID]int, len(tables))
+	for i, table := range tables {
+		index[table.Id] = i
+		schedules = append(schedules, tableSchedule{Table: table, Reservations: []store.Reservation{}})
+	}
+	for _, reservation := range reservations {
+		if i, ok := index[reservation.Table]; ok {
+			schedules[i].Reservations = append(schedules[i].Reservations, reservation)
+		}
+	}
+
+	result := struct {
+		Status  string          `json:"status"`
+		Date    string          `json:"date"`
+		Results int32           `json:"results"`
+		Data    []tableSchedule `json:"data"`
+	}{
+		Status:  "success",
+		Date:    day.Format(time.DateOnly),
+		Results: int32(len(reservations)),
+		Data:    schedules,
+	}
+	return internal.ResponseHandler(w, result, http.StatusOK)
+}
+
+// bookTable assigns a table to reservation: the requested one, or else the
+// smallest active table that seats the party and is free for the whole
+// stay. It must run inside a transaction. Touching the chosen table's
+// last_booked_at makes two concurrent bookings of it write-conflict, so one
+// transaction is retried and then sees the other's reservation.
+func (s *Server) bookTable(ctx context.Context, reservation *store.Reservation, requested primitive.ObjectID) error {
+	tblColl := s.Store.Collection(ctx, "coffeeshop", "tables")
+	resColl := s.Store.Collection(ctx, "coffeeshop", "reservations")
+
+	filter := bson.D{
+		{Key: "active", Value: true},
+		{Key: "capacity", Value: bson.D{{Key: "$gte", Value: reservation.Guests}}},
+	}
+	if !requested.IsZero() {
+		filter = append(filter, bson.E{Key: "_id", Value: requested})
+	}
+
+	tables, err := s.findTables(ctx, filter)
+	if err != nil {
+		return err
+	}
+
+	if len(tables) == 0 {
+		if !requested.IsZero() {
+			return errTableUnavailable
+		}
+		return errReservationConflict
+	}
+
+	for _, table := range tables {
+		overlapping, err := resColl.CountDocuments(ctx, bson.D{
+			{Key: "_id", Value: bson.D{{Key: "$ne", Value: reservation.Id}}},
+			{Key: "table", Value: table.Id},
+			{Key: "status", Value: types.RESERVATION_CONFIRMED},
+			{Key: "starts_at", Value: bson.D{{Key: "$lt", Value: reservation.EndsAt}}},
+			{Key: "ends_at", Value: bson.D{{Key: "$gt", Value: reservation.StartsAt}}},
+		})
+		if err != nil {
+			return err
+		}
+
+		if overlapping > 0 {
+			continue
+		}
+
+		update := bson.D{{Key: "$set", Value: bson.D{{Key: "last_booked_at", Value: time.Now()}}}}
+		if _, err := tblColl.UpdateOne(ctx, bson.D{{Key: "_id", Value: table.Id}}, update); err != nil {
+			return err
+		}
+
+		reservation.Table = table.Id
+		return nil
+	}
+	return errReservationConflict
+}
+
+// findTables returns the tables matching filter, smallest first so that
+// automatic assignment does not put a couple at the eight-seater.
+func (s *Server) findTables(ctx context.Context, filter bson.D) ([]store.CoffeeDateTable, error) {
+	tblColl := s.Store.Collection(ctx, "coffeeshop", "tables")
+
+	opts := options.Find().SetSort(bson.D{{Key: "capacity", Value: 1}, {Key: "number", Value: 1}})
+	cur, err := tblColl.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	tables := []store.CoffeeDateTable{}
+	if err := cur.All(ctx, &tables); err != nil {
+		return nil, err
+	}
+	return tables, nil
+}
+
+func (s *Server) findReservations(ctx context.Context, filter bson.D, opts ...*options.FindOptions) ([]store.Reservation, error) {
+	resColl := s.Store.Collection(ctx, "coffeeshop", "reservations")
+
+	cur, err := resColl.Find(ctx, filter, opts...)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	reservations := []store.Reservation{}
+	if err := cur.All(ctx, &reservations); err != nil {
+		return nil, err
+	}
+	return reservations, nil
+}
+
+// findOwnReservation loads a reservation by its hex id for the owner or an
+// admin, returning the status code to answer with when it cannot.
+func (s *Server) findOwnReservation(ctx context.Context, hex string, userInfo *types.UserInfo) (store.Reservation, int, error) {
+	resColl := s.Store.Collection(ctx, "coffeeshop", "reservations")
+
+	id, err := primitive.ObjectIDFromHex(hex)
+	if err != nil {
+		return store.Reservation{}, http.StatusBadRequest, err
+	}
+
+	var reservation store.Reservation
+	err = resColl.FindOne(ctx, bson.D{{Key: "_id", Value: id}}).Decode(&reservation)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return store.Reservation{}, http.StatusNotFound, fmt.Errorf("document not found %w", err)
+		}
+		return store.Reservation{}, http.StatusInternalServerError, err
+	}
+
+	if reservation.Owner != userInfo.Id && !userInfo.Can(types.PERM_RESERVATIONS_MANAGE) {
+		return store.Reservation{}, http.StatusForbidden, errors.New("user only allowed to manage their own reservations")
+	}
+	return reservation, http.StatusOK, nil
+}
+
+// sendReservationMail queues the email about the reservation's current
+// state to its owner, who is not the caller when staff move or cancel
+// somebody else's booking. The
+// reservation is already stored at this point, so a failure is logged rather
+// than failing the request.
+func (s *Server) sendReservationMail(ctx context.Context, reservation store.Reservation) {
+	var owner store.User
+	users := s.Store.Collection(ctx, "coffeeshop", "users")
+	if err := users.FindOne(ctx, bson.D{{Key: "_id", Value: reservation.Owner}}).Decode(&owner); err != nil {
+		// Bookings taken by a till with an API key have nobody to mail.
+		if err != mongo.ErrNoDocuments {
+			log.Printf("failed to look up the owner of reservation %s %v\n", reservation.Id.Hex(), err)
+		}
+		return
+	}
+
+	opts := []asynq.Option{
+		asynq.MaxRetry(5),
+		asynq.ProcessIn(3 * time.Second),
+		asynq.Queue(workers.CriticalQueue),
+	}
+
+	payload := &types.PayloadReservationMail{Email: owner.Email, Reservation: reservation.Id.Hex()}
+	if err := s.taskDistributor.ReservationConfirmationMailTask(ctx, payload, opts...); err != nil {
+		log.Printf("failed to enqueue reservation mail for %s %v\n", reservation.Id.Hex(), err)
+	}
+}
+
+func validateReservationTime(startsAt, endsAt time.Time) error {
+	day := startsAt.Truncate(24 * time.Hour)
+
+	switch {
+	case !startsAt.After(time.Now()):
+		return fmt.Errorf("%w: reservation must start in the future", errInvalidReservationTime)
+	case !endsAt.After(startsAt):
+		return fmt.Errorf("%w: reservation must end after it starts", errInvalidReservationTime)
+	case endsAt.Sub(startsAt) > maxReservationDuration:
+		return fmt.Errorf("%w: reservation may last at most %v", errInvalidReservationTime, maxReservationDuration)
+	case startsAt.Before(day.Add(reservationOpensAt)) || endsAt.After(day.Add(reservationClosesAt)):
+		return fmt.Errorf("%w: reservation must fall within opening hours", errInvalidReservationTime)
+	}
+	return nil
+}
+
+func reservationErrorResponse(w http.ResponseWriter, err error) error {
+	switch {
+	case errors.Is(err, errTableUnavailable):
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+	case errors.Is(err, errReservationConflict):
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusConflict)
+	default:
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+}
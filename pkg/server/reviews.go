@@ -0,0 +1,432 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gorilla/mux"
+	"github.com/silaselisha/coffee-api/internal"
+	"github.com/silaselisha/coffee-api/pkg/store"
+	"github.com/silaselisha/coffee-api/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	errReviewNotPurchased = errors.New("only customers with a completed order of this product can review it")
+	errReviewNotAuthor    = errors.New("user only allowed to modify their own reviews")
+)
+
+func (s *Server) GetProductReviewsHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	collection := s.Store.Collection(ctx, "coffeeshop", "reviews")
+
+	queries := r.URL.Query()
+	productId, err := primitive.ObjectIDFromHex(queries.Get("product"))
+	if err != nil {
+		err = fmt.Errorf("invalid product id %w", err)
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+	}
+
+	limit, err := internal.ParseLimit(queries)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+	}
+
+	filter := bson.D{{Key: "product", Value: productId}, {Key: "hidden", Value: false}}
+	if cursor := queries.Get("cursor"); cursor != "" {
+		lastId, err := internal.DecodeCursor(cursor)
+		if err != nil {
+			return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+		}
+		filter = append(filter, bson.E{Key: "_id", Value: bson.D{{Key: "$lt", Value: lastId}}})
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: -1}}).SetLimit(limit + 1)
+	cur, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+	defer cur.Close(ctx)
+
+	var reviews []store.Review
+	if err := cur.All(ctx, &reviews); err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+
+	var nextCursor string
+	if int64(len(reviews)) > limit {
+		reviews = reviews[:limit]
+		nextCursor = internal.EncodeCursor(reviews[len(reviews)-1].Id)
+	}
+
+	data := []types.ReviewResParams{}
+	for _, review := range reviews {
+		data = append(data, newReviewResponse(review))
+	}
+
+	result := struct {
+		Status     string                  `json:"status"`
+		Results    int32                   `json:"results"`
+		NextCursor string                  `json:"next_cursor,omitempty"`
+		Data       []types.ReviewResParams `json:"data"`
+	}{
+		Status:     "success",
+		Results:    int32(len(data)),
+		NextCursor: nextCursor,
+		Data:       data,
+	}
+	return internal.ResponseHandler(w, result, http.StatusOK)
+}
+
+func (s *Server) CreateReviewHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	payload, err := internal.ReadReqBody[types.ReviewParams](r.Body, s.vd)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+	}
+
+	productId, err := primitive.ObjectIDFromHex(payload.Product)
+	if err != nil {
+		err = fmt.Errorf("invalid product id %w", err)
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+	}
+
+	userInfo := ctx.Value(types.AuthUserInfoKey{}).(*types.UserInfo)
+
+	session, err := s.Store.TxnStartSession(ctx)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+	defer session.EndSession(ctx)
+
+	// one review per customer and product
+	_, err = s.Store.Collection(ctx, "coffeeshop", "reviews").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "product", Value: 1}, {Key: "author", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+
+	response, err := session.WithTransaction(ctx, func(ctx mongo.SessionContext) (interface{}, error) {
+		collection := s.Store.Collection(ctx, "coffeeshop", "reviews")
+		products := s.Store.Collection(ctx, "coffeeshop", "products")
+		err := products.FindOne(ctx, bson.D{{Key: "_id", Value: productId}}).Err()
+		if err != nil {
+			return nil, err
+		}
+
+		orders := s.Store.Collection(ctx, "coffeeshop", "orders")
+		purchases, err := orders.CountDocuments(ctx, bson.D{
+			{Key: "owner", Value: userInfo.Id},
+			{Key: "status", Value: types.ORDER_COMPLETED},
+			{Key: "items.product", Value: productId},
+		}, options.Count().SetLimit(1))
+		if err != nil {
+			return nil, err
+		}
+
+		if purchases == 0 {
+			return nil, errReviewNotPurchased
+		}
+
+		review := store.Review{
+			Id:        primitive.NewObjectID(),
+			Product:   productId,
+			Author:    userInfo.Id,
+			Rating:    payload.Rating,
+			Text:      payload.Text,
+			CreatedAt: time.Now(),
+			UpdatedAt: time.Now(),
+		}
+
+		_, err = collection.InsertOne(ctx, review)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := s.refreshProductRatings(ctx, productId); err != nil {
+			return nil, err
+		}
+		return review, nil
+	}, &options.TransactionOptions{})
+
+	if err != nil {
+		return reviewErrorResponse(w, err)
+	}
+
+	result := struct {
+		Status string                `json:"status"`
+		Data   types.ReviewResParams `json:"data"`
+	}{
+		Status: "success",
+		Data:   newReviewResponse(response.(store.Review)),
+	}
+	return internal.ResponseHandler(w, result, http.StatusCreated)
+}
+
+func (s *Server) UpdateReviewHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+	}
+
+	payload, err := internal.ReadReqBody[types.ReviewUpdateParams](r.Body, s.vd)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+	}
+
+	userInfo := ctx.Value(types.AuthUserInfoKey{}).(*types.UserInfo)
+
+	updates := bson.D{{Key: "updated_at", Value: time.Now()}}
+	if payload.Rating != 0 {
+		updates = append(updates, bson.E{Key: "rating", Value: payload.Rating})
+	}
+	if payload.Text != nil {
+		updates = append(updates, bson.E{Key: "text", Value: *payload.Text})
+	}
+
+	session, err := s.Store.TxnStartSession(ctx)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+	defer session.EndSession(ctx)
+
+	response, err := session.WithTransaction(ctx, func(ctx mongo.SessionContext) (interface{}, error) {
+		collection := s.Store.Collection(ctx, "coffeeshop", "reviews")
+
+		var review store.Review
+		err := collection.FindOne(ctx, bson.D{{Key: "_id", Value: id}}).Decode(&review)
+		if err != nil {
+			return nil, err
+		}
+
+		if review.Author != userInfo.Id {
+			return nil, errReviewNotAuthor
+		}
+
+		newDocs := options.After
+		err = collection.FindOneAndUpdate(ctx, bson.D{{Key: "_id", Value: id}}, bson.D{{Key: "$set", Value: updates}}, &options.FindOneAndUpdateOptions{
+			ReturnDocument: &newDocs,
+		}).Decode(&review)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := s.refreshProductRatings(ctx, review.Product); err != nil {
+			return nil, err
+		}
+		return review, nil
+	}, &options.TransactionOptions{})
+
+	if err != nil {
+		return reviewErrorResponse(w, err)
+	}
+
+	result := struct {
+		Status string                `json:"status"`
+		Data   types.ReviewResParams `json:"data"`
+	}{
+		Status: "success",
+		Data:   newReviewResponse(response.(store.Review)),
+	}
+	return internal.ResponseHandler(w, result, http.StatusOK)
+}
+
+func (s *Server) DeleteReviewHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+	}
+
+	userInfo := ctx.Value(types.AuthUserInfoKey{}).(*types.UserInfo)
+
+	session, err := s.Store.TxnStartSession(ctx)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(ctx mongo.SessionContext) (interface{}, error) {
+		collection := s.Store.Collection(ctx, "coffeeshop", "reviews")
+
+		var review store.Review
+		err := collection.FindOne(ctx, bson.D{{Key: "_id", Value: id}}).Decode(&review)
+		if err != nil {
+			return nil, err
+		}
+
+		if review.Author != userInfo.Id && !userInfo.Can(types.PERM_REVIEWS_MODERATE) {
+			return nil, errReviewNotAuthor
+		}
+
+		_, err = collection.DeleteOne(ctx, bson.D{{Key: "_id", Value: id}})
+		if err != nil {
+			return nil, err
+		}
+
+		// Authors removing their own words is not moderation.
+		if review.Author != userInfo.Id {
+			err := s.writeAudit(ctx, r, types.AUDIT_REVIEW_DELETE, "review", id.Hex(), review, nil)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return nil, s.refreshProductRatings(ctx, review.Product)
+	}, &options.TransactionOptions{})
+
+	if err != nil {
+		return reviewErrorResponse(w, err)
+	}
+
+	return internal.ResponseHandler(w, "", http.StatusNoContent)
+}
+
+// UpdateReviewVisibilityHandler lets admins hide abusive reviews without
+// deleting them. Hidden reviews are left out of listings and ratings.
+func (s *Server) UpdateReviewVisibilityHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+	}
+
+	payload, err := internal.ReadReqBody[types.ReviewVisibilityParams](r.Body, s.vd)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+	}
+
+	userInfo := ctx.Value(types.AuthUserInfoKey{}).(*types.UserInfo)
+
+	session, err := s.Store.TxnStartSession(ctx)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+	defer session.EndSession(ctx)
+
+	response, err := session.WithTransaction(ctx, func(ctx mongo.SessionContext) (interface{}, error) {
+		collection := s.Store.Collection(ctx, "coffeeshop", "reviews")
+
+		update := bson.D{{Key: "hidden", Value: payload.Hidden}, {Key: "updated_at", Value: time.Now()}}
+		if payload.Hidden {
+			update = append(update, bson.E{Key: "hidden_by", Value: userInfo.Id})
+		}
+
+		oldDocs := options.Before
+		var previous store.Review
+		err := collection.FindOneAndUpdate(ctx, bson.D{{Key: "_id", Value: id}}, bson.D{{Key: "$set", Value: update}}, &options.FindOneAndUpdateOptions{
+			ReturnDocument: &oldDocs,
+		}).Decode(&previous)
+		if err != nil {
+			return nil, err
+		}
+
+		var review store.Review
+		if err := collection.FindOne(ctx, bson.D{{Key: "_id", Value: id}}).Decode(&review); err != nil {
+			return nil, err
+		}
+
+		if err := s.refreshProductRatings(ctx, review.Product); err != nil {
+			return nil, err
+		}
+
+		err = s.writeAudit(ctx, r, types.AUDIT_REVIEW_VISIBILITY, "review", id.Hex(), previous, review)
+		if err != nil {
+			return nil, err
+		}
+		return review, nil
+	}, &options.TransactionOptions{})
+
+	if err != nil {
+		return reviewErrorResponse(w, err)
+	}
+
+	result := struct {
+		Status string                `json:"status"`
+		Data   types.ReviewResParams `json:"data"`
+	}{
+		Status: "success",
+		Data:   newReviewResponse(response.(store.Review)),
+	}
+	return internal.ResponseHandler(w, result, http.StatusOK)
+}
+
+// refreshProductRatings recomputes a product's average rating and rating
+// count from its visible reviews. It must run in the same transaction as the
+// review write so the aggregate never drifts from the reviews collection.
+func (s *Server) refreshProductRatings(ctx context.Context, productId primitive.ObjectID) error {
+	reviews := s.Store.Collection(ctx, "coffeeshop", "reviews")
+	products := s.Store.Collection(ctx, "coffeeshop", "products")
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.D{{Key: "product", Value: productId}, {Key: "hidden", Value: false}}}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: "$product"},
+			{Key: "average", Value: bson.D{{Key: "$avg", Value: "$rating"}}},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+		}}},
+	}
+
+	cur, err := reviews.Aggregate(ctx, pipeline)
+	if err != nil {
+		return err
+	}
+
+	var stats []struct {
+		Average float64 `bson:"average"`
+		Count   int64   `bson:"count"`
+	}
+	if err := cur.All(ctx, &stats); err != nil {
+		return err
+	}
+
+	var average float64
+	var count int64
+	if len(stats) > 0 {
+		average = stats[0].Average
+		count = stats[0].Count
+	}
+
+	update := bson.D{{Key: "$set", Value: bson.D{
+		{Key: "ratings", Value: average},
+		{Key: "ratings_count", Value: count},
+	}}}
+	_, err = products.UpdateOne(ctx, bson.D{{Key: "_id", Value: productId}}, update)
+	return err
+}
+
+func newReviewResponse(review store.Review) types.ReviewResParams {
+	return types.ReviewResParams{
+		Id:        review.Id.Hex(),
+		Product:   review.Product,
+		Author:    review.Author,
+		Rating:    review.Rating,
+		Text:      review.Text,
+		Hidden:    review.Hidden,
+		CreatedAt: review.CreatedAt,
+		UpdatedAt: review.UpdatedAt,
+	}
+}
+
+func reviewErrorResponse(w http.ResponseWriter, err error) error {
+	var validationErrs validator.ValidationErrors
+	var syntaxErr *json.SyntaxError
+	switch {
+	case errors.Is(err, mongo.ErrNoDocuments):
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", fmt.Errorf("document not found %w", err).Error()), http.StatusNotFound)
+	case errors.Is(err, errReviewNotPurchased), errors.Is(err, errReviewNotAuthor):
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusForbidden)
+	case mongo.IsDuplicateKeyError(err):
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", fmt.Errorf("document already exists %w", err).Error()), http.StatusBadRequest)
+	case errors.As(err, &validationErrs), errors.As(err, &syntaxErr):
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", fmt.Errorf("invalid data input for operation %w", err).Error()), http.StatusBadRequest)
+	default:
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,434 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/silaselisha/coffee-api/internal"
+	"github.com/silaselisha/coffee-api/pkg/store"
+	"github.com/silaselisha/coffee-api/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	errInvalidRole   = errors.New("invalid role")
+	errSystemRole    = errors.New("system roles cannot be deleted and only the two-factor requirement of the admin role can be changed")
+	errRoleInUse     = errors.New("role is still assigned to users")
+	errOwnRoleChange = errors.New("admins cannot change their own role")
+	errNotGrantable  = errors.New("cannot grant permissions you do not hold")
+	roleNameFormat   = regexp.MustCompile(`^[a-z][a-z0-9-]{2,31}$`)
+)
+
+// defaultRoles are inserted on start up when missing. Later edits made
+// through the API are kept.
+var defaultRoles = []store.Role{
+	{
+		Name:        types.ROLE_ADMIN,
+		Description: "Full access to the API",
+		Permissions: []string{types.PERM_ALL},
+	},
+	{
+		Name:        types.ROLE_USER,
+		Description: "Customer placing orders, reservations and reviews",
+		Permissions: []string{},
+	},
+	{
+		Name:        types.ROLE_BARISTA,
+		Description: "Sees the order queue, moves orders along and takes payments",
+		Permissions: []string{types.PERM_ORDERS_READ, types.PERM_ORDERS_ADVANCE, types.PERM_ORDERS_PAY},
+	},
+	{
+		Name:        types.ROLE_MANAGER,
+		Description: "Runs the shop floor, menu and stock",
+		Permissions: []string{
+			types.PERM_PRODUCTS_WRITE,
+			"orders:*",
+			"inventory:*",
+			types.PERM_RESERVATIONS_MANAGE,
+			types.PERM_REVIEWS_MODERATE,
+			types.PERM_USERS_READ,
+		},
+	},
+	{
+		Name:        types.ROLE_INVENTORY_CLERK,
+		Description: "Keeps ingredient stock up to date",
+		Permissions: []string{types.PERM_INVENTORY_READ, types.PERM_INVENTORY_WRITE},
+	},
+}
+
+func seedRoles(ctx context.Context, str store.Mongo) error {
+	collection := str.Collection(ctx, "coffeeshop", "roles")
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "name", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, role := range defaultRoles {
+		insert := bson.D{
+			{Key: "_id", Value: primitive.NewObjectID()},
+			{Key: "description", Value: role.Description},
+			{Key: "permissions", Value: role.Permissions},
+			{Key: "system", Value: true},
+			{Key: "require_two_factor", Value: false},
+			{Key: "created_at", Value: time.Now()},
+			{Key: "updated_at", Value: time.Now()},
+		}
+		update := bson.D{{Key: "$setOnInsert", Value: insert}}
+		_, err := collection.UpdateOne(ctx, bson.D{{Key: "name", Value: role.Name}}, update, options.Update().SetUpsert(true))
+		if err != nil {
+			return fmt.Errorf("failed to seed role %s %w", role.Name, err)
+		}
+	}
+	return nil
+}
+
+func (s *Server) GetAllRolesHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	collection := s.Store.Collection(ctx, "coffeeshop", "roles")
+
+	cur, err := collection.Find(ctx, bson.D{}, options.Find().SetSort(bson.D{{Key: "name", Value: 1}}))
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+	defer cur.Close(ctx)
+
+	roles := []store.Role{}
+	if err := cur.All(ctx, &roles); err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+
+	result := struct {
+		Status      string       `json:"status"`
+		Results     int32        `json:"results"`
+		Permissions []string     `json:"permissions"`
+		Data        []store.Role `json:"data"`
+	}{
+		Status:      "success",
+		Results:     int32(len(roles)),
+		Permissions: types.PERMISSIONS,
+		Data:        roles,
+	}
+	return internal.ResponseHandler(w, result, http.StatusOK)
+}
+
+func (s *Server) CreateRoleHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	payload, err := internal.ReadReqBody[types.RoleParams](r.Body, s.vd)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+	}
+
+	if !roleNameFormat.MatchString(payload.Name) {
+		err := fmt.Errorf("%w: names are 3 to 32 lower case letters, digits and dashes", errInvalidRole)
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+	}
+
+	if err := validatePermissions(payload.Permissions); err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+	}
+
+	userInfo := ctx.Value(types.AuthUserInfoKey{}).(*types.UserInfo)
+	if err := grantablePermissions(userInfo, payload.Permissions); err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusForbidden)
+	}
+
+	role := store.Role{
+		Id:               primitive.NewObjectID(),
+		Name:             payload.Name,
+		Description:      payload.Description,
+		Permissions:      payload.Permissions,
+		RequireTwoFactor: payload.RequireTwoFactor,
+		CreatedAt:        time.Now(),
+		UpdatedAt:        time.Now(),
+	}
+	if role.Permissions == nil {
+		role.Permissions = []string{}
+	}
+
+	session, err := s.Store.TxnStartSession(ctx)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(ctx mongo.SessionContext) (interface{}, error) {
+		collection := s.Store.Collection(ctx, "coffeeshop", "roles")
+		if _, err := collection.InsertOne(ctx, role); err != nil {
+			return nil, err
+		}
+		return nil, s.writeAudit(ctx, r, types.AUDIT_ROLE_CREATE, "role", role.Id.Hex(), nil, role)
+	}, &options.TransactionOptions{})
+
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return internal.ResponseHandler(w, internal.NewErrorResponse("failed", fmt.Errorf("document already exists %w", err).Error()), http.StatusBadRequest)
+		}
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+	// Users may already hold the name and have no permissions cached for it.
+	s.UserCache.InvalidateRole(ctx, role.Name)
+
+	result := struct {
+		Status string     `json:"status"`
+		Data   store.Role `json:"data"`
+	}{
+		Status: "success",
+		Data:   role,
+	}
+	return internal.ResponseHandler(w, result, http.StatusCreated)
+}
+
+func (s *Server) UpdateRoleHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	name := mux.Vars(r)["name"]
+
+	payload, err := internal.ReadReqBody[types.RoleUpdateParams](r.Body, s.vd)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+	}
+
+	// Admins may only decide whether their own role needs two-factor
+	// authentication.
+	if name == types.ROLE_ADMIN && (payload.Description != nil || payload.Permissions != nil) {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", errSystemRole.Error()), http.StatusConflict)
+	}
+
+	set := bson.D{{Key: "updated_at", Value: time.Now()}}
+	if payload.Description != nil {
+		set = append(set, bson.E{Key: "description", Value: *payload.Description})
+	}
+	if payload.Permissions != nil {
+		if err := validatePermissions(payload.Permissions); err != nil {
+			return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+		}
+
+		userInfo := ctx.Value(types.AuthUserInfoKey{}).(*types.UserInfo)
+		if err := grantablePermissions(userInfo, payload.Permissions); err != nil {
+			return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusForbidden)
+		}
+		set = append(set, bson.E{Key: "permissions", Value: payload.Permissions})
+	}
+	if payload.RequireTwoFactor != nil {
+		set = append(set, bson.E{Key: "require_two_factor", Value: *payload.RequireTwoFactor})
+	}
+
+	session, err := s.Store.TxnStartSession(ctx)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+	defer session.EndSession(ctx)
+
+	response, err := session.WithTransaction(ctx, func(ctx mongo.SessionContext) (interface{}, error) {
+		collection := s.Store.Collection(ctx, "coffeeshop", "roles")
+
+		var previous store.Role
+		opts := options.FindOneAndUpdate().SetReturnDocument(options.Before)
+		err := collection.FindOneAndUpdate(ctx, bson.D{{Key: "name", Value: name}}, bson.D{{Key: "$set", Value: set}}, opts).Decode(&previous)
+		if err != nil {
+			return nil, err
+		}
+
+		var role store.Role
+		if err := collection.FindOne(ctx, bson.D{{Key: "_id", Value: previous.Id}}).Decode(&role); err != nil {
+			return nil, err
+		}
+
+		err = s.writeAudit(ctx, r, types.AUDIT_ROLE_UPDATE, "role", role.Id.Hex(), previous, role)
+		if err != nil {
+			return nil, err
+		}
+		return role, nil
+	}, &options.TransactionOptions{})
+
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return internal.ResponseHandler(w, internal.NewErrorResponse("failed", fmt.Errorf("document not found %w", err).Error()), http.StatusNotFound)
+		}
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+	role := response.(store.Role)
+	s.UserCache.InvalidateRole(ctx, role.Name)
+
+	result := struct {
+		Status string     `json:"status"`
+		Data   store.Role `json:"data"`
+	}{
+		Status: "success",
+		Data:   role,
+	}
+	return internal.ResponseHandler(w, result, http.StatusOK)
+}
+
+func (s *Server) DeleteRoleHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	collection := s.Store.Collection(ctx, "coffeeshop", "roles")
+	users := s.Store.Collection(ctx, "coffeeshop", "users")
+	name := mux.Vars(r)["name"]
+
+	var role store.Role
+	err := collection.FindOne(ctx, bson.D{{Key: "name", Value: name}}).Decode(&role)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return internal.ResponseHandler(w, internal.NewErrorResponse("failed", fmt.Errorf("document not found %w", err).Error()), http.StatusNotFound)
+		}
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+
+	if role.System {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", errSystemRole.Error()), http.StatusConflict)
+	}
+
+	assigned, err := users.CountDocuments(ctx, bson.D{{Key: "role", Value: name}})
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+	if assigned > 0 {
+		err := fmt.Errorf("%w: %d users", errRoleInUse, assigned)
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusConflict)
+	}
+
+	session, err := s.Store.TxnStartSession(ctx)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(ctx mongo.SessionContext) (interface{}, error) {
+		collection := s.Store.Collection(ctx, "coffeeshop", "roles")
+		if _, err := collection.DeleteOne(ctx, bson.D{{Key: "_id", Value: role.Id}}); err != nil {
+			return nil, err
+		}
+		return nil, s.writeAudit(ctx, r, types.AUDIT_ROLE_DELETE, "role", role.Id.Hex(), role, nil)
+	}, &options.TransactionOptions{})
+
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+	s.UserCache.InvalidateRole(ctx, role.Name)
+	return internal.ResponseHandler(w, "", http.StatusNoContent)
+}
+
+// UpdateUserRoleHandler assigns an existing role to a user. The user's
+// token version is bumped so access tokens carrying the old role claim stop
+// working; their refresh token picks up the new role.
+func (s *Server) UpdateUserRoleHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	roles := s.Store.Collection(ctx, "coffeeshop", "roles")
+	userInfo := ctx.Value(types.AuthUserInfoKey{}).(*types.UserInfo)
+
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+	}
+
+	payload, err := internal.ReadReqBody[types.UserRoleParams](r.Body, s.vd)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+	}
+
+	if id == userInfo.Id {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", errOwnRoleChange.Error()), http.StatusConflict)
+	}
+
+	var role store.Role
+	err = roles.FindOne(ctx, bson.D{{Key: "name", Value: payload.Role}}).Decode(&role)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			err := fmt.Errorf("%w: %s does not exist", errInvalidRole, payload.Role)
+			return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+		}
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+
+	// Assigning a role grants its permissions, so only holders of "*" can
+	// make somebody an admin.
+	if err := grantablePermissions(userInfo, role.Permissions); err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusForbidden)
+	}
+
+	update := bson.D{
+		{Key: "$set", Value: bson.D{{Key: "role", Value: payload.Role}, {Key: "updated_at", Value: time.Now()}}},
+		{Key: "$inc", Value: bson.D{{Key: "token_version", Value: 1}}},
+	}
+	session, err := s.Store.TxnStartSession(ctx)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+	defer session.EndSession(ctx)
+
+	response, err := session.WithTransaction(ctx, func(ctx mongo.SessionContext) (interface{}, error) {
+		users := s.Store.Collection(ctx, "coffeeshop", "users")
+
+		var previous store.User
+		opts := options.FindOneAndUpdate().SetReturnDocument(options.Before)
+		err := users.FindOneAndUpdate(ctx, bson.D{{Key: "_id", Value: id}}, update, opts).Decode(&previous)
+		if err != nil {
+			return nil, err
+		}
+
+		var user store.User
+		if err := users.FindOne(ctx, bson.D{{Key: "_id", Value: id}}).Decode(&user); err != nil {
+			return nil, err
+		}
+
+		err = s.writeAudit(ctx, r, types.AUDIT_USER_ROLE_UPDATE, "user", id.Hex(), previous, user)
+		if err != nil {
+			return nil, err
+		}
+		return user, nil
+	}, &options.TransactionOptions{})
+
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return internal.ResponseHandler(w, internal.NewErrorResponse("failed", fmt.Errorf("document not found %w", err).Error()), http.StatusNotFound)
+		}
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+	user := response.(store.User)
+	s.UserCache.InvalidateUser(ctx, user.Id)
+
+	result := struct {
+		Status string               `json:"status"`
+		Data   *types.UserResParams `json:"data"`
+	}{
+		Status: "success",
+		Data: &types.UserResParams{
+			Id:          user.Id.Hex(),
+			Avatar:      user.Avatar,
+			UserName:    user.UserName,
+			Role:        user.Role,
+			Email:       user.Email,
+			PhoneNumber: user.PhoneNumber,
+			Verified:    user.Verified,
+			CreatedAt:   user.CreatedAt,
+			UpdatedAt:   user.UpdatedAt,
+		},
+	}
+	return internal.ResponseHandler(w, result, http.StatusOK)
+}
+
+// grantablePermissions keeps role managers from handing out, to a role or
+// through one to a second account of theirs, more than they hold themselves.
+func grantablePermissions(userInfo *types.UserInfo, permissions []string) error {
+	for _, permission := range permissions {
+		if !userInfo.Can(permission) {
+			return fmt.Errorf("%w: %q", errNotGrantable, permission)
+		}
+	}
+	return nil
+}
+
+func validatePermissions(permissions []string) error {
+	for _, permission := range permissions {
+		if !types.ValidPermission(permission) {
+			return fmt.Errorf("%w: unknown permission %q", errInvalidRole, permission)
+		}
+	}
+	return nil
+}
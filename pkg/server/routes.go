@@ -6,6 +6,7 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/silaselisha/coffee-api/internal"
 	middleware "github.com/silaselisha/coffee-api/pkg/server/internal"
+	"github.com/silaselisha/coffee-api/types"
 )
 
 func productRoutes(gmux *mux.Router, srv *Server) {
@@ -14,26 +15,32 @@ func productRoutes(gmux *mux.Router, srv *Server) {
 	deleteItemsRouter := gmux.Methods(http.MethodDelete).Subrouter()
 	updateItemsRouter := gmux.Methods(http.MethodPut).Subrouter()
 
-	postItemsRouter.Use(middleware.AuthMiddleware(srv.Token))
+	postItemsRouter.Use(middleware.AuthMiddleware(srv.Token, srv.apiKeys))
 	postProductsRouter := postItemsRouter.PathPrefix("/").Subrouter()
-	postProductsRouter.Use(middleware.RestrictToMiddleware(srv.Store, "admin"))
+	postProductsRouter.Use(middleware.RequirePermissionMiddleware(srv.UserCache, types.PERM_PRODUCTS_WRITE))
 	postProductsRouter.HandleFunc("/products", internal.HandleFuncDecorator(srv.CreateProductHandler))
 
-	getItemsRouter.HandleFunc("/products", internal.HandleFuncDecorator(srv.GetAllProductsHandler))
+	// The catalogue is public; identifying the caller still lets API keys
+	// and users get their own allowance instead of sharing their address's.
+	getAllProductsRouter := gmux.Methods(http.MethodGet).Subrouter()
+	getAllProductsRouter.Use(middleware.OptionalAuthMiddleware(srv.Token, srv.apiKeys))
+	getAllProductsRouter.Use(middleware.RateLimitMiddleware(srv.rateLimiter, srv.rateLimits.products, middleware.KeyByAPIKey))
+	getAllProductsRouter.HandleFunc("/products", internal.HandleFuncDecorator(srv.GetAllProductsHandler))
+
+	getItemsRouter.HandleFunc("/products/search", internal.HandleFuncDecorator(srv.SearchProductsHandler))
 	getItemsRouter.HandleFunc("/products/{category}/{id}", internal.HandleFuncDecorator(srv.GetProductByIdHandler))
 
-	deleteItemsRouter.Use(middleware.AuthMiddleware(srv.Token))
+	deleteItemsRouter.Use(middleware.AuthMiddleware(srv.Token, srv.apiKeys))
 	deleteProductsRouter := deleteItemsRouter.PathPrefix("/products").Subrouter()
-	deleteProductsRouter.Use(middleware.RestrictToMiddleware(srv.Store, "admin"))
+	deleteProductsRouter.Use(middleware.RequirePermissionMiddleware(srv.UserCache, types.PERM_PRODUCTS_WRITE))
 	deleteProductsRouter.HandleFunc("/{id}", internal.HandleFuncDecorator(srv.DeleteProductByIdHandler))
 
-	updateItemsRouter.Use(middleware.AuthMiddleware(srv.Token))
+	updateItemsRouter.Use(middleware.AuthMiddleware(srv.Token, srv.apiKeys))
 	updateProductsRouter := updateItemsRouter.PathPrefix("/products").Subrouter()
-	updateProductsRouter.Use(middleware.RestrictToMiddleware(srv.Store, "admin"))
+	updateProductsRouter.Use(middleware.RequirePermissionMiddleware(srv.UserCache, types.PERM_PRODUCTS_WRITE))
 	updateProductsRouter.HandleFunc("/{id}", internal.HandleFuncDecorator(srv.UpdateProductHandler))
 }
 
-
 func userRoutes(gmux *mux.Router, srv *Server) {
 	userGetRouter := gmux.Methods(http.MethodGet).Subrouter()
 	postUserRouter := gmux.Methods(http.MethodPost).Subrouter()
@@ -42,33 +49,232 @@ func userRoutes(gmux *mux.Router, srv *Server) {
 	resetPasswordRouter := gmux.Methods(http.MethodPut).Subrouter()
 	deleteUserRouter := gmux.Methods(http.MethodDelete).Subrouter()
 
-	userGetRouter.Use(middleware.AuthMiddleware(srv.Token))
+	userGetRouter.Use(middleware.AuthMiddleware(srv.Token, srv.apiKeys))
 
 	getAllUsersRouter := userGetRouter.PathPrefix("/").Subrouter()
-	getAllUsersRouter.Use(middleware.RestrictToMiddleware(srv.Store, "admin"))
+	getAllUsersRouter.Use(middleware.RequirePermissionMiddleware(srv.UserCache, types.PERM_USERS_READ))
 	getAllUsersRouter.HandleFunc("/users", internal.HandleFuncDecorator(srv.GetAllUsersHandlers))
 
 	getUserByIdRouter := userGetRouter.PathPrefix("/").Subrouter()
-	getUserByIdRouter.Use(middleware.RestrictToMiddleware(srv.Store, "admin", "user"))
+	getUserByIdRouter.Use(middleware.RequirePermissionMiddleware(srv.UserCache))
 	getUserByIdRouter.HandleFunc("/users/{id}", internal.HandleFuncDecorator(srv.GetUserByIdHandler))
 
-	postUserRouter.HandleFunc("/signup", internal.HandleFuncDecorator(srv.CreateUserHandler))
-	postUserRouter.HandleFunc("/login", internal.HandleFuncDecorator(srv.LoginUserHandler))
+	signupRouter := gmux.Methods(http.MethodPost).Subrouter()
+	signupRouter.Use(middleware.RateLimitMiddleware(srv.rateLimiter, srv.rateLimits.signup, middleware.KeyByIP))
+	signupRouter.HandleFunc("/signup", internal.HandleFuncDecorator(srv.CreateUserHandler))
+
+	loginRouter := gmux.Methods(http.MethodPost).Subrouter()
+	loginRouter.Use(middleware.RateLimitMiddleware(srv.rateLimiter, srv.rateLimits.login, middleware.KeyByIP))
+	loginRouter.HandleFunc("/login", internal.HandleFuncDecorator(srv.LoginUserHandler))
+	loginRouter.HandleFunc("/login/2fa", internal.HandleFuncDecorator(srv.TwoFactorLoginHandler))
+
+	postUserRouter.HandleFunc("/token/refresh", internal.HandleFuncDecorator(srv.RefreshTokenHandler))
+	postUserRouter.HandleFunc("/logout", internal.HandleFuncDecorator(srv.LogoutHandler))
+
+	oidcRouter := gmux.PathPrefix("/auth/{provider}").Subrouter()
+	oidcRouter.HandleFunc("/login", internal.HandleFuncDecorator(srv.OIDCLoginHandler)).Methods(http.MethodGet)
+	oidcRouter.HandleFunc("/callback", internal.HandleFuncDecorator(srv.OIDCCallbackHandler)).Methods(http.MethodGet, http.MethodPost)
+
+	// Enrolment stays reachable for users whose role requires two-factor
+	// authentication they have not set up yet.
+	twoFactorRouter := gmux.Methods(http.MethodPost).PathPrefix("/users/2fa").Subrouter()
+	twoFactorRouter.Use(middleware.AuthMiddleware(srv.Token, srv.apiKeys))
+	twoFactorRouter.Use(middleware.TwoFactorEnrollmentMiddleware(srv.UserCache))
+	twoFactorRouter.HandleFunc("/enroll", internal.HandleFuncDecorator(srv.EnrollTwoFactorHandler))
+	twoFactorRouter.HandleFunc("/confirm", internal.HandleFuncDecorator(srv.ConfirmTwoFactorHandler))
+	twoFactorRouter.HandleFunc("/disable", internal.HandleFuncDecorator(srv.DisableTwoFactorHandler))
+	twoFactorRouter.HandleFunc("/recovery-codes", internal.HandleFuncDecorator(srv.RegenerateRecoveryCodesHandler))
+
+	logoutAllRouter := gmux.Methods(http.MethodPost).Subrouter()
+	logoutAllRouter.Use(middleware.AuthMiddleware(srv.Token, srv.apiKeys))
+	logoutAllRouter.Use(middleware.RequirePermissionMiddleware(srv.UserCache))
+	logoutAllRouter.HandleFunc("/logout/all", internal.HandleFuncDecorator(srv.LogoutAllHandler))
+
+	verifyRouter := gmux.Methods(http.MethodGet).Subrouter()
+	verifyRouter.HandleFunc("/verify", internal.HandleFuncDecorator(srv.VerifyAccountHandler))
+	verifyRouter.HandleFunc("/unlock", internal.HandleFuncDecorator(srv.UnlockAccountHandler))
+
+	resendVerificationRouter := gmux.Methods(http.MethodPost).Subrouter()
+	resendVerificationRouter.Use(middleware.AuthMiddleware(srv.Token, srv.apiKeys))
+	resendVerificationRouter.Use(middleware.RequirePermissionMiddleware(srv.UserCache))
+	resendVerificationRouter.HandleFunc("/verify/resend", internal.HandleFuncDecorator(srv.ResendVerificationHandler))
+
+	cacheStatsRouter := gmux.Methods(http.MethodGet).Subrouter()
+	cacheStatsRouter.Use(middleware.AuthMiddleware(srv.Token, srv.apiKeys))
+	cacheStatsRouter.Use(middleware.RequirePermissionMiddleware(srv.UserCache, types.PERM_USERS_MANAGE))
+	cacheStatsRouter.HandleFunc("/metrics/cache", internal.HandleFuncDecorator(srv.UserCacheStatsHandler))
+
+	revokeSessionsRouter := gmux.Methods(http.MethodPost).Subrouter()
+	revokeSessionsRouter.Use(middleware.AuthMiddleware(srv.Token, srv.apiKeys))
+	revokeSessionsRouter.Use(middleware.RequirePermissionMiddleware(srv.UserCache, types.PERM_USERS_MANAGE))
+	revokeSessionsRouter.HandleFunc("/users/{id}/sessions/revoke", internal.HandleFuncDecorator(srv.RevokeUserSessionsHandler))
 
-	updateUserRouter.Use(middleware.AuthMiddleware(srv.Token))
-	updateUserRouter.Use(middleware.RestrictToMiddleware(srv.Store, "admin", "user"))
+	updateUserRouter.Use(middleware.AuthMiddleware(srv.Token, srv.apiKeys))
+	updateUserRouter.Use(middleware.RequirePermissionMiddleware(srv.UserCache))
 	updateUserRouter.HandleFunc("/users/{id}", internal.HandleFuncDecorator(srv.UpdateUserByIdHandler))
 
-	deleteUserRouter.Use(middleware.AuthMiddleware(srv.Token))
-	deleteUserRouter.Use(middleware.RestrictToMiddleware(srv.Store, "admin", "user"))
+	deleteUserRouter.Use(middleware.AuthMiddleware(srv.Token, srv.apiKeys))
+	deleteUserRouter.Use(middleware.RequirePermissionMiddleware(srv.UserCache))
 	deleteUserRouter.HandleFunc("/users/{id}", internal.HandleFuncDecorator(srv.DeleteUserByIdHandler))
+
+	forgotPasswordRouter.Use(middleware.RateLimitMiddleware(srv.rateLimiter, srv.rateLimits.forgotPassword, middleware.KeyByIP))
 	forgotPasswordRouter.HandleFunc("/forgotpassword", internal.HandleFuncDecorator(srv.ForgotPasswordHandler))
 	resetPasswordRouter.HandleFunc("/resetpassword", internal.HandleFuncDecorator(srv.ResetPasswordHandler))
 }
 
 func orderRoutes(gmux *mux.Router, srv *Server) {
 	orderRouter := gmux.Methods(http.MethodPost).Subrouter()
-	orderRouter.Use(middleware.AuthMiddleware(srv.Token))
-	orderRouter.Use(middleware.RestrictToMiddleware(srv.Store, "user", "admin"))
+	orderRouter.Use(middleware.AuthMiddleware(srv.Token, srv.apiKeys))
+	orderRouter.Use(middleware.RequirePermissionMiddleware(srv.UserCache))
+	orderRouter.Use(middleware.RequireVerifiedMiddleware())
 	orderRouter.HandleFunc("/products/orders", internal.HandleFuncDecorator(srv.CreateOrderHandler))
+	orderRouter.HandleFunc("/orders/{id}/payments", internal.HandleFuncDecorator(srv.CreatePaymentHandler))
+	orderRouter.HandleFunc("/orders/{id}/payments/confirm", internal.HandleFuncDecorator(srv.ConfirmPaymentHandler))
+
+	getOrdersRouter := gmux.Methods(http.MethodGet).Subrouter()
+	getOrdersRouter.Use(middleware.AuthMiddleware(srv.Token, srv.apiKeys))
+	getOrdersRouter.Use(middleware.RequirePermissionMiddleware(srv.UserCache))
+	getOrdersRouter.HandleFunc("/orders", internal.HandleFuncDecorator(srv.GetAllOrdersHandler))
+	getOrdersRouter.HandleFunc("/orders/{id}", internal.HandleFuncDecorator(srv.GetOrderByIdHandler))
+	getOrdersRouter.HandleFunc("/orders/{id}/invoice", internal.HandleFuncDecorator(srv.GetOrderInvoiceHandler))
+	getOrdersRouter.HandleFunc("/users/{id}/orders", internal.HandleFuncDecorator(srv.GetUserOrdersHandler))
+	getOrdersRouter.HandleFunc("/me/orders", internal.HandleFuncDecorator(srv.GetUserOrdersHandler))
+
+	cancelOrderRouter := gmux.Methods(http.MethodPatch).Subrouter()
+	cancelOrderRouter.Use(middleware.AuthMiddleware(srv.Token, srv.apiKeys))
+	cancelOrderRouter.Use(middleware.RequirePermissionMiddleware(srv.UserCache))
+	cancelOrderRouter.HandleFunc("/orders/{id}/cancel", internal.HandleFuncDecorator(srv.CancelOrderHandler))
+
+	orderStatusRouter := gmux.Methods(http.MethodPatch).Subrouter()
+	orderStatusRouter.Use(middleware.AuthMiddleware(srv.Token, srv.apiKeys))
+	orderStatusRouter.Use(middleware.RequirePermissionMiddleware(srv.UserCache, types.PERM_ORDERS_ADVANCE))
+	orderStatusRouter.HandleFunc("/orders/{id}/status", internal.HandleFuncDecorator(srv.UpdateOrderStatusHandler))
+
+	refundRouter := gmux.Methods(http.MethodPost).Subrouter()
+	refundRouter.Use(middleware.AuthMiddleware(srv.Token, srv.apiKeys))
+	refundRouter.Use(middleware.RequirePermissionMiddleware(srv.UserCache, types.PERM_ORDERS_REFUND))
+	refundRouter.HandleFunc("/orders/{id}/refunds", internal.HandleFuncDecorator(srv.CreateRefundHandler))
+}
+
+func reviewRoutes(gmux *mux.Router, srv *Server) {
+	getReviewsRouter := gmux.Methods(http.MethodGet).Subrouter()
+	getReviewsRouter.HandleFunc("/reviews", internal.HandleFuncDecorator(srv.GetProductReviewsHandler))
+
+	postReviewRouter := gmux.Methods(http.MethodPost).Subrouter()
+	postReviewRouter.Use(middleware.AuthMiddleware(srv.Token, srv.apiKeys))
+	postReviewRouter.Use(middleware.RequirePermissionMiddleware(srv.UserCache))
+	postReviewRouter.HandleFunc("/reviews", internal.HandleFuncDecorator(srv.CreateReviewHandler))
+
+	updateReviewRouter := gmux.Methods(http.MethodPut).Subrouter()
+	updateReviewRouter.Use(middleware.AuthMiddleware(srv.Token, srv.apiKeys))
+	updateReviewRouter.Use(middleware.RequirePermissionMiddleware(srv.UserCache))
+	updateReviewRouter.HandleFunc("/reviews/{id}", internal.HandleFuncDecorator(srv.UpdateReviewHandler))
+
+	deleteReviewRouter := gmux.Methods(http.MethodDelete).Subrouter()
+	deleteReviewRouter.Use(middleware.AuthMiddleware(srv.Token, srv.apiKeys))
+	deleteReviewRouter.Use(middleware.RequirePermissionMiddleware(srv.UserCache))
+	deleteReviewRouter.HandleFunc("/reviews/{id}", internal.HandleFuncDecorator(srv.DeleteReviewHandler))
+
+	hideReviewRouter := gmux.Methods(http.MethodPatch).Subrouter()
+	hideReviewRouter.Use(middleware.AuthMiddleware(srv.Token, srv.apiKeys))
+	hideReviewRouter.Use(middleware.RequirePermissionMiddleware(srv.UserCache, types.PERM_REVIEWS_MODERATE))
+	hideReviewRouter.HandleFunc("/reviews/{id}/visibility", internal.HandleFuncDecorator(srv.UpdateReviewVisibilityHandler))
+}
+
+func inventoryRoutes(gmux *mux.Router, srv *Server) {
+	getInventoryRouter := gmux.PathPrefix("/inventory").Methods(http.MethodGet).Subrouter()
+	getInventoryRouter.Use(middleware.AuthMiddleware(srv.Token, srv.apiKeys))
+	getInventoryRouter.Use(middleware.RequirePermissionMiddleware(srv.UserCache, types.PERM_INVENTORY_READ))
+	getInventoryRouter.HandleFunc("/ingredients", internal.HandleFuncDecorator(srv.GetAllIngredientsHandler))
+
+	inventoryRouter := gmux.PathPrefix("/inventory").Methods(http.MethodPost, http.MethodPatch).Subrouter()
+	inventoryRouter.Use(middleware.AuthMiddleware(srv.Token, srv.apiKeys))
+	inventoryRouter.Use(middleware.RequirePermissionMiddleware(srv.UserCache, types.PERM_INVENTORY_WRITE))
+	inventoryRouter.HandleFunc("/ingredients", internal.HandleFuncDecorator(srv.CreateIngredientHandler)).Methods(http.MethodPost)
+	inventoryRouter.HandleFunc("/ingredients/{id}", internal.HandleFuncDecorator(srv.UpdateIngredientStockHandler)).Methods(http.MethodPatch)
+}
+
+func apiKeyRoutes(gmux *mux.Router, srv *Server) {
+	apiKeysRouter := gmux.PathPrefix("/apikeys").Subrouter()
+	apiKeysRouter.Use(middleware.AuthMiddleware(srv.Token, srv.apiKeys))
+	apiKeysRouter.Use(middleware.RequirePermissionMiddleware(srv.UserCache, types.PERM_APIKEYS_MANAGE))
+	apiKeysRouter.HandleFunc("", internal.HandleFuncDecorator(srv.GetAllAPIKeysHandler)).Methods(http.MethodGet)
+	apiKeysRouter.HandleFunc("", internal.HandleFuncDecorator(srv.CreateAPIKeyHandler)).Methods(http.MethodPost)
+	apiKeysRouter.HandleFunc("/{id}", internal.HandleFuncDecorator(srv.RevokeAPIKeyHandler)).Methods(http.MethodDelete)
+}
+
+func auditRoutes(gmux *mux.Router, srv *Server) {
+	auditRouter := gmux.Methods(http.MethodGet).Subrouter()
+	auditRouter.Use(middleware.AuthMiddleware(srv.Token, srv.apiKeys))
+	auditRouter.Use(middleware.RequirePermissionMiddleware(srv.UserCache, types.PERM_AUDIT_READ))
+	auditRouter.HandleFunc("/audit", internal.HandleFuncDecorator(srv.GetAuditLogHandler))
+}
+
+func roleRoutes(gmux *mux.Router, srv *Server) {
+	rolesRouter := gmux.PathPrefix("/roles").Subrouter()
+	rolesRouter.Use(middleware.AuthMiddleware(srv.Token, srv.apiKeys))
+	rolesRouter.Use(middleware.RequirePermissionMiddleware(srv.UserCache, types.PERM_ROLES_MANAGE))
+	rolesRouter.HandleFunc("", internal.HandleFuncDecorator(srv.GetAllRolesHandler)).Methods(http.MethodGet)
+	rolesRouter.HandleFunc("", internal.HandleFuncDecorator(srv.CreateRoleHandler)).Methods(http.MethodPost)
+	rolesRouter.HandleFunc("/{name}", internal.HandleFuncDecorator(srv.UpdateRoleHandler)).Methods(http.MethodPut)
+	rolesRouter.HandleFunc("/{name}", internal.HandleFuncDecorator(srv.DeleteRoleHandler)).Methods(http.MethodDelete)
+
+	userRoleRouter := gmux.Methods(http.MethodPatch).Subrouter()
+	userRoleRouter.Use(middleware.AuthMiddleware(srv.Token, srv.apiKeys))
+	userRoleRouter.Use(middleware.RequirePermissionMiddleware(srv.UserCache, types.PERM_ROLES_MANAGE))
+	userRoleRouter.HandleFunc("/users/{id}/role", internal.HandleFuncDecorator(srv.UpdateUserRoleHandler))
+}
+
+func reservationRoutes(gmux *mux.Router, srv *Server) {
+	availabilityRouter := gmux.Methods(http.MethodGet).Subrouter()
+	availabilityRouter.HandleFunc("/reservations/availability", internal.HandleFuncDecorator(srv.GetReservationAvailabilityHandler))
+
+	getTablesRouter := gmux.Methods(http.MethodGet).Subrouter()
+	getTablesRouter.Use(middleware.AuthMiddleware(srv.Token, srv.apiKeys))
+	getTablesRouter.Use(middleware.RequirePermissionMiddleware(srv.UserCache, types.PERM_RESERVATIONS_MANAGE))
+	getTablesRouter.HandleFunc("/tables", internal.HandleFuncDecorator(srv.GetAllTablesHandler))
+	getTablesRouter.HandleFunc("/reservations/day", internal.HandleFuncDecorator(srv.GetDayReservationsHandler))
+
+	getReservationsRouter := gmux.Methods(http.MethodGet).Subrouter()
+	getReservationsRouter.Use(middleware.AuthMiddleware(srv.Token, srv.apiKeys))
+	getReservationsRouter.Use(middleware.RequirePermissionMiddleware(srv.UserCache))
+	getReservationsRouter.HandleFunc("/reservations", internal.HandleFuncDecorator(srv.GetReservationsHandler))
+	getReservationsRouter.HandleFunc("/reservations/{id}", internal.HandleFuncDecorator(srv.GetReservationByIdHandler))
+
+	postTablesRouter := gmux.Methods(http.MethodPost).Subrouter()
+	postTablesRouter.Use(middleware.AuthMiddleware(srv.Token, srv.apiKeys))
+	postTablesRouter.Use(middleware.RequirePermissionMiddleware(srv.UserCache, types.PERM_RESERVATIONS_MANAGE))
+	postTablesRouter.HandleFunc("/tables", internal.HandleFuncDecorator(srv.CreateTableHandler))
+
+	postReservationRouter := gmux.Methods(http.MethodPost).Subrouter()
+	postReservationRouter.Use(middleware.AuthMiddleware(srv.Token, srv.apiKeys))
+	postReservationRouter.Use(middleware.RequirePermissionMiddleware(srv.UserCache))
+	postReservationRouter.Use(middleware.RequireVerifiedMiddleware())
+	postReservationRouter.HandleFunc("/reservations", internal.HandleFuncDecorator(srv.CreateReservationHandler))
+
+	updateTablesRouter := gmux.Methods(http.MethodPut).Subrouter()
+	updateTablesRouter.Use(middleware.AuthMiddleware(srv.Token, srv.apiKeys))
+	updateTablesRouter.Use(middleware.RequirePermissionMiddleware(srv.UserCache, types.PERM_RESERVATIONS_MANAGE))
+	updateTablesRouter.HandleFunc("/tables/{id}", internal.HandleFuncDecorator(srv.UpdateTableHandler))
+
+	updateReservationRouter := gmux.Methods(http.MethodPut).Subrouter()
+	updateReservationRouter.Use(middleware.AuthMiddleware(srv.Token, srv.apiKeys))
+	updateReservationRouter.Use(middleware.RequirePermissionMiddleware(srv.UserCache))
+	updateReservationRouter.Use(middleware.RequireVerifiedMiddleware())
+	updateReservationRouter.HandleFunc("/reservations/{id}", internal.HandleFuncDecorator(srv.UpdateReservationHandler))
+
+	cancelReservationRouter := gmux.Methods(http.MethodPatch).Subrouter()
+	cancelReservationRouter.Use(middleware.AuthMiddleware(srv.Token, srv.apiKeys))
+	cancelReservationRouter.Use(middleware.RequirePermissionMiddleware(srv.UserCache))
+	cancelReservationRouter.HandleFunc("/reservations/{id}/cancel", internal.HandleFuncDecorator(srv.CancelReservationHandler))
+
+	deleteTablesRouter := gmux.Methods(http.MethodDelete).Subrouter()
+	deleteTablesRouter.Use(middleware.AuthMiddleware(srv.Token, srv.apiKeys))
+	deleteTablesRouter.Use(middleware.RequirePermissionMiddleware(srv.UserCache, types.PERM_RESERVATIONS_MANAGE))
+	deleteTablesRouter.HandleFunc("/tables/{id}", internal.HandleFuncDecorator(srv.DeleteTableHandler))
+}
+
+func paymentRoutes(gmux *mux.Router, srv *Server) {
+	webhookRouter := gmux.Methods(http.MethodPost).Subrouter()
+	webhookRouter.HandleFunc("/payments/webhook/{provider}", internal.HandleFuncDecorator(srv.PaymentWebhookHandler))
 }
@@ -4,14 +4,25 @@ import (
 	"context"
 	"log"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/go-playground/validator/v10"
 	"github.com/gorilla/mux"
+	"github.com/redis/go-redis/v9"
 	"github.com/silaselisha/coffee-api/internal"
 	"github.com/silaselisha/coffee-api/internal/aws"
+	"github.com/silaselisha/coffee-api/internal/password"
+	"github.com/silaselisha/coffee-api/pkg/apikey"
+	"github.com/silaselisha/coffee-api/pkg/cache"
 	"github.com/silaselisha/coffee-api/pkg/client"
+	"github.com/silaselisha/coffee-api/pkg/lockout"
+	"github.com/silaselisha/coffee-api/pkg/oidc"
+	"github.com/silaselisha/coffee-api/pkg/payments"
+	"github.com/silaselisha/coffee-api/pkg/ratelimit"
+	middleware "github.com/silaselisha/coffee-api/pkg/server/internal"
 	"github.com/silaselisha/coffee-api/pkg/store"
 	"github.com/silaselisha/coffee-api/pkg/token"
 	"github.com/silaselisha/coffee-api/types"
@@ -27,6 +38,16 @@ type Server struct {
 	envs               *types.Config
 	Token              token.Token
 	taskDistributor    workers.TaskDistributor
+	payments           *payments.Registry
+	passwords          *password.Manager
+	keys               *token.KeySet
+	UserCache          *cache.UserCache
+	OIDC               *oidc.Registry
+	apiKeys            *apikey.Verifier
+	loginGuard         *lockout.Guard
+	rateLimiter        ratelimit.Store
+	rateLimits         rateLimits
+	dummyPasswordHash  string
 }
 
 func NewServer(ctx context.Context,
@@ -46,6 +67,7 @@ func NewServer(ctx context.Context,
 	)
 
 	router := mux.NewRouter()
+	router.Use(middleware.RequestIDMiddleware)
 
 	render(router, templQueries, fileServer) // serve static files
 
@@ -53,6 +75,15 @@ func NewServer(ctx context.Context,
 	productRoutes(apiRouter, server)
 	userRoutes(apiRouter, server)
 	orderRoutes(apiRouter, server)
+	reviewRoutes(apiRouter, server)
+	inventoryRoutes(apiRouter, server)
+	reservationRoutes(apiRouter, server)
+	paymentRoutes(apiRouter, server)
+	roleRoutes(apiRouter, server)
+	apiKeyRoutes(apiRouter, server)
+	auditRoutes(apiRouter, server)
+
+	router.HandleFunc("/.well-known/jwks.json", internal.HandleFuncDecorator(server.JWKSHandler)).Methods(http.MethodGet)
 
 	server.Router = router
 	return server
@@ -72,14 +103,76 @@ func newServerHelper(ctx context.Context,
 		o.Region = "us-east-1"
 	})
 
-	tkn := token.NewToken(envs.SECRET_ACCESS_KEY)
+	validation := token.NewValidation(envs.JWT_ISSUER, envs.JWT_AUDIENCE)
+	tkn := token.NewToken(envs.SECRET_ACCESS_KEY, validation)
+	if envs.JWT_KEYS_FILE != "" {
+		keys, err := token.LoadKeySet(envs.JWT_KEYS_FILE)
+		if err != nil {
+			log.Panic(err)
+		}
+
+		reload := 5 * time.Minute
+		if envs.JWT_KEYS_RELOAD != "" {
+			reload, err = time.ParseDuration(envs.JWT_KEYS_RELOAD)
+			if err != nil {
+				log.Panic(err)
+			}
+		}
+
+		// ctx only bounds start up, the watcher lives as long as the process.
+		go keys.Watch(context.Background(), reload)
+		tkn = token.NewKeySetToken(keys, validation)
+		server.keys = keys
+	}
+
 	store := store.NewMongoClient(mongoClient)
 	server.coffeeShopS3Bucket = coffeShopS3Bucket
 	server.Store = store
+	server.UserCache = newUserCache(envs, store)
+	server.OIDC = newOIDCRegistry(envs)
+	server.apiKeys = apikey.NewVerifier(store, server.UserCache)
+	if err := seedRoles(ctx, store); err != nil {
+		log.Panic(err)
+	}
+	if err := ensureProductSearchIndex(ctx, store); err != nil {
+		log.Panic(err)
+	}
 	server.envs = envs
 	server.Token = tkn
 	server.taskDistributor = distributor
 
+	server.payments = newPaymentRegistry(envs)
+
+	passwords, err := password.NewDefaultManager(envs.PASSWORD_HASHER)
+	if err != nil {
+		log.Panic(err)
+	}
+	server.passwords = passwords
+
+	// Migrations outlive ctx, which only bounds start up, and run in the
+	// background so that a slow one does not hold up serving.
+	go runMigrations(context.Background(), store,
+		migration{name: "clear_leaked_phone_numbers", run: func(ctx context.Context) error {
+			return clearLeakedPhoneNumbers(ctx, store, passwords)
+		}},
+		migration{name: "lowercase_emails", run: func(ctx context.Context) error {
+			return lowercaseEmails(ctx, store)
+		}},
+	)
+
+	dummyPassword, _, err := token.NewOpaqueToken()
+	if err != nil {
+		log.Panic(err)
+	}
+	server.dummyPasswordHash, err = passwords.Hash(dummyPassword)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	redisClient := redis.NewClient(&redis.Options{Addr: envs.REDIS_SERVER_ADDRESS})
+	server.loginGuard = lockout.NewGuard(redisClient, "coffee-api:login:", loginPolicy)
+	server.rateLimiter, server.rateLimits = newRateLimiter(envs, redisClient)
+
 	validate := validator.New(validator.WithRequiredStructEnabled())
 	server.vd = validate
 }
@@ -91,3 +184,98 @@ func render(router *mux.Router,
 	router.HandleFunc("/", internal.HandleFuncDecorator(templQueries.RenderHomePageHandler))
 	router.HandleFunc("/about", internal.HandleFuncDecorator(templQueries.RenderAboutPageHandler))
 }
+
+// newPaymentRegistry only offers the fake provider in development and test:
+// it settles any charge a correctly signed webhook claims was paid. A
+// provider without a webhook key would accept webhooks signed by anyone, so
+// the API refuses to start with one.
+func newPaymentRegistry(envs *types.Config) *payments.Registry {
+	providers := []payments.Provider{}
+	fallback := envs.PAYMENT_PROVIDER
+	if envs.APP_ENV == types.ENV_DEVELOPMENT || envs.APP_ENV == types.ENV_TEST {
+		providers = append(providers, payments.NewFakeProvider(envs.PAYMENT_WEBHOOK_KEY))
+		if fallback == "" {
+			fallback = "fake"
+		}
+	}
+
+	if len(providers) > 0 && envs.PAYMENT_WEBHOOK_KEY == "" {
+		log.Panic("PAYMENT_WEBHOOK_KEY must be set")
+	}
+	return payments.NewRegistry(fallback, providers...)
+}
+
+// newUserCache keeps entries in process memory unless USER_CACHE_BACKEND is
+// "redis", in which case every instance shares the Redis at
+// REDIS_SERVER_ADDRESS.
+func newUserCache(envs *types.Config, str store.Mongo) *cache.UserCache {
+	var err error
+	ttl := 30 * time.Second
+	if envs.USER_CACHE_TTL != "" {
+		ttl, err = time.ParseDuration(envs.USER_CACHE_TTL)
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+
+	size := 10000
+	if envs.USER_CACHE_SIZE != "" {
+		size, err = strconv.Atoi(envs.USER_CACHE_SIZE)
+		if err != nil || size <= 0 {
+			log.Panicf("invalid USER_CACHE_SIZE %q", envs.USER_CACHE_SIZE)
+		}
+	}
+
+	stats := &cache.Stats{}
+	var backend cache.Backend
+	switch envs.USER_CACHE_BACKEND {
+	case "", "memory":
+		backend = cache.NewMemory(size, stats)
+	case "redis":
+		client := redis.NewClient(&redis.Options{Addr: envs.REDIS_SERVER_ADDRESS})
+		backend = cache.NewRedis(client, "coffee-api:cache:")
+	default:
+		log.Panicf("unknown USER_CACHE_BACKEND %q", envs.USER_CACHE_BACKEND)
+	}
+	return cache.NewUserCache(str, backend, ttl, stats)
+}
+
+type rateLimits struct {
+	signup         ratelimit.Rule
+	login          ratelimit.Rule
+	forgotPassword ratelimit.Rule
+	products       ratelimit.Rule
+}
+
+// newRateLimiter counts requests in the Redis asynq uses unless
+// RATE_LIMIT_BACKEND is "memory". Each RATE_LIMIT_* limit is written as
+// "<requests>/<window>".
+func newRateLimiter(envs *types.Config, client redis.UniversalClient) (ratelimit.Store, rateLimits) {
+	rule := func(name, spec, fallback string) ratelimit.Rule {
+		if spec == "" {
+			spec = fallback
+		}
+		parsed, err := ratelimit.ParseRule(name, spec)
+		if err != nil {
+			log.Panic(err)
+		}
+		return parsed
+	}
+
+	limits := rateLimits{
+		signup:         rule("signup", envs.RATE_LIMIT_SIGNUP, "10/1h"),
+		login:          rule("login", envs.RATE_LIMIT_LOGIN, "20/1m"),
+		forgotPassword: rule("forgotpassword", envs.RATE_LIMIT_FORGOT_PASSWORD, "5/15m"),
+		products:       rule("products", envs.RATE_LIMIT_PRODUCTS, "300/1m"),
+	}
+
+	switch envs.RATE_LIMIT_BACKEND {
+	case "", "redis":
+		return ratelimit.NewRedis(client, "coffee-api:ratelimit:"), limits
+	case "memory":
+		return ratelimit.NewMemory(), limits
+	default:
+		log.Panicf("unknown RATE_LIMIT_BACKEND %q", envs.RATE_LIMIT_BACKEND)
+	}
+	return nil, limits
+}
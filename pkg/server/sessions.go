@@ -0,0 +1,323 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/silaselisha/coffee-api/internal"
+	"github.com/silaselisha/coffee-api/pkg/store"
+	"github.com/silaselisha/coffee-api/pkg/token"
+	"github.com/silaselisha/coffee-api/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const defaultAccessTokenTTL = 15 * time.Minute
+
+var (
+	errInvalidRefreshToken = errors.New("invalid or expired refresh token")
+	errRefreshTokenReused  = errors.New("refresh token was already used, every session started from the same login has been signed out")
+)
+
+type tokenPair struct {
+	access  string
+	refresh string
+}
+
+// issueTokens signs a short lived access token carrying the user's role and
+// token version and stores a new refresh token for the user. A zero family
+// starts a new login session, otherwise the refresh token continues the
+// family it was rotated from.
+func (s *Server) issueTokens(ctx context.Context, r *http.Request, user store.User, family primitive.ObjectID) (tokenPair, error) {
+	accessTTL, refreshTTL, err := s.tokenDurations()
+	if err != nil {
+		return tokenPair{}, err
+	}
+
+	access, err := s.Token.CreateToken(ctx, accessTTL, token.Subject{
+		Id:      user.Id.Hex(),
+		Email:   user.Email,
+		Role:    user.Role,
+		Version: user.TokenVersion,
+	})
+	if err != nil {
+		return tokenPair{}, err
+	}
+
+	refresh, digest, err := token.NewOpaqueToken()
+	if err != nil {
+		return tokenPair{}, err
+	}
+
+	if family.IsZero() {
+		family = primitive.NewObjectID()
+	}
+
+	collection := s.Store.Collection(ctx, "coffeeshop", "refresh_tokens")
+	_, err = collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "token_hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "family", Value: 1}}},
+		{Keys: bson.D{{Key: "user", Value: 1}}},
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	if err != nil {
+		return tokenPair{}, err
+	}
+
+	_, err = collection.InsertOne(ctx, store.RefreshToken{
+		Id:        primitive.NewObjectID(),
+		User:      user.Id,
+		Family:    family,
+		TokenHash: digest,
+		UserAgent: r.UserAgent(),
+		IP:        clientIP(r),
+		ExpiresAt: time.Now().Add(refreshTTL),
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		return tokenPair{}, err
+	}
+	return tokenPair{access: access, refresh: refresh}, nil
+}
+
+// tokenDurations reads ACCESS_TOKEN_TTL (a Go duration, 15m by default) for
+// access tokens, while JWT_EXPIRES_AT keeps its meaning of how many days a
+// login lasts and now bounds the refresh token.
+func (s *Server) tokenDurations() (access time.Duration, refresh time.Duration, err error) {
+	access = defaultAccessTokenTTL
+	if s.envs.ACCESS_TOKEN_TTL != "" {
+		access, err = time.ParseDuration(s.envs.ACCESS_TOKEN_TTL)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid access token ttl %w", err)
+		}
+	}
+
+	days, err := strconv.Atoi(s.envs.JWT_EXPIRES_AT)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid jwt expiry %w", err)
+	}
+	return access, time.Duration(days) * 24 * time.Hour, nil
+}
+
+// RefreshTokenHandler exchanges a refresh token for a new access and
+// refresh token. Each refresh token works once; presenting one that was
+// already rotated means two parties hold it, so the whole family is revoked
+// and both have to sign in again.
+func (s *Server) RefreshTokenHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	collection := s.Store.Collection(ctx, "coffeeshop", "refresh_tokens")
+
+	payload, err := internal.ReadReqBody[types.RefreshTokenParams](r.Body, s.vd)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+	}
+
+	var current store.RefreshToken
+	err = collection.FindOne(ctx, bson.D{{Key: "token_hash", Value: token.HashOpaqueToken(payload.RefreshToken)}}).Decode(&current)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return internal.ResponseHandler(w, internal.NewErrorResponse("failed", errInvalidRefreshToken.Error()), http.StatusUnauthorized)
+		}
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+
+	if current.RevokedAt != nil || time.Now().After(current.ExpiresAt) {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", errInvalidRefreshToken.Error()), http.StatusUnauthorized)
+	}
+
+	if current.RotatedAt != nil {
+		return s.refreshTokenReused(ctx, w, current.Family)
+	}
+
+	filter := bson.D{
+		{Key: "_id", Value: current.Id},
+		{Key: "rotated_at", Value: bson.D{{Key: "$exists", Value: false}}},
+		{Key: "revoked_at", Value: bson.D{{Key: "$exists", Value: false}}},
+	}
+	result, err := collection.UpdateOne(ctx, filter, bson.D{{Key: "$set", Value: bson.D{{Key: "rotated_at", Value: time.Now()}}}})
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+
+	// Lost the race against another request presenting the same token.
+	if result.ModifiedCount == 0 {
+		return s.refreshTokenReused(ctx, w, current.Family)
+	}
+
+	var user store.User
+	err = s.Store.Collection(ctx, "coffeeshop", "users").FindOne(ctx, bson.D{{Key: "_id", Value: current.User}}).Decode(&user)
+	if err == nil && current.CreatedAt.Before(user.PasswordChangedAt) {
+		err = mongo.ErrNoDocuments
+	}
+
+	if err != nil {
+		// The user is gone or changed their password since this session
+		// started, either way it ends here.
+		if err == mongo.ErrNoDocuments {
+			if err := revokeRefreshTokens(ctx, collection, bson.D{{Key: "family", Value: current.Family}}); err != nil {
+				return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+			}
+			return internal.ResponseHandler(w, internal.NewErrorResponse("failed", errInvalidRefreshToken.Error()), http.StatusUnauthorized)
+		}
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+
+	tokens, err := s.issueTokens(ctx, r, user, current.Family)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+
+	res := struct {
+		Status       string `json:"status"`
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}{
+		Status:       "success",
+		Token:        tokens.access,
+		RefreshToken: tokens.refresh,
+	}
+	return internal.ResponseHandler(w, res, http.StatusOK)
+}
+
+func (s *Server) refreshTokenReused(ctx context.Context, w http.ResponseWriter, family primitive.ObjectID) error {
+	collection := s.Store.Collection(ctx, "coffeeshop", "refresh_tokens")
+	if err := revokeRefreshTokens(ctx, collection, bson.D{{Key: "family", Value: family}}); err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+	return internal.ResponseHandler(w, internal.NewErrorResponse("failed", errRefreshTokenReused.Error()), http.StatusUnauthorized)
+}
+
+// LogoutHandler ends the session the refresh token belongs to. It does not
+// need an access token, which may already have expired on the device, and
+// succeeds for unknown tokens so that logging out twice is harmless.
+func (s *Server) LogoutHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	collection := s.Store.Collection(ctx, "coffeeshop", "refresh_tokens")
+
+	payload, err := internal.ReadReqBody[types.RefreshTokenParams](r.Body, s.vd)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+	}
+
+	var current store.RefreshToken
+	err = collection.FindOne(ctx, bson.D{{Key: "token_hash", Value: token.HashOpaqueToken(payload.RefreshToken)}}).Decode(&current)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+
+	if err == nil {
+		if err := revokeRefreshTokens(ctx, collection, bson.D{{Key: "family", Value: current.Family}}); err != nil {
+			return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+		}
+	}
+	return internal.ResponseHandler(w, "", http.StatusNoContent)
+}
+
+// LogoutAllHandler signs the caller out of every device, revoking their
+// refresh tokens and every access token issued so far.
+func (s *Server) LogoutAllHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	userInfo := ctx.Value(types.AuthUserInfoKey{}).(*types.UserInfo)
+
+	if err := s.revokeUserSessions(ctx, r, userInfo.Id); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return internal.ResponseHandler(w, internal.NewErrorResponse("failed", fmt.Errorf("document not found %w", err).Error()), http.StatusNotFound)
+		}
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+	return internal.ResponseHandler(w, "", http.StatusNoContent)
+}
+
+// RevokeUserSessionsHandler lets an admin sign a user out everywhere, for
+// instance after their device was stolen.
+func (s *Server) RevokeUserSessionsHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusBadRequest)
+	}
+
+	if err := s.revokeUserSessions(ctx, r, id); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return internal.ResponseHandler(w, internal.NewErrorResponse("failed", fmt.Errorf("document not found %w", err).Error()), http.StatusNotFound)
+		}
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+	return internal.ResponseHandler(w, "", http.StatusNoContent)
+}
+
+// revokeUserSessions bumps the user's token version, which RestrictToMiddleware
+// compares against the version signed into access tokens, and revokes all of
+// the user's refresh tokens. Both are audited in the same transaction.
+func (s *Server) revokeUserSessions(ctx context.Context, r *http.Request, userId primitive.ObjectID) error {
+	session, err := s.Store.TxnStartSession(ctx)
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(ctx mongo.SessionContext) (interface{}, error) {
+		users := s.Store.Collection(ctx, "coffeeshop", "users")
+		update := bson.D{
+			{Key: "$inc", Value: bson.D{{Key: "token_version", Value: 1}}},
+			{Key: "$set", Value: bson.D{{Key: "updated_at", Value: time.Now()}}},
+		}
+
+		oldDocs := options.Before
+		var previous store.User
+		err := users.FindOneAndUpdate(ctx, bson.D{{Key: "_id", Value: userId}}, update, &options.FindOneAndUpdateOptions{
+			ReturnDocument: &oldDocs,
+		}).Decode(&previous)
+		if err != nil {
+			return nil, err
+		}
+
+		var user store.User
+		if err := users.FindOne(ctx, bson.D{{Key: "_id", Value: userId}}).Decode(&user); err != nil {
+			return nil, err
+		}
+
+		collection := s.Store.Collection(ctx, "coffeeshop", "refresh_tokens")
+		if err := revokeRefreshTokens(ctx, collection, bson.D{{Key: "user", Value: userId}}); err != nil {
+			return nil, err
+		}
+		return nil, s.writeAudit(ctx, r, types.AUDIT_USER_SESSIONS_REVOKE, "user", userId.Hex(), previous, user)
+	}, &options.TransactionOptions{})
+
+	if err != nil {
+		return err
+	}
+	s.UserCache.InvalidateUser(ctx, userId)
+	return nil
+}
+
+// JWKSHandler publishes the public signing keys so other services can
+// verify our access tokens. The set is empty while tokens are still signed
+// with the shared HMAC secret.
+func (s *Server) JWKSHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	set := token.JWKSet{Keys: []token.JWK{}}
+	if s.keys != nil {
+		set = s.keys.JWKS(time.Now())
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	return internal.ResponseHandler(w, set, http.StatusOK)
+}
+
+func revokeRefreshTokens(ctx context.Context, collection *mongo.Collection, filter bson.D) error {
+	filter = append(filter, bson.E{Key: "revoked_at", Value: bson.D{{Key: "$exists", Value: false}}})
+	_, err := collection.UpdateMany(ctx, filter, bson.D{{Key: "$set", Value: bson.D{{Key: "revoked_at", Value: time.Now()}}}})
+	return err
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
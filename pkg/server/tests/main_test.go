@@ -17,6 +17,7 @@ import (
 	"github.com/silaselisha/coffee-api/pkg/client"
 	api "github.com/silaselisha/coffee-api/pkg/server"
 	"github.com/silaselisha/coffee-api/pkg/store"
+	"github.com/silaselisha/coffee-api/types"
 	"github.com/silaselisha/coffee-api/workers"
 	"go.mongodb.org/mongo-driver/mongo"
 )
@@ -31,6 +32,8 @@ var adminTestToken string
 var distributor workers.TaskDistributor
 var server *api.Server
 var ok bool
+var webhookKey string
+var testEnvs *types.Config
 
 func TestMain(m *testing.M) {
 	fmt.Println("RUNNING")
@@ -40,6 +43,20 @@ func TestMain(m *testing.M) {
 		log.Fatal(err)
 	}
 
+	// Every test request comes from the same address, and far faster than
+	// any client is allowed to log in.
+	envs.RATE_LIMIT_BACKEND = "memory"
+	envs.RATE_LIMIT_LOGIN = "1000/1m"
+
+	// Payments go through the fake provider, which only exists in test and
+	// development.
+	envs.APP_ENV = types.ENV_TEST
+	if envs.PAYMENT_WEBHOOK_KEY == "" {
+		envs.PAYMENT_WEBHOOK_KEY = "test-webhook-key"
+	}
+	webhookKey = envs.PAYMENT_WEBHOOK_KEY
+	testEnvs = envs
+
 	mongoClient, err = internal.Connect(context.Background(), envs)
 	if err != nil {
 		log.Fatal(err)
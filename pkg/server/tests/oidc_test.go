@@ -0,0 +1,206 @@
+package api__test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/silaselisha/coffee-api/pkg/oidc"
+	"github.com/silaselisha/coffee-api/pkg/store"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// standInOIDC is a minimal OpenID provider. The code handed to the token
+// endpoint names the email the id token asserts; a code ending in
+// "unverified" yields an unverified email.
+type standInOIDC struct {
+	*httptest.Server
+	key   *rsa.PrivateKey
+	nonce string
+}
+
+func newStandInOIDC(t *testing.T) *standInOIDC {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	op := &standInOIDC{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 op.URL,
+			"authorization_endpoint": op.URL + "/authorize",
+			"token_endpoint":         op.URL + "/token",
+			"jwks_uri":               op.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "stand-in",
+				"use": "sig",
+				"alg": "RS256",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		if r.Form.Get("client_secret") != "stand-in-secret" || r.Form.Get("code_verifier") == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+			return
+		}
+
+		code := r.Form.Get("code")
+		claims := jwt.MapClaims{
+			"iss":            op.URL,
+			"aud":            "coffee-api",
+			"sub":            "subject-" + code,
+			"email":          code,
+			"email_verified": !strings.HasSuffix(code, "unverified"),
+			"nonce":          op.nonce,
+			"iat":            time.Now().Unix(),
+			"exp":            time.Now().Add(time.Minute).Unix(),
+		}
+		idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		idToken.Header["kid"] = "stand-in"
+		signed, err := idToken.SignedString(key)
+		require.NoError(t, err)
+		json.NewEncoder(w).Encode(map[string]string{"id_token": signed, "token_type": "Bearer"})
+	})
+
+	op.Server = httptest.NewServer(mux)
+	t.Cleanup(op.Close)
+
+	server.OIDC.Register(oidc.NewProvider(oidc.Config{
+		Name:         "stand-in",
+		Issuer:       op.URL,
+		ClientID:     "coffee-api",
+		ClientSecret: "stand-in-secret",
+		RedirectURL:  "http://localhost/api/v1/auth/stand-in/callback",
+	}))
+	return op
+}
+
+// login walks the redirect and callback as a browser would and returns the
+// callback response.
+func (op *standInOIDC) login(t *testing.T, code string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodGet, "/api/v1/auth/stand-in/login", nil)
+	server.Router.ServeHTTP(recorder, request)
+	require.Equal(t, http.StatusFound, recorder.Code)
+
+	location, err := url.Parse(recorder.Header().Get("Location"))
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(location.String(), op.URL+"/authorize"))
+	require.Equal(t, "S256", location.Query().Get("code_challenge_method"))
+	op.nonce = location.Query().Get("nonce")
+
+	callback := fmt.Sprintf("/api/v1/auth/stand-in/callback?code=%s&state=%s", url.QueryEscape(code), location.Query().Get("state"))
+	recorder = httptest.NewRecorder()
+	request = httptest.NewRequest(http.MethodGet, callback, nil)
+	server.Router.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestOIDCLogin(t *testing.T) {
+	op := newStandInOIDC(t)
+	email := fmt.Sprintf("espresso%d@oidc.test", time.Now().UnixNano())
+	users := mongoClient.Database("coffeeshop").Collection("users")
+
+	t.Run("unknown provider | status 404", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodGet, "/api/v1/auth/myspace/login", nil)
+		server.Router.ServeHTTP(recorder, request)
+		require.Equal(t, http.StatusNotFound, recorder.Code)
+	})
+
+	t.Run("first login creates a verified account | status 200", func(t *testing.T) {
+		recorder := op.login(t, email)
+		require.Equal(t, http.StatusOK, recorder.Code)
+
+		var res struct {
+			Token        string `json:"token"`
+			RefreshToken string `json:"refresh_token"`
+		}
+		require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &res))
+		require.NotEmpty(t, res.Token)
+		require.NotEmpty(t, res.RefreshToken)
+
+		var user store.User
+		require.NoError(t, users.FindOne(context.Background(), bson.D{{Key: "email", Value: email}}).Decode(&user))
+		require.True(t, user.Verified)
+		require.Empty(t, user.Password)
+		require.Len(t, user.Identities, 1)
+
+		payload, err := server.Token.VerifyToken(context.Background(), res.Token)
+		require.NoError(t, err)
+		require.Equal(t, user.Id.Hex(), payload.Subject)
+	})
+
+	t.Run("second login reuses the account | status 200", func(t *testing.T) {
+		recorder := op.login(t, email)
+		require.Equal(t, http.StatusOK, recorder.Code)
+
+		count, err := users.CountDocuments(context.Background(), bson.D{{Key: "email", Value: email}})
+		require.NoError(t, err)
+		require.EqualValues(t, 1, count)
+	})
+
+	t.Run("login links an account whose email differs in case | status 200", func(t *testing.T) {
+		mixed := fmt.Sprintf("Mocha%d@OIDC.test", time.Now().UnixNano())
+		body, err := json.Marshal(map[string]interface{}{
+			"username":    fmt.Sprintf("mocha%d", time.Now().UnixNano()),
+			"email":       mixed,
+			"password":    "Abstract$87",
+			"phoneNumber": "+254700000000",
+		})
+		require.NoError(t, err)
+
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPost, "/api/v1/signup", bytes.NewReader(body))
+		server.Router.ServeHTTP(recorder, request)
+		require.Equal(t, http.StatusCreated, recorder.Code)
+
+		var user store.User
+		require.NoError(t, users.FindOne(context.Background(), bson.D{{Key: "email", Value: strings.ToLower(mixed)}}).Decode(&user))
+
+		recorder = op.login(t, strings.ToUpper(mixed))
+		require.Equal(t, http.StatusOK, recorder.Code)
+
+		var linked store.User
+		require.NoError(t, users.FindOne(context.Background(), bson.D{{Key: "_id", Value: user.Id}}).Decode(&linked))
+		require.Len(t, linked.Identities, 1)
+
+		count, err := users.CountDocuments(context.Background(), bson.D{{Key: "email", Value: strings.ToLower(mixed)}})
+		require.NoError(t, err)
+		require.EqualValues(t, 1, count)
+	})
+
+	t.Run("unverified email is not linked | status 403", func(t *testing.T) {
+		recorder := op.login(t, "latte@oidc.test-unverified")
+		require.Equal(t, http.StatusForbidden, recorder.Code)
+	})
+
+	t.Run("state is single use | status 400", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodGet, "/api/v1/auth/stand-in/callback?code=x&state=forged", nil)
+		server.Router.ServeHTTP(recorder, request)
+		require.Equal(t, http.StatusBadRequest, recorder.Code)
+	})
+}
@@ -0,0 +1,452 @@
+package api__test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/silaselisha/coffee-api/pkg/store"
+	"github.com/silaselisha/coffee-api/types"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func createTestOrder(t *testing.T, token string) store.Order {
+	item := createTestProduct(t)
+
+	body, err := json.Marshal(map[string]interface{}{
+		"items": []map[string]interface{}{
+			{"product": item.Id.Hex(), "quantity": 2},
+		},
+	})
+	require.NoError(t, err)
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodPost, "/api/v1/products/orders", bytes.NewReader(body))
+	request.Header.Set("authorization", fmt.Sprintf("Bearer %s", token))
+	server.Router.ServeHTTP(recorder, request)
+	require.Equal(t, http.StatusCreated, recorder.Code)
+
+	var order store.Order
+	data, err := io.ReadAll(recorder.Body)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(data, &order))
+	return order
+}
+
+// createTestProduct inserts a throwaway product straight into the products
+// collection so order tests do not depend on the products test suite.
+func createTestProduct(t *testing.T) store.Item {
+	collection := mongoClient.Database("coffeeshop").Collection("products")
+	item := store.Item{
+		Id:          primitive.NewObjectID(),
+		Name:        fmt.Sprintf("Order Test Espresso %d", time.Now().UnixNano()),
+		Price:       3.00,
+		Summary:     product.Summary,
+		Category:    "beverages",
+		Description: product.Description,
+		Ingridients: product.Ingridients,
+		CreatedAt:   time.Now(),
+		UpdatedAt:   time.Now(),
+	}
+
+	_, err := collection.InsertOne(context.Background(), item)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		collection.DeleteOne(context.Background(), bson.D{{Key: "_id", Value: item.Id}})
+	})
+	return item
+}
+
+func TestOrderLifecycle(t *testing.T) {
+	order := createTestOrder(t, adminTestToken)
+	require.Equal(t, types.ORDER_PENDING, order.Status)
+
+	testCases := []struct {
+		name   string
+		status string
+		check  func(t *testing.T, recorder *httptest.ResponseRecorder)
+	}{
+		{
+			name:   "skip straight to ready | status 409",
+			status: types.ORDER_READY,
+			check: func(t *testing.T, recorder *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusConflict, recorder.Code)
+			},
+		},
+		{
+			name:   "accept order | status 200",
+			status: types.ORDER_ACCEPTED,
+			check: func(t *testing.T, recorder *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusOK, recorder.Code)
+			},
+		},
+		{
+			name:   "prepare order | status 200",
+			status: types.ORDER_PREPARING,
+			check: func(t *testing.T, recorder *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusOK, recorder.Code)
+			},
+		},
+		{
+			name:   "order ready | status 200",
+			status: types.ORDER_READY,
+			check: func(t *testing.T, recorder *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusOK, recorder.Code)
+			},
+		},
+		{
+			name:   "cancel ready order | status 409",
+			status: types.ORDER_CANCELLED,
+			check: func(t *testing.T, recorder *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusConflict, recorder.Code)
+			},
+		},
+		{
+			name:   "complete order | status 200",
+			status: types.ORDER_COMPLETED,
+			check: func(t *testing.T, recorder *httptest.ResponseRecorder) {
+				var result struct {
+					Status string
+					Data   store.Order
+				}
+				data, err := io.ReadAll(recorder.Body)
+				require.NoError(t, err)
+				require.NoError(t, json.Unmarshal(data, &result))
+				require.Equal(t, http.StatusOK, recorder.Code)
+				require.Len(t, result.Data.StatusHistory, 5)
+			},
+		},
+		{
+			name:   "invalid status | status 400",
+			status: "brewing",
+			check: func(t *testing.T, recorder *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusBadRequest, recorder.Code)
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			body, err := json.Marshal(map[string]interface{}{"status": tc.status})
+			require.NoError(t, err)
+
+			url := fmt.Sprintf("/api/v1/orders/%s/status", order.Id.Hex())
+			recorder := httptest.NewRecorder()
+			request := httptest.NewRequest(http.MethodPatch, url, bytes.NewReader(body))
+			request.Header.Set("authorization", fmt.Sprintf("Bearer %s", adminTestToken))
+
+			server.Router.ServeHTTP(recorder, request)
+			tc.check(t, recorder)
+		})
+	}
+}
+
+func TestCancelOrder(t *testing.T) {
+	order := createTestOrder(t, adminTestToken)
+
+	testCases := []struct {
+		name  string
+		id    string
+		token string
+		check func(t *testing.T, recorder *httptest.ResponseRecorder)
+	}{
+		{
+			name:  "cancel pending order | status 200",
+			id:    order.Id.Hex(),
+			token: adminTestToken,
+			check: func(t *testing.T, recorder *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusOK, recorder.Code)
+			},
+		},
+		{
+			name:  "cancel cancelled order | status 409",
+			id:    order.Id.Hex(),
+			token: adminTestToken,
+			check: func(t *testing.T, recorder *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusConflict, recorder.Code)
+			},
+		},
+		{
+			name:  "cancel order by invalid id | status 400",
+			id:    "1234",
+			token: adminTestToken,
+			check: func(t *testing.T, recorder *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusBadRequest, recorder.Code)
+			},
+		},
+		{
+			name:  "cancel order by unknown id | status 404",
+			id:    "65bcc06cbc92379c5b6fe79b",
+			token: adminTestToken,
+			check: func(t *testing.T, recorder *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusNotFound, recorder.Code)
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			url := fmt.Sprintf("/api/v1/orders/%s/cancel", tc.id)
+			recorder := httptest.NewRecorder()
+			request := httptest.NewRequest(http.MethodPatch, url, nil)
+			request.Header.Set("authorization", fmt.Sprintf("Bearer %s", tc.token))
+
+			server.Router.ServeHTTP(recorder, request)
+			tc.check(t, recorder)
+		})
+	}
+}
+
+func TestGetOrders(t *testing.T) {
+	order := createTestOrder(t, adminTestToken)
+
+	testCases := []struct {
+		name  string
+		url   string
+		token string
+		check func(t *testing.T, recorder *httptest.ResponseRecorder)
+	}{
+		{
+			name:  "get all orders | status 200",
+			url:   "/api/v1/orders",
+			token: adminTestToken,
+			check: func(t *testing.T, recorder *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusOK, recorder.Code)
+			},
+		},
+		{
+			name:  "get order by id | status 200",
+			url:   fmt.Sprintf("/api/v1/orders/%s", order.Id.Hex()),
+			token: adminTestToken,
+			check: func(t *testing.T, recorder *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusOK, recorder.Code)
+			},
+		},
+		{
+			name:  "get order by unknown id | status 404",
+			url:   "/api/v1/orders/65bcc06cbc92379c5b6fe79b",
+			token: adminTestToken,
+			check: func(t *testing.T, recorder *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusNotFound, recorder.Code)
+			},
+		},
+		{
+			name:  "get my order history | status 200",
+			url:   "/api/v1/users/me/orders?limit=1&status=pending,accepted",
+			token: adminTestToken,
+			check: func(t *testing.T, recorder *httptest.ResponseRecorder) {
+				var result struct {
+					Status     string
+					NextCursor string `json:"next_cursor"`
+					Data       []store.Order
+				}
+				data, err := io.ReadAll(recorder.Body)
+				require.NoError(t, err)
+				require.NoError(t, json.Unmarshal(data, &result))
+				require.Equal(t, http.StatusOK, recorder.Code)
+				require.LessOrEqual(t, len(result.Data), 1)
+			},
+		},
+		{
+			name:  "get my order history without a user id | status 200",
+			url:   "/api/v1/me/orders?status=pending",
+			token: adminTestToken,
+			check: func(t *testing.T, recorder *httptest.ResponseRecorder) {
+				var result struct {
+					Data []store.Order
+				}
+				data, err := io.ReadAll(recorder.Body)
+				require.NoError(t, err)
+				require.NoError(t, json.Unmarshal(data, &result))
+				require.Equal(t, http.StatusOK, recorder.Code)
+				for _, order := range result.Data {
+					require.Equal(t, adminID, order.Owner.Hex())
+				}
+			},
+		},
+		{
+			name:  "get user order history by id | status 200",
+			url:   fmt.Sprintf("/api/v1/users/%s/orders?from=2024-01-01", adminID),
+			token: adminTestToken,
+			check: func(t *testing.T, recorder *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusOK, recorder.Code)
+			},
+		},
+		{
+			name:  "get order history with invalid cursor | status 400",
+			url:   "/api/v1/users/me/orders?cursor=abc",
+			token: adminTestToken,
+			check: func(t *testing.T, recorder *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusBadRequest, recorder.Code)
+			},
+		},
+		{
+			name:  "get order history with invalid date | status 400",
+			url:   "/api/v1/users/me/orders?from=yesterday",
+			token: adminTestToken,
+			check: func(t *testing.T, recorder *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusBadRequest, recorder.Code)
+			},
+		},
+		{
+			name:  "get all orders without token | status 403",
+			url:   "/api/v1/orders",
+			token: "",
+			check: func(t *testing.T, recorder *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusForbidden, recorder.Code)
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			request := httptest.NewRequest(http.MethodGet, tc.url, nil)
+			request.Header.Set("authorization", fmt.Sprintf("Bearer %s", tc.token))
+
+			server.Router.ServeHTTP(recorder, request)
+			tc.check(t, recorder)
+		})
+	}
+}
+
+func TestOrderStockReservation(t *testing.T) {
+	item := createTestProduct(t)
+	products := mongoClient.Database("coffeeshop").Collection("products")
+	_, err := products.UpdateOne(context.Background(),
+		bson.D{{Key: "_id", Value: item.Id}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "track_stock", Value: true}, {Key: "stock", Value: 1}}}})
+	require.NoError(t, err)
+
+	stockLevel := func(t *testing.T) int64 {
+		var current store.Item
+		err := products.FindOne(context.Background(), bson.D{{Key: "_id", Value: item.Id}}).Decode(&current)
+		require.NoError(t, err)
+		return current.Stock
+	}
+
+	placeOrder := func(quantity int) *httptest.ResponseRecorder {
+		body, err := json.Marshal(map[string]interface{}{
+			"items": []map[string]interface{}{
+				{"product": item.Id.Hex(), "quantity": quantity},
+			},
+		})
+		require.NoError(t, err)
+
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPost, "/api/v1/products/orders", bytes.NewReader(body))
+		request.Header.Set("authorization", fmt.Sprintf("Bearer %s", adminTestToken))
+		server.Router.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	t.Run("order more than in stock | status 409", func(t *testing.T) {
+		recorder := placeOrder(2)
+		require.Equal(t, http.StatusConflict, recorder.Code)
+
+		var result struct {
+			Items []types.StockShortageParams
+		}
+		data, err := io.ReadAll(recorder.Body)
+		require.NoError(t, err)
+		require.NoError(t, json.Unmarshal(data, &result))
+		require.Len(t, result.Items, 1)
+		require.Equal(t, item.Id.Hex(), result.Items[0].Product)
+		require.Equal(t, int64(1), stockLevel(t))
+	})
+
+	var order store.Order
+	t.Run("order what is in stock | status 201", func(t *testing.T) {
+		recorder := placeOrder(1)
+		require.Equal(t, http.StatusCreated, recorder.Code)
+
+		data, err := io.ReadAll(recorder.Body)
+		require.NoError(t, err)
+		require.NoError(t, json.Unmarshal(data, &order))
+		require.Equal(t, int64(0), stockLevel(t))
+
+		var stored store.Order
+		orders := mongoClient.Database("coffeeshop").Collection("orders")
+		err = orders.FindOne(context.Background(), bson.D{{Key: "_id", Value: order.Id}}).Decode(&stored)
+		require.NoError(t, err)
+		require.NotNil(t, stored.Items[0].Reserved)
+		require.True(t, stored.Items[0].Reserved.Product)
+	})
+
+	t.Run("cancel order restocks what was reserved | status 200", func(t *testing.T) {
+		// Whether the product tracks stock now does not change what the
+		// order took.
+		_, err := products.UpdateOne(context.Background(),
+			bson.D{{Key: "_id", Value: item.Id}},
+			bson.D{{Key: "$set", Value: bson.D{{Key: "track_stock", Value: false}}}})
+		require.NoError(t, err)
+
+		url := fmt.Sprintf("/api/v1/orders/%s/cancel", order.Id.Hex())
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPatch, url, nil)
+		request.Header.Set("authorization", fmt.Sprintf("Bearer %s", adminTestToken))
+		server.Router.ServeHTTP(recorder, request)
+
+		require.Equal(t, http.StatusOK, recorder.Code)
+		require.Equal(t, int64(1), stockLevel(t))
+	})
+}
+
+func TestGetOrderInvoice(t *testing.T) {
+	order := createTestOrder(t, adminTestToken)
+	invoices := mongoClient.Database("coffeeshop").Collection("invoices")
+
+	getInvoice := func(query string) *httptest.ResponseRecorder {
+		url := fmt.Sprintf("/api/v1/orders/%s/invoice%s", order.Id.Hex(), query)
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodGet, url, nil)
+		request.Header.Set("authorization", fmt.Sprintf("Bearer %s", adminTestToken))
+		server.Router.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	t.Run("invoice of an unpaid order | status 404", func(t *testing.T) {
+		recorder := getInvoice("")
+		require.Equal(t, http.StatusNotFound, recorder.Code)
+	})
+
+	t.Run("invoice record of a paid order | status 200", func(t *testing.T) {
+		invoice := store.Invoice{
+			Id:        primitive.NewObjectID(),
+			Number:    fmt.Sprintf("TEST-%d", time.Now().UnixNano()),
+			Order:     order.Id,
+			Customer:  order.Owner,
+			Total:     order.TotalAmount,
+			IssuedAt:  time.Now(),
+			CreatedAt: time.Now(),
+			UpdatedAt: time.Now(),
+		}
+		_, err := invoices.InsertOne(context.Background(), invoice)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			invoices.DeleteOne(context.Background(), bson.D{{Key: "_id", Value: invoice.Id}})
+		})
+
+		recorder := getInvoice("?format=json")
+		require.Equal(t, http.StatusOK, recorder.Code)
+
+		var result struct {
+			Data store.Invoice
+		}
+		data, err := io.ReadAll(recorder.Body)
+		require.NoError(t, err)
+		require.NoError(t, json.Unmarshal(data, &result))
+		require.Equal(t, invoice.Number, result.Data.Number)
+
+		recorder = getInvoice("")
+		require.Equal(t, http.StatusNotFound, recorder.Code)
+	})
+}
@@ -0,0 +1,439 @@
+package api__test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/hibiken/asynq"
+	"github.com/silaselisha/coffee-api/pkg/payments"
+	"github.com/silaselisha/coffee-api/pkg/store"
+	"github.com/silaselisha/coffee-api/types"
+	"github.com/silaselisha/coffee-api/workers"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestOrderPayment(t *testing.T) {
+	fake := payments.NewFakeProvider(webhookKey)
+
+	order := createTestOrder(t, adminTestToken)
+	require.Equal(t, types.PENDING, order.PaymentStatus)
+
+	var payment store.Payment
+	t.Run("pay order by card | status 201", func(t *testing.T) {
+		body, err := json.Marshal(map[string]interface{}{"provider": "fake", "method": payments.METHOD_CARD})
+		require.NoError(t, err)
+
+		url := fmt.Sprintf("/api/v1/orders/%s/payments", order.Id.Hex())
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+		request.Header.Set("authorization", fmt.Sprintf("Bearer %s", adminTestToken))
+		server.Router.ServeHTTP(recorder, request)
+		require.Equal(t, http.StatusCreated, recorder.Code)
+
+		var result struct {
+			Data store.Payment
+		}
+		data, err := io.ReadAll(recorder.Body)
+		require.NoError(t, err)
+		require.NoError(t, json.Unmarshal(data, &result))
+		require.NotEmpty(t, result.Data.Reference)
+		require.NotEmpty(t, result.Data.RedirectURL)
+		payment = result.Data
+	})
+
+	webhook := func(signature string) *httptest.ResponseRecorder {
+		body, err := json.Marshal(map[string]interface{}{
+			"id":        "evt_" + payment.Reference,
+			"type":      payments.EVENT_PAYMENT_SUCCEEDED,
+			"reference": payment.Reference,
+		})
+		require.NoError(t, err)
+		if signature == "" {
+			signature = fake.Sign(body)
+		}
+
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPost, "/api/v1/payments/webhook/fake", bytes.NewReader(body))
+		request.Header.Set(payments.FakeSignatureHeader, signature)
+		server.Router.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	t.Run("webhook with a forged signature | status 401", func(t *testing.T) {
+		recorder := webhook("00ff")
+		require.Equal(t, http.StatusUnauthorized, recorder.Code)
+	})
+
+	t.Run("webhook marks order paid | status 200", func(t *testing.T) {
+		recorder := webhook("")
+		require.Equal(t, http.StatusOK, recorder.Code)
+
+		var updated store.Order
+		orders := mongoClient.Database("coffeeshop").Collection("orders")
+		err := orders.FindOne(context.Background(), bson.D{{Key: "_id", Value: order.Id}}).Decode(&updated)
+		require.NoError(t, err)
+		require.Equal(t, types.PAID, updated.PaymentStatus)
+		require.Equal(t, payment.Id, updated.Payment)
+	})
+
+	t.Run("redelivered webhook is acknowledged | status 200", func(t *testing.T) {
+		recorder := webhook("")
+		require.Equal(t, http.StatusOK, recorder.Code)
+		require.Contains(t, recorder.Body.String(), "already processed")
+	})
+
+	t.Run("pay a paid order | status 409", func(t *testing.T) {
+		body, err := json.Marshal(map[string]interface{}{"method": payments.METHOD_MOBILE_MONEY, "phone": "+254700000000"})
+		require.NoError(t, err)
+
+		url := fmt.Sprintf("/api/v1/orders/%s/payments", order.Id.Hex())
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+		request.Header.Set("authorization", fmt.Sprintf("Bearer %s", adminTestToken))
+		server.Router.ServeHTTP(recorder, request)
+		require.Equal(t, http.StatusConflict, recorder.Code)
+	})
+}
+
+func TestPaymentInProgress(t *testing.T) {
+	fake := payments.NewFakeProvider(webhookKey)
+	order := createTestOrder(t, adminTestToken)
+
+	pay := func() *httptest.ResponseRecorder {
+		body, err := json.Marshal(map[string]interface{}{"provider": "fake", "method": payments.METHOD_CARD})
+		require.NoError(t, err)
+
+		url := fmt.Sprintf("/api/v1/orders/%s/payments", order.Id.Hex())
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+		request.Header.Set("authorization", fmt.Sprintf("Bearer %s", adminTestToken))
+		server.Router.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	var payment store.Payment
+	t.Run("start a payment | status 201", func(t *testing.T) {
+		recorder := pay()
+		require.Equal(t, http.StatusCreated, recorder.Code)
+
+		var result struct {
+			Data store.Payment
+		}
+		data, err := io.ReadAll(recorder.Body)
+		require.NoError(t, err)
+		require.NoError(t, json.Unmarshal(data, &result))
+		payment = result.Data
+	})
+
+	t.Run("start another while it is pending | status 409", func(t *testing.T) {
+		recorder := pay()
+		require.Equal(t, http.StatusConflict, recorder.Code)
+
+		var updated store.Order
+		orders := mongoClient.Database("coffeeshop").Collection("orders")
+		err := orders.FindOne(context.Background(), bson.D{{Key: "_id", Value: order.Id}}).Decode(&updated)
+		require.NoError(t, err)
+		require.Equal(t, payment.Id, updated.Payment)
+	})
+
+	t.Run("start another once it failed | status 201", func(t *testing.T) {
+		body, err := json.Marshal(map[string]interface{}{
+			"id":        "evt_" + payment.Reference,
+			"type":      payments.EVENT_PAYMENT_FAILED,
+			"reference": payment.Reference,
+		})
+		require.NoError(t, err)
+
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPost, "/api/v1/payments/webhook/fake", bytes.NewReader(body))
+		request.Header.Set(payments.FakeSignatureHeader, fake.Sign(body))
+		server.Router.ServeHTTP(recorder, request)
+		require.Equal(t, http.StatusOK, recorder.Code)
+
+		recorder = pay()
+		require.Equal(t, http.StatusCreated, recorder.Code)
+	})
+}
+
+// payTestOrder pays for an order with the fake provider and settles it the
+// way the provider would, through a signed webhook.
+func payTestOrder(t *testing.T, order store.Order) {
+	fake := payments.NewFakeProvider(webhookKey)
+
+	body, err := json.Marshal(map[string]interface{}{"method": payments.METHOD_MOBILE_MONEY, "phone": "+254700000000"})
+	require.NoError(t, err)
+
+	url := fmt.Sprintf("/api/v1/orders/%s/payments", order.Id.Hex())
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	request.Header.Set("authorization", fmt.Sprintf("Bearer %s", adminTestToken))
+	server.Router.ServeHTTP(recorder, request)
+	require.Equal(t, http.StatusCreated, recorder.Code)
+
+	var result struct {
+		Data store.Payment
+	}
+	data, err := io.ReadAll(recorder.Body)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(data, &result))
+
+	body, err = json.Marshal(map[string]interface{}{
+		"id":        "evt_" + result.Data.Reference,
+		"type":      payments.EVENT_PAYMENT_SUCCEEDED,
+		"reference": result.Data.Reference,
+	})
+	require.NoError(t, err)
+
+	recorder = httptest.NewRecorder()
+	request = httptest.NewRequest(http.MethodPost, "/api/v1/payments/webhook/fake", bytes.NewReader(body))
+	request.Header.Set(payments.FakeSignatureHeader, fake.Sign(body))
+	server.Router.ServeHTTP(recorder, request)
+	require.Equal(t, http.StatusOK, recorder.Code)
+}
+
+// invoiceBucket keeps the documents the invoice worker uploads in memory.
+type invoiceBucket struct {
+	documents map[string][]byte
+	uploads   int
+}
+
+func (b *invoiceBucket) UploadImage(ctx context.Context, objectKey, bucketName, extension string, image []byte) error {
+	return nil
+}
+
+func (b *invoiceBucket) UploadMultipleImages(ctx context.Context, payload []*types.PayloadUploadImage, bucket string) error {
+	return nil
+}
+
+func (b *invoiceBucket) DeleteImage(ctx context.Context, objectKey string, bucket string) error {
+	return nil
+}
+
+func (b *invoiceBucket) UploadDocument(ctx context.Context, objectKey, bucketName, contentType string, document []byte) error {
+	b.uploads++
+	b.documents[objectKey] = document
+	return nil
+}
+
+func (b *invoiceBucket) DownloadObject(ctx context.Context, objectKey, bucketName string) ([]byte, error) {
+	return b.documents[objectKey], nil
+}
+
+func TestGenerateInvoice(t *testing.T) {
+	order := createTestOrder(t, adminTestToken)
+	payTestOrder(t, order)
+
+	envs := *testEnvs
+	envs.INVOICE_TAX_RATE = "16"
+	bucket := &invoiceBucket{documents: map[string][]byte{}}
+	processor := workers.NewTaskServerProcessor(asynq.RedisClientOpt{Addr: envs.REDIS_SERVER_ADDRESS}, server.Store, envs, bucket)
+
+	payload, err := json.Marshal(types.PayloadGenerateInvoice{Order: order.Id.Hex()})
+	require.NoError(t, err)
+	task := asynq.NewTask(workers.GENERATE_INVOICE, payload)
+	invoices := mongoClient.Database("coffeeshop").Collection("invoices")
+
+	var inv store.Invoice
+	t.Run("issue the invoice of a paid order", func(t *testing.T) {
+		require.NoError(t, processor.ProcessTaskGenerateInvoice(context.Background(), task))
+
+		err := invoices.FindOne(context.Background(), bson.D{{Key: "order", Value: order.Id}}).Decode(&inv)
+		require.NoError(t, err)
+		require.True(t, strings.HasPrefix(inv.Number, "INV-"))
+		require.Equal(t, 16.0, inv.TaxRate)
+		require.InDelta(t, order.TotalAmount, inv.Total, 0.001)
+		require.InDelta(t, inv.Total, inv.Net+inv.Tax, 0.001)
+		require.NotEmpty(t, inv.ObjectKey)
+		require.Equal(t, 1, bucket.uploads)
+		require.Contains(t, string(bucket.documents[inv.ObjectKey]), inv.Number)
+	})
+
+	t.Run("redelivered task keeps the invoice and its number", func(t *testing.T) {
+		var counter store.Counter
+		counters := mongoClient.Database("coffeeshop").Collection("counters")
+		err := counters.FindOne(context.Background(), bson.D{{Key: "_id", Value: "invoice"}}).Decode(&counter)
+		require.NoError(t, err)
+
+		require.NoError(t, processor.ProcessTaskGenerateInvoice(context.Background(), task))
+
+		count, err := invoices.CountDocuments(context.Background(), bson.D{{Key: "order", Value: order.Id}})
+		require.NoError(t, err)
+		require.Equal(t, int64(1), count)
+
+		var again store.Invoice
+		err = invoices.FindOne(context.Background(), bson.D{{Key: "order", Value: order.Id}}).Decode(&again)
+		require.NoError(t, err)
+		require.Equal(t, inv.Number, again.Number)
+		require.Equal(t, 1, bucket.uploads)
+
+		var after store.Counter
+		err = counters.FindOne(context.Background(), bson.D{{Key: "_id", Value: "invoice"}}).Decode(&after)
+		require.NoError(t, err)
+		require.Equal(t, counter.Seq, after.Seq)
+	})
+}
+
+func TestOrderRefunds(t *testing.T) {
+	order := createTestOrder(t, adminTestToken)
+	product := order.Items[0].Product
+
+	refund := func(body map[string]interface{}) *httptest.ResponseRecorder {
+		data, err := json.Marshal(body)
+		require.NoError(t, err)
+
+		url := fmt.Sprintf("/api/v1/orders/%s/refunds", order.Id.Hex())
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPost, url, bytes.NewReader(data))
+		request.Header.Set("authorization", fmt.Sprintf("Bearer %s", adminTestToken))
+		server.Router.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	t.Run("refund an unpaid order | status 409", func(t *testing.T) {
+		recorder := refund(map[string]interface{}{"reason": "changed mind"})
+		require.Equal(t, http.StatusConflict, recorder.Code)
+	})
+
+	payTestOrder(t, order)
+	t.Cleanup(func() {
+		refunds := mongoClient.Database("coffeeshop").Collection("refunds")
+		refunds.DeleteMany(context.Background(), bson.D{{Key: "order", Value: order.Id}})
+	})
+
+	testCases := []struct {
+		name  string
+		body  map[string]interface{}
+		check func(t *testing.T, recorder *httptest.ResponseRecorder)
+	}{
+		{
+			name: "refund one of two units | status 201",
+			body: map[string]interface{}{
+				"reason": "spilt",
+				"items":  []map[string]interface{}{{"product": product.Hex(), "quantity": 1}},
+			},
+			check: func(t *testing.T, recorder *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusCreated, recorder.Code)
+
+				var result struct {
+					Data struct {
+						Refund store.Refund
+						Order  store.Order
+					}
+				}
+				data, err := io.ReadAll(recorder.Body)
+				require.NoError(t, err)
+				require.NoError(t, json.Unmarshal(data, &result))
+				require.Equal(t, types.PARTIALLY_REFUNDED, result.Data.Order.PaymentStatus)
+				require.Equal(t, uint32(1), result.Data.Order.Items[0].Quantity)
+				require.InDelta(t, order.TotalAmount/2, result.Data.Order.TotalAmount, 0.01)
+				require.InDelta(t, order.TotalAmount/2, result.Data.Refund.Amount, 0.01)
+			},
+		},
+		{
+			name: "refund more units than remain | status 400",
+			body: map[string]interface{}{
+				"reason": "spilt",
+				"items":  []map[string]interface{}{{"product": product.Hex(), "quantity": 2}},
+			},
+			check: func(t *testing.T, recorder *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusBadRequest, recorder.Code)
+			},
+		},
+		{
+			name: "refund the rest | status 201",
+			body: map[string]interface{}{"reason": "closing early"},
+			check: func(t *testing.T, recorder *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusCreated, recorder.Code)
+
+				var result struct {
+					Data struct {
+						Order store.Order
+					}
+				}
+				data, err := io.ReadAll(recorder.Body)
+				require.NoError(t, err)
+				require.NoError(t, json.Unmarshal(data, &result))
+				require.Equal(t, types.REFUNDED, result.Data.Order.PaymentStatus)
+				require.InDelta(t, 0, result.Data.Order.TotalAmount, 0.01)
+			},
+		},
+		{
+			name: "refund a refunded order | status 409",
+			body: map[string]interface{}{"reason": "again"},
+			check: func(t *testing.T, recorder *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusConflict, recorder.Code)
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.check(t, refund(tc.body))
+		})
+	}
+}
+
+func TestCancelPaidOrder(t *testing.T) {
+	order := createTestOrder(t, adminTestToken)
+	payTestOrder(t, order)
+	t.Cleanup(func() {
+		refunds := mongoClient.Database("coffeeshop").Collection("refunds")
+		refunds.DeleteMany(context.Background(), bson.D{{Key: "order", Value: order.Id}})
+	})
+
+	cancel := func() *httptest.ResponseRecorder {
+		url := fmt.Sprintf("/api/v1/orders/%s/cancel", order.Id.Hex())
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPatch, url, nil)
+		request.Header.Set("authorization", fmt.Sprintf("Bearer %s", adminTestToken))
+		server.Router.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	t.Run("cancel a paid order | status 409", func(t *testing.T) {
+		recorder := cancel()
+		require.Equal(t, http.StatusConflict, recorder.Code)
+	})
+
+	t.Run("staff cancel a paid order | status 409", func(t *testing.T) {
+		data, err := json.Marshal(map[string]interface{}{"status": types.ORDER_CANCELLED})
+		require.NoError(t, err)
+
+		url := fmt.Sprintf("/api/v1/orders/%s/status", order.Id.Hex())
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPatch, url, bytes.NewReader(data))
+		request.Header.Set("authorization", fmt.Sprintf("Bearer %s", adminTestToken))
+		server.Router.ServeHTTP(recorder, request)
+		require.Equal(t, http.StatusConflict, recorder.Code)
+
+		var result store.Order
+		orders := mongoClient.Database("coffeeshop").Collection("orders")
+		err = orders.FindOne(context.Background(), bson.D{{Key: "_id", Value: order.Id}}).Decode(&result)
+		require.NoError(t, err)
+		require.Equal(t, types.ORDER_PENDING, result.Status)
+		require.Equal(t, types.PAID, result.PaymentStatus)
+	})
+
+	t.Run("cancel a refunded order | status 200", func(t *testing.T) {
+		data, err := json.Marshal(map[string]interface{}{"reason": "changed mind"})
+		require.NoError(t, err)
+
+		url := fmt.Sprintf("/api/v1/orders/%s/refunds", order.Id.Hex())
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPost, url, bytes.NewReader(data))
+		request.Header.Set("authorization", fmt.Sprintf("Bearer %s", adminTestToken))
+		server.Router.ServeHTTP(recorder, request)
+		require.Equal(t, http.StatusCreated, recorder.Code)
+
+		recorder = cancel()
+		require.Equal(t, http.StatusOK, recorder.Code)
+	})
+}
@@ -14,6 +14,7 @@ import (
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/silaselisha/coffee-api/types"
 	"github.com/stretchr/testify/require"
@@ -200,15 +201,142 @@ func TestUpdateProduct(t *testing.T) {
 	}
 }
 
+func TestAuditLog(t *testing.T) {
+	requestID := fmt.Sprintf("audit-test-%d", time.Now().UnixNano())
+
+	get := func(url, token string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodGet, url, nil)
+		request.Header.Set("authorization", fmt.Sprintf("Bearer %s", token))
+		server.Router.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	t.Run("price change is attributed | status 200", func(t *testing.T) {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		writer.WriteField("price", "5.25")
+		writer.Close()
+
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPut, fmt.Sprintf("/api/v1/products/%s", productID), body)
+		request.Header.Set("Content-Type", "multipart/form-data; boundary="+writer.Boundary())
+		request.Header.Set("authorization", fmt.Sprintf("Bearer %s", adminTestToken))
+		request.Header.Set("X-Request-Id", requestID)
+		server.Router.ServeHTTP(recorder, request)
+		require.Equal(t, http.StatusOK, recorder.Code)
+		require.Equal(t, requestID, recorder.Header().Get("X-Request-Id"))
+
+		recorder = get(fmt.Sprintf("/api/v1/audit?target_type=product&target_id=%s&action=%s&request_id=%s", productID, types.AUDIT_PRODUCT_UPDATE, requestID), adminTestToken)
+		require.Equal(t, http.StatusOK, recorder.Code)
+
+		var res struct {
+			Data []types.AuditEntryResParams `json:"data"`
+		}
+		require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &res))
+		require.Len(t, res.Data, 1)
+
+		entry := res.Data[0]
+		require.Equal(t, adminID, entry.ActorId)
+		require.Equal(t, "user", entry.ActorType)
+		require.NotEmpty(t, entry.IP)
+		require.Equal(t, []types.AuditChangeResParams{{Field: "price", Before: 4.99, After: 5.25}}, entry.Changes)
+	})
+
+	t.Run("filter by actor | status 200", func(t *testing.T) {
+		recorder := get(fmt.Sprintf("/api/v1/audit?actor_id=%s&limit=1", adminID), adminTestToken)
+		require.Equal(t, http.StatusOK, recorder.Code)
+
+		var res struct {
+			Results int32 `json:"results"`
+		}
+		require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &res))
+		require.Equal(t, int32(1), res.Results)
+
+		recorder = get("/api/v1/audit?actor_id=admin", adminTestToken)
+		require.Equal(t, http.StatusBadRequest, recorder.Code)
+	})
+}
+
 func TestGetAllProduct(t *testing.T) {
 	testCases := []struct {
 		name  string
+		url   string
 		check func(t *testing.T, recorder *httptest.ResponseRecorder)
 	}{
 		{
 			name: "get all products",
+			url:  "/api/v1/products",
+			check: func(t *testing.T, recorder *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusOK, recorder.Code)
+			},
+		},
+		{
+			name: "get products page sorted and filtered",
+			url:  "/api/v1/products?page=1&limit=2&sort=price,-ratings&category=beverages&minPrice=1&maxPrice=10",
+			check: func(t *testing.T, recorder *httptest.ResponseRecorder) {
+				var result struct {
+					Status string
+					Total  int64
+					Limit  int64
+					Data   []types.ItemResParams
+				}
+				data, err := io.ReadAll(recorder.Body)
+				require.NoError(t, err)
+				require.NoError(t, json.Unmarshal(data, &result))
+				require.Equal(t, http.StatusOK, recorder.Code)
+				require.Equal(t, int64(2), result.Limit)
+				require.LessOrEqual(t, len(result.Data), 2)
+				for _, item := range result.Data {
+					require.Equal(t, "beverages", item.Category)
+				}
+			},
+		},
+		{
+			name: "get products with field projection",
+			url:  "/api/v1/products?fields=name,price",
+			check: func(t *testing.T, recorder *httptest.ResponseRecorder) {
+				var result struct {
+					Data []map[string]interface{}
+				}
+				data, err := io.ReadAll(recorder.Body)
+				require.NoError(t, err)
+				require.NoError(t, json.Unmarshal(data, &result))
+				require.Equal(t, http.StatusOK, recorder.Code)
+				for _, item := range result.Data {
+					require.Len(t, item, 3)
+				}
+			},
+		},
+		{
+			name: "get products with rating projection",
+			url:  "/api/v1/products?fields=ratings,ratings_count&sort=-ratings_count",
 			check: func(t *testing.T, recorder *httptest.ResponseRecorder) {
+				var result struct {
+					Data []map[string]interface{}
+				}
+				data, err := io.ReadAll(recorder.Body)
+				require.NoError(t, err)
+				require.NoError(t, json.Unmarshal(data, &result))
 				require.Equal(t, http.StatusOK, recorder.Code)
+				for _, item := range result.Data {
+					require.Len(t, item, 3)
+					require.Contains(t, item, "ratings_count")
+				}
+			},
+		},
+		{
+			name: "get products sorted by unknown field",
+			url:  "/api/v1/products?sort=-password",
+			check: func(t *testing.T, recorder *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusBadRequest, recorder.Code)
+			},
+		},
+		{
+			name: "get products with invalid cursor",
+			url:  "/api/v1/products?cursor=***",
+			check: func(t *testing.T, recorder *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusBadRequest, recorder.Code)
 			},
 		},
 	}
@@ -216,7 +344,7 @@ func TestGetAllProduct(t *testing.T) {
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
 
-			url := "/api/v1/products"
+			url := tc.url
 			recorder := httptest.NewRecorder()
 			request, err := http.NewRequest(http.MethodGet, url, nil)
 			require.NoError(t, err)
@@ -282,6 +410,65 @@ func TestGetProduct(t *testing.T) {
 	}
 }
 
+func TestSearchProducts(t *testing.T) {
+	testCases := []struct {
+		name  string
+		url   string
+		check func(t *testing.T, recorder *httptest.ResponseRecorder)
+	}{
+		{
+			name: "search products by text",
+			url:  "/api/v1/products/search?q=latte",
+			check: func(t *testing.T, recorder *httptest.ResponseRecorder) {
+				var result struct {
+					Mode string
+					Data []types.ItemResParams
+				}
+				data, err := io.ReadAll(recorder.Body)
+				require.NoError(t, err)
+				require.NoError(t, json.Unmarshal(data, &result))
+				require.Equal(t, http.StatusOK, recorder.Code)
+				require.NotEmpty(t, result.Data)
+			},
+		},
+		{
+			name: "autocomplete products by prefix",
+			url:  "/api/v1/products/search?q=caf&autocomplete=true",
+			check: func(t *testing.T, recorder *httptest.ResponseRecorder) {
+				var result struct {
+					Mode string
+					Data []types.ItemResParams
+				}
+				data, err := io.ReadAll(recorder.Body)
+				require.NoError(t, err)
+				require.NoError(t, json.Unmarshal(data, &result))
+				require.Equal(t, http.StatusOK, recorder.Code)
+				require.Equal(t, "prefix", result.Mode)
+				require.NotEmpty(t, result.Data)
+			},
+		},
+		{
+			name: "search products without a term",
+			url:  "/api/v1/products/search",
+			check: func(t *testing.T, recorder *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusBadRequest, recorder.Code)
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+
+			recorder := httptest.NewRecorder()
+			request, err := http.NewRequest(http.MethodGet, tc.url, nil)
+			require.NoError(t, err)
+
+			server.Router.ServeHTTP(recorder, request)
+			tc.check(t, recorder)
+		})
+	}
+}
+
 func TestDeleteProduct(t *testing.T) {
 	testCases := []struct {
 		name  string
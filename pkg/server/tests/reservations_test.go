@@ -0,0 +1,186 @@
+package api__test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/silaselisha/coffee-api/pkg/store"
+	"github.com/silaselisha/coffee-api/types"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// createTestTable inserts a twelve-seat table, larger than anything a
+// real shop would have, so automatic assignment in other tests never
+// picks it up before a smaller one.
+func createTestTable(t *testing.T) store.CoffeeDateTable {
+	collection := mongoClient.Database("coffeeshop").Collection("tables")
+	table := store.CoffeeDateTable{
+		Id:        primitive.NewObjectID(),
+		Number:    uint32(100000 + time.Now().UnixNano()%900000),
+		Capacity:  12,
+		Location:  "test terrace",
+		Active:    true,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+
+	_, err := collection.InsertOne(context.Background(), table)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		collection.DeleteOne(context.Background(), bson.D{{Key: "_id", Value: table.Id}})
+		reservations := mongoClient.Database("coffeeshop").Collection("reservations")
+		reservations.DeleteMany(context.Background(), bson.D{{Key: "table", Value: table.Id}})
+	})
+	return table
+}
+
+func TestReservations(t *testing.T) {
+	table := createTestTable(t)
+	day := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, 2)
+	startsAt := day.Add(10 * time.Hour)
+
+	var reservation store.Reservation
+	testCases := []struct {
+		name  string
+		body  map[string]interface{}
+		check func(t *testing.T, recorder *httptest.ResponseRecorder)
+	}{
+		{
+			name: "reserve a table | status 201",
+			body: map[string]interface{}{
+				"table":     table.Id.Hex(),
+				"guests":    10,
+				"starts_at": startsAt,
+				"ends_at":   startsAt.Add(90 * time.Minute),
+			},
+			check: func(t *testing.T, recorder *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusCreated, recorder.Code)
+
+				var result struct {
+					Data store.Reservation
+				}
+				data, err := io.ReadAll(recorder.Body)
+				require.NoError(t, err)
+				require.NoError(t, json.Unmarshal(data, &result))
+				require.Equal(t, table.Id, result.Data.Table)
+				require.Equal(t, types.RESERVATION_CONFIRMED, result.Data.Status)
+				reservation = result.Data
+			},
+		},
+		{
+			name: "reserve an overlapping slot | status 409",
+			body: map[string]interface{}{
+				"table":     table.Id.Hex(),
+				"guests":    2,
+				"starts_at": startsAt.Add(time.Hour),
+				"ends_at":   startsAt.Add(2 * time.Hour),
+			},
+			check: func(t *testing.T, recorder *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusConflict, recorder.Code)
+			},
+		},
+		{
+			name: "reserve for more guests than seats | status 400",
+			body: map[string]interface{}{
+				"table":     table.Id.Hex(),
+				"guests":    13,
+				"starts_at": startsAt.Add(3 * time.Hour),
+				"ends_at":   startsAt.Add(4 * time.Hour),
+			},
+			check: func(t *testing.T, recorder *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusBadRequest, recorder.Code)
+			},
+		},
+		{
+			name: "reserve outside opening hours | status 400",
+			body: map[string]interface{}{
+				"table":     table.Id.Hex(),
+				"guests":    2,
+				"starts_at": day.Add(22 * time.Hour),
+				"ends_at":   day.Add(23 * time.Hour),
+			},
+			check: func(t *testing.T, recorder *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusBadRequest, recorder.Code)
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			body, err := json.Marshal(tc.body)
+			require.NoError(t, err)
+
+			recorder := httptest.NewRecorder()
+			request := httptest.NewRequest(http.MethodPost, "/api/v1/reservations", bytes.NewReader(body))
+			request.Header.Set("authorization", fmt.Sprintf("Bearer %s", adminTestToken))
+
+			server.Router.ServeHTTP(recorder, request)
+			tc.check(t, recorder)
+		})
+	}
+
+	t.Run("availability excludes the booked table | status 200", func(t *testing.T) {
+		url := fmt.Sprintf("/api/v1/reservations/availability?date=%s&guests=11&duration=60", day.Format(time.DateOnly))
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodGet, url, nil)
+
+		server.Router.ServeHTTP(recorder, request)
+		require.Equal(t, http.StatusOK, recorder.Code)
+
+		var result struct {
+			Data []types.ReservationSlotParams
+		}
+		data, err := io.ReadAll(recorder.Body)
+		require.NoError(t, err)
+		require.NoError(t, json.Unmarshal(data, &result))
+		for _, slot := range result.Data {
+			if slot.StartsAt.Equal(startsAt) {
+				require.NotContains(t, slot.Tables, table.Id)
+			}
+		}
+	})
+
+	deleteTable := func() *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/api/v1/tables/%s", table.Id.Hex()), nil)
+		request.Header.Set("authorization", fmt.Sprintf("Bearer %s", adminTestToken))
+		server.Router.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	t.Run("delete a booked table | status 409", func(t *testing.T) {
+		recorder := deleteTable()
+		require.Equal(t, http.StatusConflict, recorder.Code)
+	})
+
+	t.Run("cancel reservation | status 200", func(t *testing.T) {
+		url := fmt.Sprintf("/api/v1/reservations/%s/cancel", reservation.Id.Hex())
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPatch, url, nil)
+		request.Header.Set("authorization", fmt.Sprintf("Bearer %s", adminTestToken))
+
+		server.Router.ServeHTTP(recorder, request)
+		require.Equal(t, http.StatusOK, recorder.Code)
+
+		audit := mongoClient.Database("coffeeshop").Collection("audit_log")
+		count, err := audit.CountDocuments(context.Background(), bson.D{
+			{Key: "action", Value: types.AUDIT_RESERVATION_CANCEL},
+			{Key: "target_id", Value: reservation.Id.Hex()},
+		})
+		require.NoError(t, err)
+		require.EqualValues(t, 1, count)
+	})
+	t.Run("delete the table once it is free | status 204", func(t *testing.T) {
+		recorder := deleteTable()
+		require.Equal(t, http.StatusNoContent, recorder.Code)
+	})
+}
@@ -0,0 +1,116 @@
+package api__test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/silaselisha/coffee-api/pkg/store"
+	"github.com/silaselisha/coffee-api/types"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func advanceTestOrder(t *testing.T, order store.Order, statuses ...string) {
+	for _, status := range statuses {
+		body, err := json.Marshal(map[string]interface{}{"status": status})
+		require.NoError(t, err)
+
+		url := fmt.Sprintf("/api/v1/orders/%s/status", order.Id.Hex())
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPatch, url, bytes.NewReader(body))
+		request.Header.Set("authorization", fmt.Sprintf("Bearer %s", adminTestToken))
+		server.Router.ServeHTTP(recorder, request)
+		require.Equal(t, http.StatusOK, recorder.Code)
+	}
+}
+
+func TestCreateReview(t *testing.T) {
+	order := createTestOrder(t, adminTestToken)
+	advanceTestOrder(t, order, types.ORDER_ACCEPTED, types.ORDER_PREPARING, types.ORDER_READY, types.ORDER_COMPLETED)
+	purchased := order.Items[0].Product
+	notPurchased := createTestProduct(t)
+
+	t.Cleanup(func() {
+		reviews := mongoClient.Database("coffeeshop").Collection("reviews")
+		reviews.DeleteMany(context.Background(), bson.D{{Key: "product", Value: purchased}})
+	})
+
+	testCases := []struct {
+		name  string
+		body  map[string]interface{}
+		check func(t *testing.T, recorder *httptest.ResponseRecorder)
+	}{
+		{
+			name: "review a purchased product | status 201",
+			body: map[string]interface{}{"product": purchased.Hex(), "rating": 4, "text": "smooth"},
+			check: func(t *testing.T, recorder *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusCreated, recorder.Code)
+
+				var item store.Item
+				products := mongoClient.Database("coffeeshop").Collection("products")
+				err := products.FindOne(context.Background(), bson.D{{Key: "_id", Value: purchased}}).Decode(&item)
+				require.NoError(t, err)
+				require.Equal(t, 4.0, item.Ratings)
+				require.Equal(t, int64(1), item.RatingsCount)
+			},
+		},
+		{
+			name: "review a product twice | status 400",
+			body: map[string]interface{}{"product": purchased.Hex(), "rating": 5},
+			check: func(t *testing.T, recorder *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusBadRequest, recorder.Code)
+			},
+		},
+		{
+			name: "review a product never purchased | status 403",
+			body: map[string]interface{}{"product": notPurchased.Id.Hex(), "rating": 5},
+			check: func(t *testing.T, recorder *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusForbidden, recorder.Code)
+			},
+		},
+		{
+			name: "review with out of range rating | status 400",
+			body: map[string]interface{}{"product": purchased.Hex(), "rating": 6},
+			check: func(t *testing.T, recorder *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusBadRequest, recorder.Code)
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			body, err := json.Marshal(tc.body)
+			require.NoError(t, err)
+
+			recorder := httptest.NewRecorder()
+			request := httptest.NewRequest(http.MethodPost, "/api/v1/reviews", bytes.NewReader(body))
+			request.Header.Set("authorization", fmt.Sprintf("Bearer %s", adminTestToken))
+
+			server.Router.ServeHTTP(recorder, request)
+			tc.check(t, recorder)
+		})
+	}
+
+	t.Run("list product reviews | status 200", func(t *testing.T) {
+		url := fmt.Sprintf("/api/v1/reviews?product=%s", purchased.Hex())
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodGet, url, nil)
+
+		server.Router.ServeHTTP(recorder, request)
+		require.Equal(t, http.StatusOK, recorder.Code)
+
+		var result struct {
+			Data []types.ReviewResParams
+		}
+		data, err := io.ReadAll(recorder.Body)
+		require.NoError(t, err)
+		require.NoError(t, json.Unmarshal(data, &result))
+		require.Len(t, result.Data, 1)
+	})
+}
@@ -2,6 +2,7 @@ package api__test
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"image"
@@ -11,11 +12,18 @@ import (
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/silaselisha/coffee-api/internal"
+	"github.com/silaselisha/coffee-api/internal/totp"
+	"github.com/silaselisha/coffee-api/pkg/store"
+	"github.com/silaselisha/coffee-api/pkg/token"
 	"github.com/silaselisha/coffee-api/types"
 	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 var user = internal.CreateNewUser("johndoe@test.com", "doe", "+1(571)360-6677", "user")
@@ -50,6 +58,8 @@ func TestCreateUserSignup(t *testing.T) {
 				userTestToken = result.Token
 				userID = result.Data.Id
 				require.Equal(t, http.StatusCreated, recorder.Code)
+				require.Equal(t, user.PhoneNumber, result.Data.PhoneNumber)
+				verifyTestUser(t, userID)
 			},
 		},
 		{
@@ -76,6 +86,18 @@ func TestCreateUserSignup(t *testing.T) {
 				require.Equal(t, http.StatusBadRequest, recorder.Code)
 			},
 		},
+		{
+			name: "user signup weak password | 400 status code",
+			body: map[string]interface{}{
+				"username":    "janedoe",
+				"email":       "janedoe@test.com",
+				"password":    "coffeecoffee",
+				"phoneNumber": user.PhoneNumber,
+			},
+			check: func(t *testing.T, recorder *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusBadRequest, recorder.Code)
+			},
+		},
 		{
 			name: "user signup 400 status code",
 			body: map[string]interface{}{},
@@ -102,6 +124,103 @@ func TestCreateUserSignup(t *testing.T) {
 	}
 }
 
+// verifyTestUser marks the account verified directly, standing in for the
+// link that is mailed after signup.
+func verifyTestUser(t *testing.T, id string) {
+	objectId, err := primitive.ObjectIDFromHex(id)
+	require.NoError(t, err)
+
+	users := mongoClient.Database("coffeeshop").Collection("users")
+	_, err = users.UpdateOne(context.Background(), bson.D{{Key: "_id", Value: objectId}}, bson.D{{Key: "$set", Value: bson.D{{Key: "verified", Value: true}}}})
+	require.NoError(t, err)
+	server.UserCache.InvalidateUser(context.Background(), objectId)
+}
+
+func TestAccountVerification(t *testing.T) {
+	data, err := json.Marshal(map[string]interface{}{
+		"username":    "latteart",
+		"email":       "latteart@test.com",
+		"password":    "Flat&White99",
+		"phoneNumber": user.PhoneNumber,
+	})
+	require.NoError(t, err)
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodPost, "/api/v1/signup", bytes.NewReader(data))
+	server.Router.ServeHTTP(recorder, request)
+	require.Equal(t, http.StatusCreated, recorder.Code)
+
+	var signup struct {
+		Token string              `json:"token"`
+		Data  types.UserResParams `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &signup))
+	require.False(t, signup.Data.Verified)
+
+	send := func(method, url string, body interface{}) *httptest.ResponseRecorder {
+		data, err := json.Marshal(body)
+		require.NoError(t, err)
+
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(method, url, bytes.NewReader(data))
+		request.Header.Set("authorization", fmt.Sprintf("Bearer %s", signup.Token))
+		server.Router.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	t.Run("unverified account cannot order | status code 403", func(t *testing.T) {
+		recorder := send(http.MethodPost, "/api/v1/products/orders", map[string]interface{}{})
+		require.Equal(t, http.StatusForbidden, recorder.Code)
+
+		recorder = send(http.MethodPost, "/api/v1/reservations", map[string]interface{}{})
+		require.Equal(t, http.StatusForbidden, recorder.Code)
+	})
+
+	t.Run("resend verification link | status code 200", func(t *testing.T) {
+		recorder := send(http.MethodPost, "/api/v1/verify/resend", map[string]interface{}{})
+		require.Equal(t, http.StatusOK, recorder.Code)
+	})
+
+	id, err := primitive.ObjectIDFromHex(signup.Data.Id)
+	require.NoError(t, err)
+	plain, digest, err := token.NewOpaqueToken()
+	require.NoError(t, err)
+	_, err = mongoClient.Database("coffeeshop").Collection("user_tokens").InsertOne(context.Background(), store.UserToken{
+		Id:        primitive.NewObjectID(),
+		User:      id,
+		Email:     signup.Data.Email,
+		Purpose:   types.TOKEN_EMAIL_VERIFICATION,
+		TokenHash: digest,
+		ExpiresAt: time.Now().Add(time.Hour),
+		CreatedAt: time.Now(),
+	})
+	require.NoError(t, err)
+
+	t.Run("verify account | status code 200", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/api/v1/verify?token=%s", plain), nil)
+		server.Router.ServeHTTP(recorder, request)
+		require.Equal(t, http.StatusOK, recorder.Code)
+	})
+
+	t.Run("verification token is single use | status code 400", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/api/v1/verify?token=%s", plain), nil)
+		server.Router.ServeHTTP(recorder, request)
+		require.Equal(t, http.StatusBadRequest, recorder.Code)
+	})
+
+	t.Run("verified account passes the check | status code 400", func(t *testing.T) {
+		recorder := send(http.MethodPost, "/api/v1/products/orders", map[string]interface{}{})
+		require.Equal(t, http.StatusBadRequest, recorder.Code)
+	})
+
+	t.Run("resend once verified | status code 409", func(t *testing.T) {
+		recorder := send(http.MethodPost, "/api/v1/verify/resend", map[string]interface{}{})
+		require.Equal(t, http.StatusConflict, recorder.Code)
+	})
+}
+
 func TestUserLogin(t *testing.T) {
 	testCases := []struct {
 		name  string
@@ -130,23 +249,24 @@ func TestUserLogin(t *testing.T) {
 			},
 		},
 		{
-			name: "login user wrong email | 404 status code",
+			name: "login user wrong email | 401 status code",
 			body: map[string]interface{}{
-				"email":    "test@test.com",
+				"email":    fmt.Sprintf("test%d@test.com", time.Now().UnixNano()),
 				"password": user.Password,
 			},
 			check: func(t *testing.T, recorder *httptest.ResponseRecorder) {
-				require.Equal(t, http.StatusNotFound, recorder.Code)
+				require.Equal(t, http.StatusUnauthorized, recorder.Code)
 			},
 		},
 		{
-			name: "login user wrong password | 400 status code",
+			name: "login user wrong password | 401 status code",
 			body: map[string]interface{}{
 				"email":    user.Email,
 				"password": "abstract&87",
 			},
 			check: func(t *testing.T, recorder *httptest.ResponseRecorder) {
-				require.Equal(t, http.StatusBadRequest, recorder.Code)
+				require.Equal(t, http.StatusUnauthorized, recorder.Code)
+				require.Contains(t, recorder.Body.String(), "invalid email address or password")
 			},
 		},
 		{
@@ -175,6 +295,812 @@ func TestUserLogin(t *testing.T) {
 	}
 }
 
+func TestLoginLockout(t *testing.T) {
+	// A fresh address per run keeps the per address limit out of the way.
+	remoteAddr := fmt.Sprintf("10.%d.%d.%d:4321", time.Now().Unix()%250, time.Now().UnixNano()%250, time.Now().UnixMicro()%250)
+	login := func(password string) *httptest.ResponseRecorder {
+		data, err := json.Marshal(map[string]interface{}{"email": user.Email, "password": password})
+		require.NoError(t, err)
+
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPost, "/api/v1/login", bytes.NewReader(data))
+		request.RemoteAddr = remoteAddr
+		server.Router.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	t.Run("failures are delayed progressively | status 429", func(t *testing.T) {
+		// A successful login ends the streak left by earlier tests.
+		require.Equal(t, http.StatusOK, login(user.Password).Code)
+		for i := 0; i < 3; i++ {
+			require.Equal(t, http.StatusUnauthorized, login("abstract&87").Code)
+		}
+
+		// Even the right password has to wait.
+		recorder := login(user.Password)
+		require.Equal(t, http.StatusTooManyRequests, recorder.Code)
+		require.Equal(t, "1", recorder.Header().Get("Retry-After"))
+
+		time.Sleep(time.Second)
+		require.Equal(t, http.StatusUnauthorized, login("abstract&87").Code)
+		recorder = login(user.Password)
+		require.Equal(t, http.StatusTooManyRequests, recorder.Code)
+		require.Equal(t, "2", recorder.Header().Get("Retry-After"))
+	})
+
+	t.Run("account is locked | status 429", func(t *testing.T) {
+		time.Sleep(2 * time.Second)
+		require.Equal(t, http.StatusUnauthorized, login("abstract&87").Code)
+
+		recorder := login(user.Password)
+		require.Equal(t, http.StatusTooManyRequests, recorder.Code)
+		require.Equal(t, "900", recorder.Header().Get("Retry-After"))
+
+		count, err := mongoClient.Database("coffeeshop").Collection("user_tokens").CountDocuments(context.Background(), bson.D{
+			{Key: "email", Value: user.Email},
+			{Key: "purpose", Value: types.TOKEN_ACCOUNT_UNLOCK},
+		})
+		require.NoError(t, err)
+		require.NotZero(t, count)
+	})
+
+	t.Run("unlock link | status 200", func(t *testing.T) {
+		id, err := primitive.ObjectIDFromHex(userID)
+		require.NoError(t, err)
+		plain, digest, err := token.NewOpaqueToken()
+		require.NoError(t, err)
+		_, err = mongoClient.Database("coffeeshop").Collection("user_tokens").InsertOne(context.Background(), store.UserToken{
+			Id:        primitive.NewObjectID(),
+			User:      id,
+			Email:     user.Email,
+			Purpose:   types.TOKEN_ACCOUNT_UNLOCK,
+			TokenHash: digest,
+			ExpiresAt: time.Now().Add(time.Hour),
+			CreatedAt: time.Now(),
+		})
+		require.NoError(t, err)
+
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/api/v1/unlock?token=%s", plain), nil)
+		server.Router.ServeHTTP(recorder, request)
+		require.Equal(t, http.StatusOK, recorder.Code)
+
+		require.Equal(t, http.StatusOK, login(user.Password).Code)
+	})
+}
+
+func TestRateLimit(t *testing.T) {
+	remoteAddr := fmt.Sprintf("10.%d.%d.%d:4321", time.Now().Unix()%250, time.Now().UnixNano()%250, time.Now().UnixMicro()%250+1)
+	forgotPassword := func() *httptest.ResponseRecorder {
+		data, err := json.Marshal(map[string]interface{}{"email": "nobody@ratelimit.test"})
+		require.NoError(t, err)
+
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPost, "/api/v1/forgotpassword", bytes.NewReader(data))
+		request.RemoteAddr = remoteAddr
+		server.Router.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	t.Run("headers count down | status 200", func(t *testing.T) {
+		for remaining := 4; remaining >= 0; remaining-- {
+			recorder := forgotPassword()
+			require.Equal(t, http.StatusOK, recorder.Code)
+			require.Equal(t, "5", recorder.Header().Get("RateLimit-Limit"))
+			require.Equal(t, fmt.Sprint(remaining), recorder.Header().Get("RateLimit-Remaining"))
+			require.Equal(t, "5;w=900", recorder.Header().Get("RateLimit-Policy"))
+		}
+	})
+
+	t.Run("limit exceeded | status 429", func(t *testing.T) {
+		recorder := forgotPassword()
+		require.Equal(t, http.StatusTooManyRequests, recorder.Code)
+		require.Equal(t, "0", recorder.Header().Get("RateLimit-Remaining"))
+		require.NotEmpty(t, recorder.Header().Get("Retry-After"))
+	})
+
+	t.Run("other routes count separately | status 200", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodGet, "/api/v1/products", nil)
+		request.RemoteAddr = remoteAddr
+		server.Router.ServeHTTP(recorder, request)
+		require.Equal(t, http.StatusOK, recorder.Code)
+		require.NotEmpty(t, recorder.Header().Get("RateLimit-Remaining"))
+	})
+}
+
+func TestUserSessions(t *testing.T) {
+	type tokens struct {
+		Status       string `json:"status"`
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	post := func(url string, body map[string]interface{}, token string) *httptest.ResponseRecorder {
+		data, err := json.Marshal(body)
+		require.NoError(t, err)
+
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPost, url, bytes.NewReader(data))
+		if token != "" {
+			request.Header.Set("authorization", fmt.Sprintf("Bearer %s", token))
+		}
+		server.Router.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	login := func() tokens {
+		recorder := post("/api/v1/login", map[string]interface{}{"email": user.Email, "password": user.Password}, "")
+		require.Equal(t, http.StatusOK, recorder.Code)
+
+		var res tokens
+		require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &res))
+		require.NotEmpty(t, res.Token)
+		require.NotEmpty(t, res.RefreshToken)
+		return res
+	}
+
+	refresh := func(refreshToken string) (tokens, int) {
+		recorder := post("/api/v1/token/refresh", map[string]interface{}{"refresh_token": refreshToken}, "")
+
+		var res tokens
+		if recorder.Code == http.StatusOK {
+			require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &res))
+		}
+		return res, recorder.Code
+	}
+
+	t.Run("refresh rotates the refresh token | status code 200", func(t *testing.T) {
+		first := login()
+		second, code := refresh(first.RefreshToken)
+		require.Equal(t, http.StatusOK, code)
+		require.NotEqual(t, first.RefreshToken, second.RefreshToken)
+
+		_, code = refresh(second.RefreshToken)
+		require.Equal(t, http.StatusOK, code)
+	})
+
+	t.Run("reused refresh token revokes the family | status code 401", func(t *testing.T) {
+		first := login()
+		second, code := refresh(first.RefreshToken)
+		require.Equal(t, http.StatusOK, code)
+
+		_, code = refresh(first.RefreshToken)
+		require.Equal(t, http.StatusUnauthorized, code)
+
+		_, code = refresh(second.RefreshToken)
+		require.Equal(t, http.StatusUnauthorized, code)
+	})
+
+	t.Run("unknown refresh token | status code 401", func(t *testing.T) {
+		_, code := refresh("not-a-refresh-token")
+		require.Equal(t, http.StatusUnauthorized, code)
+	})
+
+	t.Run("logout revokes the session | status code 204", func(t *testing.T) {
+		session := login()
+		recorder := post("/api/v1/logout", map[string]interface{}{"refresh_token": session.RefreshToken}, "")
+		require.Equal(t, http.StatusNoContent, recorder.Code)
+
+		_, code := refresh(session.RefreshToken)
+		require.Equal(t, http.StatusUnauthorized, code)
+	})
+
+	t.Run("logout all devices | status code 204", func(t *testing.T) {
+		phone := login()
+		tablet := login()
+		recorder := post("/api/v1/logout/all", map[string]interface{}{}, tablet.Token)
+		require.Equal(t, http.StatusNoContent, recorder.Code)
+
+		_, code := refresh(phone.RefreshToken)
+		require.Equal(t, http.StatusUnauthorized, code)
+		_, code = refresh(tablet.RefreshToken)
+		require.Equal(t, http.StatusUnauthorized, code)
+
+		recorder = post("/api/v1/logout/all", map[string]interface{}{}, tablet.Token)
+		require.Equal(t, http.StatusUnauthorized, recorder.Code)
+	})
+
+	t.Run("admin revokes a user's sessions | status code 204", func(t *testing.T) {
+		session := login()
+		recorder := post(fmt.Sprintf("/api/v1/users/%s/sessions/revoke", userID), map[string]interface{}{}, session.Token)
+		require.Equal(t, http.StatusForbidden, recorder.Code)
+
+		recorder = post(fmt.Sprintf("/api/v1/users/%s/sessions/revoke", userID), map[string]interface{}{}, adminTestToken)
+		require.Equal(t, http.StatusNoContent, recorder.Code)
+
+		recorder = httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/api/v1/users/%s", userID), nil)
+		request.Header.Set("authorization", fmt.Sprintf("Bearer %s", session.Token))
+		server.Router.ServeHTTP(recorder, request)
+		require.Equal(t, http.StatusUnauthorized, recorder.Code)
+
+		_, code := refresh(session.RefreshToken)
+		require.Equal(t, http.StatusUnauthorized, code)
+	})
+
+	// Every earlier access token of the user is revoked by now.
+	userTestToken = login().Token
+}
+
+func TestPasswordReset(t *testing.T) {
+	newPassword := "Espresso&Crema42"
+	tokens := mongoClient.Database("coffeeshop").Collection("user_tokens")
+
+	// A fresh address so that the five requests below stay within the
+	// per-address limit of the route.
+	remoteAddr := fmt.Sprintf("10.251.%d.%d:4321", time.Now().UnixNano()%250, time.Now().UnixMicro()%250+1)
+	forgotPassword := func(email string) *httptest.ResponseRecorder {
+		data, err := json.Marshal(map[string]interface{}{"email": email})
+		require.NoError(t, err)
+
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPost, "/api/v1/forgotpassword", bytes.NewReader(data))
+		request.RemoteAddr = remoteAddr
+		server.Router.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	t.Run("forgot password for an unknown email | status code 200", func(t *testing.T) {
+		unknown := forgotPassword("nobody@forgotpassword.test")
+		known := forgotPassword(user.Email)
+		require.Equal(t, http.StatusOK, unknown.Code)
+		require.Equal(t, http.StatusOK, known.Code)
+		require.Equal(t, known.Body.String(), unknown.Body.String())
+	})
+
+	t.Run("forgot password links are capped silently | status code 200", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			require.Equal(t, http.StatusOK, forgotPassword(user.Email).Code)
+		}
+
+		count, err := tokens.CountDocuments(context.Background(), bson.D{{Key: "email", Value: user.Email}, {Key: "purpose", Value: types.TOKEN_PASSWORD_RESET}})
+		require.NoError(t, err)
+		require.LessOrEqual(t, count, int64(3))
+	})
+
+	id, err := primitive.ObjectIDFromHex(userID)
+	require.NoError(t, err)
+
+	plain, digest, err := token.NewOpaqueToken()
+	require.NoError(t, err)
+	_, err = tokens.InsertOne(context.Background(), store.UserToken{
+		Id:        primitive.NewObjectID(),
+		User:      id,
+		Email:     user.Email,
+		Purpose:   types.TOKEN_PASSWORD_RESET,
+		TokenHash: digest,
+		ExpiresAt: time.Now().Add(time.Hour),
+		CreatedAt: time.Now(),
+	})
+	require.NoError(t, err)
+
+	reset := func(resetToken, password string) int {
+		data, err := json.Marshal(map[string]interface{}{"password": password, "confirmPassword": password})
+		require.NoError(t, err)
+
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPut, fmt.Sprintf("/api/v1/resetpassword?token=%s", resetToken), bytes.NewReader(data))
+		server.Router.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+
+	t.Run("reset with a guessed token | status code 400", func(t *testing.T) {
+		require.Equal(t, http.StatusBadRequest, reset(userID, newPassword))
+	})
+
+	t.Run("weak password does not consume the token | status code 400", func(t *testing.T) {
+		require.Equal(t, http.StatusBadRequest, reset(plain, "coffeecoffee"))
+	})
+
+	t.Run("reset password | status code 308", func(t *testing.T) {
+		require.Equal(t, http.StatusPermanentRedirect, reset(plain, newPassword))
+	})
+
+	t.Run("reset token is single use | status code 400", func(t *testing.T) {
+		require.Equal(t, http.StatusBadRequest, reset(plain, newPassword))
+	})
+
+	data, err := json.Marshal(map[string]interface{}{"email": user.Email, "password": newPassword})
+	require.NoError(t, err)
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodPost, "/api/v1/login", bytes.NewReader(data))
+	server.Router.ServeHTTP(recorder, request)
+	require.Equal(t, http.StatusOK, recorder.Code)
+
+	var res struct {
+		Token string `json:"token"`
+	}
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &res))
+	userTestToken = res.Token
+	user.Password = newPassword
+}
+
+func TestAccessTokenClaims(t *testing.T) {
+	payload, err := server.Token.VerifyToken(context.Background(), adminTestToken)
+	require.NoError(t, err)
+	require.Equal(t, adminID, payload.Subject)
+	require.Equal(t, "admin", payload.Role)
+	require.NotEmpty(t, payload.ID)
+	require.NotEmpty(t, payload.Issuer)
+	require.NotEmpty(t, payload.Audience)
+	require.NotNil(t, payload.NotBefore)
+
+	other, err := server.Token.CreateToken(context.Background(), time.Minute, token.Subject{Id: adminID, Role: "admin"})
+	require.NoError(t, err)
+	otherPayload, err := server.Token.VerifyToken(context.Background(), other)
+	require.NoError(t, err)
+	require.NotEqual(t, payload.ID, otherPayload.ID)
+
+	expired, err := server.Token.CreateToken(context.Background(), -time.Hour, token.Subject{Id: adminID, Role: "admin"})
+	require.NoError(t, err)
+	_, err = server.Token.VerifyToken(context.Background(), expired)
+	require.ErrorIs(t, err, token.ErrInvalidClaims)
+}
+
+func TestJWKS(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil)
+	server.Router.ServeHTTP(recorder, request)
+	require.Equal(t, http.StatusOK, recorder.Code)
+
+	var set token.JWKSet
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &set))
+	require.NotNil(t, set.Keys)
+	for _, key := range set.Keys {
+		require.NotEmpty(t, key.Kid)
+		require.Contains(t, []string{"RS256", "EdDSA"}, key.Alg)
+	}
+}
+
+func TestRoles(t *testing.T) {
+	send := func(method, url string, body map[string]interface{}, token string) *httptest.ResponseRecorder {
+		data, err := json.Marshal(body)
+		require.NoError(t, err)
+
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(method, url, bytes.NewReader(data))
+		request.Header.Set("authorization", fmt.Sprintf("Bearer %s", token))
+		server.Router.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	login := func() string {
+		data, err := json.Marshal(map[string]interface{}{"email": user.Email, "password": user.Password})
+		require.NoError(t, err)
+
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPost, "/api/v1/login", bytes.NewReader(data))
+		server.Router.ServeHTTP(recorder, request)
+		require.Equal(t, http.StatusOK, recorder.Code)
+
+		var res struct {
+			Token string `json:"token"`
+		}
+		require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &res))
+		return res.Token
+	}
+
+	name := fmt.Sprintf("order-reader-%d", time.Now().UnixNano()%100000)
+
+	t.Run("list roles as user | status 403", func(t *testing.T) {
+		recorder := send(http.MethodGet, "/api/v1/roles", nil, userTestToken)
+		require.Equal(t, http.StatusForbidden, recorder.Code)
+	})
+
+	t.Run("list roles | status 200", func(t *testing.T) {
+		recorder := send(http.MethodGet, "/api/v1/roles", nil, adminTestToken)
+		require.Equal(t, http.StatusOK, recorder.Code)
+
+		var res struct {
+			Data []store.Role `json:"data"`
+		}
+		require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &res))
+
+		names := []string{}
+		for _, role := range res.Data {
+			names = append(names, role.Name)
+		}
+		require.Subset(t, names, []string{types.ROLE_ADMIN, types.ROLE_USER, types.ROLE_BARISTA, types.ROLE_MANAGER, types.ROLE_INVENTORY_CLERK})
+	})
+
+	t.Run("create role with unknown permission | status 400", func(t *testing.T) {
+		body := map[string]interface{}{"name": name, "permissions": []string{"orders:brew"}}
+		recorder := send(http.MethodPost, "/api/v1/roles", body, adminTestToken)
+		require.Equal(t, http.StatusBadRequest, recorder.Code)
+	})
+
+	t.Run("create role | status 201", func(t *testing.T) {
+		body := map[string]interface{}{"name": name, "description": "reads every order", "permissions": []string{types.PERM_ORDERS_READ}}
+		recorder := send(http.MethodPost, "/api/v1/roles", body, adminTestToken)
+		require.Equal(t, http.StatusCreated, recorder.Code)
+
+		recorder = send(http.MethodPost, "/api/v1/roles", body, adminTestToken)
+		require.Equal(t, http.StatusBadRequest, recorder.Code)
+	})
+
+	t.Run("delete system role | status 409", func(t *testing.T) {
+		recorder := send(http.MethodDelete, "/api/v1/roles/barista", nil, adminTestToken)
+		require.Equal(t, http.StatusConflict, recorder.Code)
+	})
+
+	t.Run("assign role | status 200", func(t *testing.T) {
+		recorder := send(http.MethodPatch, fmt.Sprintf("/api/v1/users/%s/role", userID), map[string]interface{}{"role": name}, adminTestToken)
+		require.Equal(t, http.StatusOK, recorder.Code)
+
+		// The old token carries the previous role and is revoked.
+		recorder = send(http.MethodGet, "/api/v1/orders", nil, userTestToken)
+		require.Equal(t, http.StatusUnauthorized, recorder.Code)
+
+		staffToken := login()
+		recorder = send(http.MethodGet, "/api/v1/users", nil, staffToken)
+		require.Equal(t, http.StatusForbidden, recorder.Code)
+
+		recorder = send(http.MethodDelete, fmt.Sprintf("/api/v1/roles/%s", name), nil, adminTestToken)
+		require.Equal(t, http.StatusConflict, recorder.Code)
+	})
+
+	t.Run("assign unknown role | status 400", func(t *testing.T) {
+		recorder := send(http.MethodPatch, fmt.Sprintf("/api/v1/users/%s/role", userID), map[string]interface{}{"role": "sommelier"}, adminTestToken)
+		require.Equal(t, http.StatusBadRequest, recorder.Code)
+	})
+
+	t.Run("change own role | status 409", func(t *testing.T) {
+		recorder := send(http.MethodPatch, fmt.Sprintf("/api/v1/users/%s/role", adminID), map[string]interface{}{"role": types.ROLE_USER}, adminTestToken)
+		require.Equal(t, http.StatusConflict, recorder.Code)
+	})
+
+	t.Run("grant permissions not held | status 403", func(t *testing.T) {
+		manager := name + "-mgr"
+		body := map[string]interface{}{"name": manager, "permissions": []string{types.PERM_ROLES_MANAGE}}
+		recorder := send(http.MethodPost, "/api/v1/roles", body, adminTestToken)
+		require.Equal(t, http.StatusCreated, recorder.Code)
+
+		recorder = send(http.MethodPatch, fmt.Sprintf("/api/v1/users/%s/role", userID), map[string]interface{}{"role": manager}, adminTestToken)
+		require.Equal(t, http.StatusOK, recorder.Code)
+		managerToken := login()
+
+		body = map[string]interface{}{"name": manager + "-all", "permissions": []string{types.PERM_ORDERS_READ}}
+		recorder = send(http.MethodPost, "/api/v1/roles", body, managerToken)
+		require.Equal(t, http.StatusForbidden, recorder.Code)
+
+		recorder = send(http.MethodPatch, fmt.Sprintf("/api/v1/users/%s/role", adminID), map[string]interface{}{"role": types.ROLE_ADMIN}, managerToken)
+		require.Equal(t, http.StatusForbidden, recorder.Code)
+
+		recorder = send(http.MethodPatch, fmt.Sprintf("/api/v1/users/%s/role", userID), map[string]interface{}{"role": types.ROLE_USER}, adminTestToken)
+		require.Equal(t, http.StatusOK, recorder.Code)
+
+		recorder = send(http.MethodDelete, fmt.Sprintf("/api/v1/roles/%s", manager), nil, adminTestToken)
+		require.Equal(t, http.StatusNoContent, recorder.Code)
+	})
+
+	t.Run("delete role | status 204", func(t *testing.T) {
+		recorder := send(http.MethodPatch, fmt.Sprintf("/api/v1/users/%s/role", userID), map[string]interface{}{"role": types.ROLE_USER}, adminTestToken)
+		require.Equal(t, http.StatusOK, recorder.Code)
+
+		recorder = send(http.MethodDelete, fmt.Sprintf("/api/v1/roles/%s", name), nil, adminTestToken)
+		require.Equal(t, http.StatusNoContent, recorder.Code)
+	})
+
+	userTestToken = login()
+}
+
+func TestUserCache(t *testing.T) {
+	get := func(url, token string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodGet, url, nil)
+		request.Header.Set("authorization", fmt.Sprintf("Bearer %s", token))
+		server.Router.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	t.Run("repeated lookups hit the cache", func(t *testing.T) {
+		before := server.UserCache.Stats()
+		for i := 0; i < 3; i++ {
+			require.Equal(t, http.StatusOK, get(fmt.Sprintf("/api/v1/users/%s", userID), userTestToken).Code)
+		}
+		after := server.UserCache.Stats()
+		require.GreaterOrEqual(t, after.Hits-before.Hits, uint64(4))
+	})
+
+	t.Run("revoking sessions invalidates the cached user", func(t *testing.T) {
+		id, err := primitive.ObjectIDFromHex(userID)
+		require.NoError(t, err)
+		cached, err := server.UserCache.User(context.Background(), id)
+		require.NoError(t, err)
+
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/api/v1/users/%s/sessions/revoke", userID), nil)
+		request.Header.Set("authorization", fmt.Sprintf("Bearer %s", adminTestToken))
+		server.Router.ServeHTTP(recorder, request)
+		require.Equal(t, http.StatusNoContent, recorder.Code)
+
+		require.Equal(t, http.StatusUnauthorized, get(fmt.Sprintf("/api/v1/users/%s", userID), userTestToken).Code)
+		refreshed, err := server.UserCache.User(context.Background(), id)
+		require.NoError(t, err)
+		require.Equal(t, cached.TokenVersion+1, refreshed.TokenVersion)
+
+		data, err := json.Marshal(map[string]interface{}{"email": user.Email, "password": user.Password})
+		require.NoError(t, err)
+		recorder = httptest.NewRecorder()
+		request = httptest.NewRequest(http.MethodPost, "/api/v1/login", bytes.NewReader(data))
+		server.Router.ServeHTTP(recorder, request)
+		require.Equal(t, http.StatusOK, recorder.Code)
+
+		var res struct {
+			Token string `json:"token"`
+		}
+		require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &res))
+		userTestToken = res.Token
+	})
+
+	t.Run("stats | status 200", func(t *testing.T) {
+		require.Equal(t, http.StatusForbidden, get("/api/v1/metrics/cache", userTestToken).Code)
+
+		recorder := get("/api/v1/metrics/cache", adminTestToken)
+		require.Equal(t, http.StatusOK, recorder.Code)
+
+		var res struct {
+			Data struct {
+				Hits    uint64  `json:"hits"`
+				HitRate float64 `json:"hit_rate"`
+			} `json:"data"`
+		}
+		require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &res))
+		require.NotZero(t, res.Data.Hits)
+		require.Greater(t, res.Data.HitRate, 0.0)
+	})
+}
+
+func TestAPIKeys(t *testing.T) {
+	send := func(method, url string, body map[string]interface{}, header, value string) *httptest.ResponseRecorder {
+		data, err := json.Marshal(body)
+		require.NoError(t, err)
+
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(method, url, bytes.NewReader(data))
+		request.Header.Set(header, value)
+		server.Router.ServeHTTP(recorder, request)
+		return recorder
+	}
+	admin := fmt.Sprintf("Bearer %s", adminTestToken)
+
+	var key string
+	var keyID string
+
+	t.Run("create api key as user | status 403", func(t *testing.T) {
+		body := map[string]interface{}{"name": "till", "permissions": []string{types.PERM_ORDERS_READ}}
+		recorder := send(http.MethodPost, "/api/v1/apikeys", body, "authorization", fmt.Sprintf("Bearer %s", userTestToken))
+		require.Equal(t, http.StatusForbidden, recorder.Code)
+	})
+
+	t.Run("create api key that manages keys | status 400", func(t *testing.T) {
+		for _, permission := range []string{"*", types.PERM_APIKEYS_MANAGE, types.PERM_ROLES_MANAGE, "roles:*"} {
+			body := map[string]interface{}{"name": "till", "permissions": []string{permission}}
+			recorder := send(http.MethodPost, "/api/v1/apikeys", body, "authorization", admin)
+			require.Equal(t, http.StatusBadRequest, recorder.Code)
+		}
+	})
+
+	t.Run("create expired api key | status 400", func(t *testing.T) {
+		body := map[string]interface{}{"name": "till", "permissions": []string{types.PERM_ORDERS_READ}, "expires_at": time.Now().Add(-time.Hour)}
+		recorder := send(http.MethodPost, "/api/v1/apikeys", body, "authorization", admin)
+		require.Equal(t, http.StatusBadRequest, recorder.Code)
+	})
+
+	t.Run("create api key | status 201", func(t *testing.T) {
+		body := map[string]interface{}{"name": "till", "permissions": []string{types.PERM_ORDERS_READ}}
+		recorder := send(http.MethodPost, "/api/v1/apikeys", body, "authorization", admin)
+		require.Equal(t, http.StatusCreated, recorder.Code)
+
+		var res struct {
+			Key  string                `json:"key"`
+			Data types.APIKeyResParams `json:"data"`
+		}
+		require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &res))
+		require.True(t, strings.HasPrefix(res.Key, "cfk_"))
+		require.True(t, strings.HasPrefix(res.Key, res.Data.Prefix))
+		require.Equal(t, adminID, res.Data.CreatedBy)
+		key = res.Key
+		keyID = res.Data.Id
+	})
+
+	t.Run("authenticate with api key | status 200", func(t *testing.T) {
+		recorder := send(http.MethodGet, "/api/v1/orders", nil, "x-api-key", key)
+		require.Equal(t, http.StatusOK, recorder.Code)
+
+		recorder = send(http.MethodGet, "/api/v1/orders", nil, "authorization", fmt.Sprintf("ApiKey %s", key))
+		require.Equal(t, http.StatusOK, recorder.Code)
+	})
+
+	t.Run("api key outside its permissions | status 403", func(t *testing.T) {
+		recorder := send(http.MethodGet, "/api/v1/users", nil, "x-api-key", key)
+		require.Equal(t, http.StatusForbidden, recorder.Code)
+
+		recorder = send(http.MethodGet, "/api/v1/apikeys", nil, "x-api-key", key)
+		require.Equal(t, http.StatusForbidden, recorder.Code)
+	})
+
+	t.Run("unknown api key | status 403", func(t *testing.T) {
+		recorder := send(http.MethodGet, "/api/v1/orders", nil, "x-api-key", "cfk_unknown")
+		require.Equal(t, http.StatusForbidden, recorder.Code)
+	})
+
+	t.Run("list api keys | status 200", func(t *testing.T) {
+		recorder := send(http.MethodGet, "/api/v1/apikeys", nil, "authorization", admin)
+		require.Equal(t, http.StatusOK, recorder.Code)
+		require.NotContains(t, recorder.Body.String(), "key_hash")
+		require.NotContains(t, recorder.Body.String(), key)
+
+		var res struct {
+			Data []types.APIKeyResParams `json:"data"`
+		}
+		require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &res))
+
+		var found *types.APIKeyResParams
+		for i := range res.Data {
+			if res.Data[i].Id == keyID {
+				found = &res.Data[i]
+			}
+		}
+		require.NotNil(t, found)
+		require.NotNil(t, found.LastUsedAt)
+	})
+
+	t.Run("revoke api key | status 204", func(t *testing.T) {
+		recorder := send(http.MethodDelete, fmt.Sprintf("/api/v1/apikeys/%s", keyID), nil, "authorization", admin)
+		require.Equal(t, http.StatusNoContent, recorder.Code)
+
+		recorder = send(http.MethodGet, "/api/v1/orders", nil, "x-api-key", key)
+		require.Equal(t, http.StatusForbidden, recorder.Code)
+
+		recorder = send(http.MethodDelete, fmt.Sprintf("/api/v1/apikeys/%s", keyID), nil, "authorization", admin)
+		require.Equal(t, http.StatusNotFound, recorder.Code)
+	})
+}
+
+func TestTwoFactor(t *testing.T) {
+	send := func(method, url string, body map[string]interface{}, token string) *httptest.ResponseRecorder {
+		data, err := json.Marshal(body)
+		require.NoError(t, err)
+
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(method, url, bytes.NewReader(data))
+		if token != "" {
+			request.Header.Set("authorization", fmt.Sprintf("Bearer %s", token))
+		}
+		server.Router.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	var secret, challenge string
+	var recoveryCodes []string
+	counter := totp.Counter(time.Now())
+
+	t.Run("role requires two-factor | status 403", func(t *testing.T) {
+		recorder := send(http.MethodPut, "/api/v1/roles/user", map[string]interface{}{"require_two_factor": true}, adminTestToken)
+		require.Equal(t, http.StatusOK, recorder.Code)
+
+		recorder = send(http.MethodGet, fmt.Sprintf("/api/v1/users/%s", userID), nil, userTestToken)
+		require.Equal(t, http.StatusForbidden, recorder.Code)
+	})
+
+	t.Run("enroll | status 200", func(t *testing.T) {
+		recorder := send(http.MethodPost, "/api/v1/users/2fa/enroll", nil, userTestToken)
+		require.Equal(t, http.StatusOK, recorder.Code)
+
+		var res struct {
+			Data struct {
+				Secret          string `json:"secret"`
+				ProvisioningURI string `json:"provisioning_uri"`
+			} `json:"data"`
+		}
+		require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &res))
+		require.NotEmpty(t, res.Data.Secret)
+		require.True(t, strings.HasPrefix(res.Data.ProvisioningURI, "otpauth://totp/"))
+		secret = res.Data.Secret
+	})
+
+	t.Run("confirm with a wrong code | status 400", func(t *testing.T) {
+		recorder := send(http.MethodPost, "/api/v1/users/2fa/confirm", map[string]interface{}{"code": "000000"}, userTestToken)
+		require.Equal(t, http.StatusBadRequest, recorder.Code)
+	})
+
+	t.Run("confirm | status 200", func(t *testing.T) {
+		code, err := totp.Code(secret, counter)
+		require.NoError(t, err)
+
+		recorder := send(http.MethodPost, "/api/v1/users/2fa/confirm", map[string]interface{}{"code": code}, userTestToken)
+		require.Equal(t, http.StatusOK, recorder.Code)
+
+		var res struct {
+			Data struct {
+				RecoveryCodes []string `json:"recovery_codes"`
+			} `json:"data"`
+		}
+		require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &res))
+		require.Len(t, res.Data.RecoveryCodes, 10)
+		recoveryCodes = res.Data.RecoveryCodes
+
+		recorder = send(http.MethodGet, fmt.Sprintf("/api/v1/users/%s", userID), nil, userTestToken)
+		require.Equal(t, http.StatusOK, recorder.Code)
+	})
+
+	login := func(t *testing.T) string {
+		recorder := send(http.MethodPost, "/api/v1/login", map[string]interface{}{"email": user.Email, "password": user.Password}, "")
+		require.Equal(t, http.StatusOK, recorder.Code)
+
+		var res struct {
+			Status         string `json:"status"`
+			Token          string `json:"token"`
+			ChallengeToken string `json:"challenge_token"`
+		}
+		require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &res))
+		require.Equal(t, "two_factor_required", res.Status)
+		require.Empty(t, res.Token)
+		return res.ChallengeToken
+	}
+
+	t.Run("login asks for a second factor | status 200", func(t *testing.T) {
+		challenge = login(t)
+		require.NotEmpty(t, challenge)
+	})
+
+	t.Run("replayed code | status 401", func(t *testing.T) {
+		code, err := totp.Code(secret, counter)
+		require.NoError(t, err)
+
+		recorder := send(http.MethodPost, "/api/v1/login/2fa", map[string]interface{}{"challenge_token": challenge, "code": code}, "")
+		require.Equal(t, http.StatusUnauthorized, recorder.Code)
+	})
+
+	t.Run("login with a code | status 200", func(t *testing.T) {
+		code, err := totp.Code(secret, counter+1)
+		require.NoError(t, err)
+
+		recorder := send(http.MethodPost, "/api/v1/login/2fa", map[string]interface{}{"challenge_token": challenge, "code": code}, "")
+		require.Equal(t, http.StatusOK, recorder.Code)
+
+		var res struct {
+			Token string `json:"token"`
+		}
+		require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &res))
+		require.NotEmpty(t, res.Token)
+		userTestToken = res.Token
+
+		recorder = send(http.MethodPost, "/api/v1/login/2fa", map[string]interface{}{"challenge_token": challenge, "code": code}, "")
+		require.Equal(t, http.StatusUnauthorized, recorder.Code)
+	})
+
+	t.Run("login with a recovery code | status 200", func(t *testing.T) {
+		body := map[string]interface{}{"challenge_token": login(t), "recovery_code": recoveryCodes[0]}
+		recorder := send(http.MethodPost, "/api/v1/login/2fa", body, "")
+		require.Equal(t, http.StatusOK, recorder.Code)
+
+		body["challenge_token"] = login(t)
+		recorder = send(http.MethodPost, "/api/v1/login/2fa", body, "")
+		require.Equal(t, http.StatusUnauthorized, recorder.Code)
+	})
+
+	t.Run("disable | status 204", func(t *testing.T) {
+		recorder := send(http.MethodPut, "/api/v1/roles/user", map[string]interface{}{"require_two_factor": false}, adminTestToken)
+		require.Equal(t, http.StatusOK, recorder.Code)
+
+		recorder = send(http.MethodPost, "/api/v1/users/2fa/disable", map[string]interface{}{"code": recoveryCodes[1]}, userTestToken)
+		require.Equal(t, http.StatusNoContent, recorder.Code)
+
+		recorder = send(http.MethodPost, "/api/v1/login", map[string]interface{}{"email": user.Email, "password": user.Password}, "")
+		require.Equal(t, http.StatusOK, recorder.Code)
+
+		var res struct {
+			Token string `json:"token"`
+		}
+		require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &res))
+		require.NotEmpty(t, res.Token)
+		userTestToken = res.Token
+	})
+}
+
 func TestGetAllUsers(t *testing.T) {
 	testCases := []struct {
 		name  string
@@ -5,16 +5,17 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
 	"net/http"
-	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-playground/validator/v10"
 	"github.com/gorilla/mux"
 	"github.com/hibiken/asynq"
 	"github.com/silaselisha/coffee-api/internal"
+	"github.com/silaselisha/coffee-api/internal/password"
 	"github.com/silaselisha/coffee-api/pkg/store"
-	"github.com/silaselisha/coffee-api/pkg/token"
 	"github.com/silaselisha/coffee-api/types"
 	"github.com/silaselisha/coffee-api/workers"
 	"go.mongodb.org/mongo-driver/bson"
@@ -32,72 +33,71 @@ func (s *Server) LoginUserHandler(ctx context.Context,
 		res := internal.NewErrorResponse("failed", err.Error())
 		return internal.ResponseHandler(w, res, http.StatusBadRequest)
 	}
+	credentials.Email = normalizeEmail(credentials.Email)
+
+	if wait := s.loginWait(ctx, r, credentials.Email); wait > 0 {
+		return tooManyLogins(w, wait)
+	}
 
 	var user store.User
 	collection := s.Store.Collection(ctx, "coffeeshop", "users")
 	curr := collection.FindOne(ctx, bson.D{{Key: "email", Value: credentials.Email}})
 	if err := curr.Decode(&user); err != nil {
-		if err == mongo.ErrNoDocuments {
-			response := internal.NewErrorResponse("failed", err.Error())
-			return internal.ResponseHandler(w, response, http.StatusNotFound)
+		if err != mongo.ErrNoDocuments {
+			return internal.ResponseHandler(
+				w,
+				internal.NewErrorResponse("failed", err.Error()),
+				http.StatusInternalServerError,
+			)
 		}
 
-		return internal.ResponseHandler(
-			w,
-			internal.NewErrorResponse("failed", err.Error()),
-			http.StatusInternalServerError,
-		)
-	}
-
-	if !internal.ComparePasswordEncryption(credentials.Password, user.Password) {
-		err := errors.New("invalid user password or email address")
-		response := internal.NewErrorResponse("failed", err.Error())
-		return internal.ResponseHandler(w, response, http.StatusBadRequest)
+		// Unknown emails still pay for a hash so that the response time
+		// does not tell them apart.
+		s.passwords.Verify(credentials.Password, s.dummyPasswordHash)
+		return s.loginFailed(ctx, w, r, nil, credentials.Email)
 	}
 
-	jwtToken := token.NewToken(s.envs.SECRET_ACCESS_KEY)
-	days, err := strconv.Atoi(s.envs.JWT_EXPIRES_AT)
-	if err != nil {
-		return internal.ResponseHandler(w, err, http.StatusInternalServerError)
+	// Accounts created through a social login have no password.
+	if user.Password == "" {
+		s.passwords.Verify(credentials.Password, s.dummyPasswordHash)
+		return s.loginFailed(ctx, w, r, &user, credentials.Email)
 	}
 
-	hrs := fmt.Sprintf("%dh", (days * 24))
-	duration, err := time.ParseDuration(hrs)
-	if err != nil {
+	ok, rehash, err := s.passwords.Verify(credentials.Password, user.Password)
+	if err != nil && !errors.Is(err, password.ErrUnknownHash) && !errors.Is(err, password.ErrMalformedHash) {
 		response := internal.NewErrorResponse("failed", err.Error())
 		return internal.ResponseHandler(w, response, http.StatusInternalServerError)
 	}
 
-	token, err := jwtToken.CreateToken(
-		ctx,
-		duration,
-		user.Id.Hex(),
-		user.Email,
-	)
+	if !ok {
+		return s.loginFailed(ctx, w, r, &user, credentials.Email)
+	}
 
-	if err != nil {
-		response := internal.NewErrorResponse("failed", err.Error())
-		return internal.ResponseHandler(
-			w,
-			response,
-			http.StatusInternalServerError,
-		)
+	// With two-factor authentication the login only succeeds once the
+	// second step has.
+	if user.TwoFactor == nil || !user.TwoFactor.Enabled {
+		s.loginSucceeded(ctx, credentials.Email)
 	}
 
-	res := struct {
-		Status string `json:"status"`
-		Token  string `json:"token"`
-	}{
-		Status: "success",
-		Token:  token,
+	if rehash {
+		s.rehashPassword(ctx, user, credentials.Password)
 	}
-	return internal.ResponseHandler(w, res, http.StatusOK)
+
+	return s.completeLogin(ctx, w, r, user)
 }
 
 func (s *Server) CreateUserHandler(
 	ctx context.Context,
 	w http.ResponseWriter,
 	r *http.Request) error {
+	if err := s.ensureUserTokenIndexes(ctx); err != nil {
+		return internal.ResponseHandler(
+			w,
+			internal.NewErrorResponse("failed", err.Error()),
+			http.StatusInternalServerError,
+		)
+	}
+
 	session, err := s.Store.TxnStartSession(ctx)
 	if err != nil {
 		return session.AbortTransaction(ctx)
@@ -127,14 +127,24 @@ func (s *Server) CreateUserHandler(
 			if err != nil {
 				return nil, err
 			}
+			signupData.Email = normalizeEmail(signupData.Email)
+
+			err = password.Validate(signupData.Password, signupData.UserName, emailLocalPart(signupData.Email))
+			if err != nil {
+				return nil, err
+			}
+
+			hashedPassword, err := s.passwords.Hash(signupData.Password)
+			if err != nil {
+				return nil, err
+			}
 
-			hashedPassword := internal.PasswordEncryption([]byte(signupData.Password))
 			// TODO: implement enums for user roles
 			user := store.User{
 				Id:          primitive.NewObjectID(),
 				UserName:    signupData.UserName,
 				Email:       signupData.Email,
-				PhoneNumber: signupData.Password,
+				PhoneNumber: signupData.PhoneNumber,
 				Role:        "user",
 				Avatar:      "default.jpeg",
 				Password:    hashedPassword,
@@ -152,7 +162,12 @@ func (s *Server) CreateUserHandler(
 				asynq.ProcessIn(3 * time.Second),
 				asynq.Queue(workers.CriticalQueue),
 			}
-			err = s.taskDistributor.VerificationMailTask(ctx, &types.PayloadSendMail{Email: user.Email}, opts...)
+			verificationToken, err := s.issueUserToken(ctx, user, types.TOKEN_EMAIL_VERIFICATION)
+			if err != nil {
+				return nil, err
+			}
+
+			err = s.taskDistributor.VerificationMailTask(ctx, &types.PayloadSendMail{Email: user.Email, Token: verificationToken}, opts...)
 			if err != nil {
 				return nil, err
 			}
@@ -200,6 +215,12 @@ func (s *Server) CreateUserHandler(
 				internal.NewErrorResponse("failed", fmt.Errorf("invalid data input for operation %w", err).Error()),
 				http.StatusBadRequest,
 			)
+		case errors.Is(err, password.ErrWeakPassword):
+			return internal.ResponseHandler(
+				w,
+				internal.NewErrorResponse("failed", err.Error()),
+				http.StatusBadRequest,
+			)
 		case err.(validator.ValidationErrors) != nil:
 			return internal.ResponseHandler(
 				w,
@@ -215,8 +236,8 @@ func (s *Server) CreateUserHandler(
 		}
 	}
 
-	jwtoken := token.NewToken(s.envs.SECRET_ACCESS_KEY)
-	days, err := strconv.Atoi(s.envs.JWT_EXPIRES_AT)
+	user := response.(*types.UserResParams)
+	id, err := primitive.ObjectIDFromHex(user.Id)
 	if err != nil {
 		return internal.ResponseHandler(
 			w,
@@ -225,17 +246,7 @@ func (s *Server) CreateUserHandler(
 		)
 	}
 
-	hrs := fmt.Sprintf("%dh", (days * 24))
-	duration, err := time.ParseDuration(hrs)
-	if err != nil {
-		return internal.ResponseHandler(
-			w,
-			internal.NewErrorResponse("failed", err.Error()),
-			http.StatusInternalServerError,
-		)
-	}
-	user := response.(*types.UserResParams)
-	token, err := jwtoken.CreateToken(ctx, duration, user.Id, user.Email)
+	tokens, err := s.issueTokens(ctx, r, store.User{Id: id, Email: user.Email, Role: user.Role}, primitive.NilObjectID)
 	if err != nil {
 		return internal.ResponseHandler(
 			w,
@@ -245,13 +256,15 @@ func (s *Server) CreateUserHandler(
 	}
 
 	result := struct {
-		Status string               `json:"status"`
-		Token  string               `json:"token"`
-		Data   *types.UserResParams `json:"data"`
+		Status       string               `json:"status"`
+		Token        string               `json:"token"`
+		RefreshToken string               `json:"refresh_token"`
+		Data         *types.UserResParams `json:"data"`
 	}{
-		Status: "success",
-		Token:  token,
-		Data:   user,
+		Status:       "success",
+		Token:        tokens.access,
+		RefreshToken: tokens.refresh,
+		Data:         user,
 	}
 	return internal.ResponseHandler(w, result, http.StatusCreated)
 }
@@ -323,10 +336,9 @@ func (s *Server) GetUserByIdHandler(ctx context.Context,
 		)
 	}
 
-	payload := ctx.Value(types.AuthPayloadKey{}).(*token.Payload)
 	userInfo := ctx.Value(types.AuthUserInfoKey{}).(*types.UserInfo)
 
-	if payload.Id != id.Hex() && userInfo.Role != "admin" {
+	if userInfo.Id != id && !userInfo.Can(types.PERM_USERS_READ) {
 		err := errors.New("user only allowed to retrive their person account")
 		return internal.ResponseHandler(
 			w,
@@ -377,8 +389,6 @@ func (s *Server) GetUserByIdHandler(ctx context.Context,
 }
 
 func (s *Server) UpdateUserByIdHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
-	collection := s.Store.Collection(r.Context(), "coffeeshop", "users")
-
 	params := mux.Vars(r)
 	id, err := primitive.ObjectIDFromHex(params["id"])
 	if err != nil {
@@ -464,19 +474,45 @@ func (s *Server) UpdateUserByIdHandler(ctx context.Context, w http.ResponseWrite
 	filter := bson.D{{Key: "_id", Value: id}}
 	update := bson.M{"$set": data}
 
-	newDocs := options.After
-	var updatedDocument store.User
-	err = collection.FindOneAndUpdate(ctx, filter, update, &options.FindOneAndUpdateOptions{
-		ReturnDocument: &newDocs,
-	}).Decode(&updatedDocument)
+	session, err := s.Store.TxnStartSession(ctx)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+	defer session.EndSession(ctx)
+
+	response, err := session.WithTransaction(ctx, func(ctx mongo.SessionContext) (interface{}, error) {
+		collection := s.Store.Collection(ctx, "coffeeshop", "users")
+
+		oldDocs := options.Before
+		var previousDocument store.User
+		err := collection.FindOneAndUpdate(ctx, filter, update, &options.FindOneAndUpdateOptions{
+			ReturnDocument: &oldDocs,
+		}).Decode(&previousDocument)
+		if err != nil {
+			return nil, err
+		}
+
+		var updatedDocument store.User
+		if err := collection.FindOne(ctx, filter).Decode(&updatedDocument); err != nil {
+			return nil, err
+		}
+
+		err = s.writeAudit(ctx, r, types.AUDIT_USER_UPDATE, "user", id.Hex(), previousDocument, updatedDocument)
+		if err != nil {
+			return nil, err
+		}
+		return updatedDocument, nil
+	}, &options.TransactionOptions{})
 
 	if err != nil {
-		if err == mongo.ErrNoDocuments {
+		if errors.Is(err, mongo.ErrNoDocuments) {
 			return internal.ResponseHandler(w, internal.NewErrorResponse("failed", fmt.Errorf("document not found %w", err).Error()), http.StatusNotFound)
 		}
 
 		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
 	}
+	updatedDocument := response.(store.User)
+	s.UserCache.InvalidateUser(ctx, updatedDocument.Id)
 
 	updatedUser := types.UserResParams{
 		Id:          updatedDocument.Id.Hex(),
@@ -501,8 +537,6 @@ func (s *Server) UpdateUserByIdHandler(ctx context.Context, w http.ResponseWrite
 }
 
 func (s *Server) DeleteUserByIdHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
-	collection := s.Store.Collection(ctx, "coffeeshop", "users")
-
 	params := mux.Vars(r)
 	id, err := primitive.ObjectIDFromHex(params["id"])
 	if err != nil {
@@ -515,15 +549,36 @@ func (s *Server) DeleteUserByIdHandler(ctx context.Context, w http.ResponseWrite
 		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusForbidden)
 	}
 
-	var user store.User
-	err = collection.FindOneAndDelete(ctx, bson.D{{Key: "_id", Value: id}}).Decode(&user)
+	session, err := s.Store.TxnStartSession(ctx)
 	if err != nil {
-		if err == mongo.ErrNoDocuments {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+	defer session.EndSession(ctx)
+
+	response, err := session.WithTransaction(ctx, func(ctx mongo.SessionContext) (interface{}, error) {
+		collection := s.Store.Collection(ctx, "coffeeshop", "users")
+
+		var user store.User
+		if err := collection.FindOneAndDelete(ctx, bson.D{{Key: "_id", Value: id}}).Decode(&user); err != nil {
+			return nil, err
+		}
+
+		err := s.writeAudit(ctx, r, types.AUDIT_USER_DELETE, "user", id.Hex(), user, nil)
+		if err != nil {
+			return nil, err
+		}
+		return user, nil
+	}, &options.TransactionOptions{})
+
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
 			return internal.ResponseHandler(w, internal.NewErrorResponse("failed", fmt.Errorf("document not found %w", err).Error()), http.StatusNotFound)
 		}
 
 		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
 	}
+	user := response.(store.User)
+	s.UserCache.InvalidateUser(ctx, user.Id)
 
 	errs := make(chan error)
 	go func() {
@@ -544,6 +599,9 @@ func (s *Server) DeleteUserByIdHandler(ctx context.Context, w http.ResponseWrite
 	return internal.ResponseHandler(w, "", http.StatusNoContent)
 }
 
+// ForgotPasswordHandler mails a password reset link. It answers the same
+// whether or not the address belongs to an account, and whether or not a
+// link was sent, so that it cannot be used to find out who has one.
 func (s *Server) ForgotPasswordHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	collection := s.Store.Collection(ctx, "coffeeshop", "users")
 
@@ -552,34 +610,49 @@ func (s *Server) ForgotPasswordHandler(ctx context.Context, w http.ResponseWrite
 		res := internal.NewErrorResponse("failed", err.Error())
 		return internal.ResponseHandler(w, res, http.StatusBadRequest)
 	}
+	resetPasswordData.Email = normalizeEmail(resetPasswordData.Email)
+
+	if err := s.ensureUserTokenIndexes(ctx); err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+
+	result := struct {
+		Status string `json:"status"`
+		Data   string `json:"data"`
+	}{
+		Status: "success",
+		Data:   "If an account uses this email, a URL to reset its password has been sent to it",
+	}
 
 	var user store.User
 	curr := collection.FindOne(ctx, bson.D{{Key: "email", Value: resetPasswordData.Email}})
 	err = curr.Decode(&user)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
-			return internal.ResponseHandler(w, internal.NewErrorResponse("failed", fmt.Errorf("document not found %w", err).Error()), http.StatusNotFound)
+			return internal.ResponseHandler(w, result, http.StatusOK)
 		}
 
 		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
 	}
 
+	resetToken, err := s.issueUserToken(ctx, user, types.TOKEN_PASSWORD_RESET)
+	if err != nil {
+		// The links already sent are still valid; saying that there were
+		// too many would tell that the account exists.
+		if errors.Is(err, errUserTokenRateLimited) {
+			return internal.ResponseHandler(w, result, http.StatusOK)
+		}
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+
 	opts := []asynq.Option{
 		asynq.ProcessIn(1 * time.Minute),
 		asynq.MaxRetry(10),
 		asynq.Queue("critical"),
 	}
-	err = s.taskDistributor.PasswordResetMailTask(ctx, &types.PayloadSendMail{Email: user.Email}, opts...)
+	err = s.taskDistributor.PasswordResetMailTask(ctx, &types.PayloadSendMail{Email: user.Email, Token: resetToken}, opts...)
 	if err != nil {
-		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
-	}
-
-	result := struct {
-		Status string `json:"status"`
-		Data   string `json:"data"`
-	}{
-		Status: "success",
-		Data:   "URL to reset your password sent to your email",
+		log.Printf("failed to enqueue the password reset mail of user %s %v\n", user.Id.Hex(), err)
 	}
 
 	return internal.ResponseHandler(w, result, http.StatusOK)
@@ -589,58 +662,80 @@ func (s *Server) ResetPasswordHandler(ctx context.Context,
 	w http.ResponseWriter,
 	r *http.Request) error {
 	collection := s.Store.Collection(ctx, "coffeeshop", "users")
+	tokens := s.Store.Collection(ctx, "coffeeshop", "user_tokens")
 
-	queries := r.URL.Query()
-	token := queries["token"][0]
-	timestampStr := queries["timestamp"][0]
-
-	timestamp, err := strconv.Atoi(timestampStr)
-	if err != nil {
-		err = fmt.Errorf("invalid URL reset timestamp %w", err)
+	resetToken := r.URL.Query().Get("token")
+	if resetToken == "" {
 		return internal.ResponseHandler(
 			w,
-			internal.NewErrorResponse("failed", err.Error()),
+			internal.NewErrorResponse("failed", errInvalidUserToken.Error()),
 			http.StatusBadRequest,
 		)
 	}
 
-	isURLValid := time.Now().After(time.UnixMilli(int64(timestamp)))
-	if isURLValid {
-
-		err = fmt.Errorf("expired URL reset token, kindly request for a new password reset token")
-		return internal.ResponseHandler(
-			w,
-			internal.NewErrorResponse("failed", err.Error()),
-			http.StatusBadRequest,
-		)
+	passwordResetData, err := internal.ReadReqBody[types.PasswordResetParams](r.Body, s.vd)
+	if err != nil {
+		err = fmt.Errorf("invalid data for paswword reset %w", err)
+		res := internal.NewErrorResponse("failed", err.Error())
+		return internal.ResponseHandler(w, res, http.StatusBadRequest)
 	}
 
-	id, err := primitive.ObjectIDFromHex(token)
+	// The token is only looked up here so that a password rejected by the
+	// policy does not burn the link; it is consumed right before the update.
+	userToken, err := findUserToken(ctx, tokens, resetToken, types.TOKEN_PASSWORD_RESET)
 	if err != nil {
-		err = fmt.Errorf("invalid URL reset token %w", err)
+		if errors.Is(err, errInvalidUserToken) {
+			return internal.ResponseHandler(
+				w,
+				internal.NewErrorResponse("failed", err.Error()),
+				http.StatusBadRequest,
+			)
+		}
 		return internal.ResponseHandler(
 			w,
 			internal.NewErrorResponse("failed", err.Error()),
-			http.StatusBadRequest,
+			http.StatusInternalServerError,
 		)
 	}
 
-	passwordResetData, err := internal.ReadReqBody[types.PasswordResetParams](r.Body, s.vd)
-	if err != nil {
-		err = fmt.Errorf("invalid data for paswword reset %w", err)
-		res := internal.NewErrorResponse("failed", err.Error())
-		return internal.ResponseHandler(w, res, http.StatusBadRequest)
-	}
+	var user store.User
+	err = collection.FindOne(ctx, bson.D{{Key: "_id", Value: userToken.User}}).Decode(&user)
+	if err == nil {
+		err = password.Validate(passwordResetData.Password, user.UserName, emailLocalPart(user.Email))
+		if err != nil {
+			return internal.ResponseHandler(
+				w,
+				internal.NewErrorResponse("failed", err.Error()),
+				http.StatusBadRequest,
+			)
+		}
+
+		var hashedPassword string
+		hashedPassword, err = s.passwords.Hash(passwordResetData.Password)
+		if err != nil {
+			return internal.ResponseHandler(
+				w,
+				internal.NewErrorResponse("failed", err.Error()),
+				http.StatusInternalServerError,
+			)
+		}
 
-	password := internal.PasswordEncryption([]byte(passwordResetData.Password))
-	updatedAt := time.Now()
-	passwordChangedAt := time.Now()
+		_, err = consumeUserToken(ctx, tokens, resetToken, types.TOKEN_PASSWORD_RESET)
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, errInvalidUserToken) {
+				status = http.StatusBadRequest
+			}
+			return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), status)
+		}
 
-	update := bson.D{{Key: "$set", Value: bson.D{{Key: "password", Value: password}, {Key: "updated_at", Value: updatedAt}, {Key: "password_changed_at", Value: passwordChangedAt}}}}
+		updatedAt := time.Now()
+		passwordChangedAt := time.Now()
+		update := bson.D{{Key: "$set", Value: bson.D{{Key: "password", Value: hashedPassword}, {Key: "updated_at", Value: updatedAt}, {Key: "password_changed_at", Value: passwordChangedAt}}}}
+		curr := collection.FindOneAndUpdate(ctx, bson.D{{Key: "_id", Value: user.Id}}, update)
+		err = curr.Decode(&user)
+	}
 
-	var user store.User
-	curr := collection.FindOneAndUpdate(ctx, bson.D{{Key: "_id", Value: id}}, update)
-	err = curr.Decode(&user)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
 			return internal.ResponseHandler(
@@ -658,25 +753,16 @@ func (s *Server) ResetPasswordHandler(ctx context.Context,
 			http.StatusInternalServerError,
 		)
 	}
+	s.UserCache.InvalidateUser(ctx, user.Id)
 
-	result := struct {
-		Status string `json:"status"`
-	}{
-		Status: "success",
+	// Other reset links mailed before this one die with the old password.
+	filter := bson.D{
+		{Key: "user", Value: user.Id},
+		{Key: "purpose", Value: types.TOKEN_PASSWORD_RESET},
+		{Key: "used_at", Value: bson.D{{Key: "$exists", Value: false}}},
 	}
-	return internal.ResponseHandler(w, result, http.StatusPermanentRedirect)
-}
-
-func (s *Server) VerifyAccountHandler(ctx context.Context,
-	w http.ResponseWriter,
-	r *http.Request) error {
-	queries := r.URL.Query()
-	token := queries["token"][0]
-	timestamp := queries["timestamp"][0]
-
-	id, err := primitive.ObjectIDFromHex(token)
+	_, err = tokens.UpdateMany(ctx, filter, bson.D{{Key: "$set", Value: bson.D{{Key: "used_at", Value: time.Now()}}}})
 	if err != nil {
-		err = fmt.Errorf("invalid account id %w", err)
 		return internal.ResponseHandler(
 			w,
 			internal.NewErrorResponse("failed", err.Error()),
@@ -684,29 +770,50 @@ func (s *Server) VerifyAccountHandler(ctx context.Context,
 		)
 	}
 
-	mill, err := strconv.Atoi(timestamp)
+	// A new password ends any lockout the old one was guessed into.
+	if err := s.loginGuard.Unlock(ctx, user.Email); err != nil {
+		log.Printf("failed to unlock user %s after a password reset %v\n", user.Id.Hex(), err)
+	}
+
+	// Sessions started with the old password must not outlive it.
+	err = revokeRefreshTokens(ctx, s.Store.Collection(ctx, "coffeeshop", "refresh_tokens"), bson.D{{Key: "user", Value: user.Id}})
 	if err != nil {
-		err = fmt.Errorf("invalid timestamp %w", err)
 		return internal.ResponseHandler(
 			w,
 			internal.NewErrorResponse("failed", err.Error()),
-			http.StatusBadRequest,
+			http.StatusInternalServerError,
 		)
 	}
 
-	if time.Now().After(time.UnixMilli(int64(mill))) {
-		err = fmt.Errorf("invalid timestamp expired %w", err)
-		return internal.ResponseHandler(
-			w,
-			internal.NewErrorResponse("failed", err.Error()),
-			http.StatusBadRequest,
-		)
+	result := struct {
+		Status string `json:"status"`
+	}{
+		Status: "success",
+	}
+	return internal.ResponseHandler(w, result, http.StatusPermanentRedirect)
+}
+
+func (s *Server) VerifyAccountHandler(ctx context.Context,
+	w http.ResponseWriter,
+	r *http.Request) error {
+	tokens := s.Store.Collection(ctx, "coffeeshop", "user_tokens")
+
+	userToken, err := consumeUserToken(ctx, tokens, r.URL.Query().Get("token"), types.TOKEN_EMAIL_VERIFICATION)
+	if err != nil {
+		if errors.Is(err, errInvalidUserToken) {
+			return internal.ResponseHandler(
+				w,
+				internal.NewErrorResponse("failed", err.Error()),
+				http.StatusBadRequest,
+			)
+		}
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
 	}
 
 	var user store.User
 	collection := s.Store.Collection(ctx, "coffeeshop", "users")
 	update := bson.D{{Key: "$set", Value: bson.D{{Key: "verified", Value: true}, {Key: "updated_at", Value: time.Now()}}}}
-	curr := collection.FindOneAndUpdate(ctx, bson.D{{Key: "_id", Value: id}}, update)
+	curr := collection.FindOneAndUpdate(ctx, bson.D{{Key: "_id", Value: userToken.User}}, update)
 	err = curr.Decode(&user)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
@@ -719,6 +826,7 @@ func (s *Server) VerifyAccountHandler(ctx context.Context,
 		}
 		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
 	}
+	s.UserCache.InvalidateUser(ctx, user.Id)
 
 	result := struct {
 		Status string `json:"status"`
@@ -729,3 +837,161 @@ func (s *Server) VerifyAccountHandler(ctx context.Context,
 	}
 	return internal.ResponseHandler(w, result, http.StatusOK)
 }
+
+// ResendVerificationHandler mails the caller a fresh verification link,
+// subject to the same per address limit as password reset links.
+func (s *Server) ResendVerificationHandler(ctx context.Context,
+	w http.ResponseWriter,
+	r *http.Request) error {
+	collection := s.Store.Collection(ctx, "coffeeshop", "users")
+	userInfo := ctx.Value(types.AuthUserInfoKey{}).(*types.UserInfo)
+
+	var user store.User
+	err := collection.FindOne(ctx, bson.D{{Key: "_id", Value: userInfo.Id}}).Decode(&user)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return internal.ResponseHandler(w, internal.NewErrorResponse("failed", fmt.Errorf("document not found %w", err).Error()), http.StatusNotFound)
+		}
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+
+	if user.Verified {
+		err := errors.New("account already verified")
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusConflict)
+	}
+
+	if err := s.ensureUserTokenIndexes(ctx); err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+
+	verificationToken, err := s.issueUserToken(ctx, user, types.TOKEN_EMAIL_VERIFICATION)
+	if err != nil {
+		if errors.Is(err, errUserTokenRateLimited) {
+			return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusTooManyRequests)
+		}
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+
+	opts := []asynq.Option{
+		asynq.MaxRetry(3),
+		asynq.Queue(workers.CriticalQueue),
+	}
+	err = s.taskDistributor.VerificationMailTask(ctx, &types.PayloadSendMail{Email: user.Email, Token: verificationToken}, opts...)
+	if err != nil {
+		return internal.ResponseHandler(w, internal.NewErrorResponse("failed", err.Error()), http.StatusInternalServerError)
+	}
+
+	result := struct {
+		Status string `json:"status"`
+		Data   string `json:"data"`
+	}{
+		Status: "success",
+		Data:   "verification link sent to your email",
+	}
+	return internal.ResponseHandler(w, result, http.StatusOK)
+}
+
+// rehashPassword replaces a stored hash made with a legacy scheme or weaker
+// parameters once the plain password is known again at login. Failing to
+// upgrade is not fatal, the next login simply tries again.
+func (s *Server) rehashPassword(ctx context.Context, user store.User, plain string) {
+	hashedPassword, err := s.passwords.Hash(plain)
+	if err != nil {
+		log.Printf("failed to rehash password of user %s %v\n", user.Id.Hex(), err)
+		return
+	}
+
+	collection := s.Store.Collection(ctx, "coffeeshop", "users")
+	filter := bson.D{{Key: "_id", Value: user.Id}, {Key: "password", Value: user.Password}}
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "password", Value: hashedPassword}}}}
+	if _, err := collection.UpdateOne(ctx, filter, update); err != nil {
+		log.Printf("failed to rehash password of user %s %v\n", user.Id.Hex(), err)
+	}
+}
+
+// clearLeakedPhoneNumbers repairs accounts created while signup saved the
+// plain password as the phone number: a phone number that verifies against
+// the account's own password hash is cleared. It runs as a migration, see
+// runMigrations.
+func clearLeakedPhoneNumbers(ctx context.Context, str store.Mongo, passwords *password.Manager) error {
+	users := str.Collection(ctx, "coffeeshop", "users")
+
+	filter := bson.D{
+		{Key: "phoneNumber", Value: bson.D{{Key: "$nin", Value: bson.A{"", nil}}}},
+		{Key: "password", Value: bson.D{{Key: "$nin", Value: bson.A{"", nil}}}},
+	}
+	projection := bson.D{{Key: "phoneNumber", Value: 1}, {Key: "password", Value: 1}}
+	cur, err := users.Find(ctx, filter, options.Find().SetProjection(projection))
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+
+	cleared := 0
+	for cur.Next(ctx) {
+		var user store.User
+		if err := cur.Decode(&user); err != nil {
+			return err
+		}
+
+		ok, _, err := passwords.Verify(user.PhoneNumber, user.Password)
+		if err != nil || !ok {
+			continue
+		}
+
+		update := bson.D{{Key: "$set", Value: bson.D{{Key: "phoneNumber", Value: ""}}}}
+		if _, err := users.UpdateOne(ctx, bson.D{{Key: "_id", Value: user.Id}}, update); err != nil {
+			return err
+		}
+		cleared++
+	}
+	if err := cur.Err(); err != nil {
+		return err
+	}
+	log.Printf("cleared the phone number of %d users that held their password\n", cleared)
+	return nil
+}
+
+// lowercaseEmails normalizes the emails stored before signup did, so that
+// the lookups, which normalize what they are given, find them. Accounts
+// whose emails only differ in case cannot both keep theirs; they are
+// logged and left for an admin to merge.
+func lowercaseEmails(ctx context.Context, str store.Mongo) error {
+	users := str.Collection(ctx, "coffeeshop", "users")
+
+	normalized := bson.D{{Key: "$toLower", Value: bson.D{{Key: "$trim", Value: bson.D{{Key: "input", Value: "$email"}}}}}}
+	filter := bson.D{{Key: "$expr", Value: bson.D{{Key: "$ne", Value: bson.A{"$email", normalized}}}}}
+	cur, err := users.Find(ctx, filter, options.Find().SetProjection(bson.D{{Key: "email", Value: 1}}))
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		var user store.User
+		if err := cur.Decode(&user); err != nil {
+			return err
+		}
+
+		update := bson.D{{Key: "$set", Value: bson.D{{Key: "email", Value: normalizeEmail(user.Email)}}}}
+		if _, err := users.UpdateOne(ctx, bson.D{{Key: "_id", Value: user.Id}}, update); err != nil {
+			if mongo.IsDuplicateKeyError(err) {
+				log.Printf("user %s shares the email %s with another account\n", user.Id.Hex(), normalizeEmail(user.Email))
+				continue
+			}
+			return err
+		}
+	}
+	return cur.Err()
+}
+
+// normalizeEmail is applied to every email before it is stored or looked
+// up, since addresses are matched exactly.
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+func emailLocalPart(email string) string {
+	local, _, _ := strings.Cut(email, "@")
+	return local
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/silaselisha/coffee-api/pkg/store"
+	"github.com/silaselisha/coffee-api/pkg/token"
+	"github.com/silaselisha/coffee-api/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	passwordResetTokenTTL     = time.Hour
+	emailVerificationTokenTTL = 48 * time.Hour
+	accountUnlockTokenTTL     = 24 * time.Hour
+
+	// At most userTokenIssueLimit links of one kind are mailed to an address
+	// within userTokenIssueWindow.
+	userTokenIssueLimit  = 3
+	userTokenIssueWindow = time.Hour
+)
+
+var (
+	errInvalidUserToken     = errors.New("invalid or expired token, kindly request a new link")
+	errUserTokenRateLimited = errors.New("too many requests for this email address, try again later")
+)
+
+var userTokenTTL = map[string]time.Duration{
+	types.TOKEN_PASSWORD_RESET:     passwordResetTokenTTL,
+	types.TOKEN_EMAIL_VERIFICATION: emailVerificationTokenTTL,
+	types.TOKEN_ACCOUNT_UNLOCK:     accountUnlockTokenTTL,
+}
+
+// ensureUserTokenIndexes is kept apart from issueUserToken because the
+// verification token is issued inside the signup transaction.
+func (s *Server) ensureUserTokenIndexes(ctx context.Context) error {
+	collection := s.Store.Collection(ctx, "coffeeshop", "user_tokens")
+	_, err := collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "token_hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "email", Value: 1}, {Key: "purpose", Value: 1}, {Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(int32(24 * time.Hour / time.Second))},
+	})
+	return err
+}
+
+// issueUserToken stores the digest of a new single use token for purpose
+// and returns the token to be mailed, refusing once the address has been
+// sent too many links recently.
+func (s *Server) issueUserToken(ctx context.Context, user store.User, purpose string) (string, error) {
+	collection := s.Store.Collection(ctx, "coffeeshop", "user_tokens")
+
+	filter := bson.D{
+		{Key: "email", Value: user.Email},
+		{Key: "purpose", Value: purpose},
+		{Key: "created_at", Value: bson.D{{Key: "$gte", Value: time.Now().Add(-userTokenIssueWindow)}}},
+	}
+	issued, err := collection.CountDocuments(ctx, filter)
+	if err != nil {
+		return "", err
+	}
+	if issued >= userTokenIssueLimit {
+		return "", errUserTokenRateLimited
+	}
+
+	plain, digest, err := token.NewOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	_, err = collection.InsertOne(ctx, store.UserToken{
+		Id:        primitive.NewObjectID(),
+		User:      user.Id,
+		Email:     user.Email,
+		Purpose:   purpose,
+		TokenHash: digest,
+		ExpiresAt: time.Now().Add(userTokenTTL[purpose]),
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		return "", err
+	}
+	return plain, nil
+}
+
+func findUserToken(ctx context.Context, collection *mongo.Collection, plain, purpose string) (store.UserToken, error) {
+	var userToken store.UserToken
+	err := collection.FindOne(ctx, userTokenFilter(plain, purpose)).Decode(&userToken)
+	if err == mongo.ErrNoDocuments {
+		return userToken, errInvalidUserToken
+	}
+	return userToken, err
+}
+
+// consumeUserToken marks the token used, failing with errInvalidUserToken
+// when it is unknown, expired or was consumed by a concurrent request.
+func consumeUserToken(ctx context.Context, collection *mongo.Collection, plain, purpose string) (store.UserToken, error) {
+	var userToken store.UserToken
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "used_at", Value: time.Now()}}}}
+	err := collection.FindOneAndUpdate(ctx, userTokenFilter(plain, purpose), update).Decode(&userToken)
+	if err == mongo.ErrNoDocuments {
+		return userToken, errInvalidUserToken
+	}
+	return userToken, err
+}
+
+func userTokenFilter(plain, purpose string) bson.D {
+	return bson.D{
+		{Key: "token_hash", Value: token.HashOpaqueToken(plain)},
+		{Key: "purpose", Value: purpose},
+		{Key: "used_at", Value: bson.D{{Key: "$exists", Value: false}}},
+		{Key: "expires_at", Value: bson.D{{Key: "$gt", Value: time.Now()}}},
+	}
+}
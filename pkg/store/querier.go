@@ -11,6 +11,13 @@ type Querier interface {
 	UsersQueries
 	OrdersQueries
 	ProductsQueries
+	ReviewsQueries
+	InventoryQueries
+	ReservationsQueries
+	PaymentsQueries
+	RolesQueries
+	APIKeysQueries
+	AuditQueries
 }
 
 type UsersQueries interface {
@@ -21,6 +28,22 @@ type UsersQueries interface {
 	LoginUserHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error
 	ForgotPasswordHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error
 	ResetPasswordHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error
+	RefreshTokenHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error
+	LogoutHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error
+	LogoutAllHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error
+	RevokeUserSessionsHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error
+	VerifyAccountHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error
+	UnlockAccountHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error
+	ResendVerificationHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error
+	JWKSHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error
+	UserCacheStatsHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error
+	OIDCLoginHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error
+	OIDCCallbackHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error
+	TwoFactorLoginHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error
+	EnrollTwoFactorHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error
+	ConfirmTwoFactorHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error
+	DisableTwoFactorHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error
+	RegenerateRecoveryCodesHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error
 }
 
 type ProductsQueries interface {
@@ -28,10 +51,70 @@ type ProductsQueries interface {
 	UpdateProductHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error
 	DeleteProductByIdHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error
 	GetAllProductsHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error
+	SearchProductsHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error
 	GetProductByIdHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error
 	BatchGetAllProductsByIds(ctx context.Context, data []primitive.ObjectID) (map[primitive.ObjectID]Item, error)
 }
 
 type OrdersQueries interface {
 	CreateOrderHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error
+	GetAllOrdersHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error
+	GetOrderByIdHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error
+	GetUserOrdersHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error
+	CancelOrderHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error
+	UpdateOrderStatusHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error
+	GetOrderInvoiceHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error
+}
+
+type ReviewsQueries interface {
+	GetProductReviewsHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error
+	CreateReviewHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error
+	UpdateReviewHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error
+	DeleteReviewHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error
+	UpdateReviewVisibilityHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error
+}
+
+type InventoryQueries interface {
+	GetAllIngredientsHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error
+	CreateIngredientHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error
+	UpdateIngredientStockHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error
+}
+
+type ReservationsQueries interface {
+	GetAllTablesHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error
+	CreateTableHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error
+	UpdateTableHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error
+	DeleteTableHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error
+	GetReservationAvailabilityHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error
+	CreateReservationHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error
+	GetReservationsHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error
+	GetReservationByIdHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error
+	UpdateReservationHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error
+	CancelReservationHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error
+	GetDayReservationsHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error
+}
+
+type PaymentsQueries interface {
+	CreatePaymentHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error
+	ConfirmPaymentHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error
+	PaymentWebhookHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error
+	CreateRefundHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error
+}
+
+type RolesQueries interface {
+	GetAllRolesHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error
+	CreateRoleHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error
+	UpdateRoleHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error
+	DeleteRoleHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error
+	UpdateUserRoleHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error
+}
+
+type APIKeysQueries interface {
+	GetAllAPIKeysHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error
+	CreateAPIKeyHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error
+	RevokeAPIKeyHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error
+}
+
+type AuditQueries interface {
+	GetAuditLogHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error
 }
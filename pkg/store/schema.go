@@ -3,24 +3,45 @@ package store
 import (
 	"time"
 
+	"github.com/silaselisha/coffee-api/types"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 type Item struct {
-	Id          primitive.ObjectID `bson:"_id"`
-	Images      []string           `bson:"images"`
-	Name        string             `bson:"name" validate:"required"`
-	Price       float64            `bson:"price" validate:"required"`
-	Summary     string             `bson:"summary" validate:"required"`
-	Category    string             `bson:"category" validate:"required,oneof=beverages snacks"`
-	Discount    uint32             `bson:"discount"`
-	Author      primitive.ObjectID `bson:"author"`
-	Thumbnail   string             `bson:"thumbnail"`
-	Description string             `bson:"description" validate:"required"`
-	Ingridients []string           `bson:"ingridients" validate:"required"`
-	Ratings     float64            `bson:"ratings"`
-	CreatedAt   time.Time          `bson:"created_at"`
-	UpdatedAt   time.Time          `bson:"updated_at"`
+	Id           primitive.ObjectID `bson:"_id"`
+	Images       []string           `bson:"images"`
+	Name         string             `bson:"name" validate:"required"`
+	Price        float64            `bson:"price" validate:"required"`
+	Summary      string             `bson:"summary" validate:"required"`
+	Category     string             `bson:"category" validate:"required,oneof=beverages snacks"`
+	Discount     uint32             `bson:"discount"`
+	Author       primitive.ObjectID `bson:"author"`
+	Thumbnail    string             `bson:"thumbnail"`
+	Description  string             `bson:"description" validate:"required"`
+	Ingridients  []string           `bson:"ingridients" validate:"required"`
+	Ratings      float64            `bson:"ratings"`
+	RatingsCount int64              `bson:"ratings_count"`
+	TrackStock   bool               `bson:"track_stock"`
+	Stock        int64              `bson:"stock"`
+	Recipe       []RecipeItem       `bson:"recipe,omitempty"`
+	CreatedAt    time.Time          `bson:"created_at"`
+	UpdatedAt    time.Time          `bson:"updated_at"`
+}
+
+// RecipeItem is the amount of an ingredient consumed by one unit of a
+// product. Products without a recipe do not touch ingredient stock.
+type RecipeItem struct {
+	Ingredient primitive.ObjectID `bson:"ingredient"`
+	Quantity   float64            `bson:"quantity"`
+}
+
+type Ingredient struct {
+	Id        primitive.ObjectID `bson:"_id"`
+	Name      string             `bson:"name" validate:"required"`
+	Unit      string             `bson:"unit" validate:"required"`
+	Stock     float64            `bson:"stock"`
+	CreatedAt time.Time          `bson:"created_at"`
+	UpdatedAt time.Time          `bson:"updated_at"`
 }
 
 type User struct {
@@ -33,14 +54,155 @@ type User struct {
 	Verified          bool               `bson:"verified"`
 	Password          string             `bson:"password" validate:"required"`
 	PasswordChangedAt time.Time          `bson:"password_changed_at,omitempty"`
+	TokenVersion      int64              `bson:"token_version"`
+	Identities        []Identity         `bson:"identities,omitempty"`
+	TwoFactor         *TwoFactor         `bson:"two_factor,omitempty"`
 	CreatedAt         time.Time          `bson:"created_at"`
 	UpdatedAt         time.Time          `bson:"updated_at"`
 }
 
-type Reservation struct {
+// Identity links a user to their account at an external OpenID Connect
+// provider.
+type Identity struct {
+	Provider string    `bson:"provider"`
+	Subject  string    `bson:"subject"`
+	LinkedAt time.Time `bson:"linked_at"`
+}
+
+// TwoFactor is a user's TOTP enrolment. It stays disabled until the first
+// code is confirmed. Recovery codes are stored as digests and removed once
+// used.
+type TwoFactor struct {
+	Secret        string     `bson:"secret"`
+	Enabled       bool       `bson:"enabled"`
+	LastCounter   int64      `bson:"last_counter"`
+	RecoveryCodes []string   `bson:"recovery_codes"`
+	EnabledAt     *time.Time `bson:"enabled_at,omitempty"`
+}
+
+// Role names a set of permissions. System roles ship with the API and
+// cannot be deleted; the admin role additionally cannot be edited, except
+// for RequireTwoFactor. Holders of a role with RequireTwoFactor set cannot
+// use the API until they have enrolled in two-factor authentication.
+type Role struct {
+	Id               primitive.ObjectID `bson:"_id"`
+	Name             string             `bson:"name"`
+	Description      string             `bson:"description"`
+	Permissions      []string           `bson:"permissions"`
+	System           bool               `bson:"system"`
+	RequireTwoFactor bool               `bson:"require_two_factor"`
+	CreatedAt        time.Time          `bson:"created_at"`
+	UpdatedAt        time.Time          `bson:"updated_at"`
+}
+
+// APIKey lets a machine client such as a till or a kitchen display call the
+// API without a login, holding only the permissions it was given. Only the
+// digest of the key is stored; Prefix tells keys apart in listings.
+type APIKey struct {
+	Id          primitive.ObjectID `bson:"_id"`
+	Name        string             `bson:"name"`
+	Prefix      string             `bson:"prefix"`
+	KeyHash     string             `bson:"key_hash"`
+	Permissions []string           `bson:"permissions"`
+	ExpiresAt   *time.Time         `bson:"expires_at,omitempty"`
+	LastUsedAt  *time.Time         `bson:"last_used_at,omitempty"`
+	RevokedAt   *time.Time         `bson:"revoked_at,omitempty"`
+	CreatedBy   primitive.ObjectID `bson:"created_by"`
+	CreatedAt   time.Time          `bson:"created_at"`
+}
+
+// AuditEntry records who changed what through an administrative endpoint.
+// The audit_log collection is append-only: the API inserts entries and never
+// updates or deletes them. Actors are copied rather than referenced so that
+// entries still read right after the user or key is gone.
+type AuditEntry struct {
+	Id         primitive.ObjectID `bson:"_id"`
+	ActorId    primitive.ObjectID `bson:"actor_id"`
+	ActorType  string             `bson:"actor_type"`
+	ActorEmail string             `bson:"actor_email,omitempty"`
+	ActorRole  string             `bson:"actor_role,omitempty"`
+	Action     string             `bson:"action"`
+	TargetType string             `bson:"target_type"`
+	TargetId   string             `bson:"target_id"`
+	Changes    []AuditChange      `bson:"changes"`
+	RequestId  string             `bson:"request_id"`
+	IP         string             `bson:"ip"`
+	CreatedAt  time.Time          `bson:"created_at"`
+}
+
+// AuditChange is a top level field whose value differs before and after an
+// action. Secrets are recorded as changed without their values.
+type AuditChange struct {
+	Field  string      `bson:"field"`
+	Before interface{} `bson:"before"`
+	After  interface{} `bson:"after"`
+}
+
+// RefreshToken is one link in a chain of rotated refresh tokens. Every
+// login starts a new family; rotating a token marks it as rotated and adds
+// the next token to the same family, so presenting a rotated token again
+// reveals that it was stolen and the whole family is revoked.
+type RefreshToken struct {
 	Id        primitive.ObjectID `bson:"_id"`
+	User      primitive.ObjectID `bson:"user"`
+	Family    primitive.ObjectID `bson:"family"`
+	TokenHash string             `bson:"token_hash"`
+	UserAgent string             `bson:"user_agent"`
+	IP        string             `bson:"ip"`
+	ExpiresAt time.Time          `bson:"expires_at"`
+	RotatedAt *time.Time         `bson:"rotated_at,omitempty"`
+	RevokedAt *time.Time         `bson:"revoked_at,omitempty"`
+	CreatedAt time.Time          `bson:"created_at"`
+}
+
+// UserToken backs the single use links mailed for password resets and
+// account verification. Only the digest of the token is stored.
+type UserToken struct {
+	Id        primitive.ObjectID `bson:"_id"`
+	User      primitive.ObjectID `bson:"user"`
+	Email     string             `bson:"email"`
+	Purpose   string             `bson:"purpose"`
+	TokenHash string             `bson:"token_hash"`
+	ExpiresAt time.Time          `bson:"expires_at"`
+	UsedAt    *time.Time         `bson:"used_at,omitempty"`
 	CreatedAt time.Time          `bson:"created_at"`
-	UpdatedAt time.Time          `bson:"updated_at"`
+}
+
+// LoginChallenge is handed out instead of tokens when a user with
+// two-factor authentication has passed the first login step.
+type LoginChallenge struct {
+	Id        primitive.ObjectID `bson:"_id"`
+	User      primitive.ObjectID `bson:"user"`
+	TokenHash string             `bson:"token_hash"`
+	Attempts  int                `bson:"attempts"`
+	ExpiresAt time.Time          `bson:"expires_at"`
+	CreatedAt time.Time          `bson:"created_at"`
+}
+
+// OIDCState remembers a social login between the redirect to the provider
+// and its callback.
+type OIDCState struct {
+	Id        primitive.ObjectID `bson:"_id"`
+	StateHash string             `bson:"state_hash"`
+	Provider  string             `bson:"provider"`
+	Nonce     string             `bson:"nonce"`
+	Verifier  string             `bson:"verifier"`
+	ExpiresAt time.Time          `bson:"expires_at"`
+	CreatedAt time.Time          `bson:"created_at"`
+}
+
+type Reservation struct {
+	Id          primitive.ObjectID `bson:"_id"`
+	Table       primitive.ObjectID `bson:"table"`
+	Owner       primitive.ObjectID `bson:"owner"`
+	Guests      uint32             `bson:"guests"`
+	StartsAt    time.Time          `bson:"starts_at"`
+	EndsAt      time.Time          `bson:"ends_at"`
+	Status      string             `bson:"status"`
+	Note        string             `bson:"note"`
+	CancelledBy primitive.ObjectID `bson:"cancelled_by,omitempty"`
+	CreatedAt   time.Time          `bson:"created_at"`
+	UpdatedAt   time.Time          `bson:"updated_at"`
 }
 
 type OrderItem struct {
@@ -48,21 +210,163 @@ type OrderItem struct {
 	Quantity uint32             `bson:"quantity"`
 	Amount   float64            `bson:"amount"`
 	Discount float64            `bson:"discount"`
+	Refunded uint32             `bson:"refunded"`
+	Reserved *StockReservation  `bson:"reserved,omitempty"`
+}
+
+// StockReservation is what one unit of an order line took from stock when
+// the order was placed, so that cancelling or refunding it gives back the
+// same amounts whatever happened to the product since.
+type StockReservation struct {
+	Product bool         `bson:"product"`
+	Recipe  []RecipeItem `bson:"recipe"`
+}
+
+type OrderStatusChange struct {
+	From      string             `bson:"from"`
+	To        string             `bson:"to"`
+	ChangedBy primitive.ObjectID `bson:"changed_by"`
+	Reason    string             `bson:"reason,omitempty"`
+	ChangedAt time.Time          `bson:"changed_at"`
 }
 
 type Order struct {
+	Id            primitive.ObjectID  `bson:"_id"`
+	Items         []OrderItem         `bson:"items"`
+	TotalAmount   float64             `bson:"total_amount"`
+	Owner         primitive.ObjectID  `bson:"owner"`
+	Status        string              `bson:"status"`
+	StatusHistory []OrderStatusChange `bson:"status_history"`
+	TotalDiscount float64             `bson:"total_discount"`
+	StockReserved bool                `bson:"stock_reserved"`
+	PaymentStatus types.PaymentStatus `bson:"payment_status"`
+	Payment       primitive.ObjectID  `bson:"payment,omitempty"`
+	PaidAt        time.Time           `bson:"paid_at,omitempty"`
+	RefundedTotal float64             `bson:"refunded_total"`
+	RefundPending *primitive.ObjectID `bson:"refund_pending,omitempty"`
+	CreatedAt     time.Time           `bson:"created_at"`
+	UpdatedAt     time.Time           `bson:"updated_at"`
+}
+
+// Payment is one attempt to pay for an order through a provider. An order
+// may collect several, e.g. a rejected card payment followed by mobile money,
+// and points at the latest through Order.Payment.
+type Payment struct {
+	Id          primitive.ObjectID  `bson:"_id"`
+	Order       primitive.ObjectID  `bson:"order"`
+	Provider    string              `bson:"provider"`
+	Method      string              `bson:"method"`
+	Reference   string              `bson:"reference"`
+	Amount      float64             `bson:"amount"`
+	Currency    string              `bson:"currency"`
+	Status      types.PaymentStatus `bson:"status"`
+	RedirectURL string              `bson:"redirect_url,omitempty"`
+	CreatedAt   time.Time           `bson:"created_at"`
+	UpdatedAt   time.Time           `bson:"updated_at"`
+}
+
+// PaymentEvent records a processed webhook so that providers redelivering
+// it do not apply it twice. Id is "<provider>:<event id>".
+type PaymentEvent struct {
+	Id        string             `bson:"_id"`
+	Payment   primitive.ObjectID `bson:"payment"`
+	Type      string             `bson:"type"`
+	CreatedAt time.Time          `bson:"created_at"`
+}
+
+type RefundItem struct {
+	Product  primitive.ObjectID `bson:"product"`
+	Quantity uint32             `bson:"quantity"`
+	Amount   float64            `bson:"amount"`
+	Discount float64            `bson:"discount"`
+}
+
+// Refund records money given back on an order. Amount is what the customer
+// receives, i.e. the refunded lines' amount less their discount. A refund is
+// pending from before the provider is asked to pay until the order has been
+// reduced, and failed when the provider declined.
+type Refund struct {
+	Id        primitive.ObjectID `bson:"_id"`
+	Order     primitive.ObjectID `bson:"order"`
+	Payment   primitive.ObjectID `bson:"payment"`
+	Items     []RefundItem       `bson:"items"`
+	Amount    float64            `bson:"amount"`
+	Currency  string             `bson:"currency"`
+	Reason    string             `bson:"reason"`
+	Restocked bool               `bson:"restocked"`
+	Reference string             `bson:"reference"`
+	Status    string             `bson:"status"`
+	Failure   string             `bson:"failure,omitempty"`
+	SettledAt *time.Time         `bson:"settled_at,omitempty"`
+	CreatedBy primitive.ObjectID `bson:"created_by"`
+	CreatedAt time.Time          `bson:"created_at"`
+}
+
+type Review struct {
+	Id        primitive.ObjectID `bson:"_id"`
+	Product   primitive.ObjectID `bson:"product"`
+	Author    primitive.ObjectID `bson:"author"`
+	Rating    uint8              `bson:"rating"`
+	Text      string             `bson:"text"`
+	Hidden    bool               `bson:"hidden"`
+	HiddenBy  primitive.ObjectID `bson:"hidden_by,omitempty"`
+	CreatedAt time.Time          `bson:"created_at"`
+	UpdatedAt time.Time          `bson:"updated_at"`
+}
+
+// CoffeeDateTable is a table in the shop that customers can reserve.
+// LastBookedAt is touched by every booking transaction so that two
+// concurrent bookings of the same table conflict instead of double booking.
+type CoffeeDateTable struct {
+	Id           primitive.ObjectID `bson:"_id"`
+	Number       uint32             `bson:"number" validate:"required"`
+	Capacity     uint32             `bson:"capacity" validate:"required"`
+	Location     string             `bson:"location"`
+	Active       bool               `bson:"active"`
+	LastBookedAt time.Time          `bson:"last_booked_at,omitempty"`
+	CreatedAt    time.Time          `bson:"created_at"`
+	UpdatedAt    time.Time          `bson:"updated_at"`
+}
+
+// Counter hands out gap-free sequence numbers, one document per sequence.
+type Counter struct {
+	Id  string `bson:"_id"`
+	Seq int64  `bson:"seq"`
+}
+
+type InvoiceLine struct {
+	Product   primitive.ObjectID `bson:"product"`
+	Name      string             `bson:"name"`
+	Quantity  uint32             `bson:"quantity"`
+	UnitPrice float64            `bson:"unit_price"`
+	Amount    float64            `bson:"amount"`
+	Discount  float64            `bson:"discount"`
+	Net       float64            `bson:"net"`
+	Tax       float64            `bson:"tax"`
+	Total     float64            `bson:"total"`
+}
+
+// Invoice is issued once per paid order. Prices are tax inclusive, so Net
+// and Tax split each line's Total rather than adding to it. ObjectKey stays
+// empty until the rendered document has been stored.
+type Invoice struct {
 	Id            primitive.ObjectID `bson:"_id"`
-	Items         []OrderItem        `bson:"items"`
-	TotalAmount   float64            `bson:"total_amount"`
-	Owner         primitive.ObjectID `bson:"owner"`
-	Status        string             `bson:"status"`
-	TotalDiscount float64            `bson:"total_discount"`
+	Number        string             `bson:"number"`
+	Order         primitive.ObjectID `bson:"order"`
+	Customer      primitive.ObjectID `bson:"customer"`
+	CustomerName  string             `bson:"customer_name"`
+	CustomerEmail string             `bson:"customer_email"`
+	Lines         []InvoiceLine      `bson:"lines"`
+	Discount      float64            `bson:"discount"`
+	Net           float64            `bson:"net"`
+	TaxRate       float64            `bson:"tax_rate"`
+	Tax           float64            `bson:"tax"`
+	Total         float64            `bson:"total"`
+	ObjectKey     string             `bson:"object_key"`
+	IssuedAt      time.Time          `bson:"issued_at"`
 	CreatedAt     time.Time          `bson:"created_at"`
 	UpdatedAt     time.Time          `bson:"updated_at"`
 }
 
-type CoffeeDateTable struct{}
-type Invoice struct{}
-
 type ItemList []Item
 type UserList []User
@@ -0,0 +1,240 @@
+package token
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+var (
+	ErrNoSigningKey = errors.New("no active signing key")
+	ErrUnknownKey   = errors.New("unknown signing key")
+)
+
+// SigningKey is one private key of the key set. A key is published in the
+// JWKS as soon as it is loaded, signs new tokens from ActivatesAt until a
+// newer key activates, and keeps verifying tokens until RetiresAt.
+type SigningKey struct {
+	Id          string
+	Method      jwt.SigningMethod
+	Private     crypto.Signer
+	ActivatesAt time.Time
+	RetiresAt   time.Time
+}
+
+func (key *SigningKey) retired(now time.Time) bool {
+	return !key.RetiresAt.IsZero() && now.After(key.RetiresAt)
+}
+
+// keyManifestEntry is one entry of the JWT_KEYS_FILE manifest. Paths are
+// relative to the manifest, e.g.
+//
+//	[{"kid": "2026-10", "path": "2026-10.pem", "activates_at": "2026-10-01T00:00:00Z"}]
+type keyManifestEntry struct {
+	Id          string    `json:"kid"`
+	Path        string    `json:"path"`
+	ActivatesAt time.Time `json:"activates_at"`
+	RetiresAt   time.Time `json:"retires_at"`
+}
+
+// KeySet holds the RS256 and EdDSA keys listed in a manifest file. Adding a
+// key to the manifest ahead of its activation time lets other services pick
+// it up from the JWKS before any token is signed with it.
+type KeySet struct {
+	mu       sync.RWMutex
+	manifest string
+	keys     []*SigningKey
+}
+
+func LoadKeySet(manifest string) (*KeySet, error) {
+	ks := &KeySet{manifest: manifest}
+	if err := ks.Reload(); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+// Reload rereads the manifest and the key files it lists. The current keys
+// stay in place when anything fails to load.
+func (ks *KeySet) Reload() error {
+	data, err := os.ReadFile(ks.manifest)
+	if err != nil {
+		return fmt.Errorf("failed to read jwt key manifest %w", err)
+	}
+
+	var entries []keyManifestEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("invalid jwt key manifest %w", err)
+	}
+
+	keys := make([]*SigningKey, 0, len(entries))
+	seen := map[string]bool{}
+	for _, entry := range entries {
+		if entry.Id == "" || seen[entry.Id] {
+			return fmt.Errorf("jwt key manifest entries need a unique kid, got %q", entry.Id)
+		}
+		seen[entry.Id] = true
+
+		path := entry.Path
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(filepath.Dir(ks.manifest), path)
+		}
+
+		key, err := loadSigningKey(entry.Id, path)
+		if err != nil {
+			return err
+		}
+		key.ActivatesAt = entry.ActivatesAt
+		key.RetiresAt = entry.RetiresAt
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ActivatesAt.Before(keys[j].ActivatesAt) })
+
+	ks.mu.Lock()
+	ks.keys = keys
+	ks.mu.Unlock()
+	return nil
+}
+
+// Watch reloads the manifest every interval until ctx is done, so keys can
+// be added and retired without a restart.
+func (ks *KeySet) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := ks.Reload(); err != nil {
+				log.Printf("failed to reload jwt keys %v\n", err)
+			}
+		}
+	}
+}
+
+// Signer returns the most recently activated key.
+func (ks *KeySet) Signer(now time.Time) (*SigningKey, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	for i := len(ks.keys) - 1; i >= 0; i-- {
+		key := ks.keys[i]
+		if !now.Before(key.ActivatesAt) && !key.retired(now) {
+			return key, nil
+		}
+	}
+	return nil, ErrNoSigningKey
+}
+
+func (ks *KeySet) Verifier(kid string, now time.Time) (*SigningKey, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	for _, key := range ks.keys {
+		if key.Id == kid && !key.retired(now) {
+			return key, nil
+		}
+	}
+	return nil, ErrUnknownKey
+}
+
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS lists the public half of every key that is not retired, including
+// keys that are not active yet.
+func (ks *KeySet) JWKS(now time.Time) JWKSet {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	set := JWKSet{Keys: []JWK{}}
+	for _, key := range ks.keys {
+		if key.retired(now) {
+			continue
+		}
+
+		jwk := JWK{Kid: key.Id, Use: "sig", Alg: key.Method.Alg()}
+		switch public := key.Private.Public().(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(public)
+		default:
+			continue
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set
+}
+
+func loadSigningKey(kid, path string) (*SigningKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read jwt key %s %w", kid, err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("jwt key %s is not PEM encoded", kid)
+	}
+
+	var private interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		private, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		private, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		err = fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse jwt key %s %w", kid, err)
+	}
+
+	switch private := private.(type) {
+	case *rsa.PrivateKey:
+		if private.N.BitLen() < 2048 {
+			return nil, fmt.Errorf("jwt key %s is shorter than 2048 bits", kid)
+		}
+		return &SigningKey{Id: kid, Method: jwt.SigningMethodRS256, Private: private}, nil
+	case ed25519.PrivateKey:
+		return &SigningKey{Id: kid, Method: jwt.SigningMethodEdDSA, Private: private}, nil
+	default:
+		return nil, fmt.Errorf("jwt key %s must be an RSA or Ed25519 key", kid)
+	}
+}
@@ -0,0 +1,27 @@
+package token
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+)
+
+// NewOpaqueToken returns a random token for the client, such as a refresh
+// token or the token in a password reset link, together with the digest
+// that is stored server side in its place.
+func NewOpaqueToken() (token string, digest string, err error) {
+	buff := make([]byte, 32)
+	if _, err := rand.Read(buff); err != nil {
+		return "", "", fmt.Errorf("failed to generate token %w", err)
+	}
+
+	token = base64.RawURLEncoding.EncodeToString(buff)
+	return token, HashOpaqueToken(token), nil
+}
+
+func HashOpaqueToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
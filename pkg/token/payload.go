@@ -1,30 +1,122 @@
 package token
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/silaselisha/coffee-api/types"
+)
+
+const (
+	DefaultIssuer   = "coffee-api"
+	DefaultAudience = "coffee-api"
+	// DefaultLeeway tolerates clock drift between us and other services
+	// verifying our tokens.
+	DefaultLeeway = 30 * time.Second
 )
 
+var ErrInvalidClaims = errors.New("invalid token claims")
+
+// Subject is who a token is issued to.
+type Subject struct {
+	Id    string
+	Email string
+	Role  string
+	// Version is the user's token version when the token was signed;
+	// bumping the version on the user revokes every older token.
+	Version int64
+}
+
+// Payload holds the registered claims (sub, iss, aud, iat, nbf, exp, jti)
+// plus the caller's email, role and token version.
 type Payload struct {
-	Email     string
-	Id        string
-	IssuedAt  time.Time
-	ExpiredAt time.Time
+	jwt.RegisteredClaims
+	Email   string `json:"email"`
+	Role    string `json:"role"`
+	Version int64  `json:"ver"`
 }
 
-func createNewPayload(duration time.Duration, id, email string) (*Payload, error) {
+// Validation is what VerifyToken checks beyond the signature.
+type Validation struct {
+	Issuer   string
+	Audience string
+	Leeway   time.Duration
+}
+
+// NewValidation fills in the defaults for empty settings.
+func NewValidation(issuer, audience string) Validation {
+	if issuer == "" {
+		issuer = DefaultIssuer
+	}
+	if audience == "" {
+		audience = DefaultAudience
+	}
+	return Validation{Issuer: issuer, Audience: audience, Leeway: DefaultLeeway}
+}
+
+func createNewPayload(duration time.Duration, subject Subject, validation Validation) (*Payload, error) {
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return nil, fmt.Errorf("failed to generate token id %w", err)
+	}
+
+	now := time.Now()
 	return &Payload{
-		Email:     email,
-		Id:        id,
-		IssuedAt:  time.Now(),
-		ExpiredAt: time.Now().Add(duration),
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        hex.EncodeToString(jti),
+			Subject:   subject.Id,
+			Issuer:    validation.Issuer,
+			Audience:  jwt.ClaimStrings{validation.Audience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(duration)),
+		},
+		Email:   subject.Email,
+		Role:    subject.Role,
+		Version: subject.Version,
 	}, nil
 }
 
-func (p *Payload) Valid() error {
-	if time.Now().After(p.ExpiredAt) {
-		err := errors.New("invalid token")
-		return err
+// Id is the user id the token was issued to.
+func (p *Payload) Id() string {
+	return p.Subject
+}
+
+// IssuedAtTime is the zero time for tokens without an iat claim.
+func (p *Payload) IssuedAtTime() time.Time {
+	if p.IssuedAt == nil {
+		return time.Time{}
+	}
+	return p.IssuedAt.Time
+}
+
+func (p *Payload) validate(validation Validation, now time.Time) error {
+	if p.Subject == "" || p.ExpiresAt == nil || p.IssuedAt == nil {
+		return ErrInvalidClaims
+	}
+	if !p.VerifyExpiresAt(now.Add(-validation.Leeway), true) {
+		return fmt.Errorf("%w: token expired", ErrInvalidClaims)
+	}
+	if !p.VerifyNotBefore(now.Add(validation.Leeway), false) || !p.VerifyIssuedAt(now.Add(validation.Leeway), true) {
+		return fmt.Errorf("%w: token used before issued", ErrInvalidClaims)
+	}
+	if !p.VerifyIssuer(validation.Issuer, true) {
+		return fmt.Errorf("%w: unexpected issuer", ErrInvalidClaims)
+	}
+	if !p.VerifyAudience(validation.Audience, true) {
+		return fmt.Errorf("%w: unexpected audience", ErrInvalidClaims)
 	}
 	return nil
 }
+
+// PayloadFromContext returns the verified claims AuthMiddleware stored on
+// the request context.
+func PayloadFromContext(ctx context.Context) (*Payload, bool) {
+	payload, ok := ctx.Value(types.AuthPayloadKey{}).(*Payload)
+	return payload, ok
+}
@@ -2,7 +2,6 @@ package token
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"time"
 
@@ -10,22 +9,24 @@ import (
 )
 
 type Token interface {
-	CreateToken(ctx context.Context, duration time.Duration, id, email string) (string, error)
+	CreateToken(ctx context.Context, duration time.Duration, subject Subject) (string, error)
 	VerifyToken(ctx context.Context, token string) (*Payload, error)
 }
 
 type JWToken struct {
-	secret string
+	secret     string
+	validation Validation
 }
 
-func NewToken(secret string) Token {
+func NewToken(secret string, validation Validation) Token {
 	return &JWToken{
-		secret: secret,
+		secret:     secret,
+		validation: validation,
 	}
 }
 
-func (tkn *JWToken) CreateToken(ctx context.Context, duration time.Duration, id string, email string) (string, error) {
-	payload, err := createNewPayload(duration, id, email)
+func (tkn *JWToken) CreateToken(ctx context.Context, duration time.Duration, subject Subject) (string, error) {
+	payload, err := createNewPayload(duration, subject, tkn.validation)
 	if err != nil {
 		return "", err
 	}
@@ -40,26 +41,80 @@ func (tkn *JWToken) CreateToken(ctx context.Context, duration time.Duration, id
 
 func (tkn *JWToken) VerifyToken(ctx context.Context, tok string) (*Payload, error) {
 	keyFunc := func(token *jwt.Token) (interface{}, error) {
-		_, ok := token.Method.(*jwt.SigningMethodHMAC)
-		if !ok {
-			return nil, fmt.Errorf("invalid jwt token signing alg")
-		}
 		return []byte(tkn.secret), nil
 	}
+	return parseToken(tok, keyFunc, tkn.validation, jwt.SigningMethodHS256.Alg())
+}
+
+// KeySetToken signs with the active key of a KeySet and names it in the
+// kid header, so tokens stay verifiable while keys rotate.
+type KeySetToken struct {
+	keys       *KeySet
+	validation Validation
+}
+
+func NewKeySetToken(keys *KeySet, validation Validation) Token {
+	return &KeySetToken{
+		keys:       keys,
+		validation: validation,
+	}
+}
+
+func (tkn *KeySetToken) CreateToken(ctx context.Context, duration time.Duration, subject Subject) (string, error) {
+	payload, err := createNewPayload(duration, subject, tkn.validation)
+	if err != nil {
+		return "", err
+	}
+
+	key, err := tkn.keys.Signer(time.Now())
+	if err != nil {
+		return "", err
+	}
+
+	token := jwt.NewWithClaims(key.Method, payload)
+	token.Header["kid"] = key.Id
 
-	token, err := jwt.ParseWithClaims(tok, &Payload{}, keyFunc)
+	tokenString, err := token.SignedString(key.Private)
 	if err != nil {
-		varErr, ok := err.(*jwt.ValidationError)
-		if ok && errors.Is(varErr, fmt.Errorf("invalid token")) {
-			return nil, fmt.Errorf("invalid token")
+		return "", fmt.Errorf("%w", err)
+	}
+	return tokenString, nil
+}
+
+func (tkn *KeySetToken) VerifyToken(ctx context.Context, tok string) (*Payload, error) {
+	keyFunc := func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, err := tkn.keys.Verifier(kid, time.Now())
+		if err != nil {
+			return nil, err
+		}
+
+		if token.Method.Alg() != key.Method.Alg() {
+			return nil, fmt.Errorf("invalid jwt token signing alg")
 		}
+		return key.Private.Public(), nil
+	}
+	return parseToken(tok, keyFunc, tkn.validation, jwt.SigningMethodRS256.Alg(), jwt.SigningMethodEdDSA.Alg())
+}
+
+// parseToken checks the signature and then the claims against validation,
+// which jwt's own claim checks cannot do as they know nothing of the
+// expected issuer, audience or leeway.
+func parseToken(tok string, keyFunc jwt.Keyfunc, validation Validation, methods ...string) (*Payload, error) {
+	parser := jwt.NewParser(jwt.WithValidMethods(methods), jwt.WithoutClaimsValidation())
+
+	token, err := parser.ParseWithClaims(tok, &Payload{}, keyFunc)
+	if err != nil {
 		return nil, err
 	}
 
 	payload, ok := token.Claims.(*Payload)
-	if !ok {
+	if !ok || !token.Valid {
 		return nil, fmt.Errorf("invalid token")
 	}
 
+	if err := payload.validate(validation, time.Now()); err != nil {
+		return nil, err
+	}
 	return payload, nil
 }
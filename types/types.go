@@ -1,25 +1,182 @@
 package types
 
 import (
+	"fmt"
+	"strings"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 type PaymentStatus int
-type UserRole int
 
+// PENDING is the zero value so orders created before payments were tracked
+// read back as unpaid.
 const (
-	PAID PaymentStatus = iota
-	PENDING
+	PENDING PaymentStatus = iota
+	PAID
 	REJECTED
+	REFUNDED
+	PARTIALLY_REFUNDED
 )
 
 const (
-	USER UserRole = iota
-	ADMIN
+	ROLE_ADMIN           = "admin"
+	ROLE_USER            = "user"
+	ROLE_BARISTA         = "barista"
+	ROLE_MANAGER         = "manager"
+	ROLE_INVENTORY_CLERK = "inventory-clerk"
 )
 
+// Permissions are "<resource>:<action>". A role may also be granted
+// "<resource>:*" for every action on a resource, and "*" for everything.
+const (
+	PERM_ALL                 = "*"
+	PERM_PRODUCTS_WRITE      = "products:write"
+	PERM_ORDERS_READ         = "orders:read"
+	PERM_ORDERS_ADVANCE      = "orders:advance"
+	PERM_ORDERS_REFUND       = "orders:refund"
+	PERM_ORDERS_PAY          = "orders:pay"
+	PERM_INVENTORY_READ      = "inventory:read"
+	PERM_INVENTORY_WRITE     = "inventory:write"
+	PERM_RESERVATIONS_MANAGE = "reservations:manage"
+	PERM_REVIEWS_MODERATE    = "reviews:moderate"
+	PERM_USERS_READ          = "users:read"
+	PERM_USERS_MANAGE        = "users:manage"
+	PERM_ROLES_MANAGE        = "roles:manage"
+	PERM_APIKEYS_MANAGE      = "apikeys:manage"
+	PERM_AUDIT_READ          = "audit:read"
+)
+
+var PERMISSIONS = []string{
+	PERM_PRODUCTS_WRITE,
+	PERM_ORDERS_READ,
+	PERM_ORDERS_ADVANCE,
+	PERM_ORDERS_REFUND,
+	PERM_ORDERS_PAY,
+	PERM_INVENTORY_READ,
+	PERM_INVENTORY_WRITE,
+	PERM_RESERVATIONS_MANAGE,
+	PERM_REVIEWS_MODERATE,
+	PERM_USERS_READ,
+	PERM_USERS_MANAGE,
+	PERM_ROLES_MANAGE,
+	PERM_APIKEYS_MANAGE,
+	PERM_AUDIT_READ,
+}
+
+// PermissionGranted reports whether any of granted covers permission.
+func PermissionGranted(granted []string, permission string) bool {
+	resource, _, _ := strings.Cut(permission, ":")
+	for _, grant := range granted {
+		if grant == PERM_ALL || grant == permission || grant == resource+":*" {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidPermission reports whether permission may be granted to a role
+// through the API. "*" is reserved for the admin role.
+func ValidPermission(permission string) bool {
+	for _, known := range PERMISSIONS {
+		resource, _, _ := strings.Cut(known, ":")
+		if permission == known || permission == resource+":*" {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	ORDER_PENDING   = "pending"
+	ORDER_ACCEPTED  = "accepted"
+	ORDER_PREPARING = "preparing"
+	ORDER_READY     = "ready"
+	ORDER_COMPLETED = "completed"
+	ORDER_CANCELLED = "cancelled"
+)
+
+const (
+	REFUND_PENDING = "pending"
+	REFUND_SETTLED = "settled"
+	REFUND_FAILED  = "failed"
+)
+
+const (
+	RESERVATION_CONFIRMED = "confirmed"
+	RESERVATION_CANCELLED = "cancelled"
+)
+
+// APP_ENV values. Anything else, including no value, is production.
+const (
+	ENV_DEVELOPMENT = "development"
+	ENV_TEST        = "test"
+)
+
+const (
+	TOKEN_PASSWORD_RESET     = "password_reset"
+	TOKEN_EMAIL_VERIFICATION = "email_verification"
+	TOKEN_ACCOUNT_UNLOCK     = "account_unlock"
+)
+
+// Audited actions are named "<target>.<verb>".
+const (
+	AUDIT_PRODUCT_CREATE       = "product.create"
+	AUDIT_PRODUCT_UPDATE       = "product.update"
+	AUDIT_PRODUCT_DELETE       = "product.delete"
+	AUDIT_USER_UPDATE          = "user.update"
+	AUDIT_USER_DELETE          = "user.delete"
+	AUDIT_USER_ROLE_UPDATE     = "user.role_update"
+	AUDIT_USER_SESSIONS_REVOKE = "user.sessions_revoke"
+	AUDIT_ROLE_CREATE          = "role.create"
+	AUDIT_ROLE_UPDATE          = "role.update"
+	AUDIT_ROLE_DELETE          = "role.delete"
+	AUDIT_APIKEY_CREATE        = "apikey.create"
+	AUDIT_APIKEY_REVOKE        = "apikey.revoke"
+	AUDIT_ORDER_STATUS_UPDATE  = "order.status_update"
+	AUDIT_REFUND_CREATE        = "refund.create"
+	AUDIT_INGREDIENT_CREATE    = "ingredient.create"
+	AUDIT_INGREDIENT_UPDATE    = "ingredient.update"
+	AUDIT_TABLE_CREATE         = "table.create"
+	AUDIT_TABLE_UPDATE         = "table.update"
+	AUDIT_TABLE_DELETE         = "table.delete"
+	AUDIT_RESERVATION_CANCEL   = "reservation.cancel"
+	AUDIT_REVIEW_VISIBILITY    = "review.visibility_update"
+	AUDIT_REVIEW_DELETE        = "review.delete"
+)
+
+var paymentStatusNames = map[PaymentStatus]string{
+	PENDING:            "pending",
+	PAID:               "paid",
+	REJECTED:           "rejected",
+	REFUNDED:           "refunded",
+	PARTIALLY_REFUNDED: "partially_refunded",
+}
+
+func (ps PaymentStatus) String() string {
+	if name, ok := paymentStatusNames[ps]; ok {
+		return name
+	}
+	return fmt.Sprintf("PaymentStatus(%d)", int(ps))
+}
+
+// MarshalText makes payment statuses read as words in JSON responses while
+// they are still stored as numbers.
+func (ps PaymentStatus) MarshalText() ([]byte, error) {
+	return []byte(ps.String()), nil
+}
+
+func (ps *PaymentStatus) UnmarshalText(text []byte) error {
+	for status, name := range paymentStatusNames {
+		if name == string(text) {
+			*ps = status
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown payment status %q", text)
+}
+
 type FileMetadata struct {
 	ContetntType string
 }
@@ -32,6 +189,21 @@ type PayloadUploadImage struct {
 
 type PayloadSendMail struct {
 	Email string `json:"email"`
+	Token string `json:"token,omitempty"`
+}
+
+type PayloadGenerateInvoice struct {
+	Order string `json:"order"`
+}
+
+type PayloadRefundMail struct {
+	Email  string `json:"email"`
+	Refund string `json:"refund"`
+}
+
+type PayloadReservationMail struct {
+	Email       string `json:"email"`
+	Reservation string `json:"reservation"`
 }
 
 type UserReqParams struct {
@@ -56,31 +228,47 @@ type UserResParams struct {
 type UserResListParams []UserResParams
 
 type ItemResParams struct {
-	Id          string             `json:"_id"`
-	Images      []string           `json:"images"`
-	Name        string             `json:"name"`
-	Author      primitive.ObjectID `json:"author"`
-	Price       float64            `json:"price"`
-	Discount    uint32             `json:"discount"`
-	Summary     string             `json:"summary"`
-	Category    string             `json:"category"`
-	Thumbnail   string             `json:"thumbnail"`
-	Description string             `json:"description"`
-	Ingridients []string           `json:"ingridients"`
-	Ratings     float64            `json:"ratings"`
-	CreatedAt   time.Time          `json:"created_at"`
-	UpdatedAt   time.Time          `json:"updated_at"`
+	Id           string             `json:"_id"`
+	Images       []string           `json:"images"`
+	Name         string             `json:"name"`
+	Author       primitive.ObjectID `json:"author"`
+	Price        float64            `json:"price"`
+	Discount     uint32             `json:"discount"`
+	Summary      string             `json:"summary"`
+	Category     string             `json:"category"`
+	Thumbnail    string             `json:"thumbnail"`
+	Description  string             `json:"description"`
+	Ingridients  []string           `json:"ingridients"`
+	Ratings      float64            `json:"ratings"`
+	RatingsCount int64              `json:"ratings_count"`
+	TrackStock   bool               `json:"track_stock"`
+	Stock        int64              `json:"stock"`
+	Score        float64            `json:"score,omitempty"`
+	CreatedAt    time.Time          `json:"created_at"`
+	UpdatedAt    time.Time          `json:"updated_at"`
 }
 
 type ItemResponseListParams []ItemResParams
 
 type AuthPayloadKey struct{}
 type AuthUserInfoKey struct{}
+type RequestIDKey struct{}
+
+// UserInfo is who is calling. Machine clients calling with an API key have
+// APIKey set, no role and the key's id as Id.
 type UserInfo struct {
-	Role   string
-	Email  string
-	Avatar string
-	Id     primitive.ObjectID
+	Role        string
+	Permissions []string
+	Email       string
+	Avatar      string
+	Verified    bool
+	TwoFactor   bool
+	APIKey      bool
+	Id          primitive.ObjectID
+}
+
+func (info *UserInfo) Can(permission string) bool {
+	return PermissionGranted(info.Permissions, permission)
 }
 
 type UserLoginParams struct {
@@ -92,6 +280,20 @@ type PasswordResetParams struct {
 	Password        string `bson:"password" validate:"required"`
 	ConfirmPassword string `bson:"confirmPassword" validate:"required"`
 }
+type RefreshTokenParams struct {
+	RefreshToken string `bson:"refresh_token" json:"refresh_token" validate:"required"`
+}
+
+type TwoFactorCodeParams struct {
+	Code string `bson:"code" validate:"required"`
+}
+
+type TwoFactorLoginParams struct {
+	ChallengeToken string `bson:"challenge_token" json:"challenge_token" validate:"required"`
+	Code           string `bson:"code" validate:"required_without=RecoveryCode"`
+	RecoveryCode   string `bson:"recovery_code" json:"recovery_code" validate:"required_without=Code"`
+}
+
 type ForgotPasswordParams struct {
 	Email string `bson:"email" validate:"required"`
 }
@@ -112,18 +314,219 @@ type OrderParams struct {
 	Items []OrderItemParams `bson:"items" validate:"required"`
 }
 
+type OrderStatusParams struct {
+	Status string `bson:"status" validate:"required,oneof=accepted preparing ready completed cancelled"`
+	Reason string `bson:"reason"`
+}
+
+type OrderCancelParams struct {
+	Reason string `bson:"reason"`
+}
+
+type RecipeItemParams struct {
+	Ingredient string  `bson:"ingredient" validate:"required"`
+	Quantity   float64 `bson:"quantity" validate:"required,gt=0"`
+}
+
+type IngredientParams struct {
+	Name  string  `bson:"name" validate:"required"`
+	Unit  string  `bson:"unit" validate:"required"`
+	Stock float64 `bson:"stock" validate:"gte=0"`
+}
+
+type IngredientStockParams struct {
+	Stock *float64 `bson:"stock" validate:"omitempty,gte=0"`
+	Delta float64  `bson:"delta"`
+	Unit  string   `bson:"unit"`
+}
+
+type StockShortageParams struct {
+	Product    string  `json:"product,omitempty"`
+	Ingredient string  `json:"ingredient,omitempty"`
+	Name       string  `json:"name"`
+	Requested  float64 `json:"requested"`
+	Available  float64 `json:"available"`
+}
+
+type ReviewParams struct {
+	Product string `bson:"product" validate:"required"`
+	Rating  uint8  `bson:"rating" validate:"required,min=1,max=5"`
+	Text    string `bson:"text" validate:"max=2000"`
+}
+
+type ReviewUpdateParams struct {
+	Rating uint8   `bson:"rating" validate:"omitempty,min=1,max=5"`
+	Text   *string `bson:"text" validate:"omitempty,max=2000"`
+}
+
+type ReviewVisibilityParams struct {
+	Hidden bool `bson:"hidden"`
+}
+
+type RoleParams struct {
+	Name             string   `bson:"name" validate:"required,min=3,max=32"`
+	Description      string   `bson:"description" validate:"max=200"`
+	Permissions      []string `bson:"permissions" validate:"dive,required"`
+	RequireTwoFactor bool     `bson:"require_two_factor" json:"require_two_factor"`
+}
+
+type RoleUpdateParams struct {
+	Description      *string  `bson:"description" validate:"omitempty,max=200"`
+	Permissions      []string `bson:"permissions" validate:"omitempty,dive,required"`
+	RequireTwoFactor *bool    `bson:"require_two_factor" json:"require_two_factor"`
+}
+
+type APIKeyParams struct {
+	Name        string     `bson:"name" validate:"required,max=64"`
+	Permissions []string   `bson:"permissions" validate:"required,min=1,dive,required"`
+	ExpiresAt   *time.Time `bson:"expires_at" json:"expires_at"`
+}
+
+type APIKeyResParams struct {
+	Id          string     `json:"_id"`
+	Name        string     `json:"name"`
+	Prefix      string     `json:"prefix"`
+	Permissions []string   `json:"permissions"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt  *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt   *time.Time `json:"revoked_at,omitempty"`
+	CreatedBy   string     `json:"created_by"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+type AuditChangeResParams struct {
+	Field  string      `json:"field"`
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+type AuditEntryResParams struct {
+	Id         string                 `json:"_id"`
+	ActorId    string                 `json:"actor_id"`
+	ActorType  string                 `json:"actor_type"`
+	ActorEmail string                 `json:"actor_email,omitempty"`
+	ActorRole  string                 `json:"actor_role,omitempty"`
+	Action     string                 `json:"action"`
+	TargetType string                 `json:"target_type"`
+	TargetId   string                 `json:"target_id"`
+	Changes    []AuditChangeResParams `json:"changes"`
+	RequestId  string                 `json:"request_id"`
+	IP         string                 `json:"ip"`
+	CreatedAt  time.Time              `json:"created_at"`
+}
+
+type UserRoleParams struct {
+	Role string `bson:"role" validate:"required"`
+}
+
+type ReviewResParams struct {
+	Id        string             `json:"_id"`
+	Product   primitive.ObjectID `json:"product"`
+	Author    primitive.ObjectID `json:"author"`
+	Rating    uint8              `json:"rating"`
+	Text      string             `json:"text"`
+	Hidden    bool               `json:"hidden"`
+	CreatedAt time.Time          `json:"created_at"`
+	UpdatedAt time.Time          `json:"updated_at"`
+}
+
+type TableParams struct {
+	Number   uint32 `bson:"number" validate:"required,gt=0"`
+	Capacity uint32 `bson:"capacity" validate:"required,gt=0"`
+	Location string `bson:"location"`
+}
+
+type TableUpdateParams struct {
+	Capacity uint32  `bson:"capacity" validate:"omitempty,gt=0"`
+	Location *string `bson:"location"`
+	Active   *bool   `bson:"active"`
+}
+
+type ReservationParams struct {
+	Table    string    `bson:"table"`
+	Guests   uint32    `bson:"guests" validate:"required,gt=0"`
+	StartsAt time.Time `bson:"starts_at" json:"starts_at" validate:"required"`
+	EndsAt   time.Time `bson:"ends_at" json:"ends_at" validate:"required,gtfield=StartsAt"`
+	Note     string    `bson:"note" validate:"max=500"`
+}
+
+type ReservationUpdateParams struct {
+	Table    string     `bson:"table"`
+	Guests   uint32     `bson:"guests" validate:"omitempty,gt=0"`
+	StartsAt *time.Time `bson:"starts_at" json:"starts_at"`
+	EndsAt   *time.Time `bson:"ends_at" json:"ends_at"`
+	Note     *string    `bson:"note" validate:"omitempty,max=500"`
+}
+
+type ReservationSlotParams struct {
+	StartsAt time.Time            `json:"starts_at"`
+	EndsAt   time.Time            `json:"ends_at"`
+	Tables   []primitive.ObjectID `json:"tables"`
+}
+
+type PaymentParams struct {
+	Provider string `bson:"provider"`
+	Method   string `bson:"method" validate:"required,oneof=card mobile_money"`
+	Phone    string `bson:"phone" validate:"required_if=Method mobile_money"`
+}
+
+type RefundItemParams struct {
+	Product  string `bson:"product" validate:"required"`
+	Quantity uint32 `bson:"quantity" validate:"required,gt=0"`
+}
+
+// RefundParams refunds the listed lines, or everything not yet refunded
+// when Items is empty. Refunded units go back into stock unless Restock is
+// false, e.g. for a spilt drink.
+type RefundParams struct {
+	Items   []RefundItemParams `bson:"items" validate:"dive"`
+	Reason  string             `bson:"reason" validate:"required,max=500"`
+	Restock *bool              `bson:"restock"`
+}
+
 type Config struct {
-	DB_URI               string `mapstructure:"DB_URI"`
-	SMTP_HOST            string `mapstructure:"SMTP_HOST"`
-	SMTP_PORT            string `mapstructure:"SMTP_PORT"`
-	DB_PASSWORD          string `mapstructure:"DB_PASSWORD"`
-	SMTP_PASSWORD        string `mapstructure:"SMTP_PASSWORD"`
-	SMTP_USERNAME        string `mapstructure:"SMTP_USERNAME"`
-	S3_BUCKET_NAME       string `mapstructure:"S3_BUCKET_NAME"`
-	SMTP_SENDER          string `mapstructure:"SMTP_SENDER"`
-	SERVER_REST_ADDRESS  string `mapstructure:"SERVER_REST_ADDRESS"`
-	JWT_EXPIRES_AT       string `mapstructure:"JWT_EXPIRES_AT"`
-	SECRET_ACCESS_KEY    string `mapstructure:"SECRET_ACCESS_KEY"`
-	REDIS_SERVER_PORT    string `mapstructure:"REDIS_SERVER_PORT"`
-	REDIS_SERVER_ADDRESS string `mapstructure:"REDIS_SERVER_ADDRESS"`
+	DB_URI                     string `mapstructure:"DB_URI"`
+	SMTP_HOST                  string `mapstructure:"SMTP_HOST"`
+	SMTP_PORT                  string `mapstructure:"SMTP_PORT"`
+	DB_PASSWORD                string `mapstructure:"DB_PASSWORD"`
+	SMTP_PASSWORD              string `mapstructure:"SMTP_PASSWORD"`
+	SMTP_USERNAME              string `mapstructure:"SMTP_USERNAME"`
+	S3_BUCKET_NAME             string `mapstructure:"S3_BUCKET_NAME"`
+	SMTP_SENDER                string `mapstructure:"SMTP_SENDER"`
+	SERVER_REST_ADDRESS        string `mapstructure:"SERVER_REST_ADDRESS"`
+	JWT_EXPIRES_AT             string `mapstructure:"JWT_EXPIRES_AT"`
+	SECRET_ACCESS_KEY          string `mapstructure:"SECRET_ACCESS_KEY"`
+	REDIS_SERVER_PORT          string `mapstructure:"REDIS_SERVER_PORT"`
+	REDIS_SERVER_ADDRESS       string `mapstructure:"REDIS_SERVER_ADDRESS"`
+	INVOICE_TAX_RATE           string `mapstructure:"INVOICE_TAX_RATE"`
+	PAYMENT_PROVIDER           string `mapstructure:"PAYMENT_PROVIDER"`
+	PAYMENT_CURRENCY           string `mapstructure:"PAYMENT_CURRENCY"`
+	PAYMENT_WEBHOOK_KEY        string `mapstructure:"PAYMENT_WEBHOOK_KEY"`
+	PASSWORD_HASHER            string `mapstructure:"PASSWORD_HASHER"`
+	ACCESS_TOKEN_TTL           string `mapstructure:"ACCESS_TOKEN_TTL"`
+	JWT_KEYS_FILE              string `mapstructure:"JWT_KEYS_FILE"`
+	JWT_ISSUER                 string `mapstructure:"JWT_ISSUER"`
+	JWT_AUDIENCE               string `mapstructure:"JWT_AUDIENCE"`
+	JWT_KEYS_RELOAD            string `mapstructure:"JWT_KEYS_RELOAD"`
+	USER_CACHE_BACKEND         string `mapstructure:"USER_CACHE_BACKEND"`
+	USER_CACHE_TTL             string `mapstructure:"USER_CACHE_TTL"`
+	USER_CACHE_SIZE            string `mapstructure:"USER_CACHE_SIZE"`
+	OIDC_REDIRECT_URL          string `mapstructure:"OIDC_REDIRECT_URL"`
+	GOOGLE_CLIENT_ID           string `mapstructure:"GOOGLE_CLIENT_ID"`
+	GOOGLE_CLIENT_SECRET       string `mapstructure:"GOOGLE_CLIENT_SECRET"`
+	APPLE_CLIENT_ID            string `mapstructure:"APPLE_CLIENT_ID"`
+	APPLE_TEAM_ID              string `mapstructure:"APPLE_TEAM_ID"`
+	APPLE_KEY_ID               string `mapstructure:"APPLE_KEY_ID"`
+	APPLE_KEY_FILE             string `mapstructure:"APPLE_KEY_FILE"`
+	OIDC_NAME                  string `mapstructure:"OIDC_NAME"`
+	OIDC_ISSUER                string `mapstructure:"OIDC_ISSUER"`
+	OIDC_CLIENT_ID             string `mapstructure:"OIDC_CLIENT_ID"`
+	OIDC_CLIENT_SECRET         string `mapstructure:"OIDC_CLIENT_SECRET"`
+	TOTP_ISSUER                string `mapstructure:"TOTP_ISSUER"`
+	RATE_LIMIT_BACKEND         string `mapstructure:"RATE_LIMIT_BACKEND"`
+	RATE_LIMIT_SIGNUP          string `mapstructure:"RATE_LIMIT_SIGNUP"`
+	RATE_LIMIT_LOGIN           string `mapstructure:"RATE_LIMIT_LOGIN"`
+	RATE_LIMIT_FORGOT_PASSWORD string `mapstructure:"RATE_LIMIT_FORGOT_PASSWORD"`
+	RATE_LIMIT_PRODUCTS        string `mapstructure:"RATE_LIMIT_PRODUCTS"`
+	APP_ENV                    string `mapstructure:"APP_ENV"`
 }
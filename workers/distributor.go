@@ -15,11 +15,19 @@ const (
 	DELETE_S3_OBJECT           = "task:delete_s3_object"
 	SEND_VERIFICATION_EMAIL    = "task:send_verification_email"
 	SEND_PASSWORD_RESET_EMAIL  = "task:send_password_reset_email"
+	SEND_RESERVATION_EMAIL     = "task:send_reservation_email"
+	GENERATE_INVOICE           = "task:generate_invoice"
+	SEND_REFUND_EMAIL          = "task:send_refund_email"
+	SEND_ACCOUNT_UNLOCK_EMAIL  = "task:send_account_unlock_email"
 )
 
 type TaskDistributor interface {
 	VerificationMailTask(ctx context.Context, payload *types.PayloadSendMail, opts ...asynq.Option) error
 	PasswordResetMailTask(ctx context.Context, payload *types.PayloadSendMail, opts ...asynq.Option) error
+	AccountUnlockMailTask(ctx context.Context, payload *types.PayloadSendMail, opts ...asynq.Option) error
+	ReservationConfirmationMailTask(ctx context.Context, payload *types.PayloadReservationMail, opts ...asynq.Option) error
+	RefundMailTask(ctx context.Context, payload *types.PayloadRefundMail, opts ...asynq.Option) error
+	InvoiceGenerationTask(ctx context.Context, payload *types.PayloadGenerateInvoice, opts ...asynq.Option) error
 	S3ObjectUploadTask(ctx context.Context, payload *types.PayloadUploadImage, opts ...asynq.Option) error
 	MultipleS3ObjectUploadTask(ctx context.Context, payload []*types.PayloadUploadImage, opts ...asynq.Option) error
 	S3ObjectDeleteTask(ctx context.Context, images []string, opts ...asynq.Option) error
@@ -48,7 +56,8 @@ func (dist *RedisClientTaskDistributor) VerificationMailTask(ctx context.Context
 		return fmt.Errorf("enqueueing task error %w", err)
 	}
 
-	fmt.Printf("Enqueued task: %v of max retries: %v on payload: %v\n", info.Type, info.MaxRetry, string(info.Payload))
+	// The payload carries a single use token and is kept out of the logs.
+	fmt.Printf("Enqueued task: %v of max retries: %v for: %v\n", info.Type, info.MaxRetry, payload.Email)
 	return nil
 }
 
@@ -64,6 +73,72 @@ func (dist *RedisClientTaskDistributor) PasswordResetMailTask(ctx context.Contex
 		return fmt.Errorf("enqueueing task error %w", err)
 	}
 
+	// The payload carries a single use token and is kept out of the logs.
+	fmt.Printf("Enqueued task: %v of max retries: %v for: %v\n", info.Type, info.MaxRetry, payload.Email)
+	return nil
+}
+
+func (dist *RedisClientTaskDistributor) AccountUnlockMailTask(ctx context.Context, payload *types.PayloadSendMail, opts ...asynq.Option) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("marshal error %w", err)
+	}
+
+	task := asynq.NewTask(SEND_ACCOUNT_UNLOCK_EMAIL, data, opts...)
+	info, err := dist.client.EnqueueContext(ctx, task)
+	if err != nil {
+		return fmt.Errorf("enqueueing task error %w", err)
+	}
+
+	// The payload carries a single use token and is kept out of the logs.
+	fmt.Printf("Enqueued task: %v of max retries: %v for: %v\n", info.Type, info.MaxRetry, payload.Email)
+	return nil
+}
+
+func (dist *RedisClientTaskDistributor) ReservationConfirmationMailTask(ctx context.Context, payload *types.PayloadReservationMail, opts ...asynq.Option) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("marshal error %w", err)
+	}
+
+	task := asynq.NewTask(SEND_RESERVATION_EMAIL, data, opts...)
+	info, err := dist.client.EnqueueContext(ctx, task)
+	if err != nil {
+		return fmt.Errorf("enqueueing task error %w", err)
+	}
+
+	fmt.Printf("Enqueued task: %v of max retries: %v on payload: %v\n", info.Type, info.MaxRetry, string(info.Payload))
+	return nil
+}
+
+func (dist *RedisClientTaskDistributor) RefundMailTask(ctx context.Context, payload *types.PayloadRefundMail, opts ...asynq.Option) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("marshal error %w", err)
+	}
+
+	task := asynq.NewTask(SEND_REFUND_EMAIL, data, opts...)
+	info, err := dist.client.EnqueueContext(ctx, task)
+	if err != nil {
+		return fmt.Errorf("enqueueing task error %w", err)
+	}
+
+	fmt.Printf("Enqueued task: %v of max retries: %v on payload: %v\n", info.Type, info.MaxRetry, string(info.Payload))
+	return nil
+}
+
+func (dist *RedisClientTaskDistributor) InvoiceGenerationTask(ctx context.Context, payload *types.PayloadGenerateInvoice, opts ...asynq.Option) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("marshal error %w", err)
+	}
+
+	task := asynq.NewTask(GENERATE_INVOICE, data, opts...)
+	info, err := dist.client.EnqueueContext(ctx, task)
+	if err != nil {
+		return fmt.Errorf("enqueueing task error %w", err)
+	}
+
 	fmt.Printf("Enqueued task: %v of max retries: %v on payload: %v\n", info.Type, info.MaxRetry, string(info.Payload))
 	return nil
 }
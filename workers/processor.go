@@ -8,13 +8,15 @@ import (
 
 	"github.com/hibiken/asynq"
 	"github.com/rs/zerolog/log"
-	"github.com/silaselisha/coffee-api/internal"
 	"github.com/silaselisha/coffee-api/internal/aws"
+	"github.com/silaselisha/coffee-api/internal/invoice"
 	"github.com/silaselisha/coffee-api/internal/mail"
 	"github.com/silaselisha/coffee-api/pkg/store"
 	"github.com/silaselisha/coffee-api/types"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 const (
@@ -25,6 +27,9 @@ const (
 type TaskProcessor interface {
 	Start() error
 	ProcessTaskSendVerificationMail(ctx context.Context, task *asynq.Task) error
+	ProcessTaskSendReservationMail(ctx context.Context, task *asynq.Task) error
+	ProcessTaskGenerateInvoice(ctx context.Context, task *asynq.Task) error
+	ProcessTaskSendRefundMail(ctx context.Context, task *asynq.Task) error
 	ProcessTaskUploadS3Object(ctx context.Context, task *asynq.Task) error
 	ProcessTaskDeleteS3Object(ctx context.Context, task *asynq.Task) error
 	ProcessTaskMultipleUploadS3Object(ctx context.Context, task *asynq.Task) error
@@ -55,16 +60,20 @@ func NewTaskServerProcessor(opts asynq.RedisClientOpt, store store.Mongo, envs t
 }
 
 func (processor *RedisSrvTaskProcessor) ProcessTaskSendVerificationMail(ctx context.Context, task *asynq.Task) error {
-	user, err := getUserByEmail(ctx, processor, task)
+	user, payload, err := getUserByEmail(ctx, processor, task)
 	if err != nil {
 		return fmt.Errorf("error occured while retreiving user %w", err)
 	}
 
+	if payload.Token == "" {
+		return fmt.Errorf("verification mail for %s without a token: %w", user.Email, asynq.SkipRetry)
+	}
+
 	fmt.Printf("BEGIN @%+v\n", time.Now())
 	fmt.Printf("start processing task %+s\n", task.Type())
 
 	transporter := mail.NewSMTPTransporter(&processor.envs)
-	message := fmt.Sprintf("http://localhost:3000/verify?token=%s&timestamp=%d", user.Id.Hex(), internal.ResetToken(2880))
+	message := fmt.Sprintf("http://localhost:3000/verify?token=%s", payload.Token)
 
 	err = transporter.MailSender(ctx, user.Email, []byte(message))
 	if err != nil {
@@ -77,13 +86,17 @@ func (processor *RedisSrvTaskProcessor) ProcessTaskSendVerificationMail(ctx cont
 }
 
 func (processor *RedisSrvTaskProcessor) ProcessTaskSendResetPasswordMail(ctx context.Context, task *asynq.Task) error {
-	user, err := getUserByEmail(ctx, processor, task)
+	user, payload, err := getUserByEmail(ctx, processor, task)
 	if err != nil {
 		return fmt.Errorf("error occured while retreiving user %w", err)
 	}
 
+	if payload.Token == "" {
+		return fmt.Errorf("password reset mail for %s without a token: %w", user.Email, asynq.SkipRetry)
+	}
+
 	transporter := mail.NewSMTPTransporter(&processor.envs)
-	message := fmt.Sprintf("http://localhost:3000/resetpassword?token=%s&timestamp=%d", user.Id.Hex(), internal.ResetToken(2880))
+	message := fmt.Sprintf("http://localhost:3000/resetpassword?token=%s", payload.Token)
 
 	err = transporter.MailSender(ctx, user.Email, []byte(message))
 	if err != nil {
@@ -94,6 +107,271 @@ func (processor *RedisSrvTaskProcessor) ProcessTaskSendResetPasswordMail(ctx con
 	return nil
 }
 
+// ProcessTaskSendAccountUnlockMail tells the owner of a locked account
+// about the failed logins and mails them a link that lifts the lock.
+func (processor *RedisSrvTaskProcessor) ProcessTaskSendAccountUnlockMail(ctx context.Context, task *asynq.Task) error {
+	user, payload, err := getUserByEmail(ctx, processor, task)
+	if err != nil {
+		return fmt.Errorf("error occured while retreiving user %w", err)
+	}
+
+	if payload.Token == "" {
+		return fmt.Errorf("account unlock mail for %s without a token: %w", user.Email, asynq.SkipRetry)
+	}
+
+	transporter := mail.NewSMTPTransporter(&processor.envs)
+	message := fmt.Sprintf("Your account was locked after too many failed login attempts. If this was you, unlock it at http://localhost:3000/unlock?token=%s, otherwise consider changing your password.", payload.Token)
+
+	err = transporter.MailSender(ctx, user.Email, []byte(message))
+	if err != nil {
+		return fmt.Errorf("error occured while sending an account unlock mail to %s at %v err %w", user.Email, time.Now(), err)
+	}
+
+	fmt.Printf("processing %s at %v\n", task.Type(), time.Now())
+	return nil
+}
+
+// ProcessTaskSendReservationMail mails the current state of a reservation,
+// so the same task confirms new bookings and later changes, and tells the
+// owner about a cancellation.
+func (processor *RedisSrvTaskProcessor) ProcessTaskSendReservationMail(ctx context.Context, task *asynq.Task) error {
+	var payload types.PayloadReservationMail
+	err := json.Unmarshal(task.Payload(), &payload)
+	if err != nil {
+		return fmt.Errorf("unmarshalling error %w", err)
+	}
+
+	id, err := primitive.ObjectIDFromHex(payload.Reservation)
+	if err != nil {
+		return fmt.Errorf("invalid reservation id %s %w: %w", payload.Reservation, err, asynq.SkipRetry)
+	}
+
+	var reservation store.Reservation
+	reservations := processor.store.Collection(ctx, "coffeeshop", "reservations")
+	err = reservations.FindOne(ctx, bson.D{{Key: "_id", Value: id}}).Decode(&reservation)
+	if err != nil {
+		return fmt.Errorf("error occured while retreiving reservation %w", err)
+	}
+
+	var message string
+	switch reservation.Status {
+	case types.RESERVATION_CONFIRMED:
+		var table store.CoffeeDateTable
+		tables := processor.store.Collection(ctx, "coffeeshop", "tables")
+		err = tables.FindOne(ctx, bson.D{{Key: "_id", Value: reservation.Table}}).Decode(&table)
+		if err != nil {
+			return fmt.Errorf("error occured while retreiving table %w", err)
+		}
+
+		message = fmt.Sprintf("Your reservation %s is confirmed: table %d (%s) for %d guest(s) from %s to %s UTC.",
+			reservation.Id.Hex(),
+			table.Number,
+			table.Location,
+			reservation.Guests,
+			reservation.StartsAt.Format("Mon 02 Jan 2006 15:04"),
+			reservation.EndsAt.Format("15:04"))
+	case types.RESERVATION_CANCELLED:
+		message = fmt.Sprintf("Your reservation %s for %d guest(s) on %s UTC has been cancelled.",
+			reservation.Id.Hex(),
+			reservation.Guests,
+			reservation.StartsAt.Format("Mon 02 Jan 2006 15:04"))
+	default:
+		return nil
+	}
+
+	transporter := mail.NewSMTPTransporter(&processor.envs)
+
+	err = transporter.MailSender(ctx, payload.Email, []byte(message))
+	if err != nil {
+		return fmt.Errorf("error occured while sending a reservation mail to %s at %v err %w", payload.Email, time.Now(), err)
+	}
+
+	fmt.Printf("processing %s at %v\n", task.Type(), time.Now())
+	return nil
+}
+
+func (processor *RedisSrvTaskProcessor) ProcessTaskSendRefundMail(ctx context.Context, task *asynq.Task) error {
+	var payload types.PayloadRefundMail
+	err := json.Unmarshal(task.Payload(), &payload)
+	if err != nil {
+		return fmt.Errorf("unmarshalling error %w", err)
+	}
+
+	id, err := primitive.ObjectIDFromHex(payload.Refund)
+	if err != nil {
+		return fmt.Errorf("invalid refund id %s %w: %w", payload.Refund, err, asynq.SkipRetry)
+	}
+
+	var refund store.Refund
+	refunds := processor.store.Collection(ctx, "coffeeshop", "refunds")
+	err = refunds.FindOne(ctx, bson.D{{Key: "_id", Value: id}}).Decode(&refund)
+	if err != nil {
+		return fmt.Errorf("error occured while retreiving refund %w", err)
+	}
+
+	var units uint32
+	for _, item := range refund.Items {
+		units += item.Quantity
+	}
+
+	transporter := mail.NewSMTPTransporter(&processor.envs)
+	message := fmt.Sprintf("We have refunded %.2f %s for %d item(s) of your order %s.\nReason: %s\nRefund reference: %s",
+		refund.Amount,
+		refund.Currency,
+		units,
+		refund.Order.Hex(),
+		refund.Reason,
+		refund.Reference)
+
+	err = transporter.MailSender(ctx, payload.Email, []byte(message))
+	if err != nil {
+		return fmt.Errorf("error occured while sending a refund mail to %s at %v err %w", payload.Email, time.Now(), err)
+	}
+
+	fmt.Printf("processing %s at %v\n", task.Type(), time.Now())
+	return nil
+}
+
+// ProcessTaskGenerateInvoice issues the invoice of a paid order and stores
+// the rendered document in the bucket. Retrying is safe: an order keeps the
+// invoice and number it got on the first attempt, and the counter increment
+// is rolled back together with the insert when that attempt fails.
+func (processor *RedisSrvTaskProcessor) ProcessTaskGenerateInvoice(ctx context.Context, task *asynq.Task) error {
+	var payload types.PayloadGenerateInvoice
+	err := json.Unmarshal(task.Payload(), &payload)
+	if err != nil {
+		return fmt.Errorf("unmarshalling error %w", err)
+	}
+
+	orderId, err := primitive.ObjectIDFromHex(payload.Order)
+	if err != nil {
+		return fmt.Errorf("invalid order id %s %w: %w", payload.Order, err, asynq.SkipRetry)
+	}
+
+	fmt.Printf("BEGIN @%+v\n", time.Now())
+	fmt.Printf("start processing task %+s\n", task.Type())
+
+	invoices := processor.store.Collection(ctx, "coffeeshop", "invoices")
+	_, err = invoices.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "order", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return fmt.Errorf("error occured while creating invoice index %w", err)
+	}
+
+	var inv store.Invoice
+	err = invoices.FindOne(ctx, bson.D{{Key: "order", Value: orderId}}).Decode(&inv)
+	if err == mongo.ErrNoDocuments {
+		inv, err = issueInvoice(ctx, processor, orderId)
+	}
+	if err != nil {
+		return fmt.Errorf("error occured while issuing invoice for order %s %w", payload.Order, err)
+	}
+
+	if inv.ObjectKey != "" {
+		return nil
+	}
+
+	document, err := invoice.Render(inv)
+	if err != nil {
+		return err
+	}
+
+	objectKey := invoice.ObjectKey(inv.Number)
+	err = processor.coffeeShopS3Bucket.UploadDocument(ctx, objectKey, processor.envs.S3_BUCKET_NAME, invoice.ContentType, document)
+	if err != nil {
+		return err
+	}
+
+	update := bson.D{{Key: "$set", Value: bson.D{
+		{Key: "object_key", Value: objectKey},
+		{Key: "updated_at", Value: time.Now()},
+	}}}
+	_, err = invoices.UpdateOne(ctx, bson.D{{Key: "_id", Value: inv.Id}}, update)
+	if err != nil {
+		return fmt.Errorf("error occured while saving invoice %s %w", inv.Number, err)
+	}
+
+	fmt.Printf("END @%+v\n", time.Now())
+	return nil
+}
+
+func issueInvoice(ctx context.Context, processor *RedisSrvTaskProcessor, orderId primitive.ObjectID) (store.Invoice, error) {
+	taxRate, err := invoice.ParseTaxRate(processor.envs.INVOICE_TAX_RATE)
+	if err != nil {
+		return store.Invoice{}, err
+	}
+
+	var order store.Order
+	orders := processor.store.Collection(ctx, "coffeeshop", "orders")
+	err = orders.FindOne(ctx, bson.D{{Key: "_id", Value: orderId}}).Decode(&order)
+	if err != nil {
+		return store.Invoice{}, err
+	}
+
+	customer := store.User{Id: order.Owner}
+	users := processor.store.Collection(ctx, "coffeeshop", "users")
+	err = users.FindOne(ctx, bson.D{{Key: "_id", Value: order.Owner}}).Decode(&customer)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return store.Invoice{}, err
+	}
+
+	var ids []primitive.ObjectID
+	for _, item := range order.Items {
+		ids = append(ids, item.Product)
+	}
+
+	products := make(map[primitive.ObjectID]store.Item)
+	cur, err := processor.store.Collection(ctx, "coffeeshop", "products").Find(ctx, bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: ids}}}})
+	if err != nil {
+		return store.Invoice{}, err
+	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		var product store.Item
+		if err := cur.Decode(&product); err != nil {
+			return store.Invoice{}, err
+		}
+		products[product.Id] = product
+	}
+
+	session, err := processor.store.TxnStartSession(ctx)
+	if err != nil {
+		return store.Invoice{}, err
+	}
+	defer session.EndSession(ctx)
+
+	response, err := session.WithTransaction(ctx, func(ctx mongo.SessionContext) (interface{}, error) {
+		counters := processor.store.Collection(ctx, "coffeeshop", "counters")
+		newDocs := options.After
+		upsert := true
+
+		var counter store.Counter
+		err := counters.FindOneAndUpdate(ctx,
+			bson.D{{Key: "_id", Value: "invoice"}},
+			bson.D{{Key: "$inc", Value: bson.D{{Key: "seq", Value: 1}}}},
+			&options.FindOneAndUpdateOptions{ReturnDocument: &newDocs, Upsert: &upsert},
+		).Decode(&counter)
+		if err != nil {
+			return nil, err
+		}
+
+		inv := invoice.Build(invoice.FormatNumber(counter.Seq), order, customer, products, taxRate)
+		invoices := processor.store.Collection(ctx, "coffeeshop", "invoices")
+		if _, err := invoices.InsertOne(ctx, inv); err != nil {
+			return nil, err
+		}
+		return inv, nil
+	}, &options.TransactionOptions{})
+
+	if err != nil {
+		return store.Invoice{}, err
+	}
+	return response.(store.Invoice), nil
+}
+
 func (processor *RedisSrvTaskProcessor) ProcessTaskUploadS3Object(ctx context.Context, task *asynq.Task) error {
 	var Payload types.PayloadUploadImage
 	err := json.Unmarshal(task.Payload(), &Payload)
@@ -156,12 +434,12 @@ func (processor *RedisSrvTaskProcessor) ProcessTaskDeleteS3Object(ctx context.Co
 	return nil
 }
 
-func getUserByEmail(ctx context.Context, processor *RedisSrvTaskProcessor, task *asynq.Task) (store.User, error) {
+func getUserByEmail(ctx context.Context, processor *RedisSrvTaskProcessor, task *asynq.Task) (store.User, types.PayloadSendMail, error) {
 	var Payload types.PayloadSendMail
 	err := json.Unmarshal(task.Payload(), &Payload)
 	if err != nil {
 		fmt.Print(time.Now())
-		return store.User{}, fmt.Errorf("unmarshalling error %w", err)
+		return store.User{}, Payload, fmt.Errorf("unmarshalling error %w", err)
 	}
 
 	var user store.User
@@ -171,18 +449,22 @@ func getUserByEmail(ctx context.Context, processor *RedisSrvTaskProcessor, task
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
 			fmt.Print(time.Now())
-			return store.User{}, fmt.Errorf("document not found %w", err)
+			return store.User{}, Payload, fmt.Errorf("document not found %w", err)
 		}
-		return store.User{}, fmt.Errorf("internal server error %w", err)
+		return store.User{}, Payload, fmt.Errorf("internal server error %w", err)
 	}
 
-	return user, nil
+	return user, Payload, nil
 }
 
 func (processor *RedisSrvTaskProcessor) Start() error {
 	mux := asynq.NewServeMux()
 	mux.HandleFunc(SEND_VERIFICATION_EMAIL, processor.ProcessTaskSendVerificationMail)
 	mux.HandleFunc(SEND_PASSWORD_RESET_EMAIL, processor.ProcessTaskSendResetPasswordMail)
+	mux.HandleFunc(SEND_ACCOUNT_UNLOCK_EMAIL, processor.ProcessTaskSendAccountUnlockMail)
+	mux.HandleFunc(SEND_RESERVATION_EMAIL, processor.ProcessTaskSendReservationMail)
+	mux.HandleFunc(GENERATE_INVOICE, processor.ProcessTaskGenerateInvoice)
+	mux.HandleFunc(SEND_REFUND_EMAIL, processor.ProcessTaskSendRefundMail)
 	mux.HandleFunc(UPLOAD_S3_OBJECT, processor.ProcessTaskUploadS3Object)
 	mux.HandleFunc(UPLOAD_MULTIPLE_S3_OBJECTS, processor.ProcessTaskMultipleUploadS3Object)
 	mux.HandleFunc(DELETE_S3_OBJECT, processor.ProcessTaskDeleteS3Object)